@@ -0,0 +1,53 @@
+// Package apierror writes error responses in one JSON form, with a stable code
+// that clients can branch on instead of parsing the message.
+package apierror
+
+import (
+	"fmt"
+	"strings"
+
+	"github.com/gin-gonic/gin"
+)
+
+// --- Types and constants
+
+// Code names the kind of failure.  Codes are part of the API, so existing ones
+// must not be renamed.
+type Code string
+
+const (
+	InvalidRequest       Code = "INVALID_REQUEST"
+	ValidationFailed     Code = "VALIDATION_FAILED"
+	NotFound             Code = "NOT_FOUND"
+	ParentNotFound       Code = "PARENT_NOT_FOUND"
+	CycleDetected        Code = "CYCLE_DETECTED"
+	Conflict             Code = "CONFLICT"
+	Locked               Code = "LOCKED"
+	ResyncRequired       Code = "RESYNC_REQUIRED"
+	UnsupportedMediaType Code = "UNSUPPORTED_MEDIA_TYPE"
+	Unauthorized         Code = "UNAUTHORIZED"
+	Forbidden            Code = "FORBIDDEN"
+	TooManyRequests      Code = "TOO_MANY_REQUESTS"
+	Internal             Code = "INTERNAL"
+)
+
+// Response is the body of every error response.
+type Response struct {
+	Code    Code   `json:"code"`
+	Message string `json:"message"`
+}
+
+// --- Helpers
+
+// New builds an error body, formatting the message like fmt.Sprintf.
+func New(code Code, format string, values ...interface{}) *Response {
+	return &Response{
+		Code:    code,
+		Message: strings.TrimSpace(fmt.Sprintf(format, values...)),
+	}
+}
+
+// Respond writes an error body with the given status.
+func Respond(context *gin.Context, status int, code Code, format string, values ...interface{}) {
+	context.JSON(status, New(code, format, values...))
+}
@@ -1,9 +1,25 @@
 package appengine
 
 import (
+	"bytes"
+	"compress/gzip"
+	"compress/zlib"
+	"errors"
+	"io"
 	"net/http"
+	"strconv"
+	"strings"
 
+	"appengine/memcache"
+
+	"bootcamp/editorservice/apierror"
+	"bootcamp/editorservice/auth"
+	"bootcamp/editorservice/cache"
+	"bootcamp/editorservice/config"
+	"bootcamp/editorservice/flags"
+	"bootcamp/editorservice/ids"
 	"bootcamp/editorservice/levels"
+	"bootcamp/editorservice/requestid"
 	"bootcamp/editorservice/territories"
 
 	"github.com/gin-gonic/gin"
@@ -18,15 +34,27 @@ func init() {
 	gin.SetMode(gin.ReleaseMode)
 	router := gin.New()
 	//router.Use(gin.Recovery())
+	router.Use(requestid.Middleware())
 	router.Use(allowOrigins())
+	router.Use(refreshCacheMaintenance())
+	router.Use(flushCacheWrites())
+	router.Use(decodeRequestBodies())
+	router.Use(compressResponses())
+	router.Use(normalizeIds())
 
 	// Support OPTIONS for CORS
 	router.OPTIONS("/*any", index)
 
 	// Set up routes
 	router.GET("/", index)
+	router.GET("/_ah/stop", stop)
+	router.GET("/admin/cache/*key", auth.RequireAdmin(), cacheEntry)
+	router.POST(cache.RetryInvalidationPath, auth.RequireAdminOrTask(), retryInvalidation)
+	router.POST("/admin/cache/maintenance", auth.RequireAdmin(), cacheMaintenance)
+	router.GET("/admin/flags", auth.RequireAdmin(), featureFlags)
 	levels.Init(router)
 	territories.Init(router)
+	router.POST(batchPath, multiBatch(router))
 
 	// Tell AppEngine to forward all requests to gin
 	http.Handle("/", router)
@@ -36,6 +64,147 @@ func index(context *gin.Context) {
 	context.String(http.StatusOK, "hi\n")
 }
 
+// stop is called by AppEngine before it shuts down an instance (on manual and
+// basic scaling).  Anything still queued for the cache is sent before we go.
+func stop(context *gin.Context) {
+	appengineContext := requestid.NewContext(context.Request)
+	err := cache.FlushPending(appengineContext)
+	if err != nil {
+		appengineContext.Errorf("Could not flush the pending cache writes: %v", err)
+	}
+
+	context.String(http.StatusOK, "stopped\n")
+}
+
+// cacheEntryResponse shows what's cached under a key.  Raw is base64 encoded, and
+// Decoded is left out when the value can't be decoded.  Memcache doesn't report
+// how long an entry has left.
+type cacheEntryResponse struct {
+	Key     string      `json:"key"`
+	Exists  bool        `json:"exists"`
+	Leased  bool        `json:"leased"`
+	Raw     []byte      `json:"raw"`
+	Decoded interface{} `json:"decoded,omitempty"`
+}
+
+// cacheEntry shows the cache entry for a key, e.g. /admin/cache/level:some_level.
+// /admin/cache/stats is the cache statistics instead; no cache key is "stats".
+func cacheEntry(context *gin.Context) {
+	key := strings.TrimPrefix(context.Param("key"), "/")
+	if key == "stats" {
+		cacheStats(context)
+		return
+	}
+
+	appengineContext := requestid.NewContext(context.Request)
+	value, leased, err := cache.Inspect(appengineContext, key)
+	if err == memcache.ErrCacheMiss {
+		apierror.Respond(context, http.StatusNotFound, apierror.NotFound, "Nothing is cached under %q", key)
+		return
+	} else if err != nil {
+		apierror.Respond(context, http.StatusInternalServerError, apierror.Internal, "Could not read the cache: %+v", err)
+		return
+	}
+
+	response := &cacheEntryResponse{Key: key, Exists: true, Leased: leased, Raw: value}
+	if !leased {
+		response.Decoded, _ = levels.DecodeCacheEntry(key, value)
+	}
+	context.JSON(http.StatusOK, response)
+}
+
+// retryInvalidation deletes the cache keys given as key form values, for the
+// task queued when an invalidation failed.  A failure responds 500, so the task
+// queue tries again later.
+func retryInvalidation(context *gin.Context) {
+	err := context.Request.ParseForm()
+	if err != nil {
+		apierror.Respond(context, http.StatusBadRequest, apierror.InvalidRequest, "Could not parse the form: %+v", err)
+		return
+	}
+
+	appengineContext := requestid.NewContext(context.Request)
+	for _, key := range context.Request.PostForm["key"] {
+		err = memcache.Delete(appengineContext, key)
+		if err != nil && err != memcache.ErrCacheMiss {
+			apierror.Respond(context, http.StatusInternalServerError, apierror.Internal, "Could not invalidate %q: %+v", key, err)
+			return
+		}
+	}
+
+	context.JSON(http.StatusOK, nil)
+}
+
+// cacheMaintenance turns cache maintenance on or off with ?enabled=true or
+// false, and responds with whether it's now on.  The state is stored, so every
+// instance picks it up within a few seconds.  Lifting it invalidates every level
+// and territory entry, since entries cached before or during the migration may
+// be stale.  Locks and everything else in the cache are left alone.
+func cacheMaintenance(context *gin.Context) {
+	enabled, err := strconv.ParseBool(context.Query("enabled"))
+	if err != nil {
+		apierror.Respond(context, http.StatusBadRequest, apierror.InvalidRequest, "?enabled= must be true or false")
+		return
+	}
+
+	appengineContext := requestid.NewContext(context.Request)
+	state, err := cache.SetMaintenance(appengineContext, enabled)
+	if err != nil {
+		apierror.Respond(context, http.StatusInternalServerError, apierror.Internal, "Could not store the maintenance state: %+v", err)
+		return
+	}
+	if !enabled {
+		err = levels.InvalidateAllCaches(appengineContext)
+		if err == nil {
+			err = territories.InvalidateAllCaches(appengineContext)
+		}
+		if err != nil {
+			apierror.Respond(context, http.StatusInternalServerError, apierror.Internal, "Maintenance is over, but the cache could not be invalidated: %+v", err)
+			return
+		}
+	}
+
+	// The cache_maintenance flag keeps it on whatever is stored
+	state.Enabled = cache.InMaintenance()
+	context.JSON(http.StatusOK, state)
+}
+
+// cacheStats reports this instance's cache hits and misses.
+func cacheStats(context *gin.Context) {
+	context.JSON(http.StatusOK, cache.Stats())
+}
+
+// featureFlags reports which feature flags this instance has on.
+func featureFlags(context *gin.Context) {
+	context.JSON(http.StatusOK, flags.All())
+}
+
+// --- Cache maintenance middleware
+
+// refreshCacheMaintenance re-reads the stored cache maintenance state before a
+// request is handled, once this instance's copy is a few seconds old.
+func refreshCacheMaintenance() gin.HandlerFunc {
+	return func(c *gin.Context) {
+		cache.RefreshMaintenance(requestid.NewContext(c.Request))
+		c.Next()
+	}
+}
+
+// --- Cache flush middleware
+
+// flushCacheWrites sends any cache writes a request queued once it's handled.
+func flushCacheWrites() gin.HandlerFunc {
+	return func(c *gin.Context) {
+		c.Next()
+
+		appengineContext := requestid.NewContext(c.Request)
+		err := cache.FlushPending(appengineContext)
+		if err != nil {
+			appengineContext.Errorf("Could not flush the pending cache writes: %v", err)
+		}
+	}
+}
+
 // --- Allowed origins middleware
 
 var allowedOrigins = map[string]bool{
@@ -43,12 +212,275 @@ var allowedOrigins = map[string]bool{
 	"test.badunicorngames.com": true,
 }
 
+// exposedHeaders are the response headers the editor reads.  Browsers hide any
+// header that isn't a CORS-safelisted one from scripts unless it's listed here,
+// so add new ones as the API starts sending them.
+var exposedHeaders = []string{
+	"ETag",
+	"Location",
+	"Preference-Applied",
+	"Retry-After",
+	"X-Level-Unresolved",
+	"X-Request-ID",
+	"X-Result-Limited",
+}
+
 func allowOrigins() gin.HandlerFunc {
 	return func(c *gin.Context) {
 
 		c.Header("Access-Control-Allow-Origin", "*")
-		c.Header("Access-Control-Allow-Methods", "GET, POST, PUT, DELETE, OPTIONS")
+		c.Header("Access-Control-Allow-Methods", "GET, POST, PUT, PATCH, DELETE, OPTIONS")
+		c.Header("Access-Control-Expose-Headers", strings.Join(exposedHeaders, ", "))
 		c.Next()
 		return
 	}
 }
+
+// --- Request body decoding middleware
+
+// errBodyTooLarge is what reading a decompressed body past
+// config.MaxCacheItemBytes returns.
+var errBodyTooLarge = errors.New("the decompressed request body is too large")
+
+// decodeRequestBodies unpacks request bodies sent with Content-Encoding: gzip or
+// deflate, so handlers always read plain JSON.  Other encodings get a 415.  A
+// small body can decompress to a huge one, so reading stops with an error past
+// config.MaxCacheItemBytes, which is as big as a level written here can get
+// anyway.
+func decodeRequestBodies() gin.HandlerFunc {
+	return func(c *gin.Context) {
+		var body io.ReadCloser
+		var err error
+		switch encoding := c.Request.Header.Get("Content-Encoding"); encoding {
+		case "", "identity":
+			c.Next()
+			return
+		case "gzip":
+			body, err = gzip.NewReader(c.Request.Body)
+		case "deflate":
+			body, err = zlib.NewReader(c.Request.Body)
+		default:
+			apierror.Respond(c, http.StatusUnsupportedMediaType, apierror.UnsupportedMediaType, "Unsupported Content-Encoding %q", encoding)
+			c.Abort()
+			return
+		}
+
+		if err != nil {
+			apierror.Respond(c, http.StatusBadRequest, apierror.InvalidRequest, "Could not decode the request body: %+v", err)
+			c.Abort()
+			return
+		}
+
+		if config.MaxCacheItemBytes > 0 {
+			body = &cappedBody{ReadCloser: body, limited: io.LimitReader(body, int64(config.MaxCacheItemBytes)+1), remaining: int64(config.MaxCacheItemBytes)}
+		}
+		c.Request.Body = body
+		c.Request.Header.Del("Content-Encoding")
+		c.Request.ContentLength = -1
+		c.Next()
+	}
+}
+
+// cappedBody reads a decompressed body through an io.LimitReader, failing with
+// errBodyTooLarge instead of quietly stopping short when there's more.
+type cappedBody struct {
+	io.ReadCloser
+	limited   io.Reader
+	remaining int64
+}
+
+func (body *cappedBody) Read(data []byte) (int, error) {
+	n, err := body.limited.Read(data)
+	body.remaining -= int64(n)
+	if body.remaining < 0 {
+		return n, errBodyTooLarge
+	}
+
+	return n, err
+}
+
+// --- Id normalization middleware
+
+// idParams are the path parameters that hold level or territory ids.
+var idParams = map[string]bool{
+	"id":       true,
+	"sourceId": true,
+}
+
+// normalizeIds puts the ids in a request's path into their canonical form with
+// flags.NormalizeIds, or responds 400 if they can't be.  The path itself is
+// rewritten too, since the response caches are keyed by it.
+func normalizeIds() gin.HandlerFunc {
+	return func(c *gin.Context) {
+		if !flags.NormalizeIds.Enabled {
+			c.Next()
+			return
+		}
+
+		segments := strings.Split(c.Request.URL.Path, "/")
+		next := 0
+		for i, param := range c.Params {
+			if !idParams[param.Key] {
+				continue
+			}
+
+			normalized, err := ids.Normalize(param.Value)
+			if err != nil {
+				apierror.Respond(c, http.StatusBadRequest, apierror.InvalidRequest, "Invalid id %q: %+v", param.Value, err)
+				c.Abort()
+				return
+			}
+			if normalized == param.Value {
+				continue
+			}
+
+			// Parameters come in path order, and no static segment needs normalizing
+			for ; next < len(segments); next++ {
+				if segments[next] == param.Value {
+					segments[next] = normalized
+					break
+				}
+			}
+			c.Params[i].Value = normalized
+		}
+
+		c.Request.URL.Path = strings.Join(segments, "/")
+		c.Next()
+	}
+}
+
+// --- Response compression middleware
+
+// compressResponses gzips response bodies of at least config.MinGzipBytes for
+// clients that accept it.  Smaller ones are sent as they are, since gzip's own
+// overhead makes tiny bodies bigger.  Only the first config.MinGzipBytes are
+// held back to measure a body; past that, it's compressed as it's written, so
+// streamed responses like the export still stream.
+func compressResponses() gin.HandlerFunc {
+	return func(c *gin.Context) {
+		if !acceptsGzip(c.Request) {
+			c.Next()
+			return
+		}
+
+		original := c.Writer
+		original.Header().Add("Vary", "Accept-Encoding")
+		compressing := &compressingWriter{ResponseWriter: original}
+		c.Writer = compressing
+		c.Next()
+		c.Writer = original
+
+		compressing.finish()
+	}
+}
+
+// acceptsGzip reports whether a request's Accept-Encoding lists gzip, and
+// doesn't turn it off with q=0.
+func acceptsGzip(request *http.Request) bool {
+	for _, element := range strings.Split(request.Header.Get("Accept-Encoding"), ",") {
+		parts := strings.Split(element, ";")
+		if strings.TrimSpace(parts[0]) != "gzip" {
+			continue
+		}
+		for _, parameter := range parts[1:] {
+			parameter = strings.TrimSpace(parameter)
+			if !strings.HasPrefix(parameter, "q=") {
+				continue
+			}
+			if quality, err := strconv.ParseFloat(parameter[2:], 64); err == nil && quality == 0 {
+				return false
+			}
+		}
+		return true
+	}
+
+	return false
+}
+
+// compressingWriter holds a response body back until it's known to be worth
+// compressing, then compresses the rest as it's written.  Headers and the status
+// still go to the underlying writer, which only sends them with the first write.
+type compressingWriter struct {
+	gin.ResponseWriter
+	buffered   bytes.Buffer
+	compressor *gzip.Writer
+
+	// direct is set when the handler encoded the body itself, so it's passed on
+	// as it is
+	direct bool
+	size   int
+}
+
+func (writer *compressingWriter) Write(data []byte) (int, error) {
+	writer.size += len(data)
+	if writer.compressor != nil {
+		return writer.compressor.Write(data)
+	} else if writer.direct {
+		return writer.ResponseWriter.Write(data)
+	}
+
+	writer.buffered.Write(data)
+	if writer.buffered.Len() >= config.MinGzipBytes {
+		writer.start()
+	}
+	return len(data), nil
+}
+
+func (writer *compressingWriter) WriteString(data string) (int, error) {
+	return writer.Write([]byte(data))
+}
+
+func (writer *compressingWriter) Size() int {
+	return writer.size
+}
+
+func (writer *compressingWriter) Written() bool {
+	return writer.size > 0
+}
+
+// WriteHeaderNow holds the headers back along with the body, since they change
+// if it's compressed.
+func (writer *compressingWriter) WriteHeaderNow() {
+	if writer.compressor != nil || writer.direct {
+		writer.ResponseWriter.WriteHeaderNow()
+	}
+}
+
+// Flush sends what's been written so far.  A handler only flushes a response it
+// streams, so the first flush settles the encoding even when nothing's been
+// written yet: a body still under the threshold is compressed from then on
+// rather than held back, and the headers go out with it.
+func (writer *compressingWriter) Flush() {
+	if writer.compressor == nil && !writer.direct {
+		writer.start()
+	}
+	if writer.compressor != nil {
+		writer.compressor.Flush()
+	}
+	writer.ResponseWriter.Flush()
+}
+
+// start sends the headers and the held back part of the body, and has the rest
+// of the body follow it.
+func (writer *compressingWriter) start() {
+	if len(writer.Header().Get("Content-Encoding")) > 0 {
+		writer.direct = true
+		writer.ResponseWriter.Write(writer.buffered.Bytes())
+	} else {
+		writer.Header().Set("Content-Encoding", "gzip")
+		writer.Header().Del("Content-Length")
+		writer.compressor = gzip.NewWriter(writer.ResponseWriter)
+		writer.compressor.Write(writer.buffered.Bytes())
+	}
+	writer.buffered.Reset()
+}
+
+// finish ends the body: a compressed one is closed off, and one that never
+// reached the threshold is sent as it is.
+func (writer *compressingWriter) finish() {
+	if writer.compressor != nil {
+		writer.compressor.Close()
+	} else if !writer.direct && writer.buffered.Len() > 0 {
+		writer.ResponseWriter.Write(writer.buffered.Bytes())
+	}
+}
@@ -0,0 +1,243 @@
+package appengine
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"path"
+	"strings"
+
+	"github.com/gin-gonic/gin"
+
+	"bootcamp/editorservice/apierror"
+	"bootcamp/editorservice/config"
+	"bootcamp/editorservice/flags"
+	"bootcamp/editorservice/ids"
+	"bootcamp/editorservice/levels"
+	"bootcamp/editorservice/requestid"
+)
+
+// --- Types and constants
+
+// POST /v1/batch runs its sub-requests in one of three modes, selected with
+// ?mode=.  In best-effort mode every sub-request runs.  In stop-on-error mode the
+// batch stops at the first one that fails, and the rest aren't run.  Either way
+// each sub-request commits on its own, and nothing is rolled back: the ones
+// before a failure stay applied, since the routes run their own datastore
+// transactions, which can't nest inside one for the whole batch.
+//
+// Transactional mode is all-or-nothing instead, so it only takes the writes that
+// can share one transaction: PUT and DELETE of /levels/:id, which all live in
+// the levels' entity group.  They're applied by levels.ApplyAtomically rather
+// than through the routes.
+const (
+	batchPath              string = "/v1/batch"
+	batchModeBestEffort    string = "best-effort"
+	batchModeStopOnError   string = "stop-on-error"
+	batchModeTransactional string = "transactional"
+)
+
+// levelPathPrefix is the path of the level routes a transactional batch takes.
+const levelPathPrefix string = "/levels/"
+
+var batchMethods = map[string]bool{
+	"GET":    true,
+	"POST":   true,
+	"PUT":    true,
+	"PATCH":  true,
+	"DELETE": true,
+}
+
+// subRequest is one request of a batch.  Body is sent as it is, so it's whatever
+// JSON the route takes.
+type subRequest struct {
+	Method string          `json:"method"`
+	Path   string          `json:"path"`
+	Body   json.RawMessage `json:"body,omitempty"`
+}
+
+// subResponse is the outcome of one sub-request.  Body is left out when the
+// route sent nothing back.
+type subResponse struct {
+	Status int             `json:"status"`
+	Body   json.RawMessage `json:"body,omitempty"`
+}
+
+type batchResponse struct {
+	Results []subResponse `json:"results"`
+}
+
+// --- Route handlers
+
+// multiBatch handles POST /v1/batch, which takes an ordered array of sub-requests
+// and runs them through handler one after another, or in transactional mode
+// applies them together.  The results are in the same order.
+func multiBatch(handler http.Handler) gin.HandlerFunc {
+	return func(context *gin.Context) {
+		mode := context.DefaultQuery("mode", batchModeBestEffort)
+		if mode != batchModeBestEffort && mode != batchModeStopOnError && mode != batchModeTransactional {
+			apierror.Respond(context, http.StatusBadRequest, apierror.InvalidRequest, "Unknown batch mode %q", mode)
+			return
+		}
+
+		var requests []subRequest
+		err := context.BindJSON(&requests)
+		if err != nil {
+			apierror.Respond(context, http.StatusBadRequest, apierror.InvalidRequest, "Failed to unmarshal the JSON: %+v", err)
+			return
+		}
+		if len(requests) > config.MaxBatchItems {
+			apierror.Respond(context, http.StatusBadRequest, apierror.InvalidRequest, "A batch may have at most %d items, but this one has %d.  Split it into smaller batches.", config.MaxBatchItems, len(requests))
+			return
+		}
+
+		if mode == batchModeTransactional {
+			runAtomically(context, requests)
+			return
+		}
+
+		response := &batchResponse{Results: make([]subResponse, len(requests))}
+		failed := false
+		for i := range requests {
+			if failed && mode == batchModeStopOnError {
+				response.Results[i] = errorResult(http.StatusFailedDependency, apierror.Conflict, "Not run because an earlier sub-request failed")
+				continue
+			}
+
+			response.Results[i] = runSubRequest(handler, context.Request, &requests[i])
+			failed = failed || response.Results[i].Status >= http.StatusMultipleChoices
+		}
+
+		context.JSON(batchStatus(response), response)
+	}
+}
+
+// --- Helpers
+
+// runSubRequest serves one sub-request.  The App Engine context of a request is
+// tied to the *http.Request itself, so the batch's own request is borrowed for
+// it, keeping the caller's headers (and so their login), then put back.
+func runSubRequest(handler http.Handler, request *http.Request, sub *subRequest) subResponse {
+	if !batchMethods[sub.Method] {
+		return errorResult(http.StatusBadRequest, apierror.InvalidRequest, "Unsupported method %q", sub.Method)
+	}
+
+	target, err := url.Parse(sub.Path)
+	if err != nil || !strings.HasPrefix(target.Path, "/") || len(target.Host) > 0 {
+		return errorResult(http.StatusBadRequest, apierror.InvalidRequest, "The path must be a path on this service, not %q", sub.Path)
+	}
+	if strings.HasPrefix(path.Clean(target.Path), batchPath) {
+		return errorResult(http.StatusBadRequest, apierror.InvalidRequest, "A batch can't contain another batch")
+	}
+
+	original := *request
+	defer func() { *request = original }()
+
+	request.Method = sub.Method
+	request.URL = target
+	request.RequestURI = target.RequestURI()
+	request.Header = make(http.Header)
+	for name, values := range original.Header {
+		request.Header[name] = values
+	}
+	request.Header.Set("Content-Type", "application/json")
+	request.Header.Del("Accept-Encoding") // the body is embedded as JSON, so it mustn't be gzipped
+	request.Body = ioutil.NopCloser(bytes.NewReader(sub.Body))
+	request.ContentLength = int64(len(sub.Body))
+
+	recorder := httptest.NewRecorder()
+	handler.ServeHTTP(recorder, request)
+
+	result := subResponse{Status: recorder.Code}
+	var decoded interface{}
+	if json.Unmarshal(recorder.Body.Bytes(), &decoded) == nil {
+		result.Body = json.RawMessage(recorder.Body.Bytes())
+	}
+
+	return result
+}
+
+// runAtomically runs a transactional batch.  Every sub-request has to be a level
+// write, or none of them are applied.
+func runAtomically(context *gin.Context, requests []subRequest) {
+	response := &batchResponse{Results: make([]subResponse, len(requests))}
+	writes := make([]levels.Write, len(requests))
+	failed := false
+	for i := range requests {
+		write, err := levelWrite(&requests[i])
+		if err != nil {
+			response.Results[i] = errorResult(http.StatusBadRequest, apierror.InvalidRequest, "%+v", err)
+			failed = true
+			continue
+		}
+		writes[i] = *write
+	}
+
+	if failed {
+		for i := range response.Results {
+			if response.Results[i].Status == 0 {
+				response.Results[i] = errorResult(http.StatusFailedDependency, apierror.Conflict, "Not applied because another sub-request can't run in a transactional batch")
+			}
+		}
+		context.JSON(batchStatus(response), response)
+		return
+	}
+
+	appengineContext := requestid.NewContext(context.Request)
+	for i, result := range levels.ApplyAtomically(appengineContext, writes) {
+		response.Results[i].Status = result.Status
+		if result.Status != http.StatusNoContent {
+			response.Results[i].Body, _ = json.Marshal(result.Body)
+		}
+	}
+
+	context.JSON(batchStatus(response), response)
+}
+
+// levelWrite turns a sub-request of a transactional batch into the level write
+// it stands for, or says why it can't run in one.
+func levelWrite(sub *subRequest) (*levels.Write, error) {
+	if sub.Method != "PUT" && sub.Method != "DELETE" {
+		return nil, fmt.Errorf("only PUT and DELETE of %s:id can run in a transactional batch, not %s", levelPathPrefix, sub.Method)
+	}
+
+	target, err := url.Parse(sub.Path)
+	if err != nil || len(target.Host) > 0 || len(target.RawQuery) > 0 {
+		return nil, fmt.Errorf("the path must be a path on this service without a query, not %q", sub.Path)
+	}
+	cleaned := path.Clean(target.Path)
+	levelId := strings.TrimPrefix(cleaned, levelPathPrefix)
+	if !strings.HasPrefix(cleaned, levelPathPrefix) || strings.Contains(levelId, "/") {
+		return nil, fmt.Errorf("only PUT and DELETE of %s:id can run in a transactional batch, not %q", levelPathPrefix, sub.Path)
+	}
+
+	if flags.NormalizeIds.Enabled {
+		levelId, err = ids.Normalize(levelId)
+		if err != nil {
+			return nil, fmt.Errorf("invalid id: %+v", err)
+		}
+	}
+
+	return &levels.Write{LevelId: levelId, Delete: sub.Method == "DELETE", Body: sub.Body}, nil
+}
+
+// batchStatus is 200 when every sub-request succeeded and 207 (Multi-Status)
+// otherwise.
+func batchStatus(response *batchResponse) int {
+	for _, result := range response.Results {
+		if result.Status >= http.StatusMultipleChoices {
+			return http.StatusMultiStatus
+		}
+	}
+
+	return http.StatusOK
+}
+
+func errorResult(status int, code apierror.Code, format string, values ...interface{}) subResponse {
+	body, _ := json.Marshal(apierror.New(code, format, values...))
+	return subResponse{Status: status, Body: body}
+}
@@ -0,0 +1,64 @@
+// Package auth guards routes that only some users may call.
+package auth
+
+import (
+	"net/http"
+
+	"appengine/user"
+
+	"github.com/gin-gonic/gin"
+
+	"bootcamp/editorservice/apierror"
+	"bootcamp/editorservice/requestid"
+)
+
+// RequireAdmin is middleware that rejects requests from anyone who isn't signed
+// in as an administrator of the app.
+func RequireAdmin() gin.HandlerFunc {
+	return func(context *gin.Context) {
+		appengineContext := requestid.NewContext(context.Request)
+		if user.Current(appengineContext) == nil {
+			apierror.Respond(context, http.StatusUnauthorized, apierror.Unauthorized, "Sign in as an administrator to use this route")
+			context.Abort()
+			return
+		}
+
+		if !user.IsAdmin(appengineContext) {
+			apierror.Respond(context, http.StatusForbidden, apierror.Forbidden, "Only administrators may use this route")
+			context.Abort()
+			return
+		}
+
+		context.Next()
+	}
+}
+
+// RequireAdminOrCron is RequireAdmin that also lets in requests from App Engine
+// cron.  Cron requests aren't signed in; App Engine marks them with a header it
+// strips from outside requests.
+func RequireAdminOrCron() gin.HandlerFunc {
+	requireAdmin := RequireAdmin()
+	return func(context *gin.Context) {
+		if context.Request.Header.Get("X-Appengine-Cron") == "true" {
+			context.Next()
+			return
+		}
+
+		requireAdmin(context)
+	}
+}
+
+// RequireAdminOrTask is RequireAdmin that also lets in requests from the App
+// Engine task queue, which marks them with a header it strips from outside
+// requests.
+func RequireAdminOrTask() gin.HandlerFunc {
+	requireAdmin := RequireAdmin()
+	return func(context *gin.Context) {
+		if len(context.Request.Header.Get("X-Appengine-QueueName")) > 0 {
+			context.Next()
+			return
+		}
+
+		requireAdmin(context)
+	}
+}
@@ -2,10 +2,25 @@
 package cache
 
 import (
+	"bytes"
+	"encoding/json"
 	"errors"
+	"fmt"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
 
 	"appengine"
+	"appengine/datastore"
 	"appengine/memcache"
+	"appengine/taskqueue"
+
+	"bootcamp/editorservice/config"
+	"bootcamp/editorservice/flags"
 )
 
 type CacheItem interface {
@@ -16,52 +31,525 @@ type CacheItem interface {
 
 var (
 	ErrNilCacheItem = errors.New("cache: CacheItem must not be nil")
+	ErrLeaseLost    = errors.New("cache: the lease was invalidated or taken over")
 )
 
+// A lease marks a key that a reader is about to fill.  Leases expire quickly so
+// that a reader that never comes back doesn't keep the key empty for long.
+const leaseExpiration = 10 * time.Second
+
+var leaseMarker = []byte("cache:lease")
+
+type Lease struct {
+	item *memcache.Item
+}
+
+// GetCachedResource fills cacheItem from memcache.  During cache maintenance
+// (see InMaintenance), every read is a miss and nothing is cached, though
+// invalidations still go through.
 func GetCachedResource(context appengine.Context, cacheItem CacheItem) error {
 	if cacheItem == nil {
 		return ErrNilCacheItem
 	}
+	if InMaintenance() {
+		atomic.AddInt64(&misses, 1)
+		return memcache.ErrCacheMiss
+	}
 
 	// Check memcache
 	item, err := memcache.Get(context, cacheItem.GetCacheKey())
 	if err != nil {
+		atomic.AddInt64(&misses, 1)
 		return err
 	}
 
-	// Unmarshal and return
-	err = cacheItem.UnmarshalBinary(item.Value)
+	// Someone is filling this key, but it isn't filled yet
+	if bytes.Equal(item.Value, leaseMarker) {
+		atomic.AddInt64(&misses, 1)
+		return memcache.ErrCacheMiss
+	}
+
+	// Unmarshal and return.  An entry that won't unmarshal (say it was written by
+	// an older version) is dropped and treated as a miss, so it gets refilled.
+	err = unmarshalSafely(cacheItem, item.Value)
 	if err != nil {
-		return err
+		context.Warningf("Dropping the unreadable cache entry %q: %v", item.Key, err)
+		memcache.Delete(context, item.Key)
+		atomic.AddInt64(&misses, 1)
+		return memcache.ErrCacheMiss
 	}
 
+	atomic.AddInt64(&hits, 1)
 	return nil
 }
 
+// unmarshalSafely is UnmarshalBinary with any panic turned into an error, so
+// that a corrupt entry can't take the request down with it.
+func unmarshalSafely(cacheItem CacheItem, data []byte) (err error) {
+	defer func() {
+		if recovered := recover(); recovered != nil {
+			err = fmt.Errorf("cache: unmarshalling panicked: %v", recovered)
+		}
+	}()
+
+	return cacheItem.UnmarshalBinary(data)
+}
+
+// Inspect returns the raw value cached under key, for debugging.  leased is true
+// when the key holds a lease rather than a value.  A missing key is
+// memcache.ErrCacheMiss.
+func Inspect(context appengine.Context, key string) (value []byte, leased bool, err error) {
+	item, err := memcache.Get(context, key)
+	if err != nil {
+		return nil, false, err
+	}
+
+	return item.Value, bytes.Equal(item.Value, leaseMarker), nil
+}
+
 func CacheResource(context appengine.Context, cacheItem CacheItem) error {
+	return CacheResourceFor(context, cacheItem, 0)
+}
+
+// CacheResourceFor caches a resource that goes stale on its own, so that it's
+// dropped after expiration even if nothing invalidates it.
+func CacheResourceFor(context appengine.Context, cacheItem CacheItem, expiration time.Duration) error {
 	if cacheItem == nil {
 		return ErrNilCacheItem
 	}
+	if InMaintenance() {
+		return nil
+	}
 
 	// Marshal
 	data, err := cacheItem.MarshalBinary()
 	if err != nil {
 		return err
 	}
+	if tooLarge(context, cacheItem.GetCacheKey(), data) {
+		return nil
+	}
 
 	// Write to memcache
 	item := &memcache.Item{
-		Key:   cacheItem.GetCacheKey(),
-		Value: data,
+		Key:        cacheItem.GetCacheKey(),
+		Value:      data,
+		Expiration: expiration,
 	}
 
 	return memcache.Set(context, item)
 }
 
+// TakeLease is called after a cache miss, before loading the value from
+// elsewhere.  Filling the cache with CacheResourceWithLease then only succeeds
+// if nothing invalidated the key in the meantime, so a value loaded before a
+// write can't be cached after it.  Returns nil if another reader holds the lease,
+// or during cache maintenance.
+func TakeLease(context appengine.Context, cacheItem CacheItem) *Lease {
+	if cacheItem == nil || InMaintenance() {
+		return nil
+	}
+
+	key := cacheItem.GetCacheKey()
+	err := memcache.Add(context, &memcache.Item{
+		Key:        key,
+		Value:      leaseMarker,
+		Expiration: leaseExpiration,
+	})
+	if err != nil {
+		return nil
+	}
+
+	// Read the marker back for its CAS token
+	item, err := memcache.Get(context, key)
+	if err != nil || !bytes.Equal(item.Value, leaseMarker) {
+		return nil
+	}
+
+	return &Lease{item: item}
+}
+
+// CacheResourceWithLease replaces a lease with the cached value.  Returns
+// ErrLeaseLost, and caches nothing, if the lease is nil or no longer held.
+func CacheResourceWithLease(context appengine.Context, lease *Lease, cacheItem CacheItem) error {
+	if cacheItem == nil {
+		return ErrNilCacheItem
+	}
+	if InMaintenance() {
+		return nil
+	}
+	if lease == nil {
+		return ErrLeaseLost
+	}
+
+	// Marshal.  An item too large to cache leaves the lease to expire, which
+	// readers treat as a miss anyway.
+	data, err := cacheItem.MarshalBinary()
+	if err != nil {
+		return err
+	}
+	if tooLarge(context, cacheItem.GetCacheKey(), data) {
+		return nil
+	}
+
+	// Swap the value in for the lease
+	lease.item.Value = data
+	lease.item.Expiration = 0
+	err = memcache.CompareAndSwap(context, lease.item)
+	if err == memcache.ErrCASConflict || err == memcache.ErrNotStored {
+		return ErrLeaseLost
+	}
+
+	return err
+}
+
 func InvalidateCacheEntry(context appengine.Context, cacheItem CacheItem) error {
-	return memcache.Delete(context, cacheItem.GetCacheKey())
+	return InvalidateCacheEntryByKey(context, cacheItem.GetCacheKey())
 }
 
 func InvalidateCacheEntryByKey(context appengine.Context, cacheKey string) error {
-	return memcache.Delete(context, cacheKey)
+	if config.BatchCacheInvalidations {
+		pendingMutex.Lock()
+		pendingInvalidations = append(pendingInvalidations, cacheKey)
+		pendingMutex.Unlock()
+		return nil
+	}
+
+	return deleteWithRetry(context, cacheKey)
+}
+
+// deleteWithRetry deletes a key from memcache, trying config.InvalidationRetries
+// more times if memcache fails.  If it still can't, the key is queued for
+// RetryInvalidationPath, since a stale entry would otherwise stay until evicted.
+func deleteWithRetry(context appengine.Context, cacheKey string) error {
+	var err error
+	for attempt := 0; attempt <= config.InvalidationRetries; attempt++ {
+		if attempt > 0 {
+			time.Sleep(time.Duration(attempt) * retryBackoff)
+		}
+
+		err = deleteItem(context, cacheKey)
+		if err == nil || err == memcache.ErrCacheMiss {
+			return nil
+		}
+	}
+
+	context.Warningf("Could not invalidate %q, so queueing a retry: %v", cacheKey, err)
+	return queueInvalidation(context, []string{cacheKey})
+}
+
+// tooLarge reports whether data is over config.MaxCacheItemBytes, logging the
+// key it skips.
+func tooLarge(context appengine.Context, key string, data []byte) bool {
+	if config.MaxCacheItemBytes <= 0 || len(data) <= config.MaxCacheItemBytes {
+		return false
+	}
+
+	context.Infof("Not caching %q: %d bytes is over the %d byte limit", key, len(data), config.MaxCacheItemBytes)
+	return true
+}
+
+// --- Response entries
+// A cached response is kept as the JSON it was written as.  Decoding it into an
+// interface{} would turn every number into a float64, so float32 fields would be
+// written back with float64 digits.
+
+// ResponseEntry caches a whole response under the path it answers.  Response is
+// a *json.RawMessage once it's been read back from the cache.
+type ResponseEntry struct {
+	Path     string
+	Code     int
+	Response interface{}
+	ETag     string
+}
+
+func (entry *ResponseEntry) GetCacheKey() string {
+	return "response:" + entry.Path
+}
+
+func (entry *ResponseEntry) MarshalBinary() ([]byte, error) {
+	return json.Marshal(entry)
+}
+
+func (entry *ResponseEntry) UnmarshalBinary(data []byte) error {
+	var stored struct {
+		Path     string
+		Code     int
+		Response *json.RawMessage
+		ETag     string
+	}
+	err := json.Unmarshal(data, &stored)
+	if err != nil {
+		return err
+	}
+
+	entry.Path, entry.Code, entry.Response, entry.ETag = stored.Path, stored.Code, stored.Response, stored.ETag
+	return nil
+}
+
+// --- Batched invalidations
+// With config.BatchCacheInvalidations, invalidations wait here until the next
+// FlushPending.  The queue is shared by the whole instance.
+
+var pendingMutex sync.Mutex
+var pendingInvalidations []string
+
+// FlushPending sends every queued invalidation to memcache and waits for it to
+// finish.  It does nothing when no invalidations are queued.
+func FlushPending(context appengine.Context) error {
+	pendingMutex.Lock()
+	keys := pendingInvalidations
+	pendingInvalidations = nil
+	pendingMutex.Unlock()
+
+	if len(keys) == 0 {
+		return nil
+	}
+
+	return deleteMultiWithRetry(context, keys)
+}
+
+// InvalidateCacheKeys deletes many keys with one call, for invalidations that
+// cover a whole collection.  It isn't batched with config.BatchCacheInvalidations.
+func InvalidateCacheKeys(context appengine.Context, cacheKeys []string) error {
+	if len(cacheKeys) == 0 {
+		return nil
+	}
+
+	return deleteMultiWithRetry(context, cacheKeys)
+}
+
+// deleteMultiWithRetry deletes keys from memcache.  Keys that were never cached
+// aren't a problem.  The ones memcache failed are queued for a retry.
+func deleteMultiWithRetry(context appengine.Context, keys []string) error {
+	err := memcache.DeleteMulti(context, keys)
+	if multiError, ok := err.(appengine.MultiError); ok {
+		var failed []string
+		for i, keyErr := range multiError {
+			if keyErr != nil && keyErr != memcache.ErrCacheMiss {
+				failed = append(failed, keys[i])
+			}
+		}
+		if len(failed) == 0 {
+			return nil
+		}
+		keys = failed
+	} else if err == nil {
+		return nil
+	}
+
+	context.Warningf("Could not invalidate %d keys, so queueing a retry: %v", len(keys), err)
+	return queueInvalidation(context, keys)
+}
+
+// --- Invalidation retries
+
+// RetryInvalidationPath is the route that deletes the keys of a queued retry,
+// given as key form values.  It should fail while memcache does, so that the
+// task queue keeps retrying it.
+const RetryInvalidationPath = "/admin/cache/invalidate"
+
+// retryBackoff is how much longer each inline retry waits than the last.
+const retryBackoff = 20 * time.Millisecond
+
+// deleteItem and addTask are memcache.Delete and taskqueue.Add, swapped out by
+// tests to make memcache fail.
+var deleteItem = memcache.Delete
+var addTask = taskqueue.Add
+
+func queueInvalidation(context appengine.Context, keys []string) error {
+	task := taskqueue.NewPOSTTask(RetryInvalidationPath, url.Values{"key": keys})
+	_, err := addTask(context, task, "")
+	return err
+}
+
+// --- Maintenance
+// Cache maintenance is kept in a datastore entity, so that turning it on or off
+// reaches every instance.  Each instance keeps a copy, which RefreshMaintenance
+// re-reads at the start of a request once it's maintenanceTTL old.  Checking it
+// never touches the datastore, since some checks run inside transactions.
+
+const maintenanceKind = "CacheMaintenance"
+const maintenanceKeyName = "state"
+
+// maintenanceTTL is how long an instance goes on with its copy of the state, so
+// how long a change takes to reach every instance.
+const maintenanceTTL = 10 * time.Second
+
+type MaintenanceState struct {
+	Enabled   bool      `json:"enabled"`
+	ChangedAt time.Time `json:"changed_at"`
+}
+
+var maintenanceMutex sync.Mutex
+var maintenance MaintenanceState
+var maintenanceReadAt time.Time
+
+// InMaintenance reports whether nothing should be read from or written to the
+// cache.  That's while the stored state is on, as this instance last read it, or
+// while the cache_maintenance flag is.
+func InMaintenance() bool {
+	if flags.CacheMaintenance.Enabled {
+		return true
+	}
+
+	maintenanceMutex.Lock()
+	defer maintenanceMutex.Unlock()
+	return maintenance.Enabled
+}
+
+// RefreshMaintenance re-reads the stored state if this instance's copy is older
+// than maintenanceTTL.  If the read fails, the copy is kept until the next one.
+func RefreshMaintenance(context appengine.Context) {
+	maintenanceMutex.Lock()
+	stale := time.Since(maintenanceReadAt) >= maintenanceTTL
+	if stale {
+		maintenanceReadAt = time.Now()
+	}
+	maintenanceMutex.Unlock()
+	if !stale {
+		return
+	}
+
+	state := MaintenanceState{}
+	err := datastore.Get(context, datastore.NewKey(context, maintenanceKind, maintenanceKeyName, 0, nil), &state)
+	if err != nil && err != datastore.ErrNoSuchEntity {
+		context.Warningf("Could not read the cache maintenance state, so keeping this instance's copy: %v", err)
+		return
+	}
+
+	maintenanceMutex.Lock()
+	maintenance = state
+	maintenanceMutex.Unlock()
+}
+
+// SetMaintenance stores whether cache maintenance is on.  This instance takes
+// the change straight away, and the others within maintenanceTTL.
+func SetMaintenance(context appengine.Context, enabled bool) (*MaintenanceState, error) {
+	state := MaintenanceState{Enabled: enabled, ChangedAt: time.Now()}
+	_, err := datastore.Put(context, datastore.NewKey(context, maintenanceKind, maintenanceKeyName, 0, nil), &state)
+	if err != nil {
+		return nil, err
+	}
+
+	maintenanceMutex.Lock()
+	maintenance = state
+	maintenanceReadAt = time.Now()
+	maintenanceMutex.Unlock()
+	return &state, nil
+}
+
+// --- Semaphores
+// A semaphore counts the requests holding one of its slots across every
+// instance.  The count is changed with compare-and-swap, and each change puts
+// off its expiry, so slots held by requests that never released them (e.g.
+// their instance died) come back once the semaphore has been left alone for a
+// while.
+
+const semaphoreExpiration = 5 * time.Minute
+
+// semaphoreAttempts is how many times a change to a semaphore is retried when
+// other requests change it at the same time.
+const semaphoreAttempts = 5
+
+var ErrNoSlotFree = errors.New("cache: every slot of the semaphore is taken")
+
+// AcquireSlot takes one of limit slots of the named semaphore, or returns
+// ErrNoSlotFree.  A slot that was taken must be given back with ReleaseSlot.
+// A semaphore too busy to change is treated as full.
+func AcquireSlot(context appengine.Context, name string, limit int) error {
+	err := changeSemaphore(context, name, func(count int) (int, error) {
+		if count >= limit {
+			return count, ErrNoSlotFree
+		}
+		return count + 1, nil
+	})
+	if err == memcache.ErrCASConflict {
+		return ErrNoSlotFree
+	}
+
+	return err
+}
+
+// ReleaseSlot gives back a slot taken with AcquireSlot.  A semaphore that has
+// expired or been evicted has nothing to give back.
+func ReleaseSlot(context appengine.Context, name string) error {
+	return changeSemaphore(context, name, func(count int) (int, error) {
+		if count <= 0 {
+			return 0, nil
+		}
+		return count - 1, nil
+	})
+}
+
+// changeSemaphore replaces the named semaphore's count with what change makes
+// of it, retrying when it's changed underneath.  A missing semaphore counts as
+// zero, and is only created if change raises it.
+func changeSemaphore(context appengine.Context, name string, change func(count int) (int, error)) error {
+	key := "semaphore:" + name
+	err := memcache.ErrCASConflict
+	for attempt := 0; attempt < semaphoreAttempts && err == memcache.ErrCASConflict; attempt++ {
+		item, getErr := memcache.Get(context, key)
+		if getErr != nil && getErr != memcache.ErrCacheMiss {
+			return getErr
+		}
+
+		count := 0
+		if item != nil {
+			count, _ = strconv.Atoi(string(item.Value))
+		}
+		next, changeErr := change(count)
+		if changeErr != nil {
+			return changeErr
+		}
+
+		if item == nil {
+			if next == 0 {
+				return nil
+			}
+			err = memcache.Add(context, &memcache.Item{Key: key, Value: []byte(strconv.Itoa(next)), Expiration: semaphoreExpiration})
+		} else {
+			item.Value = []byte(strconv.Itoa(next))
+			item.Expiration = semaphoreExpiration
+			err = memcache.CompareAndSwap(context, item)
+		}
+		if err == memcache.ErrNotStored {
+			err = memcache.ErrCASConflict
+		}
+	}
+
+	return err
+}
+
+// --- Statistics
+// Counts of the lookups this instance has made with GetCachedResource.
+
+type Statistics struct {
+	Hits   int64 `json:"hits"`
+	Misses int64 `json:"misses"`
+}
+
+var hits int64
+var misses int64
+
+// Stats returns the lookup counts since the instance started.
+func Stats() Statistics {
+	return Statistics{
+		Hits:   atomic.LoadInt64(&hits),
+		Misses: atomic.LoadInt64(&misses),
+	}
+}
+
+// --- Requests
+
+// WantsFreshData reports whether a request asked to bypass caches with
+// Cache-Control: no-cache (or the older Pragma: no-cache).
+func WantsFreshData(request *http.Request) bool {
+	for _, directive := range strings.Split(request.Header.Get("Cache-Control"), ",") {
+		if strings.TrimSpace(strings.ToLower(directive)) == "no-cache" {
+			return true
+		}
+	}
+
+	return strings.ToLower(request.Header.Get("Pragma")) == "no-cache"
 }
@@ -0,0 +1,116 @@
+package cache
+
+import (
+	"encoding/json"
+	"errors"
+	"net/http"
+	"net/url"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+
+	"appengine"
+	"appengine/aetest"
+	"appengine/memcache"
+	"appengine/taskqueue"
+
+	"bootcamp/editorservice/config"
+)
+
+var errMemcacheDown = errors.New("memcache is down")
+
+func TestFailedInvalidationIsQueuedForRetry(t *testing.T) {
+	context, err := aetest.NewContext(nil)
+	assert.Nil(t, err)
+	defer context.Close()
+
+	deletes := 0
+	var queued []*taskqueue.Task
+	restore := stubMemcache(func(key string) error {
+		deletes++
+		return errMemcacheDown
+	}, &queued)
+	defer restore()
+
+	err = InvalidateCacheEntryByKey(context, "level:stale")
+	assert.Nil(t, err)
+	assert.Equal(t, 1+config.InvalidationRetries, deletes)
+
+	if assert.Equal(t, 1, len(queued)) {
+		assert.Equal(t, RetryInvalidationPath, queued[0].Path)
+		values, err := url.ParseQuery(string(queued[0].Payload))
+		assert.Nil(t, err)
+		assert.Equal(t, []string{"level:stale"}, values["key"])
+	}
+}
+
+func TestInvalidationRetriesTransientFailures(t *testing.T) {
+	context, err := aetest.NewContext(nil)
+	assert.Nil(t, err)
+	defer context.Close()
+
+	deletes := 0
+	var queued []*taskqueue.Task
+	restore := stubMemcache(func(key string) error {
+		deletes++
+		if deletes == 1 {
+			return errMemcacheDown
+		}
+		return memcache.ErrCacheMiss
+	}, &queued)
+	defer restore()
+
+	err = InvalidateCacheEntryByKey(context, "level:stale")
+	assert.Nil(t, err)
+	assert.Equal(t, 2, deletes)
+	assert.Empty(t, queued)
+}
+
+// stubMemcache swaps in deleteKey for memcache.Delete, and records queued
+// tasks in queued instead of adding them.  The returned func puts them back.
+func stubMemcache(deleteKey func(key string) error, queued *[]*taskqueue.Task) func() {
+	originalDelete, originalAdd := deleteItem, addTask
+	deleteItem = func(context appengine.Context, key string) error {
+		return deleteKey(key)
+	}
+	addTask = func(context appengine.Context, task *taskqueue.Task, queueName string) (*taskqueue.Task, error) {
+		*queued = append(*queued, task)
+		return task, nil
+	}
+
+	return func() {
+		deleteItem, addTask = originalDelete, originalAdd
+	}
+}
+
+func TestWantsFreshDataReadsEitherHeader(t *testing.T) {
+	for header, expected := range map[string]bool{
+		"":                                   false,
+		"Cache-Control: max-age=0":           false,
+		"Cache-Control: max-age=0, No-Cache": true,
+		"Pragma: no-cache":                   true,
+	} {
+		request, _ := http.NewRequest("GET", "/", nil)
+		if parts := strings.SplitN(header, ": ", 2); len(parts) == 2 {
+			request.Header.Set(parts[0], parts[1])
+		}
+		assert.Equal(t, expected, WantsFreshData(request), header)
+	}
+}
+
+func TestResponseEntryKeepsTheJSONAsWritten(t *testing.T) {
+	written := &ResponseEntry{Path: "/levels/a", Code: http.StatusOK, Response: map[string]float32{"duration": 0.1}, ETag: `"abc"`}
+	data, err := written.MarshalBinary()
+	assert.Nil(t, err)
+
+	read := &ResponseEntry{}
+	assert.Nil(t, read.UnmarshalBinary(data))
+	assert.Equal(t, "response:/levels/a", read.GetCacheKey())
+	assert.Equal(t, `"abc"`, read.ETag)
+
+	// Written back out, the float32 keeps its own digits
+	response, err := json.Marshal(read.Response)
+	assert.Nil(t, err)
+	assert.Equal(t, `{"duration":0.1}`, string(response))
+}
@@ -0,0 +1,180 @@
+// Package config holds settings that can be tuned per deployment.
+//
+// Every setting has a sensible default and can be overridden with an
+// environment variable (see env_variables in app.yaml).
+package config
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+	"strconv"
+	"strings"
+)
+
+// --- Settings
+
+// MaxSpawnFrequencyEntries caps how many unit types a level's spawn_frequency
+// map may contain, after parent properties have been merged in.
+var MaxSpawnFrequencyEntries = intFromEnv("MAX_SPAWN_FREQUENCY_ENTRIES", 64)
+
+// FieldRule bounds a numeric level field, or caps the number of entries in a
+// map field.  Unset bounds aren't checked.
+type FieldRule struct {
+	Min        *float64 `json:"min,omitempty"`
+	Max        *float64 `json:"max,omitempty"`
+	MaxEntries *int     `json:"max_entries,omitempty"`
+}
+
+// ValidationRules maps the JSON names of level fields to the rules levels must
+// meet, e.g. {"rows": {"min": 1, "max": 12}}.  It's read once at startup, and
+// spawn_frequency falls back to MaxSpawnFrequencyEntries when it isn't capped here.
+// An instance with invalid VALIDATION_RULES fails to start.
+var ValidationRules = rulesFromEnv("VALIDATION_RULES")
+
+// LevelDefaults is a JSON level whose fields fill in anything a resolved level
+// leaves unset, when a client asks for defaults with ?applyDefaults=true.
+var LevelDefaults = stringFromEnv("LEVEL_DEFAULTS", `{"combo_timer": 2.0, "unit_delay_multiplier": 1.0}`)
+
+// ChangeNotificationQueue names the pull queue that gets a task for every level
+// write, listing the fields that changed.  queue.yaml declares level-changes for
+// this.  Notifications are off when it's empty.
+var ChangeNotificationQueue = stringFromEnv("CHANGE_NOTIFICATION_QUEUE", "")
+
+// BatchCacheInvalidations queues cache invalidations and sends them together at
+// the end of each request (and when the instance is stopped), instead of one
+// memcache call each.
+var BatchCacheInvalidations = boolFromEnv("BATCH_CACHE_INVALIDATIONS", false)
+
+// InvalidationRetries is how many more times an invalidation that memcache
+// failed is tried before it's handed to a task on the default queue, which keeps
+// retrying it until it goes through.
+var InvalidationRetries = intFromEnv("INVALIDATION_RETRIES", 2)
+
+// PageTokenSecret signs the page tokens handed out by paged queries.  Set it
+// per deployment so that tokens can't be forged; there's no default, and until
+// it's set paged queries can't go past their first page.
+var PageTokenSecret = stringFromEnv("PAGE_TOKEN_SECRET", "")
+
+// MaxBatchItems caps the items in one request to a batch route.  The datastore
+// takes at most 500 entities per call, so clients with more split them into
+// several requests of at most this many.
+var MaxBatchItems = intFromEnv("MAX_BATCH_ITEMS", 500)
+
+// MaxHeavyRequests caps how many requests to the routes that scan every level
+// (the stats, the tree and the export) may run at once across all instances.
+// Any more get a 429.  Zero or less turns the cap off.
+var MaxHeavyRequests = intFromEnv("MAX_HEAVY_REQUESTS", 4)
+
+// MaxTerritoryLevels caps how many distinct levels a territory may list, since
+// every one is stored on the territory's entity and expanded on reads.  Writes
+// over it get a 400.  Zero or less turns the cap off.
+var MaxTerritoryLevels = intFromEnv("MAX_TERRITORY_LEVELS", 1000)
+
+// TombstoneRetentionDays is how long a deleted level's tombstone is kept for
+// delta syncs.  Mirrors that haven't synced in that long have to start over.
+var TombstoneRetentionDays = intFromEnv("TOMBSTONE_RETENTION_DAYS", 30)
+
+// MaxCacheItemBytes is the largest marshalled item the cache will hold.  Bigger
+// ones are read fresh every time instead, so that they don't evict many small
+// entries.  Zero turns the limit off; memcache itself refuses items over 1MB.
+var MaxCacheItemBytes = intFromEnv("MAX_CACHE_ITEM_BYTES", 512*1024)
+
+// MinGzipBytes is the smallest response body that's gzipped for clients that
+// accept it.  Below it, gzip costs more CPU than it saves in bytes, and can even
+// make the body bigger.
+var MinGzipBytes = intFromEnv("MIN_GZIP_BYTES", 1024)
+
+// MigrateOnRead has a task write levels stored under an older schema version
+// back in the current one when they're first read.  Reads upgrade them in memory
+// either way, so turning it off just leaves the stored entities for the reindex
+// route.
+var MigrateOnRead = boolFromEnv("MIGRATE_ON_READ", true)
+
+// EventuallyConsistentQueries runs GET /levels as a plain (non-ancestor) query
+// instead of an ancestor query over the levels' entity group.  Ancestor queries
+// are strongly consistent, but are served by the group's single tablet; plain
+// queries spread across the datastore and scale with read traffic, at the cost
+// of missing writes made in the last few seconds.  The cached response expires
+// on its own in this mode, so a stale list doesn't outlive the delay.  Levels
+// still share one entity group either way, and filtered and paged queries stay
+// strongly consistent.
+var EventuallyConsistentQueries = boolFromEnv("EVENTUALLY_CONSISTENT_QUERIES", false)
+
+// TreeOrder sorts the siblings in GET /levels/tree: "name" orders them by their
+// resolved name (inherited if they don't set one), then by key to break ties;
+// "key" orders them by key alone.
+var TreeOrder = stringFromEnv("TREE_ORDER", "name")
+
+// StrictReferences refuses writes that reference something that doesn't exist:
+// a level's parent, or a level listed by a territory.  When it's off those
+// writes go through, and the response carries a warning for each dangling
+// reference instead, so that data can be loaded in any order.
+var StrictReferences = boolFromEnv("STRICT_REFERENCES", false)
+
+// LevelLockSeconds is how long a level lock lasts unless it's renewed.
+var LevelLockSeconds = intFromEnv("LEVEL_LOCK_SECONDS", 300)
+
+// PinnedLevels lists the keys of levels, separated by commas, that are kept in
+// the cache.  The warm-pinned route reloads them, and cron calls it often enough
+// that they're back soon after memcache evicts them.
+var PinnedLevels = listFromEnv("PINNED_LEVELS")
+
+// --- Helpers
+
+func stringFromEnv(name string, fallback string) string {
+	value := os.Getenv(name)
+	if len(value) == 0 {
+		return fallback
+	}
+
+	return value
+}
+
+func intFromEnv(name string, fallback int) int {
+	value, err := strconv.Atoi(os.Getenv(name))
+	if err != nil {
+		return fallback
+	}
+
+	return value
+}
+
+// listFromEnv splits a comma-separated variable, dropping empty elements.
+func listFromEnv(name string) []string {
+	var result []string
+	for _, element := range strings.Split(os.Getenv(name), ",") {
+		element = strings.TrimSpace(element)
+		if len(element) > 0 {
+			result = append(result, element)
+		}
+	}
+
+	return result
+}
+
+// rulesFromEnv panics if the variable isn't valid JSON, so that a typo stops the
+// instance from starting instead of quietly turning validation off.
+func rulesFromEnv(name string) map[string]FieldRule {
+	rules := make(map[string]FieldRule)
+	value := os.Getenv(name)
+	if len(value) == 0 {
+		return rules
+	}
+
+	err := json.Unmarshal([]byte(value), &rules)
+	if err != nil {
+		panic(fmt.Sprintf("config: %s is not valid JSON: %+v", name, err))
+	}
+
+	return rules
+}
+
+func boolFromEnv(name string, fallback bool) bool {
+	value, err := strconv.ParseBool(os.Getenv(name))
+	if err != nil {
+		return fallback
+	}
+
+	return value
+}
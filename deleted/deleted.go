@@ -0,0 +1,22 @@
+// Package deleted answers successful DELETE requests the same way for every
+// resource.
+package deleted
+
+import (
+	"net/http"
+
+	"github.com/gin-gonic/gin"
+
+	"bootcamp/editorservice/flags"
+)
+
+// Respond answers a successful DELETE with a 204, or with the delete_with_body
+// flag, the 200 and null body it used to get.
+func Respond(context *gin.Context) {
+	if flags.DeleteWithBody.Enabled {
+		context.JSON(http.StatusOK, nil)
+		return
+	}
+
+	context.Status(http.StatusNoContent)
+}
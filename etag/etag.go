@@ -0,0 +1,51 @@
+// Package etag supports conditional GETs with entity tags.
+package etag
+
+import (
+	"crypto/sha1"
+	"encoding/hex"
+	"encoding/json"
+	"net/http"
+	"strings"
+
+	"github.com/gin-gonic/gin"
+)
+
+// Of returns a strong entity tag for the JSON encoding of a response.
+func Of(response interface{}) string {
+	data, err := json.Marshal(response)
+	if err != nil {
+		return ""
+	}
+
+	sum := sha1.Sum(data)
+	return `"` + hex.EncodeToString(sum[:]) + `"`
+}
+
+// NotModified sets the ETag header, then checks it against the request's
+// If-None-Match header.  If they match, it responds with 304 and returns true.
+func NotModified(context *gin.Context, tag string) bool {
+	if len(tag) == 0 {
+		return false
+	}
+
+	context.Header("ETag", tag)
+	if !Matches(context.Request.Header.Get("If-None-Match"), tag) {
+		return false
+	}
+
+	context.AbortWithStatus(http.StatusNotModified)
+	return true
+}
+
+// Matches reports whether an If-None-Match header value names tag.
+func Matches(ifNoneMatch string, tag string) bool {
+	for _, candidate := range strings.Split(ifNoneMatch, ",") {
+		candidate = strings.TrimSpace(candidate)
+		if candidate == "*" || strings.TrimPrefix(candidate, "W/") == tag {
+			return true
+		}
+	}
+
+	return false
+}
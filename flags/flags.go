@@ -0,0 +1,106 @@
+// Package flags gates behaviors that deployments opt into.
+//
+// Flags are switched on by listing their names, separated by commas, in the
+// FEATURE_FLAGS environment variable (see env_variables in app.yaml), e.g.
+// FEATURE_FLAGS=strict_delete,require_parent.  They're read once at startup and
+// are all off by default.
+package flags
+
+import (
+	"os"
+	"strings"
+)
+
+// --- Types and constants
+
+type Flag struct {
+	Name        string `json:"name"`
+	Description string `json:"description"`
+	Enabled     bool   `json:"enabled"`
+}
+
+// --- Flags
+
+// StrictDelete makes deleting a level or territory that doesn't exist a 404
+// rather than a successful no-op.
+var StrictDelete = define("strict_delete", "DELETE of a level or territory that doesn't exist responds 404 instead of succeeding")
+
+// RejectUnknownFields makes a level write with JSON fields the service doesn't
+// know a 400, rather than dropping them.  It catches misspelled field names.
+var RejectUnknownFields = define("reject_unknown_fields", "Level writes with unknown JSON fields respond 400 instead of ignoring them")
+
+// RequireParent makes a level write whose parent doesn't exist a 400, rather than
+// storing a level that can't be resolved until the parent is written.
+// config.StrictReferences does the same, and checks territories' levels too.
+var RequireParent = define("require_parent", "Level writes whose parent doesn't exist respond 400 instead of being stored")
+
+// LockReferencedDimensions keeps a level's rows and columns from changing once a
+// territory lists it, since live territories are laid out for the grid.
+var LockReferencedDimensions = define("lock_referenced_dimensions", "Level writes that change the rows or columns of a level a territory lists respond 409")
+
+// EnforceLevelLocks refuses writes to a level someone else has locked with
+// POST /levels/:id/lock.  Without it, locks only tell editors who else is busy.
+var EnforceLevelLocks = define("enforce_level_locks", "Writes to a level another editor has locked respond 423")
+
+// RecomputeDescendants has a write to a level queue a task that resolves and
+// caches everything below it, rather than leaving each descendant to be resolved
+// on its next read.  It suits base templates that many levels inherit from.
+var RecomputeDescendants = define("recompute_descendants", "Level writes queue a task that recaches every level below the written one")
+
+// RejectEmptyBodies makes a level write with an empty body a 400, rather than
+// taking it as {} and storing a level with nothing but its key.
+var RejectEmptyBodies = define("reject_empty_bodies", "Level writes with an empty body respond 400 instead of storing a level with only its key")
+
+// CacheMaintenance stops reading and writing cached levels and responses, so
+// every read goes to the datastore.  It's for bulk migrations, which would
+// otherwise keep filling and invalidating entries, and could have the cache serve
+// partly migrated data.  POST /admin/cache/maintenance turns maintenance on and
+// off at runtime for every instance without this flag, which keeps it on.
+var CacheMaintenance = define("cache_maintenance", "Nothing is read from or written to the cache, so every read goes to the datastore")
+
+// NormalizeIds trims and lowercases the level and territory ids in request
+// paths, so that test_key_1 and Test_Key_1 are the same entity.  Ids given in
+// bodies, such as parents, batch ids and a territory's levels, and the ?to= of a
+// reparent, can't be rewritten in place, so ones that aren't canonical are
+// refused instead.
+var NormalizeIds = define("normalize_ids", "Ids in paths are trimmed and lowercased, ids in bodies must already be, and ids with characters other than a-z, 0-9, _ and - respond 400")
+
+// WarmOnMiss answers a level read that misses the caches with the level as it's
+// stored, and queues a task to resolve and cache it, so the unlucky read only
+// waits for one datastore get.  Levels with a parent are still resolved inline
+// unless the client passes ?allowUnresolved=true.
+var WarmOnMiss = define("warm_on_miss", "Level reads that miss the caches answer with the stored level and leave caching it to a task")
+
+// DeleteWithBody has a successful DELETE respond 200 with a null body, as it
+// used to, rather than 204 with none.  It's for clients that haven't moved to
+// the 204 yet, and goes away once they have.
+var DeleteWithBody = define("delete_with_body", "Successful DELETEs respond 200 with a null body instead of 204 with none")
+
+// --- Helpers
+
+var enabledNames = namesFromEnv("FEATURE_FLAGS")
+
+var registry []*Flag
+
+func define(name string, description string) *Flag {
+	flag := &Flag{Name: name, Description: description, Enabled: enabledNames[name]}
+	registry = append(registry, flag)
+	return flag
+}
+
+// All lists every flag in the order they're defined.
+func All() []*Flag {
+	return registry
+}
+
+func namesFromEnv(name string) map[string]bool {
+	result := make(map[string]bool)
+	for _, element := range strings.Split(os.Getenv(name), ",") {
+		element = strings.TrimSpace(element)
+		if len(element) > 0 {
+			result[element] = true
+		}
+	}
+
+	return result
+}
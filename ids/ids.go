@@ -0,0 +1,82 @@
+// Package ids checks the ids clients pick for levels and territories, which
+// become datastore key names.
+package ids
+
+import (
+	"errors"
+	"strings"
+
+	"appengine"
+	"appengine/datastore"
+)
+
+// maxLength is the longest key name the datastore accepts, in bytes.
+const maxLength int = 500
+
+var (
+	ErrEmpty        = errors.New("ids: the id must not be empty")
+	ErrTooLong      = errors.New("ids: the id must be at most 500 bytes")
+	ErrReserved     = errors.New("ids: ids that start and end with __ are reserved by the datastore")
+	ErrCharset      = errors.New("ids: canonical ids may only contain a-z, 0-9, _ and -")
+	ErrNotCanonical = errors.New("ids: canonical ids are lowercase, without surrounding whitespace")
+)
+
+// Check returns nil if id can be used as a key name, and otherwise an error
+// explaining the constraint it breaks.
+func Check(id string) error {
+	if len(id) == 0 {
+		return ErrEmpty
+	}
+	if len(id) > maxLength {
+		return ErrTooLong
+	}
+	if len(id) >= 4 && strings.HasPrefix(id, "__") && strings.HasSuffix(id, "__") {
+		return ErrReserved
+	}
+
+	return nil
+}
+
+// Normalize returns the canonical form of id: trimmed of surrounding whitespace
+// and lowercased, so that variants of an id name the same entity.  It returns an
+// error if the result has characters other than a-z, 0-9, _ and -, or doesn't
+// pass Check.
+func Normalize(id string) (string, error) {
+	result := strings.ToLower(strings.TrimSpace(id))
+	for _, r := range result {
+		if (r < 'a' || r > 'z') && (r < '0' || r > '9') && r != '_' && r != '-' {
+			return "", ErrCharset
+		}
+	}
+
+	return result, Check(result)
+}
+
+// CheckCanonical returns nil if id is already in the form Normalize gives it,
+// and otherwise Normalize's error or ErrNotCanonical.
+func CheckCanonical(id string) error {
+	normalized, err := Normalize(id)
+	if err != nil {
+		return err
+	}
+	if normalized != id {
+		return ErrNotCanonical
+	}
+
+	return nil
+}
+
+// IsKeyError reports whether err is the datastore rejecting a key.  The keys we
+// build are otherwise well formed, so it means the id didn't pass Check.
+func IsKeyError(err error) bool {
+	if multiError, ok := err.(appengine.MultiError); ok {
+		for _, element := range multiError {
+			if IsKeyError(element) {
+				return true
+			}
+		}
+		return false
+	}
+
+	return err == datastore.ErrInvalidKey
+}
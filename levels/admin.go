@@ -0,0 +1,185 @@
+package levels
+
+import (
+	"crypto/sha1"
+	"encoding/hex"
+	"encoding/json"
+	"net/http"
+	"sort"
+
+	"appengine"
+	"appengine/datastore"
+
+	"github.com/gin-gonic/gin"
+
+	"bootcamp/editorservice/apierror"
+	"bootcamp/editorservice/levels/level"
+	"bootcamp/editorservice/mismatch"
+	"bootcamp/editorservice/requestid"
+)
+
+// --- Types and constants
+
+// reindexBatchSize is how many levels are rewritten per datastore call.
+const reindexBatchSize int = 100
+
+type reindexResponse struct {
+	Scanned int `json:"scanned"`
+	Updated int `json:"updated"`
+}
+
+// duplicatesResponse lists groups of level keys whose content is identical.
+// Keys are sorted within each group, and groups by their first key.
+type duplicatesResponse struct {
+	Groups [][]string `json:"groups"`
+}
+
+// --- Route handlers
+
+// handleReindex migrates every stored level to the current schema version and
+// rewrites the ones that were older, so that their derived index fields are
+// filled in and they show up in filtered queries.
+func handleReindex(context *gin.Context) {
+	appengineContext := requestid.NewContext(context.Request)
+
+	// Load every stored level in one go
+	var dsLevels []level.DatastoreLevel
+	query := datastore.NewQuery(kind).Ancestor(getLevelRootKey(appengineContext))
+	keys, err := query.GetAll(appengineContext, &dsLevels)
+	err = mismatch.Ignore(appengineContext, err)
+	if err != nil {
+		apierror.Respond(context, http.StatusInternalServerError, apierror.Internal, "Could not load the levels: %+v", err)
+		return
+	}
+
+	// Collect the stale ones
+	var staleKeys []*datastore.Key
+	var staleLevels []*level.DatastoreLevel
+	for i := range dsLevels {
+		if dsLevels[i].Migrate() {
+			staleKeys = append(staleKeys, keys[i])
+			staleLevels = append(staleLevels, &dsLevels[i])
+		}
+	}
+
+	// And rewrite them in batches, each recorded for delta syncs along with it
+	response := &reindexResponse{Scanned: len(dsLevels)}
+	for start := 0; start < len(staleKeys); start += reindexBatchSize {
+		end := start + reindexBatchSize
+		if end > len(staleKeys) {
+			end = len(staleKeys)
+		}
+
+		err = datastore.RunInTransaction(appengineContext, func(transactionContext appengine.Context) error {
+			_, err := datastore.PutMulti(transactionContext, staleKeys[start:end], staleLevels[start:end])
+			if err != nil {
+				return err
+			}
+
+			return recordChanges(transactionContext, keyIds(staleKeys[start:end]), nil)
+		}, nil)
+		if err != nil {
+			invalidateReindexedCaches(appengineContext, staleKeys)
+			apierror.Respond(context, http.StatusInternalServerError, apierror.Internal, "Could not rewrite the levels after updating %d: %+v", response.Updated, err)
+			return
+		}
+		response.Updated = end
+	}
+
+	invalidateReindexedCaches(appengineContext, staleKeys)
+	context.JSON(http.StatusOK, response)
+}
+
+// handleDuplicates groups levels by their content, ignoring their keys.  Stored
+// levels are compared by default, and resolved ones with ?resolved=true.
+func handleDuplicates(context *gin.Context) {
+	appengineContext := requestid.NewContext(context.Request)
+	resolved := context.Query("resolved") == "true"
+
+	// Load every stored level in one go
+	var dsLevels []level.DatastoreLevel
+	query := datastore.NewQuery(kind).Ancestor(getLevelRootKey(appengineContext))
+	_, err := query.GetAll(appengineContext, &dsLevels)
+	err = mismatch.Ignore(appengineContext, err)
+	if err != nil {
+		apierror.Respond(context, http.StatusInternalServerError, apierror.Internal, "Could not load the levels: %+v", err)
+		return
+	}
+
+	// Group them by content
+	groups := make(map[string][]string)
+	for i := range dsLevels {
+		dsLevel := &dsLevels[i]
+		if resolved {
+			resolvedLevel, err := getLevel(dsLevel.Key, appengineContext)
+			if err != nil {
+				continue
+			}
+			dsLevel = (*level.DatastoreLevel)(resolvedLevel)
+		}
+
+		hash := contentHash(dsLevel)
+		groups[hash] = append(groups[hash], dsLevel.Key)
+	}
+
+	response := &duplicatesResponse{Groups: [][]string{}}
+	for _, keys := range groups {
+		if len(keys) > 1 {
+			sort.Strings(keys)
+			response.Groups = append(response.Groups, keys)
+		}
+	}
+	sort.Sort(byFirstKey(response.Groups))
+
+	context.JSON(http.StatusOK, response)
+}
+
+// handleRaw shows a level exactly as the datastore holds it, Has* flags, spawn
+// frequency slice order and schema version included, for debugging how it's
+// stored.  Unlike everywhere else, an older schema version isn't upgraded first.
+func handleRaw(context *gin.Context) {
+	appengineContext := requestid.NewContext(context.Request)
+	result := &level.DatastoreLevel{}
+	err := datastore.Get(appengineContext, makeDatastoreKey(appengineContext, context.Param("id")), result)
+	err = mismatch.Ignore(appengineContext, err)
+	if err == datastore.ErrNoSuchEntity {
+		apierror.Respond(context, http.StatusNotFound, apierror.NotFound, "Level does not exist")
+		return
+	} else if err != nil {
+		apierror.Respond(context, http.StatusInternalServerError, apierror.Internal, "Could not retrieve the level: %+v", err)
+		return
+	}
+
+	context.JSON(http.StatusOK, result)
+}
+
+// --- Helpers
+
+// contentHash hashes everything about a level but its key.  The JSON encoding is
+// deterministic: struct fields keep their order and map keys are sorted.
+func contentHash(dsLevel *level.DatastoreLevel) string {
+	content := dsLevel.ToJsonLevel()
+	content.Key = nil
+
+	encoded, _ := json.Marshal(content)
+	sum := sha1.Sum(encoded)
+	return hex.EncodeToString(sum[:])
+}
+
+type byFirstKey [][]string
+
+func (groups byFirstKey) Len() int           { return len(groups) }
+func (groups byFirstKey) Swap(i, j int)      { groups[i], groups[j] = groups[j], groups[i] }
+func (groups byFirstKey) Less(i, j int) bool { return groups[i][0] < groups[j][0] }
+
+func invalidateReindexedCaches(context appengine.Context, keys []*datastore.Key) {
+	if len(keys) == 0 {
+		return
+	}
+
+	for _, key := range keys {
+		invalidateLevelCaches(context, key.StringID())
+		invalidateChildLevelCaches(context, key.StringID())
+	}
+	invalidateQueryCaches(context)
+}
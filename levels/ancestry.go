@@ -0,0 +1,313 @@
+package levels
+
+import (
+	"errors"
+	"net/http"
+	"strings"
+
+	"appengine"
+	"appengine/datastore"
+
+	"github.com/gin-gonic/gin"
+
+	"bootcamp/editorservice/apierror"
+	"bootcamp/editorservice/levels/level"
+	"bootcamp/editorservice/mismatch"
+	"bootcamp/editorservice/requestid"
+)
+
+// --- Types and constants
+
+// maxParentDepth bounds how many ancestors a level may have.
+const maxParentDepth int = 32
+
+var (
+	ErrParentNotFound     = errors.New("levels: the parent level does not exist")
+	ErrParentChainTooDeep = errors.New("levels: the level has too many ancestors")
+)
+
+// levelWithChain is a resolved level along with the keys of its ancestors,
+// nearest first, so the root is last.
+type levelWithChain struct {
+	*level.JsonLevel
+	AncestryKeys []string `json:"ancestry_keys"`
+}
+
+// reparentCheck is whether a level could be reparented, and if not, why not.
+type reparentCheck struct {
+	Valid  bool          `json:"valid"`
+	Code   apierror.Code `json:"code,omitempty"`
+	Reason string        `json:"reason,omitempty"`
+}
+
+// --- Route handlers
+
+// handleReparent changes only a level's parent.  ?to= names the new parent, and
+// an empty value detaches the level so that it becomes a root.
+func handleReparent(context *gin.Context) {
+	newParentIds, ok := context.Request.URL.Query()["to"]
+	if !ok {
+		apierror.Respond(context, http.StatusBadRequest, apierror.InvalidRequest, "The new parent must be given with ?to=")
+		return
+	}
+
+	levelId := context.Param("id")
+	newParentId := newParentIds[0]
+	if err := checkCanonicalIds(newParentId); err != nil {
+		apierror.Respond(context, http.StatusBadRequest, apierror.InvalidRequest, "Invalid new parent: %+v", err)
+		return
+	}
+
+	appengineContext := requestid.NewContext(context.Request)
+	if lock := lockedByOther(appengineContext, levelId); lock != nil {
+		respondLocked(context, lock)
+		return
+	}
+
+	err := datastore.RunInTransaction(appengineContext, func(transactionContext appengine.Context) error {
+		stored, err := getRawLevel(transactionContext, levelId)
+		if err != nil {
+			return err
+		}
+
+		err = checkReparent(transactionContext, levelId, newParentId)
+		if err != nil {
+			return err
+		}
+
+		previous := *stored
+		stored.Parent = newParentId
+		stored.HasParent = len(newParentId) > 0
+		markEdited(transactionContext, stored)
+		_, err = datastore.Put(transactionContext, makeDatastoreKey(transactionContext, levelId), stored)
+		if err != nil {
+			return err
+		}
+
+		err = recordChanges(transactionContext, []string{levelId}, nil)
+		if err != nil {
+			return err
+		}
+
+		return queueChangeNotification(transactionContext, levelId, level.ChangedFields(&previous, stored))
+	}, nil)
+	if err == datastore.ErrNoSuchEntity {
+		apierror.Respond(context, http.StatusNotFound, apierror.NotFound, "Level does not exist")
+		return
+	} else if err == ErrParentNotFound {
+		apierror.Respond(context, http.StatusBadRequest, apierror.ParentNotFound, "Could not reparent the level: %+v", err)
+		return
+	} else if err == ErrParentCycle {
+		apierror.Respond(context, http.StatusConflict, apierror.CycleDetected, "Could not reparent the level: %+v", err)
+		return
+	} else if err == ErrParentChainTooDeep {
+		apierror.Respond(context, http.StatusConflict, apierror.Conflict, "Could not reparent the level: %+v", err)
+		return
+	} else if err != nil {
+		apierror.Respond(context, http.StatusInternalServerError, apierror.Internal, "Failed to reparent the level: %+v", err)
+		return
+	}
+
+	// Invalidate everything.  The level and everything below it resolve differently now.
+	invalidateLevelCaches(appengineContext, levelId)
+	invalidateChildLevelCaches(appengineContext, levelId)
+	invalidateQueryCaches(appengineContext)
+	prewarmCaches(appengineContext, levelId)
+	queueRecomputeDescendants(appengineContext, levelId)
+
+	context.JSON(http.StatusOK, nil)
+}
+
+// handleCanReparent reports whether POST /levels/:id/reparent would accept the
+// same ?to=, without changing anything.  Editors ask it while a level is dragged
+// over another, so an invalid reparent is a 200 that says why.
+func handleCanReparent(context *gin.Context) {
+	newParentIds, ok := context.Request.URL.Query()["to"]
+	if !ok {
+		apierror.Respond(context, http.StatusBadRequest, apierror.InvalidRequest, "The new parent must be given with ?to=")
+		return
+	}
+
+	levelId := context.Param("id")
+	appengineContext := requestid.NewContext(context.Request)
+	_, err := getRawLevel(appengineContext, levelId)
+	if err == datastore.ErrNoSuchEntity {
+		apierror.Respond(context, http.StatusNotFound, apierror.NotFound, "Level does not exist")
+		return
+	} else if err != nil {
+		apierror.Respond(context, http.StatusInternalServerError, apierror.Internal, "Could not retrieve the level: %+v", err)
+		return
+	}
+
+	err = checkReparent(appengineContext, levelId, newParentIds[0])
+	switch err {
+	case nil:
+		context.JSON(http.StatusOK, &reparentCheck{Valid: true})
+	case ErrParentNotFound, ErrParentCycle:
+		context.JSON(http.StatusOK, &reparentCheck{Code: errorCode(err), Reason: err.Error()})
+	case ErrParentChainTooDeep:
+		context.JSON(http.StatusOK, &reparentCheck{Code: apierror.Conflict, Reason: err.Error()})
+	default:
+		apierror.Respond(context, http.StatusInternalServerError, apierror.Internal, "Could not check the new parent: %+v", err)
+	}
+}
+
+// --- Helpers
+
+// respondWithChain responds to GET /levels/:id?withChain=true with the resolved
+// level and its ancestry keys.
+func respondWithChain(context *gin.Context, appengineContext appengine.Context, resolved *levelCacheEntry, applyDefaults bool, fields []string) {
+	chain, err := ancestryKeys(appengineContext, resolved)
+	if err != nil {
+		apierror.Respond(context, http.StatusInternalServerError, apierror.Internal, "Could not retrieve the level's ancestors: %+v", err)
+		return
+	}
+
+	dsLevel := (*level.DatastoreLevel)(resolved)
+	if applyDefaults {
+		dsLevel = applyLevelDefaults(appengineContext, dsLevel)
+	}
+	if fields != nil {
+		fields = append(fields, "ancestry_keys")
+	}
+
+	context.JSON(http.StatusOK, selectFields(&levelWithChain{JsonLevel: dsLevel.ToJsonLevel(), AncestryKeys: chain}, fields))
+}
+
+// ancestryKeys follows a resolved level's parents up to the root.  The parents
+// come from the level cache, where resolving the level left them.
+func ancestryKeys(appengineContext appengine.Context, resolved *levelCacheEntry) ([]string, error) {
+	keys := []string{}
+	current := resolved
+	for current.HasParent && len(current.Parent) > 0 {
+		if len(keys) > maxParentDepth {
+			return nil, ErrParentChainTooDeep
+		}
+		keys = append(keys, current.Parent)
+
+		parent, err := getLevel(current.Parent, appengineContext)
+		if err != nil {
+			return nil, err
+		}
+		current = parent
+	}
+
+	return keys, nil
+}
+
+// getRawLevel loads a level as it's stored, without its parent's properties.
+// Levels from an older schema version are upgraded in memory only, since this is
+// often called inside a transaction; resolving them writes the upgrade back.
+func getRawLevel(appengineContext appengine.Context, levelId string) (*level.DatastoreLevel, error) {
+	result := &level.DatastoreLevel{}
+	err := datastore.Get(appengineContext, makeDatastoreKey(appengineContext, levelId), result)
+	err = mismatch.Ignore(appengineContext, err)
+	if err != nil {
+		return nil, err
+	}
+
+	result.Migrate()
+	return result, nil
+}
+
+// resolveUncached resolves a level straight from the datastore, without reading
+// or writing any cache.
+func resolveUncached(appengineContext appengine.Context, levelId string) (*level.DatastoreLevel, error) {
+	chain, err := loadRawChain(appengineContext, levelId)
+	if err != nil {
+		return nil, err
+	}
+
+	// Merge from the top of the chain down
+	result := chain[len(chain)-1]
+	for i := len(chain) - 2; i >= 0; i-- {
+		child := *chain[i]
+		child.MergeParentProperties(result)
+		result = &child
+	}
+
+	return result, nil
+}
+
+// loadRawChain loads a level and then each of its ancestors as they're stored.
+// Whatever was loaded before an error is returned along with it.
+func loadRawChain(appengineContext appengine.Context, levelId string) ([]*level.DatastoreLevel, error) {
+	var chain []*level.DatastoreLevel
+	visited := make(map[string]bool)
+	currentId := levelId
+	for {
+		if visited[currentId] {
+			return chain, ErrParentCycle
+		}
+		if len(chain) > maxParentDepth {
+			return chain, ErrParentChainTooDeep
+		}
+		visited[currentId] = true
+
+		current, err := getRawLevel(appengineContext, currentId)
+		if err != nil {
+			return chain, err
+		}
+
+		chain = append(chain, current)
+		if !current.HasParent || len(current.Parent) == 0 {
+			return chain, nil
+		}
+		currentId = current.Parent
+	}
+}
+
+// describeParentCycle names the levels in the cycle above levelId, from the
+// first level in it back around to that level again, e.g. "a -> b -> a".  The
+// cycle is read from the stored levels, since resolving stops at the first
+// repeated key without saying which it was.
+func describeParentCycle(appengineContext appengine.Context, levelId string) string {
+	chain, err := loadRawChain(appengineContext, levelId)
+	if err != ErrParentCycle {
+		return "the cycle could not be read back"
+	}
+
+	repeated := chain[len(chain)-1].Parent
+	var keys []string
+	for i, ancestor := range chain {
+		if ancestor.Key == repeated {
+			for _, element := range chain[i:] {
+				keys = append(keys, element.Key)
+			}
+			break
+		}
+	}
+
+	return strings.Join(append(keys, repeated), " -> ")
+}
+
+// checkReparent returns nil if levelId can take newParentId as its parent.  An
+// empty newParentId (making the level a root) is always allowed.
+func checkReparent(appengineContext appengine.Context, levelId string, newParentId string) error {
+	if len(newParentId) == 0 {
+		return nil
+	}
+	if newParentId == levelId {
+		return ErrParentCycle
+	}
+
+	// The level must not be one of its new ancestors
+	chain, err := loadRawChain(appengineContext, newParentId)
+	for _, ancestor := range chain {
+		if ancestor.Key == levelId {
+			return ErrParentCycle
+		}
+	}
+
+	if err == datastore.ErrNoSuchEntity {
+		return ErrParentNotFound
+	} else if err != nil {
+		return err
+	}
+
+	if len(chain) >= maxParentDepth {
+		return ErrParentChainTooDeep
+	}
+
+	return nil
+}
@@ -0,0 +1,256 @@
+package levels
+
+import (
+	"errors"
+	"net/http"
+	"strings"
+
+	"appengine"
+	"appengine/datastore"
+
+	"bootcamp/editorservice/apierror"
+	"bootcamp/editorservice/flags"
+	"bootcamp/editorservice/levels/level"
+)
+
+// --- Types and constants
+
+// Write is one level write of an atomic batch: a PUT of Body to the level, or a
+// DELETE of it.
+type Write struct {
+	LevelId string
+	Delete  bool
+	Body    []byte
+}
+
+// WriteResult is the status and body a write would have gotten as a single
+// request.  A nil Body is sent as null, except with a 204.
+type WriteResult struct {
+	Status int
+	Body   interface{}
+}
+
+var errWrittenTwice = errors.New("the level is written more than once in the batch")
+
+// --- Helpers
+
+// ApplyAtomically applies writes all-or-nothing, for POST /v1/batch in its
+// transactional mode.  Every write is validated up front as a batch put or
+// delete would be, and if they're all valid, they're applied in one datastore
+// transaction.  Otherwise nothing is written, and the valid ones are reported
+// as not applied.
+func ApplyAtomically(appengineContext appengine.Context, writes []Write) []WriteResult {
+	results := make([]WriteResult, len(writes))
+
+	// A parent anywhere in the batch counts as existing, as with a batch put
+	pending := make(map[string]bool)
+	written := make(map[string]bool)
+	for _, write := range writes {
+		if !write.Delete {
+			pending[write.LevelId] = true
+		}
+	}
+
+	var putKeys, deleteKeys []*datastore.Key
+	var dsLevels []*level.DatastoreLevel
+	warnings := make([][]queryWarning, len(writes))
+	failed := false
+	for i, write := range writes {
+		var dsLevel *level.DatastoreLevel
+		var failure *WriteResult
+		if written[write.LevelId] {
+			failure = writeFailure(http.StatusBadRequest, apierror.InvalidRequest, "%s", errWrittenTwice.Error())
+		} else if write.Delete {
+			failure = checkAtomicDelete(appengineContext, write.LevelId)
+		} else {
+			dsLevel, warnings[i], failure = checkAtomicPut(appengineContext, write, pending)
+		}
+		written[write.LevelId] = true
+
+		if failure != nil {
+			results[i] = *failure
+			failed = true
+			continue
+		}
+
+		key := makeDatastoreKey(appengineContext, write.LevelId)
+		if write.Delete {
+			deleteKeys = append(deleteKeys, key)
+		} else {
+			putKeys = append(putKeys, key)
+			dsLevels = append(dsLevels, dsLevel)
+		}
+	}
+	if failed {
+		return markWritesNotApplied(results)
+	}
+
+	// Write to datastore, noting what each level was before for notifications
+	previous, err := loadPreviousLevels(appengineContext, append(append([]*datastore.Key{}, putKeys...), deleteKeys...))
+	if err != nil {
+		return failWrites(results, apierror.New(apierror.Internal, "Could not load the levels being replaced: %+v", err))
+	}
+	err = datastore.RunInTransaction(appengineContext, func(transactionContext appengine.Context) error {
+		// With strict_delete, deleting a level that doesn't exist is a 404
+		if flags.StrictDelete.Enabled && len(deleteKeys) > 0 {
+			existing := make([]*level.DatastoreLevel, len(deleteKeys))
+			for i := range existing {
+				existing[i] = &level.DatastoreLevel{}
+			}
+			err := datastore.GetMulti(transactionContext, deleteKeys, existing)
+			if isNotFound(err) {
+				return datastore.ErrNoSuchEntity
+			} else if _, isMulti := err.(appengine.MultiError); err != nil && !isMulti {
+				return err
+			}
+		}
+
+		if len(putKeys) > 0 {
+			_, err := datastore.PutMulti(transactionContext, putKeys, dsLevels)
+			if err != nil {
+				return err
+			}
+		}
+		if len(deleteKeys) > 0 {
+			err := datastore.DeleteMulti(transactionContext, deleteKeys)
+			if err != nil {
+				return err
+			}
+		}
+
+		return recordChanges(transactionContext, keyIds(putKeys), keyIds(deleteKeys))
+	}, nil)
+	if err == datastore.ErrNoSuchEntity {
+		return failWrites(results, apierror.New(apierror.NotFound, "A level the batch deletes does not exist"))
+	} else if err != nil {
+		return failWrites(results, apierror.New(apierror.Internal, "Failed to apply the batch: %+v", err))
+	}
+
+	// Invalidate everything that was written
+	levelIds := append(keyIds(putKeys), keyIds(deleteKeys)...)
+	queueChangeNotifications(appengineContext, levelIds, previous, levelsByKey(dsLevels))
+	for _, levelId := range levelIds {
+		invalidateLevelCaches(appengineContext, levelId)
+		invalidateChildLevelCaches(appengineContext, levelId)
+	}
+	invalidateQueryCaches(appengineContext)
+	queueRecomputeDescendants(appengineContext, keyIds(putKeys)...)
+
+	for i, write := range writes {
+		if write.Delete && !flags.DeleteWithBody.Enabled {
+			results[i] = WriteResult{Status: http.StatusNoContent}
+		} else if len(warnings[i]) > 0 {
+			results[i] = WriteResult{Status: http.StatusOK, Body: &referenceWarnings{Warnings: warnings[i]}}
+		} else {
+			results[i] = WriteResult{Status: http.StatusOK}
+		}
+	}
+
+	return results
+}
+
+// checkAtomicPut validates a PUT of an atomic batch as handlePut would, and
+// returns the level to store along with any warnings about its parent.  If it
+// can't be written, the failure says why.
+func checkAtomicPut(appengineContext appengine.Context, write Write, pending map[string]bool) (*level.DatastoreLevel, []queryWarning, *WriteResult) {
+	var jsonLevel level.JsonLevel
+	err := decodeLevel(write.Body, &jsonLevel)
+	if err != nil {
+		return nil, nil, writeFailure(http.StatusBadRequest, apierror.InvalidRequest, "Failed to unmarshal the JSON: %+v", err)
+	}
+
+	// The level key/id must come from the URL path
+	jsonLevel.Key = &write.LevelId
+	err = validateBatchLevel(appengineContext, &jsonLevel)
+	if err != nil {
+		return nil, nil, writeFailure(http.StatusBadRequest, apierror.ValidationFailed, "Invalid level: %+v", err)
+	}
+
+	dsLevel := jsonLevel.ToDatastoreLevel()
+	warnings, err := checkParentReference(appengineContext, dsLevel, pending)
+	if err != nil {
+		return nil, nil, writeFailure(http.StatusInternalServerError, apierror.Internal, "Could not check the parent: %+v", err)
+	}
+	if len(warnings) > 0 && parentsRequired() {
+		return nil, nil, writeFailure(http.StatusBadRequest, apierror.ParentNotFound, "%s", warnings[0].Message)
+	}
+
+	if lock := lockedByOther(appengineContext, dsLevel.Key); lock != nil {
+		return nil, nil, writeFailure(http.StatusLocked, apierror.Locked, "%s is editing the level", lock.Editor)
+	}
+
+	territories, err := lockingTerritories(appengineContext, dsLevel)
+	if err != nil {
+		return nil, nil, writeFailure(http.StatusInternalServerError, apierror.Internal, "Could not check the territories that list the level: %+v", err)
+	}
+	if len(territories) > 0 {
+		return nil, nil, writeFailure(http.StatusConflict, apierror.Conflict, "The level's rows and columns can't change while territories list it: %s", strings.Join(territories, ", "))
+	}
+
+	markEdited(appengineContext, dsLevel)
+	return dsLevel, warnings, nil
+}
+
+// checkAtomicDelete validates a DELETE of an atomic batch as handleDelete would.
+func checkAtomicDelete(appengineContext appengine.Context, levelId string) *WriteResult {
+	if len(levelId) == 0 {
+		return writeFailure(http.StatusBadRequest, apierror.InvalidRequest, "The level id must not be empty")
+	}
+	if err := checkCanonicalIds(levelId); err != nil {
+		return writeFailure(http.StatusBadRequest, apierror.InvalidRequest, "Invalid level id: %+v", err)
+	}
+	if lock := lockedByOther(appengineContext, levelId); lock != nil {
+		return writeFailure(http.StatusLocked, apierror.Locked, "%s is editing the level", lock.Editor)
+	}
+
+	return nil
+}
+
+func writeFailure(status int, code apierror.Code, format string, values ...interface{}) *WriteResult {
+	return &WriteResult{Status: status, Body: apierror.New(code, format, values...)}
+}
+
+// markWritesNotApplied fails the writes of an atomic batch that were valid
+// themselves, once another one wasn't.
+func markWritesNotApplied(results []WriteResult) []WriteResult {
+	for i := range results {
+		if results[i].Status == 0 {
+			results[i] = *writeFailure(http.StatusFailedDependency, apierror.Conflict, "Not applied because another sub-request failed")
+		}
+	}
+
+	return results
+}
+
+// failWrites fails every write of an atomic batch with the same error, for a
+// transaction that didn't commit.
+func failWrites(results []WriteResult, body *apierror.Response) []WriteResult {
+	status := http.StatusInternalServerError
+	if body.Code == apierror.NotFound {
+		status = http.StatusNotFound
+	}
+
+	for i := range results {
+		results[i] = WriteResult{Status: status, Body: body}
+	}
+
+	return results
+}
+
+// isNotFound reports whether a GetMulti failed because a key doesn't exist.
+func isNotFound(err error) bool {
+	if err == datastore.ErrNoSuchEntity {
+		return true
+	}
+	multiError, ok := err.(appengine.MultiError)
+	if !ok {
+		return false
+	}
+	for _, keyErr := range multiError {
+		if keyErr == datastore.ErrNoSuchEntity {
+			return true
+		}
+	}
+
+	return false
+}
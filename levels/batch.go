@@ -0,0 +1,468 @@
+package levels
+
+import (
+	"errors"
+	"net/http"
+	"strings"
+
+	"appengine"
+	"appengine/datastore"
+
+	"github.com/gin-gonic/gin"
+
+	"bootcamp/editorservice/apierror"
+	"bootcamp/editorservice/config"
+	"bootcamp/editorservice/ids"
+	"bootcamp/editorservice/levels/level"
+	"bootcamp/editorservice/requestid"
+)
+
+// --- Types and constants
+
+// Batch writes run in one of two modes, selected with ?mode=.  In best-effort
+// mode every valid item is applied, batchChunkSize at a time, and each item
+// reports its own outcome.  In transactional mode the items are applied
+// all-or-nothing.
+const (
+	batchModeBestEffort    string = "best-effort"
+	batchModeTransactional string = "transactional"
+)
+
+// batchChunkSize is how many items of a best-effort batch are written in each
+// transaction.
+const batchChunkSize = 100
+
+var errNotApplied = errors.New("not applied because another item in the batch failed")
+
+type batchIdsRequest struct {
+	Ids []string `json:"ids"`
+}
+
+// batchItemResult reports the outcome for one item of a batch, using the status
+// code the item would have gotten as a single request.
+type batchItemResult struct {
+	Key      string         `json:"key"`
+	Status   int            `json:"status"`
+	Error    string         `json:"error,omitempty"`
+	Warnings []queryWarning `json:"warnings,omitempty"`
+}
+
+// batchSummary counts the outcomes of a batch put.  Created and updated count
+// the items that were written, by whether the level existed before.  Failed
+// counts every other item, including ones not applied in a transactional batch.
+type batchSummary struct {
+	Created int `json:"created"`
+	Updated int `json:"updated"`
+	Failed  int `json:"failed"`
+}
+
+type batchWriteResponse struct {
+	Results []batchItemResult `json:"results"`
+	Summary *batchSummary     `json:"summary,omitempty"`
+}
+
+type batchGetResponse struct {
+	Results []batchItemResult  `json:"results"`
+	Levels  []*level.JsonLevel `json:"levels"`
+	Missing []string           `json:"missing"`
+}
+
+// --- Route handlers
+
+func handleBatchGet(context *gin.Context) {
+	var request batchIdsRequest
+	err := context.BindJSON(&request)
+	if err != nil {
+		apierror.Respond(context, http.StatusBadRequest, apierror.InvalidRequest, "Failed to unmarshal the JSON: %+v", err)
+		return
+	}
+	if !checkBatchSize(context, len(request.Ids)) {
+		return
+	}
+
+	appengineContext := requestid.NewContext(context.Request)
+	response := &batchGetResponse{
+		Results: make([]batchItemResult, len(request.Ids)),
+		Levels:  []*level.JsonLevel{},
+		Missing: []string{},
+	}
+	for i, levelId := range request.Ids {
+		response.Results[i].Key = levelId
+		if err := checkCanonicalIds(levelId); err != nil {
+			response.Results[i].Status = http.StatusBadRequest
+			response.Results[i].Error = err.Error()
+			continue
+		}
+
+		resolvedLevel, err := getLevel(levelId, appengineContext)
+		if err == datastore.ErrNoSuchEntity {
+			response.Results[i].Status = http.StatusNotFound
+			response.Results[i].Error = "Level does not exist"
+			response.Missing = append(response.Missing, levelId)
+		} else if err != nil {
+			response.Results[i].Status, _ = errorStatus(err)
+			response.Results[i].Error = err.Error()
+		} else {
+			response.Results[i].Status = http.StatusOK
+			response.Levels = append(response.Levels, (*level.DatastoreLevel)(resolvedLevel).ToJsonLevel())
+		}
+	}
+
+	context.JSON(batchStatus(response.Results), response)
+}
+
+func handleBatchPut(context *gin.Context) {
+	mode, ok := parseBatchMode(context)
+	if !ok {
+		apierror.Respond(context, http.StatusBadRequest, apierror.InvalidRequest, "Unknown batch mode %q", mode)
+		return
+	}
+
+	var jsonLevels []level.JsonLevel
+	err := context.BindJSON(&jsonLevels)
+	if err != nil {
+		apierror.Respond(context, http.StatusBadRequest, apierror.InvalidRequest, "Failed to unmarshal the JSON: %+v", err)
+		return
+	}
+	if !checkBatchSize(context, len(jsonLevels)) {
+		return
+	}
+
+	// Validate every item up front.  A parent anywhere in the batch counts as
+	// existing, so a tree can be written in one go.
+	appengineContext := requestid.NewContext(context.Request)
+	results := make([]batchItemResult, len(jsonLevels))
+	pending := make(map[string]bool)
+	for i := range jsonLevels {
+		if jsonLevels[i].Key != nil {
+			pending[*jsonLevels[i].Key] = true
+		}
+	}
+	var positions []int
+	var keys []*datastore.Key
+	var dsLevels []*level.DatastoreLevel
+	for i := range jsonLevels {
+		jsonLevel := &jsonLevels[i]
+		if jsonLevel.Key != nil {
+			results[i].Key = *jsonLevel.Key
+		}
+
+		err := validateBatchLevel(appengineContext, jsonLevel)
+		if err != nil {
+			results[i].Status = http.StatusBadRequest
+			results[i].Error = err.Error()
+			continue
+		}
+
+		dsLevel := jsonLevel.ToDatastoreLevel()
+		results[i].Warnings, err = checkParentReference(appengineContext, dsLevel, pending)
+		if err != nil {
+			results[i].Status = http.StatusInternalServerError
+			results[i].Error = err.Error()
+			continue
+		}
+		if len(results[i].Warnings) > 0 && parentsRequired() {
+			results[i].Status = http.StatusBadRequest
+			results[i].Error = results[i].Warnings[0].Message
+			results[i].Warnings = nil
+			continue
+		}
+
+		if lock := lockedByOther(appengineContext, dsLevel.Key); lock != nil {
+			results[i].Status = http.StatusLocked
+			results[i].Error = lock.Editor + " is editing the level"
+			continue
+		}
+
+		territories, err := lockingTerritories(appengineContext, dsLevel)
+		if err != nil {
+			results[i].Status = http.StatusInternalServerError
+			results[i].Error = err.Error()
+			continue
+		}
+		if len(territories) > 0 {
+			results[i].Status = http.StatusConflict
+			results[i].Error = ErrDimensionsLocked.Error() + ": " + strings.Join(territories, ", ")
+			continue
+		}
+
+		markEdited(appengineContext, dsLevel)
+		positions = append(positions, i)
+		keys = append(keys, makeDatastoreKey(appengineContext, dsLevel.Key))
+		dsLevels = append(dsLevels, dsLevel)
+	}
+
+	if mode == batchModeTransactional && len(positions) < len(results) {
+		markNotApplied(results, positions)
+		context.JSON(batchStatus(results), &batchWriteResponse{Results: results, Summary: summarize(results, nil)})
+		return
+	}
+
+	// Note which levels are new, for the summary
+	missing, err := MissingLevels(appengineContext, keyIds(keys))
+	if err != nil {
+		apierror.Respond(context, http.StatusInternalServerError, apierror.Internal, "Could not check which levels exist: %+v", err)
+		return
+	}
+	created := make(map[string]bool)
+	for _, levelId := range missing {
+		created[levelId] = true
+	}
+
+	// Write to datastore, noting what each level was before for notifications
+	previous, err := loadPreviousLevels(appengineContext, keys)
+	if err != nil {
+		apierror.Respond(context, http.StatusInternalServerError, apierror.Internal, "Could not load the levels being replaced: %+v", err)
+		return
+	}
+	applyInChunks(appengineContext, mode, results, positions, func(transactionContext appengine.Context, start int, end int) error {
+		_, err := datastore.PutMulti(transactionContext, keys[start:end], dsLevels[start:end])
+		if err != nil {
+			return err
+		}
+
+		return recordChanges(transactionContext, keyIds(keys[start:end]), nil)
+	})
+
+	// Invalidate everything that was written
+	queueChangeNotifications(appengineContext, succeededIds(results), previous, levelsByKey(dsLevels))
+	invalidateBatchCaches(appengineContext, results)
+	queueRecomputeDescendants(appengineContext, succeededIds(results)...)
+
+	context.JSON(batchStatus(results), &batchWriteResponse{Results: results, Summary: summarize(results, created)})
+}
+
+func handleBatchDelete(context *gin.Context) {
+	mode, ok := parseBatchMode(context)
+	if !ok {
+		apierror.Respond(context, http.StatusBadRequest, apierror.InvalidRequest, "Unknown batch mode %q", mode)
+		return
+	}
+
+	var request batchIdsRequest
+	err := context.BindJSON(&request)
+	if err != nil {
+		apierror.Respond(context, http.StatusBadRequest, apierror.InvalidRequest, "Failed to unmarshal the JSON: %+v", err)
+		return
+	}
+	if !checkBatchSize(context, len(request.Ids)) {
+		return
+	}
+
+	// Validate every item up front
+	appengineContext := requestid.NewContext(context.Request)
+	results := make([]batchItemResult, len(request.Ids))
+	var positions []int
+	var keys []*datastore.Key
+	for i, levelId := range request.Ids {
+		results[i].Key = levelId
+		if len(levelId) == 0 {
+			results[i].Status = http.StatusBadRequest
+			results[i].Error = "The level id must not be empty"
+			continue
+		}
+		if err := checkCanonicalIds(levelId); err != nil {
+			results[i].Status = http.StatusBadRequest
+			results[i].Error = err.Error()
+			continue
+		}
+		if lock := lockedByOther(appengineContext, levelId); lock != nil {
+			results[i].Status = http.StatusLocked
+			results[i].Error = lock.Editor + " is editing the level"
+			continue
+		}
+
+		positions = append(positions, i)
+		keys = append(keys, makeDatastoreKey(appengineContext, levelId))
+	}
+
+	if mode == batchModeTransactional && len(positions) < len(results) {
+		markNotApplied(results, positions)
+		context.JSON(batchStatus(results), &batchWriteResponse{Results: results})
+		return
+	}
+
+	// Delete from datastore, noting what each level was for notifications
+	previous, err := loadPreviousLevels(appengineContext, keys)
+	if err != nil {
+		apierror.Respond(context, http.StatusInternalServerError, apierror.Internal, "Could not load the levels being deleted: %+v", err)
+		return
+	}
+	applyInChunks(appengineContext, mode, results, positions, func(transactionContext appengine.Context, start int, end int) error {
+		err := datastore.DeleteMulti(transactionContext, keys[start:end])
+		if err != nil {
+			return err
+		}
+
+		return recordChanges(transactionContext, nil, keyIds(keys[start:end]))
+	})
+
+	// Invalidate everything that was deleted
+	queueChangeNotifications(appengineContext, succeededIds(results), previous, nil)
+	invalidateBatchCaches(appengineContext, results)
+
+	context.JSON(batchStatus(results), &batchWriteResponse{Results: results})
+}
+
+// --- Helpers
+
+// checkBatchSize rejects a batch with more than config.MaxBatchItems items,
+// reporting whether the batch may go ahead.
+func checkBatchSize(context *gin.Context, count int) bool {
+	if count > config.MaxBatchItems {
+		apierror.Respond(context, http.StatusBadRequest, apierror.InvalidRequest, "A batch may have at most %d items, but this one has %d.  Split it into smaller batches.", config.MaxBatchItems, count)
+		return false
+	}
+
+	return true
+}
+
+func parseBatchMode(context *gin.Context) (string, bool) {
+	mode := context.DefaultQuery("mode", batchModeBestEffort)
+	return mode, mode == batchModeBestEffort || mode == batchModeTransactional
+}
+
+func validateBatchLevel(appengineContext appengine.Context, jsonLevel *level.JsonLevel) error {
+	if jsonLevel.Key == nil || len(*jsonLevel.Key) == 0 {
+		return errors.New("the level key must be set")
+	}
+	if isReservedId(*jsonLevel.Key) {
+		return errors.New("the level key is reserved")
+	}
+	err := ids.Check(*jsonLevel.Key)
+	if err != nil {
+		return err
+	}
+	err = checkCanonicalIds(*jsonLevel.Key, jsonLevel.ToDatastoreLevel().Parent)
+	if err != nil {
+		return err
+	}
+
+	err = jsonLevel.Validate()
+	if err != nil {
+		return err
+	}
+
+	return validateResolved(appengineContext, jsonLevel.ToDatastoreLevel())
+}
+
+// batchStatus is 200 when every item succeeded and 207 (Multi-Status) otherwise.
+func batchStatus(results []batchItemResult) int {
+	for _, result := range results {
+		if result.Status >= http.StatusMultipleChoices {
+			return http.StatusMultiStatus
+		}
+	}
+
+	return http.StatusOK
+}
+
+// markNotApplied fails the otherwise-valid items of a transactional batch.
+func markNotApplied(results []batchItemResult, positions []int) {
+	for _, position := range positions {
+		results[position].Status = http.StatusFailedDependency
+		results[position].Error = errNotApplied.Error()
+	}
+}
+
+// applyInChunks runs apply over the items at positions, in one transaction for a
+// transactional batch and a transaction per batchChunkSize items otherwise.
+// apply gets the range of positions to write, and records the changes in the
+// same transaction so that delta syncs see exactly what was written.  A chunk
+// that fails is rolled back as a whole, so items that didn't fail themselves
+// are reported as not applied.
+func applyInChunks(appengineContext appengine.Context, mode string, results []batchItemResult, positions []int, apply func(transactionContext appengine.Context, start int, end int) error) {
+	chunkSize := batchChunkSize
+	if mode == batchModeTransactional {
+		chunkSize = len(positions)
+	}
+
+	for start := 0; start < len(positions); start += chunkSize {
+		end := start + chunkSize
+		if end > len(positions) {
+			end = len(positions)
+		}
+
+		err := datastore.RunInTransaction(appengineContext, func(transactionContext appengine.Context) error {
+			return apply(transactionContext, start, end)
+		}, nil)
+		applyBatchError(results, positions[start:end], err)
+		if err == nil {
+			continue
+		}
+		for _, position := range positions[start:end] {
+			if results[position].Status == http.StatusOK {
+				results[position].Status = http.StatusFailedDependency
+				results[position].Error = errNotApplied.Error()
+			}
+		}
+	}
+}
+
+// applyBatchError records the outcome of a multi-entity datastore call.  err is
+// either nil, an appengine.MultiError parallel to positions, or an error that
+// applies to every item.
+func applyBatchError(results []batchItemResult, positions []int, err error) {
+	multiError, isMultiError := err.(appengine.MultiError)
+	for i, position := range positions {
+		itemErr := err
+		if isMultiError {
+			itemErr = multiError[i]
+		}
+
+		if itemErr != nil {
+			results[position].Status = http.StatusInternalServerError
+			results[position].Error = itemErr.Error()
+		} else {
+			results[position].Status = http.StatusOK
+		}
+	}
+}
+
+// summarize counts a batch put's outcomes.  created holds the keys of the
+// levels that didn't exist before the batch.
+func summarize(results []batchItemResult, created map[string]bool) *batchSummary {
+	summary := &batchSummary{}
+	for _, itemResult := range results {
+		if itemResult.Status != http.StatusOK {
+			summary.Failed++
+		} else if created[itemResult.Key] {
+			summary.Created++
+		} else {
+			summary.Updated++
+		}
+	}
+
+	return summary
+}
+
+// succeededIds lists the keys of the items that were applied.
+func succeededIds(results []batchItemResult) []string {
+	var result []string
+	for _, itemResult := range results {
+		if itemResult.Status == http.StatusOK {
+			result = append(result, itemResult.Key)
+		}
+	}
+
+	return result
+}
+
+func keyIds(keys []*datastore.Key) []string {
+	result := make([]string, len(keys))
+	for i, key := range keys {
+		result[i] = key.StringID()
+	}
+
+	return result
+}
+
+func invalidateBatchCaches(context appengine.Context, results []batchItemResult) {
+	for _, result := range results {
+		if result.Status == http.StatusOK {
+			invalidateLevelCaches(context, result.Key)
+			invalidateChildLevelCaches(context, result.Key)
+		}
+	}
+	invalidateQueryCaches(context)
+}
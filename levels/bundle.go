@@ -0,0 +1,320 @@
+package levels
+
+import (
+	"fmt"
+	"net/http"
+	"strings"
+
+	"appengine"
+	"appengine/datastore"
+
+	"github.com/gin-gonic/gin"
+
+	"bootcamp/editorservice/apierror"
+	"bootcamp/editorservice/ids"
+	"bootcamp/editorservice/levels/level"
+	"bootcamp/editorservice/mismatch"
+	"bootcamp/editorservice/requestid"
+	"bootcamp/editorservice/territories/territory"
+)
+
+// --- Types and constants
+
+// importBundle is a set of levels and territories to be imported together.
+// Levels are as stored (unresolved), like the ones /export writes.
+type importBundle struct {
+	Levels      []*level.JsonLevel     `json:"levels"`
+	Territories []*territory.Territory `json:"territories"`
+}
+
+// What an import problem is about
+const (
+	problemKindLevel     string = "level"
+	problemKindTerritory string = "territory"
+)
+
+// ImportProblem is one reason a bundle can't be imported.  The territories
+// resource reports these for its scoped import too.
+type ImportProblem struct {
+	Kind    string        `json:"kind"`
+	Key     string        `json:"key"`
+	Code    apierror.Code `json:"code"`
+	Message string        `json:"message"`
+}
+
+type importValidation struct {
+	Valid    bool            `json:"valid"`
+	Problems []ImportProblem `json:"problems"`
+}
+
+// --- Route handlers
+
+// handleImportValidate checks a bundle the way an import would, without writing
+// anything.  The bundle's levels are checked against each other and the stored
+// levels together, with a bundle level taking the place of a stored one with the
+// same key, so parents and territory references may point either way.
+func handleImportValidate(context *gin.Context) {
+	var bundle importBundle
+	err := context.BindJSON(&bundle)
+	if err != nil {
+		apierror.Respond(context, http.StatusBadRequest, apierror.InvalidRequest, "Failed to unmarshal the JSON: %+v", err)
+		return
+	}
+
+	appengineContext := requestid.NewContext(context.Request)
+	stored, err := loadStoredLevels(appengineContext)
+	if err != nil {
+		apierror.Respond(context, http.StatusInternalServerError, apierror.Internal, "Could not load the levels: %+v", err)
+		return
+	}
+
+	problems := validateBundle(&bundle, stored)
+	context.JSON(http.StatusOK, &importValidation{Valid: len(problems) == 0, Problems: problems})
+}
+
+// --- Helpers
+
+// validateBundle lists everything wrong with a bundle, in bundle order.  stored
+// maps the keys of the stored levels to them, and is updated with the bundle's.
+func validateBundle(bundle *importBundle, stored map[string]*level.DatastoreLevel) []ImportProblem {
+	problems := []ImportProblem{}
+	levelProblem := func(key string, code apierror.Code, format string, values ...interface{}) {
+		problems = append(problems, ImportProblem{Kind: problemKindLevel, Key: key, Code: code, Message: fmt.Sprintf(format, values...)})
+	}
+	territoryProblem := func(key string, code apierror.Code, format string, values ...interface{}) {
+		problems = append(problems, ImportProblem{Kind: problemKindTerritory, Key: key, Code: code, Message: fmt.Sprintf(format, values...)})
+	}
+
+	// Each level on its own
+	var levelIds []string
+	seen := make(map[string]bool)
+	for i, jsonLevel := range bundle.Levels {
+		if jsonLevel == nil || jsonLevel.Key == nil || len(*jsonLevel.Key) == 0 {
+			levelProblem("", apierror.InvalidRequest, "Level %d in the bundle has no key", i)
+			continue
+		}
+
+		levelId := *jsonLevel.Key
+		if isReservedId(levelId) {
+			levelProblem(levelId, apierror.InvalidRequest, "The level id %q is reserved", levelId)
+			continue
+		}
+		if err := ids.Check(levelId); err != nil {
+			levelProblem(levelId, apierror.InvalidRequest, "Invalid level id: %v", err)
+			continue
+		}
+		if err := checkCanonicalIds(levelId, jsonLevel.ToDatastoreLevel().Parent); err != nil {
+			levelProblem(levelId, apierror.InvalidRequest, "Invalid level id: %v", err)
+			continue
+		}
+		if seen[levelId] {
+			levelProblem(levelId, apierror.InvalidRequest, "The bundle has more than one level with this key")
+			continue
+		}
+		seen[levelId] = true
+
+		err := jsonLevel.Validate()
+		if err != nil {
+			levelProblem(levelId, apierror.ValidationFailed, "Level failed validation: %v", err)
+		}
+
+		stored[levelId] = jsonLevel.ToDatastoreLevel()
+		levelIds = append(levelIds, levelId)
+	}
+
+	// Then resolved through whichever parents they'd have after the import
+	for _, levelId := range levelIds {
+		chain, err := chainInMemory(levelId, stored)
+		if err == datastore.ErrNoSuchEntity {
+			levelProblem(levelId, apierror.ParentNotFound, "The parent %q is neither in the bundle nor stored", chain[len(chain)-1].Parent)
+			continue
+		} else if err == ErrParentCycle {
+			levelProblem(levelId, apierror.CycleDetected, "Could not resolve the level: %v", err)
+			continue
+		} else if err == ErrParentChainTooDeep {
+			levelProblem(levelId, apierror.Conflict, "Could not resolve the level: %v", err)
+			continue
+		}
+
+		err = resolveInMemory(levelId, stored).ValidateResolved()
+		if err != nil {
+			levelProblem(levelId, apierror.ValidationFailed, "Resolved level failed validation: %v", err)
+		}
+	}
+
+	// And the levels each territory lists
+	seen = make(map[string]bool)
+	for i, element := range bundle.Territories {
+		if element == nil || element.Id == nil || len(*element.Id) == 0 {
+			territoryProblem("", apierror.InvalidRequest, "Territory %d in the bundle has no id", i)
+			continue
+		}
+
+		territoryId := *element.Id
+		if err := ids.Check(territoryId); err != nil {
+			territoryProblem(territoryId, apierror.InvalidRequest, "Invalid territory id: %v", err)
+			continue
+		}
+		if seen[territoryId] {
+			territoryProblem(territoryId, apierror.InvalidRequest, "The bundle has more than one territory with this id")
+			continue
+		}
+		seen[territoryId] = true
+
+		if element.Levels == nil {
+			continue
+		}
+		for _, levelId := range *element.Levels {
+			if _, ok := stored[levelId]; !ok {
+				territoryProblem(territoryId, apierror.NotFound, "The level %q is neither in the bundle nor stored", levelId)
+			}
+		}
+	}
+
+	return problems
+}
+
+// LevelsWithAncestors loads the levels as they're stored, along with every
+// ancestor they inherit from, for a bundle that can be imported on its own.
+// Ancestors come before their descendants, and each level appears once.  The
+// keys of listed levels or ancestors that don't exist are returned as missing.
+func LevelsWithAncestors(appengineContext appengine.Context, levelIds []string) ([]*level.JsonLevel, []string, error) {
+	levels := []*level.JsonLevel{}
+	missing := []string{}
+	seen := make(map[string]bool)
+	for _, levelId := range levelIds {
+		if seen[levelId] {
+			continue
+		}
+
+		chain, err := loadRawChain(appengineContext, levelId)
+		if err == datastore.ErrNoSuchEntity {
+			missingId := levelId
+			if len(chain) > 0 {
+				missingId = chain[len(chain)-1].Parent
+			}
+			if !seen[missingId] {
+				seen[missingId] = true
+				missing = append(missing, missingId)
+			}
+		} else if err != nil && err != ErrParentCycle && err != ErrParentChainTooDeep {
+			return nil, nil, err
+		}
+
+		for i := len(chain) - 1; i >= 0; i-- {
+			if !seen[chain[i].Key] {
+				seen[chain[i].Key] = true
+				levels = append(levels, chain[i].ToJsonLevel())
+			}
+		}
+	}
+
+	return levels, missing, nil
+}
+
+// ValidateImport checks levels and territories about to be imported together,
+// as /import/validate would.  The territories resource calls this before its
+// scoped import.  A level someone else has locked is a problem too, since the
+// import would overwrite it.
+func ValidateImport(appengineContext appengine.Context, jsonLevels []*level.JsonLevel, territories []*territory.Territory) ([]ImportProblem, error) {
+	stored, err := loadStoredLevels(appengineContext)
+	if err != nil {
+		return nil, err
+	}
+
+	problems := validateBundle(&importBundle{Levels: jsonLevels, Territories: territories}, stored)
+	for _, jsonLevel := range jsonLevels {
+		if jsonLevel == nil || jsonLevel.Key == nil {
+			continue
+		}
+		if lock := lockedByOther(appengineContext, *jsonLevel.Key); lock != nil {
+			problems = append(problems, ImportProblem{Kind: problemKindLevel, Key: lock.Key, Code: apierror.Locked, Message: lock.Editor + " is editing the level"})
+		}
+	}
+
+	return problems, nil
+}
+
+// ImportLevels writes levels that passed ValidateImport, as they are, in one
+// transaction, and invalidates everything cached about them.  Like a PUT, it
+// refuses a level someone else has locked, or a resize of one that territories
+// list under lock_referenced_dimensions.  Those are returned as problems, and
+// then nothing is written.
+func ImportLevels(appengineContext appengine.Context, jsonLevels []*level.JsonLevel) ([]ImportProblem, error) {
+	if len(jsonLevels) == 0 {
+		return nil, nil
+	}
+
+	keys := make([]*datastore.Key, len(jsonLevels))
+	dsLevels := make([]*level.DatastoreLevel, len(jsonLevels))
+	problems := []ImportProblem{}
+	for i, jsonLevel := range jsonLevels {
+		dsLevels[i] = jsonLevel.ToDatastoreLevel()
+		if lock := lockedByOther(appengineContext, dsLevels[i].Key); lock != nil {
+			problems = append(problems, ImportProblem{Kind: problemKindLevel, Key: lock.Key, Code: apierror.Locked, Message: lock.Editor + " is editing the level"})
+			continue
+		}
+
+		territories, err := lockingTerritories(appengineContext, dsLevels[i])
+		if err != nil {
+			return nil, err
+		}
+		if len(territories) > 0 {
+			problems = append(problems, ImportProblem{Kind: problemKindLevel, Key: dsLevels[i].Key, Code: apierror.Conflict, Message: ErrDimensionsLocked.Error() + ": " + strings.Join(territories, ", ")})
+			continue
+		}
+
+		markEdited(appengineContext, dsLevels[i])
+		keys[i] = makeDatastoreKey(appengineContext, dsLevels[i].Key)
+	}
+	if len(problems) > 0 {
+		return problems, nil
+	}
+
+	var previous map[string]*level.DatastoreLevel
+	err := datastore.RunInTransaction(appengineContext, func(transactionContext appengine.Context) error {
+		var err error
+		previous, err = loadPreviousLevels(transactionContext, keys)
+		if err != nil {
+			return err
+		}
+
+		_, err = datastore.PutMulti(transactionContext, keys, dsLevels)
+		if err != nil {
+			return err
+		}
+
+		return recordChanges(transactionContext, keyIds(keys), nil)
+	}, nil)
+	if err != nil {
+		return nil, err
+	}
+
+	queueChangeNotifications(appengineContext, keyIds(keys), previous, levelsByKey(dsLevels))
+	for _, levelId := range keyIds(keys) {
+		invalidateLevelCaches(appengineContext, levelId)
+		invalidateChildLevelCaches(appengineContext, levelId)
+	}
+	invalidateQueryCaches(appengineContext)
+
+	return nil, nil
+}
+
+// loadStoredLevels maps the key of every stored level to it.
+func loadStoredLevels(appengineContext appengine.Context) (map[string]*level.DatastoreLevel, error) {
+	var dsLevels []level.DatastoreLevel
+	query := datastore.NewQuery(kind).Ancestor(getLevelRootKey(appengineContext))
+	_, err := query.GetAll(appengineContext, &dsLevels)
+	err = mismatch.Ignore(appengineContext, err)
+	if err != nil {
+		return nil, err
+	}
+
+	result := make(map[string]*level.DatastoreLevel)
+	for i := range dsLevels {
+		dsLevels[i].Migrate()
+		result[dsLevels[i].Key] = &dsLevels[i]
+	}
+
+	return result, nil
+}
@@ -0,0 +1,40 @@
+package levels
+
+import (
+	"encoding/json"
+	"sync"
+
+	"appengine"
+
+	"bootcamp/editorservice/config"
+	"bootcamp/editorservice/levels/level"
+)
+
+// --- Types and constants
+
+var levelDefaults *level.DatastoreLevel
+var levelDefaultsOnce sync.Once
+
+// --- Helpers
+
+func getLevelDefaults(appengineContext appengine.Context) *level.DatastoreLevel {
+	levelDefaultsOnce.Do(func() {
+		var jsonLevel level.JsonLevel
+		err := json.Unmarshal([]byte(config.LevelDefaults), &jsonLevel)
+		if err != nil {
+			appengineContext.Errorf("Ignoring the invalid level defaults: %v", err)
+		}
+		levelDefaults = jsonLevel.ToDatastoreLevel()
+	})
+
+	return levelDefaults
+}
+
+// applyLevelDefaults fills in the fields a resolved level still leaves unset.
+// Defaults never override a field the level sets or inherits, and the result is
+// only meant for responses: it's never stored or cached.
+func applyLevelDefaults(appengineContext appengine.Context, resolved *level.DatastoreLevel) *level.DatastoreLevel {
+	result := *resolved
+	result.MergeParentProperties(getLevelDefaults(appengineContext))
+	return &result
+}
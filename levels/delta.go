@@ -0,0 +1,234 @@
+package levels
+
+import (
+	"fmt"
+	"net/http"
+	"strconv"
+	"time"
+
+	"appengine"
+	"appengine/datastore"
+
+	"github.com/gin-gonic/gin"
+
+	"bootcamp/editorservice/apierror"
+	"bootcamp/editorservice/etag"
+	"bootcamp/editorservice/levels/level"
+	"bootcamp/editorservice/requestid"
+)
+
+// --- Types and constants
+
+// Every write to the levels bumps a collection version, and each level keeps a
+// change record of the version that last touched it.  Deleted levels get a
+// tombstone instead (see tombstones.go).  Editors that mirror the levels ask for
+// what changed since the version they last saw.
+const (
+	changeKind               string = "LevelChange"
+	collectionVersionKind    string = "LevelCollectionVersion"
+	collectionVersionKeyName string = "version"
+)
+
+// levelChange is keyed by the level's id.
+type levelChange struct {
+	Version   int64
+	UpdatedAt time.Time
+}
+
+// collectionVersion also remembers the newest tombstone that has been pruned.
+// Deltas from before it could be missing deletes.
+type collectionVersion struct {
+	Version       int64
+	PrunedVersion int64
+}
+
+// deltaResponse holds the levels as they're stored, not resolved, since a change
+// to a parent doesn't touch its children's versions.  Mirrors resolve them
+// themselves.
+type deltaResponse struct {
+	Version int64              `json:"version"`
+	Levels  []*level.JsonLevel `json:"levels"`
+	Deleted []string           `json:"deleted"`
+}
+
+// versionResponse is the current collection version.  It only moves forward, so
+// an editor can poll it to learn whether anything changed since it last synced.
+type versionResponse struct {
+	Version int64 `json:"version"`
+}
+
+// --- Route handlers
+
+// handleCollectionVersion serves GET /levels/version.
+func handleCollectionVersion(context *gin.Context) {
+	appengineContext := requestid.NewContext(context.Request)
+	version, err := getCollectionVersion(appengineContext)
+	if err != nil {
+		apierror.Respond(context, http.StatusInternalServerError, apierror.Internal, "Could not read the collection version: %+v", err)
+		return
+	}
+
+	response := &versionResponse{Version: version.Version}
+	if etag.NotModified(context, collectionETag(version.Version, "version")) {
+		return
+	}
+	context.JSON(http.StatusOK, response)
+}
+
+// handleDelta serves GET /levels/delta?since=<version>.  Without since, every
+// level is returned.  A since from before the last tombstone prune gets a 410,
+// and the mirror has to start over.
+func handleDelta(context *gin.Context) {
+	since, err := strconv.ParseInt(context.DefaultQuery("since", "0"), 10, 64)
+	if err != nil || since < 0 {
+		apierror.Respond(context, http.StatusBadRequest, apierror.InvalidRequest, "since must be a collection version")
+		return
+	}
+
+	// Read the version first.  A write that lands while the changes are being
+	// read then shows up again next time rather than being missed.
+	appengineContext := requestid.NewContext(context.Request)
+	version, err := getCollectionVersion(appengineContext)
+	if err != nil {
+		apierror.Respond(context, http.StatusInternalServerError, apierror.Internal, "Could not read the collection version: %+v", err)
+		return
+	}
+	if since > 0 && since < version.PrunedVersion {
+		apierror.Respond(context, http.StatusGone, apierror.ResyncRequired, "Deletes up to version %d have been forgotten, so the mirror must be rebuilt", version.PrunedVersion)
+		return
+	}
+
+	query := datastore.NewQuery(changeKind).Ancestor(getLevelRootKey(appengineContext)).Filter("Version >", since).KeysOnly()
+	keys, err := query.GetAll(appengineContext, nil)
+	if err != nil {
+		apierror.Respond(context, http.StatusInternalServerError, apierror.Internal, "Could not query the changes: %+v", err)
+		return
+	}
+
+	query = datastore.NewQuery(tombstoneKind).Ancestor(getLevelRootKey(appengineContext)).Filter("Version >", since).KeysOnly()
+	tombstoneKeys, err := query.GetAll(appengineContext, nil)
+	if err != nil {
+		apierror.Respond(context, http.StatusInternalServerError, apierror.Internal, "Could not query the tombstones: %+v", err)
+		return
+	}
+
+	response := &deltaResponse{Version: version.Version, Levels: []*level.JsonLevel{}, Deleted: keyIds(tombstoneKeys)}
+	for _, key := range keys {
+		stored, err := getRawLevel(appengineContext, key.StringID())
+		if err == datastore.ErrNoSuchEntity {
+			continue
+		} else if err != nil {
+			apierror.Respond(context, http.StatusInternalServerError, apierror.Internal, "Could not retrieve the level: %+v", err)
+			return
+		}
+		response.Levels = append(response.Levels, stored.ToJsonLevel())
+	}
+
+	context.JSON(http.StatusOK, response)
+}
+
+// --- Helpers
+
+func getCollectionVersion(appengineContext appengine.Context) (*collectionVersion, error) {
+	result := &collectionVersion{}
+	err := datastore.Get(appengineContext, makeCollectionVersionKey(appengineContext), result)
+	if err == datastore.ErrNoSuchEntity {
+		return result, nil
+	} else if err != nil {
+		return nil, err
+	}
+
+	return result, nil
+}
+
+// recordChanges bumps the collection version and marks the written levels with
+// it.  Deleted levels swap their change record for a tombstone, and written ones
+// clear any tombstone left from an earlier delete.  It has to run inside a
+// transaction on the levels' entity group.
+func recordChanges(transactionContext appengine.Context, written []string, deleted []string) error {
+	if len(written) == 0 && len(deleted) == 0 {
+		return nil
+	}
+
+	version, err := getCollectionVersion(transactionContext)
+	if err != nil {
+		return err
+	}
+	version.Version++
+
+	_, err = datastore.Put(transactionContext, makeCollectionVersionKey(transactionContext), version)
+	if err != nil {
+		return err
+	}
+
+	now := time.Now()
+	var putKeys []*datastore.Key
+	var puts []interface{}
+	var deleteKeys []*datastore.Key
+	for _, levelId := range written {
+		putKeys = append(putKeys, makeChangeKey(transactionContext, levelId))
+		puts = append(puts, &levelChange{Version: version.Version, UpdatedAt: now})
+		deleteKeys = append(deleteKeys, makeTombstoneKey(transactionContext, levelId))
+	}
+	for _, levelId := range deleted {
+		putKeys = append(putKeys, makeTombstoneKey(transactionContext, levelId))
+		puts = append(puts, &levelTombstone{Version: version.Version, DeletedAt: now})
+		deleteKeys = append(deleteKeys, makeChangeKey(transactionContext, levelId))
+	}
+
+	_, err = datastore.PutMulti(transactionContext, putKeys, puts)
+	if err != nil {
+		return err
+	}
+
+	return datastore.DeleteMulti(transactionContext, deleteKeys)
+}
+
+// ChangeVersions maps each of levelIds to the collection version that last
+// wrote it.  Levels with no change record, because they haven't been written
+// since versions were kept or don't exist, are left out.  The territories
+// resource calls this to export and import bundles.
+func ChangeVersions(appengineContext appengine.Context, levelIds []string) (map[string]int64, error) {
+	result := make(map[string]int64)
+	if len(levelIds) == 0 {
+		return result, nil
+	}
+
+	keys := make([]*datastore.Key, len(levelIds))
+	changes := make([]levelChange, len(levelIds))
+	for i, levelId := range levelIds {
+		keys[i] = makeChangeKey(appengineContext, levelId)
+	}
+
+	err := datastore.GetMulti(appengineContext, keys, changes)
+	multiError, isMulti := err.(appengine.MultiError)
+	if err != nil && !isMulti {
+		return nil, err
+	}
+
+	for i, levelId := range levelIds {
+		if isMulti && multiError[i] == datastore.ErrNoSuchEntity {
+			continue
+		} else if isMulti && multiError[i] != nil {
+			return nil, multiError[i]
+		}
+		result[levelId] = changes[i].Version
+	}
+
+	return result, nil
+}
+
+// collectionETag tags a response built from the whole collection at a version.
+// Every write bumps the version, so the tag changes whenever the levels do.  The
+// variant tells apart the different responses built from the same version.
+func collectionETag(version int64, variant string) string {
+	return fmt.Sprintf(`"levels-%d-%s"`, version, variant)
+}
+
+func makeCollectionVersionKey(context appengine.Context) *datastore.Key {
+	return datastore.NewKey(context, collectionVersionKind, collectionVersionKeyName, 0, getLevelRootKey(context))
+}
+
+func makeChangeKey(context appengine.Context, levelId string) *datastore.Key {
+	return datastore.NewKey(context, changeKind, levelId, 0, getLevelRootKey(context))
+}
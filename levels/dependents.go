@@ -0,0 +1,139 @@
+package levels
+
+import (
+	"sort"
+
+	"appengine"
+	"appengine/datastore"
+
+	"bootcamp/editorservice/levels/level"
+)
+
+// --- Types and constants
+
+// dependentChild is a level below the one being written that would lose fields
+// it inherits today.
+type dependentChild struct {
+	Key    string   `json:"key"`
+	Fields []string `json:"fields"`
+}
+
+type dependentsReport struct {
+	AffectedChildren []dependentChild `json:"affected_children"`
+	Warnings         []queryWarning   `json:"warnings,omitempty"`
+}
+
+// --- Helpers
+
+// findDependents works out which levels below dsLevel would end up with fields
+// unset if dsLevel were stored as given.  Every level is resolved in memory twice,
+// once as things stand and once with dsLevel swapped in.
+func findDependents(appengineContext appengine.Context, dsLevel *level.DatastoreLevel) (*dependentsReport, error) {
+	before, err := loadStoredLevels(appengineContext)
+	if err != nil {
+		return nil, err
+	}
+
+	after := make(map[string]*level.DatastoreLevel)
+	for levelId, stored := range before {
+		after[levelId] = stored
+	}
+	after[dsLevel.Key] = dsLevel
+
+	// Compare every descendant's resolution.  The children come from the stored
+	// tree, since that's who depends on the level today.
+	report := &dependentsReport{AffectedChildren: []dependentChild{}}
+	for _, childId := range descendantIds(dsLevel.Key, before) {
+		unset := level.UnsetFields(resolveInMemory(childId, before), resolveInMemory(childId, after))
+		if len(unset) > 0 {
+			report.AffectedChildren = append(report.AffectedChildren, dependentChild{Key: childId, Fields: unset})
+		}
+	}
+
+	sort.Sort(byDependentKey(report.AffectedChildren))
+	return report, nil
+}
+
+// descendantIds lists the keys of every level below levelId in a map of stored
+// levels, nearest first.
+func descendantIds(levelId string, stored map[string]*level.DatastoreLevel) []string {
+	children := make(map[string][]string)
+	for childId, child := range stored {
+		if child.HasParent && len(child.Parent) > 0 {
+			children[child.Parent] = append(children[child.Parent], childId)
+		}
+	}
+	for _, childIds := range children {
+		sort.Strings(childIds)
+	}
+
+	var result []string
+	visited := map[string]bool{levelId: true}
+	queue := append([]string{}, children[levelId]...)
+	for len(queue) > 0 {
+		childId := queue[0]
+		queue = queue[1:]
+		if visited[childId] {
+			continue
+		}
+		visited[childId] = true
+		queue = append(queue, children[childId]...)
+		result = append(result, childId)
+	}
+
+	return result
+}
+
+// resolveInMemory resolves a level from a map of stored levels, stopping at a
+// missing parent, a cycle, or maxParentDepth.
+func resolveInMemory(levelId string, stored map[string]*level.DatastoreLevel) *level.DatastoreLevel {
+	chain, _ := chainInMemory(levelId, stored)
+
+	result := &level.DatastoreLevel{}
+	if len(chain) == 0 {
+		return result
+	}
+
+	*result = *chain[len(chain)-1]
+	for i := len(chain) - 2; i >= 0; i-- {
+		child := *chain[i]
+		child.MergeParentProperties(result)
+		result = &child
+	}
+
+	return result
+}
+
+// chainInMemory is loadRawChain for a map of stored levels.  A missing level
+// is reported as datastore.ErrNoSuchEntity.
+func chainInMemory(levelId string, stored map[string]*level.DatastoreLevel) ([]*level.DatastoreLevel, error) {
+	var chain []*level.DatastoreLevel
+	visited := make(map[string]bool)
+	currentId := levelId
+	for {
+		if visited[currentId] {
+			return chain, ErrParentCycle
+		}
+		if len(chain) > maxParentDepth {
+			return chain, ErrParentChainTooDeep
+		}
+		visited[currentId] = true
+
+		current, ok := stored[currentId]
+		if !ok {
+			return chain, datastore.ErrNoSuchEntity
+		}
+
+		chain = append(chain, current)
+		if !current.HasParent || len(current.Parent) == 0 {
+			return chain, nil
+		}
+		currentId = current.Parent
+	}
+}
+
+type byDependentKey []dependentChild
+
+func (children byDependentKey) Len() int           { return len(children) }
+func (children byDependentKey) Swap(i, j int)      { children[i], children[j] = children[j], children[i] }
+func (children byDependentKey) Less(i, j int) bool { return children[i].Key < children[j].Key }
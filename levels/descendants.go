@@ -0,0 +1,112 @@
+package levels
+
+import (
+	"fmt"
+	"net/http"
+	"time"
+
+	"appengine"
+	"appengine/datastore"
+
+	"github.com/gin-gonic/gin"
+
+	"bootcamp/editorservice/apierror"
+	"bootcamp/editorservice/cache"
+	"bootcamp/editorservice/requestid"
+)
+
+// --- Types and constants
+
+// descendantCountExpiration bounds how long a count outlives the collection
+// version it was taken at.  Entries for older versions are never read again, so
+// this only keeps them from lingering.
+const descendantCountExpiration = time.Hour
+
+type descendantCountResponse struct {
+	Key       string `json:"key"`
+	Recursive bool   `json:"recursive"`
+	Count     int    `json:"count"`
+}
+
+// --- Route handlers
+
+// handleDescendantCount counts the levels whose parent is the level, or with
+// ?recursive=true every level below it, for badges in the editor.  Counts are
+// cached under the collection version, which every write bumps, so a count is
+// never read back after the tree changes.
+func handleDescendantCount(context *gin.Context) {
+	levelId := context.Param("id")
+	recursive := context.Query("recursive") == "true"
+	appengineContext := requestid.NewContext(context.Request)
+
+	version, err := getCollectionVersion(appengineContext)
+	if err != nil {
+		apierror.Respond(context, http.StatusInternalServerError, apierror.Internal, "Could not read the collection version: %+v", err)
+		return
+	}
+
+	// Check response cache
+	responseEntry := &cache.ResponseEntry{Path: descendantCountPath(levelId, recursive, version.Version)}
+	err = cache.GetCachedResource(appengineContext, responseEntry)
+	if err == nil {
+		context.JSON(responseEntry.Code, responseEntry.Response)
+		return
+	}
+
+	_, err = getRawLevel(appengineContext, levelId)
+	if err == datastore.ErrNoSuchEntity {
+		apierror.Respond(context, http.StatusNotFound, apierror.NotFound, "Level does not exist")
+		return
+	} else if err != nil {
+		apierror.Respond(context, http.StatusInternalServerError, apierror.Internal, "Could not retrieve the level: %+v", err)
+		return
+	}
+
+	count, err := countDescendants(appengineContext, levelId, recursive)
+	if err != nil {
+		apierror.Respond(context, http.StatusInternalServerError, apierror.Internal, "Could not count the level's descendants: %+v", err)
+		return
+	}
+
+	// Cache and return the result
+	responseEntry.Code = http.StatusOK
+	responseEntry.Response = &descendantCountResponse{Key: levelId, Recursive: recursive, Count: count}
+	cache.CacheResourceFor(appengineContext, responseEntry, descendantCountExpiration)
+
+	context.JSON(responseEntry.Code, responseEntry.Response)
+}
+
+// --- Helpers
+
+// descendantCountPath is where a level's descendant count is cached for a
+// collection version.
+func descendantCountPath(levelId string, recursive bool, version int64) string {
+	return fmt.Sprintf("descendant-count:%s:%t@%d", levelId, recursive, version)
+}
+
+// countDescendants walks down from levelId with a keys-only query per level.
+// Each level is counted once, so a cycle below levelId ends the walk rather than
+// looping, and levelId itself is never counted.
+func countDescendants(appengineContext appengine.Context, levelId string, recursive bool) (int, error) {
+	visited := map[string]bool{levelId: true}
+	pending := []string{levelId}
+	for len(pending) > 0 {
+		children, err := childIds(appengineContext, pending[0])
+		if err != nil {
+			return 0, err
+		}
+		pending = pending[1:]
+
+		for _, childId := range children {
+			if visited[childId] {
+				continue
+			}
+			visited[childId] = true
+			if recursive {
+				pending = append(pending, childId)
+			}
+		}
+	}
+
+	return len(visited) - 1, nil
+}
@@ -0,0 +1,168 @@
+package levels
+
+import (
+	"net/http"
+	"sort"
+
+	"appengine"
+	"appengine/datastore"
+
+	"github.com/gin-gonic/gin"
+
+	"bootcamp/editorservice/apierror"
+	"bootcamp/editorservice/levels/level"
+	"bootcamp/editorservice/mismatch"
+	"bootcamp/editorservice/requestid"
+	"bootcamp/editorservice/territories/territory"
+)
+
+// --- Types and constants
+
+// diffRequest names the two bundles to compare.  Without To, From is compared
+// with the stored levels and territories.
+type diffRequest struct {
+	From *importBundle `json:"from"`
+	To   *importBundle `json:"to"`
+}
+
+type diffResponse struct {
+	Levels      entityDiff `json:"levels"`
+	Territories entityDiff `json:"territories"`
+}
+
+// entityDiff lists the keys that were added, removed and modified going from one
+// bundle to the other, each in sorted order.
+type entityDiff struct {
+	Added    []string         `json:"added"`
+	Removed  []string         `json:"removed"`
+	Modified []modifiedEntity `json:"modified"`
+}
+
+type modifiedEntity struct {
+	Key    string   `json:"key"`
+	Fields []string `json:"fields"`
+}
+
+// --- Route handlers
+
+func handleDiffBundle(context *gin.Context) {
+	var request diffRequest
+	err := context.BindJSON(&request)
+	if err != nil {
+		apierror.Respond(context, http.StatusBadRequest, apierror.InvalidRequest, "Failed to unmarshal the JSON: %+v", err)
+		return
+	}
+	if request.From == nil {
+		apierror.Respond(context, http.StatusBadRequest, apierror.InvalidRequest, "The request needs a from bundle")
+		return
+	}
+
+	fromLevels, fromTerritories := bundleLevels(request.From), bundleTerritories(request.From)
+	var toLevels map[string]*level.DatastoreLevel
+	var toTerritories map[string]*territory.Territory
+	if request.To != nil {
+		toLevels, toTerritories = bundleLevels(request.To), bundleTerritories(request.To)
+	} else {
+		appengineContext := requestid.NewContext(context.Request)
+		toLevels, err = loadStoredLevels(appengineContext)
+		if err == nil {
+			toTerritories, err = loadStoredTerritories(appengineContext)
+		}
+		if err != nil {
+			apierror.Respond(context, http.StatusInternalServerError, apierror.Internal, "Could not load the live data: %+v", err)
+			return
+		}
+	}
+
+	response := &diffResponse{Levels: newEntityDiff(), Territories: newEntityDiff()}
+	for levelId, from := range fromLevels {
+		if to, ok := toLevels[levelId]; !ok {
+			response.Levels.Removed = append(response.Levels.Removed, levelId)
+		} else if fields := level.ChangedFields(from, to); len(fields) > 0 {
+			response.Levels.Modified = append(response.Levels.Modified, modifiedEntity{Key: levelId, Fields: fields})
+		}
+	}
+	for levelId := range toLevels {
+		if _, ok := fromLevels[levelId]; !ok {
+			response.Levels.Added = append(response.Levels.Added, levelId)
+		}
+	}
+
+	for territoryId, from := range fromTerritories {
+		if to, ok := toTerritories[territoryId]; !ok {
+			response.Territories.Removed = append(response.Territories.Removed, territoryId)
+		} else if fields := territory.ChangedFields(from, to); len(fields) > 0 {
+			response.Territories.Modified = append(response.Territories.Modified, modifiedEntity{Key: territoryId, Fields: fields})
+		}
+	}
+	for territoryId := range toTerritories {
+		if _, ok := fromTerritories[territoryId]; !ok {
+			response.Territories.Added = append(response.Territories.Added, territoryId)
+		}
+	}
+
+	response.Levels.sort()
+	response.Territories.sort()
+	context.JSON(http.StatusOK, response)
+}
+
+// --- Helpers
+
+func newEntityDiff() entityDiff {
+	return entityDiff{Added: []string{}, Removed: []string{}, Modified: []modifiedEntity{}}
+}
+
+func (diff *entityDiff) sort() {
+	sort.Strings(diff.Added)
+	sort.Strings(diff.Removed)
+	sort.Sort(byModifiedKey(diff.Modified))
+}
+
+// bundleLevels maps the keys of a bundle's levels to them.  Levels without a key
+// are skipped, and a later level replaces an earlier one with the same key.
+func bundleLevels(bundle *importBundle) map[string]*level.DatastoreLevel {
+	result := make(map[string]*level.DatastoreLevel)
+	for _, jsonLevel := range bundle.Levels {
+		if jsonLevel != nil && jsonLevel.Key != nil && len(*jsonLevel.Key) > 0 {
+			result[*jsonLevel.Key] = jsonLevel.ToDatastoreLevel()
+		}
+	}
+
+	return result
+}
+
+// bundleTerritories is bundleLevels for territories.
+func bundleTerritories(bundle *importBundle) map[string]*territory.Territory {
+	result := make(map[string]*territory.Territory)
+	for _, element := range bundle.Territories {
+		if element != nil && element.Id != nil && len(*element.Id) > 0 {
+			result[*element.Id] = element
+		}
+	}
+
+	return result
+}
+
+// loadStoredTerritories maps the id of every stored territory to it.
+func loadStoredTerritories(appengineContext appengine.Context) (map[string]*territory.Territory, error) {
+	var territories []*territory.Territory
+	query := datastore.NewQuery(territory.Kind).Ancestor(territory.RootKey(appengineContext))
+	keys, err := query.GetAll(appengineContext, &territories)
+	err = mismatch.Ignore(appengineContext, err)
+	if err != nil {
+		return nil, err
+	}
+
+	result := make(map[string]*territory.Territory)
+	for i, key := range keys {
+		result[key.StringID()] = territories[i]
+	}
+
+	return result, nil
+}
+
+type byModifiedKey []modifiedEntity
+
+func (entities byModifiedKey) Len() int           { return len(entities) }
+func (entities byModifiedKey) Swap(i, j int)      { entities[i], entities[j] = entities[j], entities[i] }
+func (entities byModifiedKey) Less(i, j int) bool { return entities[i].Key < entities[j].Key }
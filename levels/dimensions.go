@@ -0,0 +1,78 @@
+package levels
+
+import (
+	"errors"
+	"net/http"
+	"strings"
+
+	"appengine"
+	"appengine/datastore"
+
+	"github.com/gin-gonic/gin"
+
+	"bootcamp/editorservice/apierror"
+	"bootcamp/editorservice/flags"
+	"bootcamp/editorservice/levels/level"
+	"bootcamp/editorservice/territories/territory"
+)
+
+// --- Types and constants
+
+var ErrDimensionsLocked = errors.New("levels: the level's rows and columns can't change while territories list it")
+
+// dimensionsLocked is the body of the 409 for a write that would resize a level
+// that territories list.
+type dimensionsLocked struct {
+	apierror.Response
+	Territories []string `json:"territories"`
+}
+
+// --- Helpers
+
+// lockingTerritories returns the territories that keep dsLevel from being
+// stored.  There are none unless the lock_referenced_dimensions flag is on and
+// the write changes the level's own rows or columns.
+func lockingTerritories(appengineContext appengine.Context, dsLevel *level.DatastoreLevel) ([]string, error) {
+	if !flags.LockReferencedDimensions.Enabled {
+		return nil, nil
+	}
+
+	previous, err := getRawLevel(appengineContext, dsLevel.Key)
+	if err == datastore.ErrNoSuchEntity {
+		return nil, nil
+	} else if err != nil {
+		return nil, err
+	}
+	if !dimensionsChanged(previous, dsLevel) {
+		return nil, nil
+	}
+
+	return referencingTerritories(appengineContext, dsLevel.Key)
+}
+
+// referencingTerritories lists the ids of the territories whose levels include
+// levelId.  It queries the territories' entity group, so it can't run inside a
+// level transaction.
+func referencingTerritories(appengineContext appengine.Context, levelId string) ([]string, error) {
+	query := datastore.NewQuery(territory.Kind).Ancestor(territory.RootKey(appengineContext)).Filter("Levels =", levelId).KeysOnly()
+	keys, err := query.GetAll(appengineContext, nil)
+	if err != nil {
+		return nil, err
+	}
+
+	return keyIds(keys), nil
+}
+
+// dimensionsChanged reports whether a write sets, clears or changes the rows or
+// columns the level had stored.  What it inherits doesn't count.
+func dimensionsChanged(previous *level.DatastoreLevel, next *level.DatastoreLevel) bool {
+	return previous.HasRows != next.HasRows || previous.Rows != next.Rows ||
+		previous.HasColumns != next.HasColumns || previous.Columns != next.Columns
+}
+
+func respondDimensionsLocked(context *gin.Context, territories []string) {
+	context.JSON(http.StatusConflict, &dimensionsLocked{
+		Response:    *apierror.New(apierror.Conflict, "The level's rows and columns can't change while territories list it: %s", strings.Join(territories, ", ")),
+		Territories: territories,
+	})
+}
@@ -0,0 +1,62 @@
+package levels
+
+import (
+	"net/http"
+	"time"
+
+	"appengine"
+	"appengine/datastore"
+	"appengine/user"
+
+	"github.com/gin-gonic/gin"
+
+	"bootcamp/editorservice/apierror"
+	"bootcamp/editorservice/levels/level"
+	"bootcamp/editorservice/requestid"
+)
+
+// --- Route handlers
+
+// handleEditedByQuery returns the levels last written by the editor named with
+// ?editedBy=, optionally only those written at or after ?changedSince= (an
+// RFC 3339 time).  Editors are identified by the email they sign in with, and
+// an empty editedBy matches anonymous writes.
+//
+// The filters run in the datastore, which needs the composite (ancestor,
+// LastEditedBy, LastEditedAt) index in index.yaml.
+func handleEditedByQuery(context *gin.Context) {
+	appengineContext := requestid.NewContext(context.Request)
+	query := datastore.NewQuery(kind).Ancestor(getLevelRootKey(appengineContext)).KeysOnly()
+	query = query.Filter("LastEditedBy =", context.Query("editedBy"))
+
+	if value := context.Query("changedSince"); len(value) > 0 {
+		since, err := time.Parse(time.RFC3339, value)
+		if err != nil {
+			apierror.Respond(context, http.StatusBadRequest, apierror.InvalidRequest, "changedSince must be an RFC 3339 time: %+v", err)
+			return
+		}
+		query = query.Filter("LastEditedAt >=", since)
+	}
+
+	keys, err := query.GetAll(appengineContext, nil)
+	if err != nil {
+		apierror.Respond(context, http.StatusInternalServerError, apierror.Internal, "Could not query the levels: %+v", err)
+		return
+	}
+
+	// Resolve each match like the query-all does
+	levels, warnings := resolveLevels(appengineContext, keys)
+	context.JSON(http.StatusOK, queryBody(context, levels, warnings))
+}
+
+// --- Helpers
+
+// markEdited stamps a level that's about to be written with the signed-in user
+// and the current time.
+func markEdited(appengineContext appengine.Context, dsLevel *level.DatastoreLevel) {
+	dsLevel.LastEditedBy = ""
+	if current := user.Current(appengineContext); current != nil {
+		dsLevel.LastEditedBy = current.Email
+	}
+	dsLevel.LastEditedAt = time.Now()
+}
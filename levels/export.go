@@ -0,0 +1,88 @@
+package levels
+
+import (
+	"encoding/json"
+	"net/http"
+
+	"appengine/datastore"
+
+	"github.com/gin-gonic/gin"
+
+	"bootcamp/editorservice/levels/level"
+	"bootcamp/editorservice/mismatch"
+	"bootcamp/editorservice/requestid"
+)
+
+// --- Types and constants
+
+// exportPageSize is how many levels are read from the datastore at a time.
+const exportPageSize int = 100
+
+// --- Route handlers
+
+// handleExport writes every stored (unresolved) level as one JSON array.  It pages
+// through the datastore with cursors and writes each page as it goes, so only one
+// page is held at a time no matter how many levels there are.
+//
+// The status is sent before the first level is read, so a failure part way can't
+// change it.  Instead the array is left unterminated, which no JSON parser will
+// mistake for a complete export.
+func handleExport(context *gin.Context) {
+	appengineContext := requestid.NewContext(context.Request)
+	writer := context.Writer
+	writer.Header().Set("Content-Type", "application/json; charset=utf-8")
+	writer.WriteHeader(http.StatusOK)
+	writer.WriteString("[")
+
+	exported := 0
+	var cursor *datastore.Cursor
+	for {
+		query := datastore.NewQuery(kind).Ancestor(getLevelRootKey(appengineContext)).Limit(exportPageSize)
+		if cursor != nil {
+			query = query.Start(*cursor)
+		}
+
+		iterator := query.Run(appengineContext)
+		count := 0
+		for {
+			var dsLevel level.DatastoreLevel
+			_, err := iterator.Next(&dsLevel)
+			if err == datastore.Done {
+				break
+			}
+			err = mismatch.Ignore(appengineContext, err)
+			if err != nil {
+				appengineContext.Errorf("Export stopped after %d levels: %v", exported, err)
+				return
+			}
+
+			encoded, err := json.Marshal(dsLevel.ToJsonLevel())
+			if err != nil {
+				appengineContext.Errorf("Export stopped after %d levels: %v", exported, err)
+				return
+			}
+
+			if exported > 0 {
+				writer.WriteString(",")
+			}
+			writer.Write(encoded)
+			exported++
+			count++
+		}
+		writer.Flush()
+
+		// A short page is the last one
+		if count < exportPageSize {
+			break
+		}
+
+		next, err := iterator.Cursor()
+		if err != nil {
+			appengineContext.Errorf("Export stopped after %d levels: %v", exported, err)
+			return
+		}
+		cursor = &next
+	}
+
+	writer.WriteString("]")
+}
@@ -0,0 +1,64 @@
+package levels
+
+import (
+	"encoding/json"
+	"net/http"
+
+	"github.com/gin-gonic/gin"
+
+	"bootcamp/editorservice/apierror"
+	"bootcamp/editorservice/levels/level"
+	"bootcamp/editorservice/requestid"
+)
+
+// --- Types and constants
+
+// sourceSelf is the source of a field the level sets itself.
+const sourceSelf string = "self"
+
+// fieldResponse is one resolved field of a level.  Source is the key of the
+// ancestor it's inherited from, or "self".
+type fieldResponse struct {
+	Value     json.RawMessage `json:"value"`
+	Source    string          `json:"source"`
+	Inherited bool            `json:"inherited"`
+}
+
+// --- Route handlers
+
+// handleField returns the resolved value of a single field and where it comes
+// from.  A field that no level in the chain sets is a 404.
+func handleField(context *gin.Context) {
+	levelId := context.Param("id")
+	name := context.Param("name")
+	if !level.FieldNames[name] {
+		apierror.Respond(context, http.StatusBadRequest, apierror.InvalidRequest, "Unknown level field %q", name)
+		return
+	}
+
+	appengineContext := requestid.NewContext(context.Request)
+	chain, ok := loadChainOrRespond(context, appengineContext, levelId)
+	if !ok {
+		return
+	}
+
+	stored := make(map[string]*level.DatastoreLevel)
+	for _, element := range chain {
+		stored[element.Key] = element
+	}
+	values, ok := selectFields(resolveInMemory(levelId, stored).ToJsonLevel(), []string{name}).(map[string]json.RawMessage)
+	value, set := values[name]
+	if !ok || !set {
+		apierror.Respond(context, http.StatusNotFound, apierror.NotFound, "The field %q isn't set on the level or any of its ancestors", name)
+		return
+	}
+
+	// Key and parent_key aren't inherited, so they're always the level's own
+	response := &fieldResponse{Value: value, Source: sourceSelf}
+	if source, ok := level.Provenance(chain)[name]; ok && source != levelId {
+		response.Source = source
+		response.Inherited = true
+	}
+
+	context.JSON(http.StatusOK, response)
+}
@@ -0,0 +1,113 @@
+package levels
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"strings"
+
+	"github.com/gin-gonic/gin"
+
+	"bootcamp/editorservice/flags"
+	"bootcamp/editorservice/levels/level"
+)
+
+// --- Types and constants
+
+var errEmptyBody = errors.New("the request body is empty")
+
+// --- Helpers
+
+// parseFields reads the sparse fieldset asked for with ?fields=name,duration.  It
+// returns nil when every field is wanted.  Unknown names are rejected rather than
+// ignored, so that a typo doesn't quietly return less than the client expects.
+func parseFields(context *gin.Context) ([]string, error) {
+	value := context.Query("fields")
+	if len(value) == 0 {
+		return nil, nil
+	}
+
+	var fields []string
+	for _, name := range strings.Split(value, ",") {
+		name = strings.TrimSpace(name)
+		if len(name) == 0 {
+			continue
+		}
+		if !level.FieldNames[name] {
+			return nil, fmt.Errorf("unknown level field %q", name)
+		}
+		fields = append(fields, name)
+	}
+
+	return fields, nil
+}
+
+// selectFields trims a level response down to the given fields, always keeping
+// the key.  It works from the JSON so that it applies equally to a resolved level
+// and to a response read back from the cache.
+func selectFields(response interface{}, fields []string) interface{} {
+	if fields == nil {
+		return response
+	}
+
+	encoded, err := json.Marshal(response)
+	if err != nil {
+		return response
+	}
+	var all map[string]json.RawMessage
+	err = json.Unmarshal(encoded, &all)
+	if err != nil {
+		return response
+	}
+
+	result := make(map[string]json.RawMessage)
+	for _, name := range append([]string{"key"}, fields...) {
+		if value, ok := all[name]; ok {
+			result[name] = value
+		}
+	}
+
+	return result
+}
+
+// bindLevel unmarshals the request body into a level.  With the
+// reject_unknown_fields flag, top-level fields that aren't level fields are an
+// error instead of being dropped.  An empty body is taken as {}, so a level can
+// be created with nothing but its key, unless the reject_empty_bodies flag is on.
+func bindLevel(context *gin.Context, jsonLevel *level.JsonLevel) error {
+	body, err := ioutil.ReadAll(context.Request.Body)
+	if err != nil {
+		return err
+	}
+
+	return decodeLevel(body, jsonLevel)
+}
+
+// decodeLevel is bindLevel for a body that's already been read.
+func decodeLevel(body []byte, jsonLevel *level.JsonLevel) error {
+	if len(bytes.TrimSpace(body)) == 0 {
+		if flags.RejectEmptyBodies.Enabled {
+			return errEmptyBody
+		}
+		body = []byte("{}")
+	}
+	err := json.Unmarshal(body, jsonLevel)
+	if err != nil || !flags.RejectUnknownFields.Enabled {
+		return err
+	}
+
+	var all map[string]json.RawMessage
+	err = json.Unmarshal(body, &all)
+	if err != nil {
+		return err
+	}
+	for name := range all {
+		if !level.FieldNames[name] {
+			return fmt.Errorf("unknown level field %q", name)
+		}
+	}
+
+	return nil
+}
@@ -0,0 +1,49 @@
+package levels
+
+import (
+	"net/http"
+
+	"github.com/gin-gonic/gin"
+
+	"bootcamp/editorservice/apierror"
+	"bootcamp/editorservice/cache"
+	"bootcamp/editorservice/config"
+	"bootcamp/editorservice/requestid"
+)
+
+// --- Types and constants
+
+// heavySemaphore is shared by every route that scans the whole collection.
+const heavySemaphore string = "heavy"
+
+// heavyRetryAfter is the Retry-After, in seconds, sent with a 429.
+const heavyRetryAfter string = "5"
+
+// --- Helpers
+
+// limitHeavy wraps a route that scans every level, so that at most
+// config.MaxHeavyRequests of them run at once.  Past that it responds 429.  If
+// memcache can't be reached, the request is let through rather than refused.
+func limitHeavy(handler gin.HandlerFunc) gin.HandlerFunc {
+	return func(context *gin.Context) {
+		if config.MaxHeavyRequests <= 0 {
+			handler(context)
+			return
+		}
+
+		appengineContext := requestid.NewContext(context.Request)
+		err := cache.AcquireSlot(appengineContext, heavySemaphore, config.MaxHeavyRequests)
+		if err == cache.ErrNoSlotFree {
+			context.Header("Retry-After", heavyRetryAfter)
+			apierror.Respond(context, http.StatusTooManyRequests, apierror.TooManyRequests, "Too many requests that scan every level are running.  Try again shortly.")
+			return
+		} else if err != nil {
+			appengineContext.Warningf("Could not take a heavy request slot, so running the request anyway: %v", err)
+			handler(context)
+			return
+		}
+
+		defer cache.ReleaseSlot(appengineContext, heavySemaphore)
+		handler(context)
+	}
+}
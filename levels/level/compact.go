@@ -0,0 +1,274 @@
+package level
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"math"
+)
+
+// --- Compact encoding
+// A hand-packed binary form of DatastoreLevel for the level cache.  Resolved levels
+// are read from memcache on nearly every request, and this form is a fraction of
+// the size of the JSON and cheaper to encode and decode.
+//
+// The layout is a version byte, then a bitmask of the fields that are set, then
+// each set field in the order below.  Strings are length-prefixed, integers are
+// varints and floats are 4 little-endian bytes.
+
+const compactVersion byte = 1
+
+const (
+	compactKey uint64 = 1 << iota
+	compactParent
+	compactName
+	compactRows
+	compactColumns
+	compactHealth
+	compactDuration
+	compactComboTimer
+	compactUnitDelayMultiplier
+	compactMaxActiveUnits
+	compactSpawnsPerSecond
+	compactSpawnFrequency
+	compactTags
+)
+
+var ErrInvalidCompactLevel = errors.New("level: invalid compact encoding")
+
+func (level *DatastoreLevel) MarshalCompact() []byte {
+	var fields uint64
+	body := &compactWriter{}
+
+	if level.HasKey {
+		fields |= compactKey
+		body.writeString(level.Key)
+	}
+	if level.HasParent {
+		fields |= compactParent
+		body.writeString(level.Parent)
+	}
+	if level.HasName {
+		fields |= compactName
+		body.writeString(level.Name)
+	}
+	if level.HasRows {
+		fields |= compactRows
+		body.writeVarint(int64(level.Rows))
+	}
+	if level.HasColumns {
+		fields |= compactColumns
+		body.writeVarint(int64(level.Columns))
+	}
+	if level.HasHealth {
+		fields |= compactHealth
+		body.writeVarint(int64(level.Health))
+	}
+	if level.HasDuration {
+		fields |= compactDuration
+		body.writeVarint(int64(level.Duration))
+	}
+	if level.HasComboTimer {
+		fields |= compactComboTimer
+		body.writeFloat32(level.ComboTimer)
+	}
+	if level.HasUnitDelayMultiplier {
+		fields |= compactUnitDelayMultiplier
+		body.writeFloat32(level.UnitDelayMultiplier)
+	}
+	if level.HasMaxActiveUnits {
+		fields |= compactMaxActiveUnits
+		body.writeVarint(int64(level.MaxActiveUnits))
+	}
+	if level.HasSpawnsPerSecond {
+		fields |= compactSpawnsPerSecond
+		body.writeFloat32(level.SpawnsPerSecond)
+	}
+	if level.HasSpawnFrequency {
+		fields |= compactSpawnFrequency
+		body.writeUvarint(uint64(len(level.SpawnFrequency)))
+		for _, element := range level.SpawnFrequency {
+			body.writeString(element.UnitType)
+			body.writeFloat32(element.SpawnFrequency)
+		}
+	}
+	if level.HasTags {
+		fields |= compactTags
+		body.writeUvarint(uint64(len(level.Tags)))
+		for _, tag := range level.Tags {
+			body.writeString(tag)
+		}
+	}
+
+	result := &compactWriter{}
+	result.buffer.WriteByte(compactVersion)
+	result.writeUvarint(fields)
+	result.buffer.Write(body.buffer.Bytes())
+	return result.buffer.Bytes()
+}
+
+func (level *DatastoreLevel) UnmarshalCompact(data []byte) error {
+	if len(data) == 0 || data[0] != compactVersion {
+		return ErrInvalidCompactLevel
+	}
+
+	reader := &compactReader{data: data[1:]}
+	fields := reader.readUvarint()
+	result := DatastoreLevel{}
+
+	if fields&compactKey != 0 {
+		result.HasKey = true
+		result.Key = reader.readString()
+	}
+	if fields&compactParent != 0 {
+		result.HasParent = true
+		result.Parent = reader.readString()
+	}
+	if fields&compactName != 0 {
+		result.HasName = true
+		result.Name = reader.readString()
+	}
+	if fields&compactRows != 0 {
+		result.HasRows = true
+		result.Rows = int32(reader.readVarint())
+	}
+	if fields&compactColumns != 0 {
+		result.HasColumns = true
+		result.Columns = int32(reader.readVarint())
+	}
+	if fields&compactHealth != 0 {
+		result.HasHealth = true
+		result.Health = int32(reader.readVarint())
+	}
+	if fields&compactDuration != 0 {
+		result.HasDuration = true
+		result.Duration = int32(reader.readVarint())
+	}
+	if fields&compactComboTimer != 0 {
+		result.HasComboTimer = true
+		result.ComboTimer = reader.readFloat32()
+	}
+	if fields&compactUnitDelayMultiplier != 0 {
+		result.HasUnitDelayMultiplier = true
+		result.UnitDelayMultiplier = reader.readFloat32()
+	}
+	if fields&compactMaxActiveUnits != 0 {
+		result.HasMaxActiveUnits = true
+		result.MaxActiveUnits = int32(reader.readVarint())
+	}
+	if fields&compactSpawnsPerSecond != 0 {
+		result.HasSpawnsPerSecond = true
+		result.SpawnsPerSecond = reader.readFloat32()
+	}
+	if fields&compactSpawnFrequency != 0 {
+		result.HasSpawnFrequency = true
+		count := reader.readUvarint()
+		for i := uint64(0); i < count && reader.err == nil; i++ {
+			element := datastoreSpawnFrequency{}
+			element.UnitType = reader.readString()
+			element.SpawnFrequency = reader.readFloat32()
+			result.SpawnFrequency = append(result.SpawnFrequency, element)
+		}
+	}
+	if fields&compactTags != 0 {
+		result.HasTags = true
+		count := reader.readUvarint()
+		for i := uint64(0); i < count && reader.err == nil; i++ {
+			result.Tags = append(result.Tags, reader.readString())
+		}
+	}
+
+	if reader.err != nil || len(reader.data) > 0 {
+		return ErrInvalidCompactLevel
+	}
+
+	*level = result
+	return nil
+}
+
+// --- Helpers
+
+type compactWriter struct {
+	buffer  bytes.Buffer
+	scratch [binary.MaxVarintLen64]byte
+}
+
+func (writer *compactWriter) writeUvarint(value uint64) {
+	size := binary.PutUvarint(writer.scratch[:], value)
+	writer.buffer.Write(writer.scratch[:size])
+}
+
+func (writer *compactWriter) writeVarint(value int64) {
+	size := binary.PutVarint(writer.scratch[:], value)
+	writer.buffer.Write(writer.scratch[:size])
+}
+
+func (writer *compactWriter) writeString(value string) {
+	writer.writeUvarint(uint64(len(value)))
+	writer.buffer.WriteString(value)
+}
+
+func (writer *compactWriter) writeFloat32(value float32) {
+	binary.LittleEndian.PutUint32(writer.scratch[:4], math.Float32bits(value))
+	writer.buffer.Write(writer.scratch[:4])
+}
+
+// compactReader reads values until the first error, after which every read
+// returns a zero value.  Check err once at the end.
+type compactReader struct {
+	data []byte
+	err  error
+}
+
+func (reader *compactReader) readUvarint() uint64 {
+	if reader.err != nil {
+		return 0
+	}
+
+	value, size := binary.Uvarint(reader.data)
+	if size <= 0 {
+		reader.err = ErrInvalidCompactLevel
+		return 0
+	}
+
+	reader.data = reader.data[size:]
+	return value
+}
+
+func (reader *compactReader) readVarint() int64 {
+	if reader.err != nil {
+		return 0
+	}
+
+	value, size := binary.Varint(reader.data)
+	if size <= 0 {
+		reader.err = ErrInvalidCompactLevel
+		return 0
+	}
+
+	reader.data = reader.data[size:]
+	return value
+}
+
+func (reader *compactReader) readString() string {
+	length := reader.readUvarint()
+	if reader.err != nil || uint64(len(reader.data)) < length {
+		reader.err = ErrInvalidCompactLevel
+		return ""
+	}
+
+	value := string(reader.data[:length])
+	reader.data = reader.data[length:]
+	return value
+}
+
+func (reader *compactReader) readFloat32() float32 {
+	if reader.err != nil || len(reader.data) < 4 {
+		reader.err = ErrInvalidCompactLevel
+		return 0
+	}
+
+	value := math.Float32frombits(binary.LittleEndian.Uint32(reader.data))
+	reader.data = reader.data[4:]
+	return value
+}
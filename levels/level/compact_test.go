@@ -0,0 +1,116 @@
+package level
+
+import (
+	"encoding/json"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestCompactRoundTripFullLevel(t *testing.T) {
+	dsLevel := buildFullLevel()
+
+	var result DatastoreLevel
+	err := result.UnmarshalCompact(dsLevel.MarshalCompact())
+	assert.Nil(t, err)
+	assert.Equal(t, *dsLevel, result)
+}
+
+func TestCompactRoundTripSparseLevel(t *testing.T) {
+	dsLevel := &DatastoreLevel{
+		Key:       "sparse",
+		HasKey:    true,
+		Health:    -4,
+		HasHealth: true,
+		HasName:   true,
+	}
+
+	result := DatastoreLevel{Name: "stale", HasRows: true}
+	err := result.UnmarshalCompact(dsLevel.MarshalCompact())
+	assert.Nil(t, err)
+	assert.Equal(t, *dsLevel, result)
+}
+
+func TestCompactSmallerThanJson(t *testing.T) {
+	dsLevel := buildFullLevel()
+
+	compact := dsLevel.MarshalCompact()
+	encoded, err := json.Marshal(dsLevel)
+	assert.Nil(t, err)
+	t.Logf("compact: %d bytes, json: %d bytes", len(compact), len(encoded))
+	assert.True(t, len(compact)*2 < len(encoded))
+}
+
+func TestCompactRejectsBadData(t *testing.T) {
+	// JSON written by the old cache format
+	encoded, err := json.Marshal(buildFullLevel())
+	assert.Nil(t, err)
+
+	compact := buildFullLevel().MarshalCompact()
+	for _, data := range [][]byte{nil, encoded, compact[:len(compact)-1], append(compact, 0)} {
+		result := DatastoreLevel{}
+		err := result.UnmarshalCompact(data)
+		assert.Equal(t, ErrInvalidCompactLevel, err)
+		assert.Equal(t, DatastoreLevel{}, result)
+	}
+}
+
+func BenchmarkMarshalCompact(b *testing.B) {
+	dsLevel := buildFullLevel()
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		dsLevel.MarshalCompact()
+	}
+}
+
+func BenchmarkUnmarshalCompact(b *testing.B) {
+	data := buildFullLevel().MarshalCompact()
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		var result DatastoreLevel
+		result.UnmarshalCompact(data)
+	}
+}
+
+func BenchmarkMarshalJson(b *testing.B) {
+	dsLevel := buildFullLevel()
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		json.Marshal(dsLevel)
+	}
+}
+
+func BenchmarkUnmarshalJson(b *testing.B) {
+	data, _ := json.Marshal(buildFullLevel())
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		var result DatastoreLevel
+		json.Unmarshal(data, &result)
+	}
+}
+
+// --- Helpers
+
+func buildFullLevel() *DatastoreLevel {
+	return &DatastoreLevel{
+		Key: "level-one", HasKey: true,
+		Parent: "base", HasParent: true,
+		Name: "Level One", HasName: true,
+		Rows: 5, HasRows: true,
+		Columns: 9, HasColumns: true,
+		Health: 20, HasHealth: true,
+		Duration: 180, HasDuration: true,
+		ComboTimer: 2.5, HasComboTimer: true,
+		UnitDelayMultiplier: 0.75, HasUnitDelayMultiplier: true,
+		MaxActiveUnits: 12, HasMaxActiveUnits: true,
+		SpawnsPerSecond: 1.25, HasSpawnsPerSecond: true,
+		SpawnFrequency: []datastoreSpawnFrequency{
+			{UnitType: "grunt", SpawnFrequency: 0.6},
+			{UnitType: "archer", SpawnFrequency: 0.3},
+			{UnitType: "giant", SpawnFrequency: 0.1},
+		},
+		HasSpawnFrequency: true,
+		Tags:              []string{"boss", "fire"},
+		HasTags:           true,
+	}
+}
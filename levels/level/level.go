@@ -1,5 +1,16 @@
 package level
 
+import (
+	"encoding/json"
+	"fmt"
+	"reflect"
+	"sort"
+	"strings"
+	"time"
+
+	"bootcamp/editorservice/config"
+)
+
 // --- JSON
 
 type JsonLevel struct {
@@ -15,6 +26,21 @@ type JsonLevel struct {
 	MaxActiveUnits      *int32              `json:"max_active_units,omitempty"`
 	SpawnsPerSecond     *float32            `json:"spawns_per_second,omitempty"`
 	SpawnFrequency      *map[string]float32 `json:"spawn_frequency,omitempty"`
+	Tags                *[]string           `json:"tags,omitempty"`
+}
+
+// FieldNames holds the JSON name of every level field.
+var FieldNames = jsonFieldNames()
+
+func jsonFieldNames() map[string]bool {
+	result := make(map[string]bool)
+	levelType := reflect.TypeOf(JsonLevel{})
+	for i := 0; i < levelType.NumField(); i++ {
+		name := strings.Split(levelType.Field(i).Tag.Get("json"), ",")[0]
+		result[name] = true
+	}
+
+	return result
 }
 
 // --- Datastore
@@ -60,9 +86,43 @@ type DatastoreLevel struct {
 
 	SpawnFrequency    []datastoreSpawnFrequency
 	HasSpawnFrequency bool
+
+	// Tags label the level itself, so they're never inherited.  Queries match
+	// them with equality filters, which on a list property match any element.
+	Tags    []string
+	HasTags bool
+
+	// SchemaVersion is the version of this struct the entity was last written
+	// with.  Entities from before it was added load as 0.  It describes the stored
+	// entity rather than the level, so it isn't part of the JSON or the cache.
+	SchemaVersion int64
+
+	// LastEditedBy and LastEditedAt record who last wrote the level through the
+	// API, and when.  They describe the stored entity like SchemaVersion does, so
+	// they aren't part of the JSON or the cache either.  LastEditedBy is empty for
+	// anonymous writes and for levels last written before it was added.
+	LastEditedBy string
+	LastEditedAt time.Time
 }
 
+// MergeParentProperties fills in the fields this level leaves unset from its
+// resolved parent.
+//
+// Key and Parent are never merged.  They place the level in the tree rather than
+// describe it, so a level without a parent of its own must not adopt its parent's
+// parent (which would move it up a generation), and the guard below keeps it that
+// way even if fields are added here later.  Tags are kept out the same way, since
+// they label this level rather than everything below it.
 func (level *DatastoreLevel) MergeParentProperties(parentLevel *DatastoreLevel) {
+	key, hasKey := level.Key, level.HasKey
+	parent, hasParent := level.Parent, level.HasParent
+	tags, hasTags := level.Tags, level.HasTags
+	defer func() {
+		level.Key, level.HasKey = key, hasKey
+		level.Parent, level.HasParent = parent, hasParent
+		level.Tags, level.HasTags = tags, hasTags
+	}()
+
 	if !level.HasName && parentLevel.HasName {
 		level.HasName = true
 		level.Name = parentLevel.Name
@@ -117,7 +177,7 @@ func (level *DatastoreLevel) MergeParentProperties(parentLevel *DatastoreLevel)
 // --- Conversion
 
 func (level *JsonLevel) ToDatastoreLevel() *DatastoreLevel {
-	result := &DatastoreLevel{}
+	result := &DatastoreLevel{SchemaVersion: CurrentSchemaVersion}
 
 	if level.Key != nil {
 		result.Key = *level.Key
@@ -185,6 +245,11 @@ func (level *JsonLevel) ToDatastoreLevel() *DatastoreLevel {
 		result.HasSpawnFrequency = true
 	}
 
+	if level.Tags != nil {
+		result.Tags = *level.Tags
+		result.HasTags = true
+	}
+
 	return result
 }
 
@@ -254,5 +319,253 @@ func (level *DatastoreLevel) ToJsonLevel() *JsonLevel {
 		result.SpawnFrequency = &spawnFrequency
 	}
 
+	if level.HasTags == true {
+		tags := append([]string{}, level.Tags...)
+		result.Tags = &tags
+	}
+
 	return result
 }
+
+// --- Changes
+
+// ChangedFields lists the JSON names of the fields that differ between two stored
+// levels, in sorted order.  A field that's set on only one of them counts as
+// changed.  previous may be nil for a level that didn't exist before, and next
+// for one that was deleted.
+func ChangedFields(previous *DatastoreLevel, next *DatastoreLevel) []string {
+	if previous == nil {
+		previous = &DatastoreLevel{}
+	}
+	if next == nil {
+		next = &DatastoreLevel{}
+	}
+
+	before := previous.fieldValues()
+	after := next.fieldValues()
+	result := []string{}
+	for name, value := range after {
+		if before[name] != value {
+			result = append(result, name)
+		}
+	}
+	for name := range before {
+		if _, ok := after[name]; !ok {
+			result = append(result, name)
+		}
+	}
+
+	sort.Strings(result)
+	return result
+}
+
+// UnsetFields lists the JSON names of the fields that are set on previous but
+// not on next, in sorted order.
+func UnsetFields(previous *DatastoreLevel, next *DatastoreLevel) []string {
+	after := next.fieldValues()
+	result := []string{}
+	for name := range previous.fieldValues() {
+		if _, ok := after[name]; !ok {
+			result = append(result, name)
+		}
+	}
+
+	sort.Strings(result)
+	return result
+}
+
+// Provenance maps each field of the resolved level to the key of the level that
+// supplies it.  chain holds the stored level followed by its ancestors, nearest
+// first.  Key and Parent aren't level content, so they're left out.
+func Provenance(chain []*DatastoreLevel) map[string]string {
+	result := make(map[string]string)
+	for i, current := range chain {
+		for name := range current.fieldValues() {
+			_, seen := result[name]
+			if seen || name == "key" || name == "parent_key" || (i > 0 && name == "tags") {
+				continue
+			}
+			result[name] = current.Key
+		}
+	}
+
+	return result
+}
+
+// fieldValues maps the JSON name of each set field to its encoded value.
+func (level *DatastoreLevel) fieldValues() map[string]string {
+	encoded, _ := json.Marshal(level.ToJsonLevel())
+	var fields map[string]json.RawMessage
+	json.Unmarshal(encoded, &fields)
+
+	result := make(map[string]string)
+	for name, value := range fields {
+		result[name] = string(value)
+	}
+
+	return result
+}
+
+// --- Validation
+
+// Validate checks the fields supplied by a client before the level is stored.
+// The grid must have at least one row and column, whatever the configured rules
+// say, but either may be left unset to be inherited.
+func (level *JsonLevel) Validate() error {
+	if level.Rows != nil && *level.Rows <= 0 {
+		return fmt.Errorf("rows is %d but must be more than 0", *level.Rows)
+	}
+	if level.Columns != nil && *level.Columns <= 0 {
+		return fmt.Errorf("columns is %d but must be more than 0", *level.Columns)
+	}
+
+	for _, name := range sortedRuleFields() {
+		rule := config.ValidationRules[name]
+		value, ok := level.numericField(name)
+		if !ok {
+			continue
+		}
+
+		if rule.Min != nil && value < *rule.Min {
+			return fmt.Errorf("%s is %v but must be at least %v", name, value, *rule.Min)
+		}
+		if rule.Max != nil && value > *rule.Max {
+			return fmt.Errorf("%s is %v but must be at most %v", name, value, *rule.Max)
+		}
+	}
+
+	if level.SpawnFrequency != nil {
+		err := validateSpawnFrequencySize(len(*level.SpawnFrequency))
+		if err != nil {
+			return err
+		}
+
+		// Unit types are checked in order, so the same one is named every time
+		var unitTypes []string
+		for unitType := range *level.SpawnFrequency {
+			unitTypes = append(unitTypes, unitType)
+		}
+		sort.Strings(unitTypes)
+		for _, unitType := range unitTypes {
+			if frequency := (*level.SpawnFrequency)[unitType]; frequency < 0 {
+				return fmt.Errorf("spawn_frequency of %s is %v but must be at least 0", unitType, frequency)
+			}
+		}
+	}
+
+	if level.Tags != nil {
+		for _, tag := range *level.Tags {
+			if len(tag) == 0 {
+				return fmt.Errorf("tags must not be empty")
+			}
+		}
+	}
+
+	return nil
+}
+
+// ValidateResolved checks the constraints that apply once parent properties
+// have been merged in.
+func (level *DatastoreLevel) ValidateResolved() error {
+	return level.ToJsonLevel().Validate()
+}
+
+func validateSpawnFrequencySize(size int) error {
+	maxEntries := config.MaxSpawnFrequencyEntries
+	if rule, ok := config.ValidationRules["spawn_frequency"]; ok && rule.MaxEntries != nil {
+		maxEntries = *rule.MaxEntries
+	}
+
+	if size > maxEntries {
+		return fmt.Errorf("spawn_frequency has %d entries but at most %d are allowed", size, maxEntries)
+	}
+
+	return nil
+}
+
+// numericField looks up a numeric field by its JSON name, reporting whether it's
+// both numeric and set.
+func (level *JsonLevel) numericField(name string) (float64, bool) {
+	var intValue *int32
+	var floatValue *float32
+	switch name {
+	case "rows":
+		intValue = level.Rows
+	case "columns":
+		intValue = level.Columns
+	case "health_bar":
+		intValue = level.Health
+	case "duration":
+		intValue = level.Duration
+	case "max_active_units":
+		intValue = level.MaxActiveUnits
+	case "combo_timer":
+		floatValue = level.ComboTimer
+	case "unit_delay_multiplier":
+		floatValue = level.UnitDelayMultiplier
+	case "spawns_per_second":
+		floatValue = level.SpawnsPerSecond
+	}
+
+	if intValue != nil {
+		return float64(*intValue), true
+	} else if floatValue != nil {
+		return float64(*floatValue), true
+	}
+
+	return 0, false
+}
+
+// sortedRuleFields orders the configured rules so that errors are reported
+// consistently.
+func sortedRuleFields() []string {
+	var names []string
+	for name := range config.ValidationRules {
+		names = append(names, name)
+	}
+
+	sort.Strings(names)
+	return names
+}
+
+// --- Schema versions
+
+// CurrentSchemaVersion is the version levels are written with.  Add a migration
+// below and bump it whenever stored levels need upgrading.
+const CurrentSchemaVersion int64 = 1
+
+// migrations[n] upgrades a level from schema version n to n+1.
+var migrations = []func(level *DatastoreLevel){
+	// 0 -> 1: HasParent is derived from Parent, and older levels didn't set it
+	func(level *DatastoreLevel) { level.RefreshIndexFields() },
+}
+
+// Migrate upgrades a level loaded from an older schema version to the current
+// one, and reports whether it was older.
+func (level *DatastoreLevel) Migrate() bool {
+	if level.SchemaVersion >= CurrentSchemaVersion {
+		return false
+	}
+
+	for version := level.SchemaVersion; version < CurrentSchemaVersion; version++ {
+		migrations[version](level)
+	}
+	level.SchemaVersion = CurrentSchemaVersion
+	return true
+}
+
+// --- Index fields
+
+// RefreshIndexFields recomputes the stored fields that queries filter on from the
+// level's other fields, and reports whether any of them changed.
+func (level *DatastoreLevel) RefreshIndexFields() bool {
+	changed := false
+
+	hasParent := len(level.Parent) > 0
+	if level.HasParent != hasParent {
+		level.HasParent = hasParent
+		changed = true
+	}
+
+	return changed
+}
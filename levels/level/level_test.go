@@ -0,0 +1,160 @@
+package level
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+
+	"bootcamp/editorservice/config"
+)
+
+func TestChangedFieldsWithSingleFieldUpdate(t *testing.T) {
+	previous := buildFullLevel()
+	next := buildFullLevel()
+	next.Duration = 240
+
+	assert.Equal(t, []string{"duration"}, ChangedFields(previous, next))
+}
+
+func TestChangedFieldsWithNoOpWrite(t *testing.T) {
+	previous := buildFullLevel()
+	next := buildFullLevel()
+
+	// Spawn frequencies are compared as maps, so their stored order doesn't matter
+	next.SpawnFrequency[0], next.SpawnFrequency[1] = next.SpawnFrequency[1], next.SpawnFrequency[0]
+
+	assert.Equal(t, []string{}, ChangedFields(previous, next))
+}
+
+func TestChangedFieldsWithSetAndUnsetFields(t *testing.T) {
+	previous := &DatastoreLevel{Key: "level", HasKey: true, Rows: 5, HasRows: true}
+	next := &DatastoreLevel{Key: "level", HasKey: true, Columns: 5, HasColumns: true}
+
+	assert.Equal(t, []string{"columns", "rows"}, ChangedFields(previous, next))
+}
+
+func TestChangedFieldsWithNewLevel(t *testing.T) {
+	next := &DatastoreLevel{Key: "level", HasKey: true, Name: "new", HasName: true}
+
+	assert.Equal(t, []string{"key", "name"}, ChangedFields(nil, next))
+}
+
+func TestChangedFieldsWithDeletedLevel(t *testing.T) {
+	previous := &DatastoreLevel{Key: "level", HasKey: true, Name: "old", HasName: true}
+
+	assert.Equal(t, []string{"key", "name"}, ChangedFields(previous, nil))
+}
+
+func TestMergeParentPropertiesNeverMergesParent(t *testing.T) {
+	grandparent := &DatastoreLevel{Key: "grandparent", HasKey: true, Rows: 3, HasRows: true}
+	parent := &DatastoreLevel{Key: "parent", HasKey: true, Parent: "grandparent", HasParent: true}
+	parent.MergeParentProperties(grandparent)
+
+	// The child keeps its own parent, not the grandparent...
+	child := &DatastoreLevel{Key: "child", HasKey: true, Parent: "parent", HasParent: true}
+	child.MergeParentProperties(parent)
+	assert.Equal(t, "child", child.Key)
+	assert.Equal(t, "parent", child.Parent)
+	assert.True(t, child.HasParent)
+	assert.EqualValues(t, 3, child.Rows)
+
+	// ...and a level without a parent of its own doesn't pick one up
+	orphan := &DatastoreLevel{Key: "orphan", HasKey: true}
+	orphan.MergeParentProperties(parent)
+	assert.Equal(t, "orphan", orphan.Key)
+	assert.False(t, orphan.HasParent)
+	assert.Equal(t, "", orphan.Parent)
+}
+
+func TestValidateAppliesConfiguredBounds(t *testing.T) {
+	defer func(rules map[string]config.FieldRule) { config.ValidationRules = rules }(config.ValidationRules)
+
+	rows := int32(10)
+	jsonLevel := &JsonLevel{Rows: &rows}
+	config.ValidationRules = map[string]config.FieldRule{}
+	assert.Nil(t, jsonLevel.Validate())
+
+	// A stricter bound rejects the same level
+	maxRows := 8.0
+	config.ValidationRules = map[string]config.FieldRule{"rows": {Max: &maxRows}}
+	assert.NotNil(t, jsonLevel.Validate())
+
+	// Resolved levels are held to the same rules
+	dsLevel := &DatastoreLevel{Rows: 10, HasRows: true}
+	assert.NotNil(t, dsLevel.ValidateResolved())
+}
+
+func TestValidateRequiresAPositiveGrid(t *testing.T) {
+	defer func(rules map[string]config.FieldRule) { config.ValidationRules = rules }(config.ValidationRules)
+	config.ValidationRules = map[string]config.FieldRule{}
+
+	zero, one, negative := int32(0), int32(1), int32(-1)
+	assert.Nil(t, (&JsonLevel{}).Validate())
+	assert.Nil(t, (&JsonLevel{Rows: &one, Columns: &one}).Validate())
+	assert.Nil(t, (&JsonLevel{Rows: &one}).Validate())
+
+	assert.NotNil(t, (&JsonLevel{Rows: &zero}).Validate())
+	assert.NotNil(t, (&JsonLevel{Rows: &negative}).Validate())
+	assert.NotNil(t, (&JsonLevel{Columns: &zero}).Validate())
+	assert.NotNil(t, (&JsonLevel{Rows: &one, Columns: &negative}).Validate())
+}
+
+func TestValidateAppliesConfiguredSpawnFrequencyCap(t *testing.T) {
+	defer func(rules map[string]config.FieldRule) { config.ValidationRules = rules }(config.ValidationRules)
+
+	spawnFrequency := map[string]float32{"grunt": 0.5, "archer": 0.3, "giant": 0.2}
+	jsonLevel := &JsonLevel{SpawnFrequency: &spawnFrequency}
+	config.ValidationRules = map[string]config.FieldRule{}
+	assert.Nil(t, jsonLevel.Validate())
+
+	maxEntries := 2
+	config.ValidationRules = map[string]config.FieldRule{"spawn_frequency": {MaxEntries: &maxEntries}}
+	assert.NotNil(t, jsonLevel.Validate())
+}
+
+func TestValidateRejectsNegativeSpawnFrequencies(t *testing.T) {
+	defer func(rules map[string]config.FieldRule) { config.ValidationRules = rules }(config.ValidationRules)
+	config.ValidationRules = map[string]config.FieldRule{}
+
+	empty := map[string]float32{}
+	assert.Nil(t, (&JsonLevel{SpawnFrequency: &empty}).Validate())
+
+	valid := map[string]float32{"grunt": 0.5, "archer": 0, "giant": 2}
+	assert.Nil(t, (&JsonLevel{SpawnFrequency: &valid}).Validate())
+
+	// The error names the unit type
+	negative := map[string]float32{"grunt": 0.5, "archer": -0.1, "giant": 2}
+	err := (&JsonLevel{SpawnFrequency: &negative}).Validate()
+	assert.NotNil(t, err)
+	assert.Contains(t, err.Error(), "archer")
+}
+
+func TestProvenanceNamesTheNearestSource(t *testing.T) {
+	grandparent := &DatastoreLevel{Key: "grandparent", HasKey: true, Rows: 3, HasRows: true, Tags: []string{"boss"}, HasTags: true}
+	parent := &DatastoreLevel{Key: "parent", HasKey: true, Parent: "grandparent", HasParent: true, Rows: 4, HasRows: true}
+	child := &DatastoreLevel{Key: "child", HasKey: true, Parent: "parent", HasParent: true, Name: "child", HasName: true}
+
+	// Tags aren't inherited, so the grandparent's don't show up
+	assert.Equal(t, map[string]string{"name": "child", "rows": "parent"}, Provenance([]*DatastoreLevel{child, parent, grandparent}))
+}
+
+func TestMigrateUpgradesOlderLevels(t *testing.T) {
+	legacy := &DatastoreLevel{Key: "legacy", HasKey: true, Parent: "parent"}
+
+	assert.True(t, legacy.Migrate())
+	assert.True(t, legacy.HasParent)
+	assert.Equal(t, CurrentSchemaVersion, legacy.SchemaVersion)
+
+	// Levels already at the current version are left alone
+	assert.False(t, legacy.Migrate())
+	assert.Equal(t, CurrentSchemaVersion, (&JsonLevel{}).ToDatastoreLevel().SchemaVersion)
+	assert.Len(t, migrations, int(CurrentSchemaVersion))
+}
+
+func TestFieldNamesMatchTheJson(t *testing.T) {
+	assert.True(t, FieldNames["key"])
+	assert.True(t, FieldNames["health_bar"])
+	assert.True(t, FieldNames["spawn_frequency"])
+	assert.False(t, FieldNames["Health"])
+	assert.Len(t, FieldNames, len(buildFullLevel().fieldValues()))
+}
@@ -3,21 +3,39 @@ package levels
 
 import (
 	"encoding/json"
+	"errors"
+	"fmt"
 	"net/http"
+	"strings"
+	"time"
 
 	"appengine"
 	"appengine/datastore"
 
 	"github.com/gin-gonic/gin"
 
+	"bootcamp/editorservice/apierror"
+	"bootcamp/editorservice/auth"
 	"bootcamp/editorservice/cache"
+	"bootcamp/editorservice/config"
+	"bootcamp/editorservice/deleted"
+	"bootcamp/editorservice/etag"
+	"bootcamp/editorservice/flags"
+	"bootcamp/editorservice/ids"
 	"bootcamp/editorservice/levels/level"
+	"bootcamp/editorservice/mismatch"
+	"bootcamp/editorservice/requestid"
 )
 
 // --- Types and constants
 
 const kind string = "Level"
 const queryAllKey string = "query:all@levels"
+const queryAllWarningsKey string = "query:all-warnings@levels"
+
+// eventualQueryCacheExpiration bounds how long an eventually consistent query
+// result is cached, since writes don't reliably show up in it straight away.
+const eventualQueryCacheExpiration = 10 * time.Second
 
 // All levels share a single entity root.  This is important because this provides
 // strong consistency for levels.
@@ -25,27 +43,30 @@ const levelRootKeyName string = "LevelRoot"
 
 var levelRootKey *datastore.Key
 
-// -- Response cache
-
-type responseCacheEntry struct {
-	Path     string
-	Code     int
-	Response interface{}
-}
+var (
+	ErrParentCycle = errors.New("levels: the level's parents form a cycle")
 
-func (entry *responseCacheEntry) GetCacheKey() string {
-	return "response:" + entry.Path
-}
+	errCacheSkipped = errors.New("levels: the cache was skipped")
+)
 
-func (entry *responseCacheEntry) MarshalBinary() ([]byte, error) {
-	return json.Marshal(entry)
+// queryResponse is the body of a level query asked for with ?warnings=true.
+// Levels that couldn't be resolved are left out of Levels and listed in Warnings
+// instead.  Without it, queries respond with just the array of levels.
+type queryResponse struct {
+	Levels   interface{}    `json:"levels"`
+	Warnings []queryWarning `json:"warnings"`
 }
 
-func (entry *responseCacheEntry) UnmarshalBinary(data []byte) error {
-	return json.Unmarshal(data, entry)
+type queryWarning struct {
+	Key     string        `json:"key"`
+	Code    apierror.Code `json:"code"`
+	Message string        `json:"message"`
 }
 
 // --- Level cache
+// Resolved levels are cached in the compact binary form rather than JSON, since
+// they're read on nearly every request.  Entries written in any other format fail
+// to unmarshal and are treated as misses.
 
 type levelCacheEntry level.DatastoreLevel
 
@@ -54,92 +75,313 @@ func (entry *levelCacheEntry) GetCacheKey() string {
 }
 
 func (entry *levelCacheEntry) MarshalBinary() ([]byte, error) {
-	return json.Marshal(entry)
+	return (*level.DatastoreLevel)(entry).MarshalCompact(), nil
 }
 
 func (entry *levelCacheEntry) UnmarshalBinary(data []byte) error {
-	return json.Unmarshal(data, entry)
+	return (*level.DatastoreLevel)(entry).UnmarshalCompact(data)
+}
+
+// DecodeCacheEntry decodes a raw cache value for inspection.  Level cache
+// entries come back as JSON levels, and anything else is decoded as JSON.
+func DecodeCacheEntry(cacheKey string, data []byte) (interface{}, error) {
+	if strings.HasPrefix(cacheKey, "level:") {
+		entry := &levelCacheEntry{}
+		err := entry.UnmarshalBinary(data)
+		if err != nil {
+			return nil, err
+		}
+		return (*level.DatastoreLevel)(entry).ToJsonLevel(), nil
+	}
+
+	var result interface{}
+	err := json.Unmarshal(data, &result)
+	return result, err
 }
 
 // --- Route handlers
 
+// Collection-wide routes share the /levels/:id pattern with single levels, so
+// their names can't be used as level ids.  They're filled in by init because
+// some of the handlers check for reserved ids themselves.
+var collectionGetRoutes map[string]gin.HandlerFunc
+var collectionPostRoutes map[string]gin.HandlerFunc
+
+func init() {
+	collectionGetRoutes = map[string]gin.HandlerFunc{
+		"tree":    limitHeavy(handleTree),
+		"delta":   handleDelta,
+		"stats":   limitHeavy(handleStats),
+		"version": handleCollectionVersion,
+	}
+
+	collectionPostRoutes = map[string]gin.HandlerFunc{
+		"batch-get":    handleBatchGet,
+		"batch-put":    handleBatchPut,
+		"batch-delete": handleBatchDelete,
+		"tags":         handleTags,
+	}
+}
+
 // Init sets up routes for this resource
 func Init(router *gin.Engine) {
 	router.GET("/levels/:id", handleGet)
 	router.POST("/levels/:id", handlePost)
 	router.PUT("/levels/:id", handlePut)
+	router.PATCH("/levels/:id", handlePatch)
 	router.DELETE("/levels/:id", handleDelete)
+	router.POST("/levels/:id/reparent", handleReparent)
+	router.GET("/levels/:id/can-reparent", handleCanReparent)
+	router.GET("/levels/:id/rename-impact", handleRenameImpact)
+	router.GET("/levels/:id/descendant-count", handleDescendantCount)
+	router.GET("/levels/:id/overrides", handleOverrides)
+	router.GET("/levels/:id/inheritance-delta", handleInheritanceDelta)
+	router.GET("/levels/:id/field/:name", handleField)
+	router.GET("/levels/:id/delete-preview", handleDeletePreview)
+	router.GET("/levels/:id/spawns", handleSpawns)
+	router.GET("/levels/:id/lock", handleGetLock)
+	router.POST("/levels/:id/lock", handleLock)
+	router.DELETE("/levels/:id/lock", handleUnlock)
 	router.GET("/levels", handleQuery)
+	router.GET("/export", limitHeavy(handleExport))
+	router.POST("/import/validate", handleImportValidate)
+	router.POST("/diff-bundle", handleDiffBundle)
+	router.GET("/schema/version", handleSchemaVersion)
+	router.POST("/admin/levels/reindex", auth.RequireAdmin(), handleReindex)
+	router.POST("/admin/levels/prune-tombstones", auth.RequireAdmin(), handlePruneTombstones)
+	router.GET("/admin/levels/duplicates", auth.RequireAdmin(), handleDuplicates)
+	router.GET("/admin/levels/raw/:id", auth.RequireAdmin(), handleRaw)
+	router.GET("/admin/levels/warm-pinned", auth.RequireAdminOrCron(), handleWarmPinned)
+	router.POST(recomputeDescendantsPath, auth.RequireAdminOrTask(), limitHeavy(handleRecomputeDescendants))
+	router.POST(warmLevelPath, auth.RequireAdminOrTask(), handleWarmLevel)
+	router.POST(migrateLevelsPath, auth.RequireAdminOrTask(), handleMigrateLevels)
+	router.POST("/admin/cache/verify", auth.RequireAdmin(), handleVerifyCache)
+	router.POST("/admin/cache/purge-orphans", auth.RequireAdmin(), handlePurgeOrphanedCache)
 }
 
 func handleGet(context *gin.Context) {
+	if handler, ok := collectionGetRoutes[context.Param("id")]; ok {
+		handler(context)
+		return
+	}
+
 	path := context.Request.URL.Path
 	levelId := context.Param("id")
-	appengineContext := appengine.NewContext(context.Request)
+	appengineContext := requestid.NewContext(context.Request)
+
+	// Responses with defaults applied aren't cached, since they share a path with the plain response
+	applyDefaults := context.Query("applyDefaults") == "true"
+
+	// Cache-Control: no-cache skips the caches, but still refreshes them
+	fresh := cache.WantsFreshData(context.Request)
+
+	// ?withChain=true adds the keys of the level's ancestors.  Those responses
+	// aren't cached either, but the levels they're built from are.
+	withChain := context.Query("withChain") == "true"
+
+	// A sparse fieldset is cut from the full response, so it shares its cache entry
+	fields, err := parseFields(context)
+	if err != nil {
+		apierror.Respond(context, http.StatusBadRequest, apierror.InvalidRequest, "Could not select the fields: %+v", err)
+		return
+	}
+
+	// ?resolveDepth=N merges only the nearest N ancestors, for debugging
+	if _, ok := context.Request.URL.Query()["resolveDepth"]; ok {
+		respondPartiallyResolved(context, appengineContext, levelId, fields)
+		return
+	}
 
 	// Check response cache
-	cachedResponse := &responseCacheEntry{Path: path}
-	err := cache.GetCachedResource(appengineContext, cachedResponse)
-	if err == nil {
-		context.JSON(cachedResponse.Code, cachedResponse.Response)
+	if !applyDefaults && !fresh && !withChain {
+		cachedResponse := &cache.ResponseEntry{Path: path}
+		err := cache.GetCachedResource(appengineContext, cachedResponse)
+		if err == nil {
+			if cachedResponse.Code == http.StatusOK {
+				cachedResponse.Response = selectFields(cachedResponse.Response, fields)
+			}
+			context.JSON(cachedResponse.Code, cachedResponse.Response)
+			return
+		}
+	}
+
+	// With warm_on_miss, a miss may be answered before the level is resolved
+	if !applyDefaults && !fresh && !withChain && respondBeforeWarming(context, appengineContext, levelId, fields) {
 		return
 	}
 
 	// Fetch from level cache or datastore
-	result, err := getLevel(levelId, appengineContext)
-	if err == datastore.ErrNoSuchEntity {
-		cacheEntry := responseCacheEntry{
+	var result *levelCacheEntry
+	if fresh {
+		result, err = getFreshLevel(levelId, appengineContext)
+	} else {
+		result, err = getLevel(levelId, appengineContext)
+	}
+	if err == datastore.ErrNoSuchEntity || err == ErrParentNotFound {
+		cacheEntry := cache.ResponseEntry{
 			Path:     path,
 			Code:     http.StatusNotFound,
-			Response: "Level does not exist",
+			Response: apierror.New(apierror.NotFound, "Level does not exist"),
+		}
+		if err == ErrParentNotFound {
+			cacheEntry.Response = apierror.New(apierror.ParentNotFound, "Could not resolve the level: %+v", err)
+		}
+		if cachesMisses(context) {
+			cache.CacheResource(appengineContext, &cacheEntry)
 		}
-		cache.CacheResource(appengineContext, &cacheEntry)
-		context.String(cacheEntry.Code, cacheEntry.Response.(string))
+		context.JSON(cacheEntry.Code, cacheEntry.Response)
+		return
+	} else if err == ErrParentCycle {
+		apierror.Respond(context, http.StatusConflict, apierror.CycleDetected, "Could not resolve the level: %+v: %s", err, describeParentCycle(appengineContext, levelId))
+		return
+	} else if err == ErrParentChainTooDeep {
+		apierror.Respond(context, http.StatusConflict, apierror.Conflict, "Could not resolve the level: %+v", err)
 		return
 	} else if err != nil {
-		context.String(http.StatusInternalServerError, "Could not retrieve the level: %+v\n", err)
+		apierror.Respond(context, http.StatusInternalServerError, apierror.Internal, "Could not retrieve the level: %+v", err)
 		return
 	}
 
 	// If we got this far, then we found the level
+	if withChain {
+		respondWithChain(context, appengineContext, result, applyDefaults, fields)
+		return
+	}
+	if applyDefaults {
+		context.JSON(http.StatusOK, selectFields(applyLevelDefaults(appengineContext, (*level.DatastoreLevel)(result)).ToJsonLevel(), fields))
+		return
+	}
+
 	// Cache and return the result
-	cacheEntry := &responseCacheEntry{
+	cacheEntry := &cache.ResponseEntry{
 		Path:     path,
 		Code:     http.StatusOK,
 		Response: (*level.DatastoreLevel)(result).ToJsonLevel(),
 	}
 	cache.CacheResource(appengineContext, cacheEntry)
 
-	context.JSON(cacheEntry.Code, cacheEntry.Response)
+	context.JSON(cacheEntry.Code, selectFields(cacheEntry.Response, fields))
 }
 
 func handlePost(context *gin.Context) {
+	if handler, ok := collectionPostRoutes[context.Param("id")]; ok && context.Request.Method == "POST" {
+		handler(context)
+		return
+	}
+
 	var level level.JsonLevel
 
 	// Unmarshal to JsonLevel
-	err := context.BindJSON(&level)
+	err := bindLevel(context, &level)
 	if err != nil {
-		context.String(http.StatusBadRequest, "Failed to unmarshal the JSON: %+v\n", err)
+		apierror.Respond(context, http.StatusBadRequest, apierror.InvalidRequest, "Failed to unmarshal the JSON: %+v", err)
 		return
 	}
 
 	// The level key/id must come from the URL path
 	level.Key = new(string)
 	*level.Key = context.Param("id")
+	if isReservedId(*level.Key) {
+		apierror.Respond(context, http.StatusBadRequest, apierror.InvalidRequest, "The level id %q is reserved", *level.Key)
+		return
+	}
+	err = ids.Check(*level.Key)
+	if err != nil {
+		apierror.Respond(context, http.StatusBadRequest, apierror.InvalidRequest, "Invalid level id: %+v", err)
+		return
+	}
+
+	// Validate
+	err = level.Validate()
+	if err != nil {
+		apierror.Respond(context, http.StatusBadRequest, apierror.ValidationFailed, "Invalid level: %+v", err)
+		return
+	}
 
-	// Write to datastore
 	dsLevel := level.ToDatastoreLevel()
-	appengineContext := appengine.NewContext(context.Request)
-	_, err = datastore.Put(appengineContext, makeDatastoreKey(appengineContext, dsLevel.Key), dsLevel)
+	err = checkCanonicalIds(dsLevel.Parent)
 	if err != nil {
-		context.String(http.StatusInternalServerError, "Failed to store the level: %+v", err)
+		apierror.Respond(context, http.StatusBadRequest, apierror.InvalidRequest, "Invalid parent_key: %+v", err)
 		return
 	}
 
-	// Invalidate everything
+	appengineContext := requestid.NewContext(context.Request)
+	err = validateResolved(appengineContext, dsLevel)
+	if err != nil {
+		apierror.Respond(context, http.StatusBadRequest, apierror.ValidationFailed, "Invalid level: %+v", err)
+		return
+	}
+
+	// A missing parent is refused when parents are required, and otherwise
+	// reported back with the response
+	warnings, err := checkParentReference(appengineContext, dsLevel, nil)
+	if err != nil {
+		apierror.Respond(context, http.StatusInternalServerError, apierror.Internal, "Could not check the parent: %+v", err)
+		return
+	}
+	if len(warnings) > 0 && parentsRequired() {
+		apierror.Respond(context, http.StatusBadRequest, apierror.ParentNotFound, "%s", warnings[0].Message)
+		return
+	}
+
+	if lock := lockedByOther(appengineContext, dsLevel.Key); lock != nil {
+		respondLocked(context, lock)
+		return
+	}
+
+	// With lock_referenced_dimensions, a level territories list keeps its size
+	territories, err := lockingTerritories(appengineContext, dsLevel)
+	if err != nil {
+		apierror.Respond(context, http.StatusInternalServerError, apierror.Internal, "Could not check the territories that list the level: %+v", err)
+		return
+	}
+	if len(territories) > 0 {
+		respondDimensionsLocked(context, territories)
+		return
+	}
+
+	// Optionally look for children that would lose fields they inherit.  With
+	// enforce=true they block the write, otherwise they're reported back.
+	var dependents *dependentsReport
+	if context.Query("checkDependents") == "true" {
+		dependents, err = findDependents(appengineContext, dsLevel)
+		if err != nil {
+			apierror.Respond(context, http.StatusInternalServerError, apierror.Internal, "Could not check the dependent levels: %+v", err)
+			return
+		}
+		if len(dependents.AffectedChildren) > 0 && context.Query("enforce") == "true" {
+			context.JSON(http.StatusConflict, dependents)
+			return
+		}
+	}
+
+	// Write to datastore
+	markEdited(appengineContext, dsLevel)
+	err = putLevelAndNotify(appengineContext, dsLevel)
+	if ids.IsKeyError(err) {
+		apierror.Respond(context, http.StatusBadRequest, apierror.InvalidRequest, "Invalid level id: %+v", err)
+		return
+	} else if err != nil {
+		apierror.Respond(context, http.StatusInternalServerError, apierror.Internal, "Failed to store the level: %+v", err)
+		return
+	}
+
+	// Invalidate everything, then fill in the level itself for the next read
 	invalidateLevelCaches(appengineContext, dsLevel.Key)
 	invalidateChildLevelCaches(appengineContext, dsLevel.Key)
 	invalidateQueryCaches(appengineContext)
+	prewarmCaches(appengineContext, dsLevel.Key)
+	queueRecomputeDescendants(appengineContext, dsLevel.Key)
+
+	if dependents != nil {
+		dependents.Warnings = warnings
+		context.JSON(http.StatusOK, dependents)
+		return
+	}
+	if len(warnings) > 0 {
+		context.JSON(http.StatusOK, &referenceWarnings{Warnings: warnings})
+		return
+	}
 
 	context.JSON(http.StatusOK, nil)
 }
@@ -150,12 +392,39 @@ func handlePut(context *gin.Context) {
 
 func handleDelete(context *gin.Context) {
 	levelId := context.Param("id")
-	appengineContext := appengine.NewContext(context.Request)
+	appengineContext := requestid.NewContext(context.Request)
+	if lock := lockedByOther(appengineContext, levelId); lock != nil {
+		respondLocked(context, lock)
+		return
+	}
 
-	// Delete from datastore
-	err := datastore.Delete(appengineContext, makeDatastoreKey(appengineContext, levelId))
-	if err != nil {
-		context.String(http.StatusInternalServerError, "Failed to delete the level: %+v", err)
+	// Delete from datastore, leaving a tombstone for delta syncs.  With
+	// strict_delete, a level that doesn't exist is a 404.
+	err := datastore.RunInTransaction(appengineContext, func(transactionContext appengine.Context) error {
+		previous, err := getRawLevel(transactionContext, levelId)
+		if err == datastore.ErrNoSuchEntity && !flags.StrictDelete.Enabled {
+			previous = nil
+		} else if err != nil {
+			return err
+		}
+
+		err = datastore.Delete(transactionContext, makeDatastoreKey(transactionContext, levelId))
+		if err != nil {
+			return err
+		}
+
+		err = recordChanges(transactionContext, nil, []string{levelId})
+		if err != nil {
+			return err
+		}
+
+		return queueChangeNotification(transactionContext, levelId, level.ChangedFields(previous, nil))
+	}, nil)
+	if err == datastore.ErrNoSuchEntity {
+		apierror.Respond(context, http.StatusNotFound, apierror.NotFound, "Level does not exist")
+		return
+	} else if err != nil {
+		apierror.Respond(context, http.StatusInternalServerError, apierror.Internal, "Failed to delete the level: %+v", err)
 		return
 	}
 
@@ -164,104 +433,419 @@ func handleDelete(context *gin.Context) {
 	invalidateChildLevelCaches(appengineContext, levelId)
 	invalidateQueryCaches(appengineContext)
 
-	context.JSON(http.StatusOK, nil)
+	deleted.Respond(context)
 }
 
 func handleQuery(context *gin.Context) {
-	appengineContext := appengine.NewContext(context.Request)
+	// Filtered queries
+	if context.Query("unassigned") == "true" {
+		handleUnassignedQuery(context)
+		return
+	}
+	if _, ok := context.Request.URL.Query()["tag"]; ok {
+		handleTagQuery(context)
+		return
+	}
+	if _, ok := context.Request.URL.Query()["editedBy"]; ok {
+		handleEditedByQuery(context)
+		return
+	}
+	if _, ok := context.Request.URL.Query()["usesUnit"]; ok {
+		handleUnitQuery(context)
+		return
+	}
+	if isPagedQuery(context) {
+		handlePagedQuery(context)
+		return
+	}
 
-	// Check response cache
-	responseEntry := &responseCacheEntry{Path: queryAllKey}
-	err := cache.GetCachedResource(appengineContext, responseEntry)
-	if err == nil {
-		context.JSON(responseEntry.Code, responseEntry.Response)
+	appengineContext := requestid.NewContext(context.Request)
+
+	// Responses with defaults applied aren't cached, since they share a path with the plain response
+	applyDefaults := context.Query("applyDefaults") == "true"
+
+	// ?includeDeleted=true adds a marker for each deleted level, for mirrors to
+	// drop.  Those responses aren't cached either.
+	includeDeleted := context.Query("includeDeleted") == "true"
+	uncached := applyDefaults || includeDeleted
+
+	// Levels that can't be resolved are dropped, unless ?warnings=true asks for
+	// them to be listed alongside.  The array of levels then moves into an
+	// envelope, so it's a different response.
+	cacheKey, variant := queryAllKey, "all"
+	if wantsWarnings(context) {
+		cacheKey, variant = queryAllWarningsKey, "warnings"
+	}
+	if includeDeleted {
+		variant += "-deleted"
+	}
+
+	// The collection version tags the response.  It's read before the levels, so
+	// a write that lands in between only makes the tag older than the response.
+	version, err := getCollectionVersion(appengineContext)
+	if err != nil {
+		apierror.Respond(context, http.StatusInternalServerError, apierror.Internal, "Could not read the collection version: %+v", err)
+		return
+	}
+	tag := collectionETag(version.Version, variant)
+
+	// With strongly consistent queries, an unchanged version means an unchanged
+	// response, and the levels don't need to be looked at at all
+	if !applyDefaults && !config.EventuallyConsistentQueries && etag.NotModified(context, tag) {
 		return
 	}
 
+	// Check response cache
+	if !uncached {
+		responseEntry := &cache.ResponseEntry{Path: cacheKey}
+		err := cache.GetCachedResource(appengineContext, responseEntry)
+		if err == nil {
+			if etag.NotModified(context, responseEntry.ETag) {
+				return
+			}
+			context.JSON(responseEntry.Code, responseEntry.Response)
+			return
+		}
+	}
+
 	// Query to get a list of level keys
-	query := datastore.NewQuery(kind).Ancestor(getLevelRootKey(appengineContext)).Limit(100).KeysOnly()
+	query := collectionQuery(appengineContext).Limit(100).KeysOnly()
 	keys, err := query.GetAll(appengineContext, nil)
+	if err != nil {
+		apierror.Respond(context, http.StatusInternalServerError, apierror.Internal, "Could not query the levels: %+v", err)
+		return
+	}
 
 	// Load each level by its key
 	// We have to do it this way in order to resolve the parent-child relationships.
 	var dsResults []level.DatastoreLevel
+	warnings := []queryWarning{}
 	for _, element := range keys {
 		resolvedLevel, err := getLevel(element.StringID(), appengineContext)
 		if err == nil {
 			dsResults = append(dsResults, (level.DatastoreLevel)(*resolvedLevel))
+		} else {
+			warnings = append(warnings, resolveWarning(element.StringID(), err))
 		}
 	}
 
-	var response []*level.JsonLevel
+	levels := []interface{}{}
 	for _, element := range dsResults {
-		response = append(response, (&element).ToJsonLevel())
+		if applyDefaults {
+			levels = append(levels, applyLevelDefaults(appengineContext, &element).ToJsonLevel())
+		} else {
+			levels = append(levels, (&element).ToJsonLevel())
+		}
+	}
+	if includeDeleted {
+		deleted, err := deletedLevels(appengineContext)
+		if err != nil {
+			apierror.Respond(context, http.StatusInternalServerError, apierror.Internal, "Could not query the tombstones: %+v", err)
+			return
+		}
+		for _, marker := range deleted {
+			levels = append(levels, marker)
+		}
+	}
+
+	response := queryBody(context, levels, warnings)
+
+	if uncached {
+		if !applyDefaults && etag.NotModified(context, tag) {
+			return
+		}
+		context.JSON(http.StatusOK, response)
+		return
 	}
 
 	// Cache and return the result
-	cacheEntry := &responseCacheEntry{
-		Path:     queryAllKey,
+	cacheEntry := &cache.ResponseEntry{
+		Path:     cacheKey,
 		Code:     http.StatusOK,
 		Response: response,
+		ETag:     tag,
+	}
+	if config.EventuallyConsistentQueries {
+		cache.CacheResourceFor(appengineContext, cacheEntry, eventualQueryCacheExpiration)
+	} else {
+		cache.CacheResource(appengineContext, cacheEntry)
+	}
+	if etag.NotModified(context, cacheEntry.ETag) {
+		return
 	}
-	cache.CacheResource(appengineContext, cacheEntry)
 	context.JSON(cacheEntry.Code, cacheEntry.Response)
 }
 
 // --- Helpers
 
 func getLevel(levelId string, appengineContext appengine.Context) (*levelCacheEntry, error) {
+	return resolveLevel(levelId, appengineContext, false)
+}
+
+// getFreshLevel resolves a level from the datastore without reading the level
+// cache, and replaces whatever the cache held for it and its ancestors.
+func getFreshLevel(levelId string, appengineContext appengine.Context) (*levelCacheEntry, error) {
+	return resolveLevel(levelId, appengineContext, true)
+}
+
+// resolveLevel does the work for getLevel.  It walks up the parents, loading
+// each level the cache doesn't have, until it reaches a cached ancestor or a
+// root, then merges back down and caches each level on the way.  A parent cycle
+// is reported rather than walked forever, and so is a walk that loads more than
+// maxParentDepth ancestors; a cached ancestor was bounded when it was resolved.
+func resolveLevel(levelId string, appengineContext appengine.Context, fresh bool) (*levelCacheEntry, error) {
+	// The levels loaded from the datastore, nearest first, and the leases
+	// taken on them.  The lease keeps a write that lands while we're loading
+	// from leaving our stale copy in the cache.
+	var chain []*levelCacheEntry
+	var leases []*cache.Lease
+
+	// The resolved level above the top of the chain, if it has a parent
+	var resolved *levelCacheEntry
+
+	visited := make(map[string]bool)
+	currentId := levelId
+	for {
+		if visited[currentId] {
+			return nil, ErrParentCycle
+		}
+		if len(chain) > maxParentDepth {
+			return nil, ErrParentChainTooDeep
+		}
+		visited[currentId] = true
+
+		// Check level cache
+		cached := &levelCacheEntry{Key: currentId}
+		if !fresh && cache.GetCachedResource(appengineContext, cached) == nil {
+			resolved = cached
+			break
+		}
 
-	// Check level cache
-	result := &levelCacheEntry{Key: levelId}
-	err := cache.GetCachedResource(appengineContext, result)
+		// Check datastore
+		var lease *cache.Lease
+		if !fresh {
+			lease = cache.TakeLease(appengineContext, cached)
+		}
+		current := &levelCacheEntry{}
+		err := datastore.Get(appengineContext, makeDatastoreKey(appengineContext, currentId), current)
+		err = mismatch.Ignore(appengineContext, err)
+		if err == datastore.ErrNoSuchEntity && len(chain) > 0 {
+			return nil, ErrParentNotFound
+		} else if err != nil {
+			return nil, err
+		}
+
+		// Levels written under an older schema are upgraded before anything
+		// else looks at them, and written back by a task
+		if (*level.DatastoreLevel)(current).Migrate() {
+			queueMigration(appengineContext, currentId)
+		}
+
+		chain = append(chain, current)
+		leases = append(leases, lease)
+		if !current.HasParent || len(current.Parent) == 0 {
+			break
+		}
+		currentId = current.Parent
+	}
 
-	// Check datastore if necessary
+	// Merge from the top of the chain down.  Levels that share ancestry only walk
+	// the part of the chain that isn't cached, since each level is cached fully
+	// resolved.  A fresh read replaces what's there, so it can't wait for a lease.
+	for i := len(chain) - 1; i >= 0; i-- {
+		current := chain[i]
+		if resolved != nil {
+			(*level.DatastoreLevel)(current).MergeParentProperties((*level.DatastoreLevel)(resolved))
+		}
+
+		if fresh {
+			cache.CacheResource(appengineContext, current)
+		} else {
+			cache.CacheResourceWithLease(appengineContext, leases[i], current)
+		}
+		resolved = current
+	}
+
+	return resolved, nil
+}
+
+// collectionQuery starts the query behind GET /levels.  It's an ancestor query,
+// and so strongly consistent, unless config.EventuallyConsistentQueries is set.
+func collectionQuery(appengineContext appengine.Context) *datastore.Query {
+	if config.EventuallyConsistentQueries {
+		return datastore.NewQuery(kind)
+	}
+
+	return datastore.NewQuery(kind).Ancestor(getLevelRootKey(appengineContext))
+}
+
+// prewarmCaches fills the level and response caches for a level that was just
+// written, so that the next read doesn't go to the datastore.  It's called after
+// the invalidations and fills through leases like any other read, so a write that
+// lands in the meantime still wins.  Under batched invalidations the old entries
+// are still there at this point, so nothing is filled.
+func prewarmCaches(appengineContext appengine.Context, levelId string) {
+	responseEntry := &cache.ResponseEntry{Path: buildResourcePath(levelId)}
+	lease := cache.TakeLease(appengineContext, responseEntry)
+
+	resolvedLevel, err := getLevel(levelId, appengineContext)
 	if err != nil {
-		result = &levelCacheEntry{}
-		err = datastore.Get(appengineContext, makeDatastoreKey(appengineContext, levelId), result)
+		return
+	}
+
+	responseEntry.Code = http.StatusOK
+	responseEntry.Response = (*level.DatastoreLevel)(resolvedLevel).ToJsonLevel()
+	cache.CacheResourceWithLease(appengineContext, lease, responseEntry)
+}
+
+// resolveLevels resolves each of keys like the query-all does.  The levels that
+// can't be resolved are left out, and listed as warnings instead.
+func resolveLevels(appengineContext appengine.Context, keys []*datastore.Key) ([]*level.JsonLevel, []queryWarning) {
+	levels := []*level.JsonLevel{}
+	warnings := []queryWarning{}
+	for _, key := range keys {
+		resolvedLevel, err := getLevel(key.StringID(), appengineContext)
+		if err == nil {
+			levels = append(levels, (*level.DatastoreLevel)(resolvedLevel).ToJsonLevel())
+		} else {
+			warnings = append(warnings, resolveWarning(key.StringID(), err))
+		}
+	}
+
+	return levels, warnings
+}
+
+func resolveWarning(levelId string, err error) queryWarning {
+	return queryWarning{Key: levelId, Code: errorCode(err), Message: err.Error()}
+}
+
+// wantsWarnings reports whether a level query asked with ?warnings=true to hear
+// about the levels it couldn't resolve.
+func wantsWarnings(context *gin.Context) bool {
+	return context.Query("warnings") == "true"
+}
+
+// queryBody is what a level query responds with: the bare array of levels, or
+// the levels and warnings together if the request asked for them.
+func queryBody(context *gin.Context, levels interface{}, warnings []queryWarning) interface{} {
+	if wantsWarnings(context) {
+		return &queryResponse{Levels: levels, Warnings: warnings}
+	}
+
+	return levels
+}
+
+// errorStatus picks the status and API error code for a level that couldn't be
+// resolved.
+func errorStatus(err error) (int, apierror.Code) {
+	switch err {
+	case datastore.ErrNoSuchEntity:
+		return http.StatusNotFound, apierror.NotFound
+	case ErrParentNotFound:
+		return http.StatusNotFound, apierror.ParentNotFound
+	case ErrParentCycle:
+		return http.StatusConflict, apierror.CycleDetected
+	case ErrParentChainTooDeep:
+		return http.StatusConflict, apierror.Conflict
+	}
+
+	return http.StatusInternalServerError, apierror.Internal
+}
+
+// errorCode is the API error code errorStatus picks.
+func errorCode(err error) apierror.Code {
+	_, code := errorStatus(err)
+	return code
+}
+
+// cachesMisses reports whether a 404 may be cached for the request.  Clients
+// that are about to create what they looked up send ?cacheMiss=false, so that
+// nothing remembers the miss once it's been created.
+func cachesMisses(context *gin.Context) bool {
+	return context.Query("cacheMiss") != "false"
+}
+
+func isReservedId(levelId string) bool {
+	_, isGetRoute := collectionGetRoutes[levelId]
+	_, isPostRoute := collectionPostRoutes[levelId]
+	return isGetRoute || isPostRoute
+}
+
+// checkCanonicalIds returns an error for the first of levelIds that isn't in
+// canonical form while flags.NormalizeIds is on.  The middleware normalizes the
+// ids in paths, but ids given any other way are stored as they are, where a
+// variant would name a different level.  Empty ids are left to the caller.
+func checkCanonicalIds(levelIds ...string) error {
+	if !flags.NormalizeIds.Enabled {
+		return nil
+	}
+
+	for _, levelId := range levelIds {
+		if len(levelId) == 0 {
+			continue
+		}
+
+		err := ids.CheckCanonical(levelId)
 		if err != nil {
-			return nil, err
-		} else /*err == nil. level was found.*/ {
-			// Level loaded from datastore will not yet have its parent's properties applied,
-			// so we need to fetch the parent and do that.
-			if result.HasParent && len(result.Parent) > 0 {
-				parentLevel, err := getLevel(result.Parent, appengineContext)
-				if err != nil {
-					return nil, err
-				}
-
-				(*level.DatastoreLevel)(result).MergeParentProperties((*level.DatastoreLevel)(parentLevel))
-			}
+			return fmt.Errorf("the level id %q: %v", levelId, err)
+		}
+	}
+
+	return nil
+}
 
-			// Cache the finalized level object with its parent's properties applied
-			cache.CacheResource(appengineContext, result)
+// validateResolved checks a level as it would look once its parent's properties
+// are merged in.  A missing parent isn't treated as an error here.
+func validateResolved(appengineContext appengine.Context, dsLevel *level.DatastoreLevel) error {
+	resolved := *dsLevel
+	if resolved.HasParent && len(resolved.Parent) > 0 {
+		parentLevel, err := getLevel(resolved.Parent, appengineContext)
+		if err == nil {
+			resolved.MergeParentProperties((*level.DatastoreLevel)(parentLevel))
 		}
 	}
 
-	return result, nil
+	return resolved.ValidateResolved()
 }
 
 func buildResourcePath(levelId string) string {
 	return "/levels/" + levelId
 }
 
+// invalidateChildLevelCaches invalidates every level below parentId.  Cached levels
+// have their whole chain of ancestors merged in, so grandchildren (and so on) go
+// stale just like direct children do.
 func invalidateChildLevelCaches(context appengine.Context, parentId string) {
-	// Query to find children
-	query := datastore.NewQuery(kind).Ancestor(getLevelRootKey(context)).Filter("Parent =", parentId).KeysOnly()
-	keys, err := query.GetAll(context, nil)
-	if err != nil {
-		return
-	}
+	visited := map[string]bool{parentId: true}
+	pending := []string{parentId}
+	for len(pending) > 0 {
+		currentId := pending[0]
+		pending = pending[1:]
+
+		// Query to find children
+		query := datastore.NewQuery(kind).Ancestor(getLevelRootKey(context)).Filter("Parent =", currentId).KeysOnly()
+		keys, err := query.GetAll(context, nil)
+		if err != nil {
+			continue
+		}
 
-	// Invalidate each one
-	for _, element := range keys {
-		invalidateLevelCaches(context, element.StringID())
+		// Invalidate each one, then look for its own children
+		for _, element := range keys {
+			childId := element.StringID()
+			if visited[childId] {
+				continue
+			}
+			visited[childId] = true
+
+			invalidateLevelCaches(context, childId)
+			pending = append(pending, childId)
+		}
 	}
 }
 
 func invalidateLevelCaches(context appengine.Context, levelId string) {
 	// Response cache
-	responseEntry := &responseCacheEntry{Path: buildResourcePath(levelId)}
+	responseEntry := &cache.ResponseEntry{Path: buildResourcePath(levelId)}
 	cache.InvalidateCacheEntry(context, responseEntry)
 
 	// Level cache
@@ -270,9 +854,49 @@ func invalidateLevelCaches(context appengine.Context, levelId string) {
 }
 
 func invalidateQueryCaches(context appengine.Context) {
-	// Query-all cache
-	queryAllEntry := &responseCacheEntry{Path: queryAllKey}
-	cache.InvalidateCacheEntry(context, queryAllEntry)
+	for _, cacheKey := range queryCacheKeys() {
+		cache.InvalidateCacheEntryByKey(context, cacheKey)
+	}
+}
+
+// queryCacheKeys lists the cache keys of the responses built from the whole
+// collection: the query-all in each of its forms, the tree, the stats and the
+// unassigned levels.
+func queryCacheKeys() []string {
+	var result []string
+	for _, path := range []string{queryAllKey, queryAllWarningsKey, queryTreeKey, queryStatsKey, queryUnassignedKey, queryUnassignedWarningsKey} {
+		result = append(result, (&cache.ResponseEntry{Path: path}).GetCacheKey())
+	}
+
+	return result
+}
+
+// InvalidateAllCaches drops every cached level and level response: each level's
+// entries, its descendant counts at the current collection version, and the
+// queries.  Lifting cache maintenance calls it, since anything cached before the
+// migration may be stale.
+func InvalidateAllCaches(context appengine.Context) error {
+	keys, err := datastore.NewQuery(kind).Ancestor(getLevelRootKey(context)).KeysOnly().GetAll(context, nil)
+	if err != nil {
+		return err
+	}
+	version, err := getCollectionVersion(context)
+	if err != nil {
+		return err
+	}
+
+	cacheKeys := queryCacheKeys()
+	for _, key := range keys {
+		levelId := key.StringID()
+		cacheKeys = append(cacheKeys,
+			(&levelCacheEntry{Key: levelId}).GetCacheKey(),
+			(&cache.ResponseEntry{Path: buildResourcePath(levelId)}).GetCacheKey())
+		for _, recursive := range []bool{false, true} {
+			cacheKeys = append(cacheKeys, (&cache.ResponseEntry{Path: descendantCountPath(levelId, recursive, version.Version)}).GetCacheKey())
+		}
+	}
+
+	return cache.InvalidateCacheKeys(context, cacheKeys)
 }
 
 func getLevelRootKey(context appengine.Context) *datastore.Key {
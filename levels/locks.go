@@ -0,0 +1,197 @@
+package levels
+
+import (
+	"encoding/json"
+	"net/http"
+	"time"
+
+	"appengine"
+	"appengine/datastore"
+	"appengine/memcache"
+	"appengine/user"
+
+	"github.com/gin-gonic/gin"
+
+	"bootcamp/editorservice/apierror"
+	"bootcamp/editorservice/config"
+	"bootcamp/editorservice/deleted"
+	"bootcamp/editorservice/flags"
+	"bootcamp/editorservice/requestid"
+)
+
+// --- Types and constants
+
+// levelLock marks a level as being edited by one editor, identified by the
+// email they sign in with.  Locks live only in memcache and expire on their own,
+// so one left behind by a closed editor doesn't block anyone for long.
+type levelLock struct {
+	Key       string    `json:"key"`
+	Editor    string    `json:"editor"`
+	ExpiresAt time.Time `json:"expires_at"`
+}
+
+// lockedResponse is the body of a 423 for a level someone else has locked.
+type lockedResponse struct {
+	apierror.Response
+	Lock *levelLock `json:"lock"`
+}
+
+// --- Route handlers
+
+// handleGetLock shows who has a level locked, or 404s if nobody does.
+func handleGetLock(context *gin.Context) {
+	appengineContext := requestid.NewContext(context.Request)
+	lock, _, err := getLock(appengineContext, context.Param("id"))
+	if err != nil {
+		apierror.Respond(context, http.StatusInternalServerError, apierror.Internal, "Could not read the lock: %+v", err)
+		return
+	}
+	if lock == nil {
+		apierror.Respond(context, http.StatusNotFound, apierror.NotFound, "The level isn't locked")
+		return
+	}
+
+	context.JSON(http.StatusOK, lock)
+}
+
+// handleLock locks a level for the signed-in editor for config.LevelLockSeconds.
+// Locking a level again before the lock runs out extends it.
+func handleLock(context *gin.Context) {
+	levelId := context.Param("id")
+	appengineContext := requestid.NewContext(context.Request)
+	editor := user.Current(appengineContext)
+	if editor == nil {
+		apierror.Respond(context, http.StatusUnauthorized, apierror.Unauthorized, "Sign in to lock a level")
+		return
+	}
+
+	_, err := getRawLevel(appengineContext, levelId)
+	if err == datastore.ErrNoSuchEntity {
+		apierror.Respond(context, http.StatusNotFound, apierror.NotFound, "Level does not exist")
+		return
+	} else if err != nil {
+		apierror.Respond(context, http.StatusInternalServerError, apierror.Internal, "Could not retrieve the level: %+v", err)
+		return
+	}
+
+	expiration := time.Duration(config.LevelLockSeconds) * time.Second
+	lock := &levelLock{Key: levelId, Editor: editor.Email, ExpiresAt: time.Now().Add(expiration)}
+	data, err := json.Marshal(lock)
+	if err != nil {
+		apierror.Respond(context, http.StatusInternalServerError, apierror.Internal, "Could not encode the lock: %+v", err)
+		return
+	}
+
+	// Take a free lock, or else swap in for one that's ours or has run out
+	item := &memcache.Item{Key: lockCacheKey(levelId), Value: data, Expiration: expiration}
+	err = memcache.Add(appengineContext, item)
+	if err == memcache.ErrNotStored {
+		var current *levelLock
+		current, item, err = getLock(appengineContext, levelId)
+		if err == nil && current != nil && current.Editor != editor.Email {
+			respondLocked(context, current)
+			return
+		} else if err == nil && item == nil {
+			err = memcache.ErrCASConflict
+		} else if err == nil {
+			item.Value = data
+			item.Expiration = expiration
+			err = memcache.CompareAndSwap(appengineContext, item)
+		}
+	}
+	if err == memcache.ErrCASConflict || err == memcache.ErrNotStored {
+		apierror.Respond(context, http.StatusConflict, apierror.Conflict, "Someone else locked the level at the same time.  Try again.")
+		return
+	} else if err != nil {
+		apierror.Respond(context, http.StatusInternalServerError, apierror.Internal, "Could not store the lock: %+v", err)
+		return
+	}
+
+	context.JSON(http.StatusOK, lock)
+}
+
+// handleUnlock releases a level's lock.  Only the editor holding it, or an
+// administrator, may release it.
+func handleUnlock(context *gin.Context) {
+	levelId := context.Param("id")
+	appengineContext := requestid.NewContext(context.Request)
+	lock, _, err := getLock(appengineContext, levelId)
+	if err != nil {
+		apierror.Respond(context, http.StatusInternalServerError, apierror.Internal, "Could not read the lock: %+v", err)
+		return
+	}
+	if lock == nil {
+		apierror.Respond(context, http.StatusNotFound, apierror.NotFound, "The level isn't locked")
+		return
+	}
+	if !holdsLock(appengineContext, lock) && !user.IsAdmin(appengineContext) {
+		respondLocked(context, lock)
+		return
+	}
+
+	err = memcache.Delete(appengineContext, lockCacheKey(levelId))
+	if err != nil && err != memcache.ErrCacheMiss {
+		apierror.Respond(context, http.StatusInternalServerError, apierror.Internal, "Could not release the lock: %+v", err)
+		return
+	}
+
+	deleted.Respond(context)
+}
+
+// --- Helpers
+
+// getLock returns a level's lock and the memcache item holding it, or a nil
+// lock if the level isn't locked.  A lock past its expiry is ignored, even if
+// memcache hasn't dropped it yet, but its item is still returned.
+func getLock(appengineContext appengine.Context, levelId string) (*levelLock, *memcache.Item, error) {
+	item, err := memcache.Get(appengineContext, lockCacheKey(levelId))
+	if err == memcache.ErrCacheMiss {
+		return nil, nil, nil
+	} else if err != nil {
+		return nil, nil, err
+	}
+
+	lock := &levelLock{}
+	err = json.Unmarshal(item.Value, lock)
+	if err != nil || !time.Now().Before(lock.ExpiresAt) {
+		return nil, item, nil
+	}
+
+	return lock, item, nil
+}
+
+// lockedByOther returns the lock on a level if the enforce_level_locks flag is
+// on and someone other than the signed-in editor holds it.  Memcache errors let
+// the write through, since locks are advisory when memcache is down anyway.
+func lockedByOther(appengineContext appengine.Context, levelId string) *levelLock {
+	if !flags.EnforceLevelLocks.Enabled {
+		return nil
+	}
+
+	lock, _, err := getLock(appengineContext, levelId)
+	if err != nil {
+		appengineContext.Warningf("Could not check the lock on %s, so letting the write through: %v", levelId, err)
+		return nil
+	}
+	if lock == nil || holdsLock(appengineContext, lock) {
+		return nil
+	}
+
+	return lock
+}
+
+func holdsLock(appengineContext appengine.Context, lock *levelLock) bool {
+	current := user.Current(appengineContext)
+	return current != nil && current.Email == lock.Editor
+}
+
+func respondLocked(context *gin.Context, lock *levelLock) {
+	context.JSON(http.StatusLocked, &lockedResponse{
+		Response: *apierror.New(apierror.Locked, "%s is editing the level until %s", lock.Editor, lock.ExpiresAt.Format(time.RFC3339)),
+		Lock:     lock,
+	})
+}
+
+func lockCacheKey(levelId string) string {
+	return "lock:level:" + levelId
+}
@@ -0,0 +1,156 @@
+package levels
+
+import (
+	"encoding/json"
+
+	"appengine"
+	"appengine/datastore"
+	"appengine/taskqueue"
+
+	"bootcamp/editorservice/config"
+	"bootcamp/editorservice/levels/level"
+	"bootcamp/editorservice/mismatch"
+)
+
+// --- Types and constants
+
+// changeNotification is the payload of the task queued for each level write.
+// ChangedFields holds the JSON names of the fields the write changed, and is
+// empty when the write changed nothing.
+type changeNotification struct {
+	Key           string   `json:"key"`
+	ChangedFields []string `json:"changed_fields"`
+}
+
+// maxTasksPerAdd is how many tasks taskqueue.AddMulti takes at once.
+const maxTasksPerAdd int = 100
+
+// --- Helpers
+
+// putLevelAndNotify stores a level, records the change for delta syncs, and
+// queues a change notification for it in one transaction, so consumers hear
+// about exactly the writes that happened.
+func putLevelAndNotify(appengineContext appengine.Context, dsLevel *level.DatastoreLevel) error {
+	return datastore.RunInTransaction(appengineContext, func(transactionContext appengine.Context) error {
+		previous, err := getRawLevel(transactionContext, dsLevel.Key)
+		if err == datastore.ErrNoSuchEntity {
+			previous = nil
+		} else if err != nil {
+			return err
+		}
+
+		_, err = datastore.Put(transactionContext, makeDatastoreKey(transactionContext, dsLevel.Key), dsLevel)
+		if err != nil {
+			return err
+		}
+
+		err = recordChanges(transactionContext, []string{dsLevel.Key}, nil)
+		if err != nil {
+			return err
+		}
+
+		return queueChangeNotification(transactionContext, dsLevel.Key, level.ChangedFields(previous, dsLevel))
+	}, nil)
+}
+
+// queueChangeNotification adds a pull task describing a level write.  Given a
+// transaction context, the task is only added if the transaction commits.
+func queueChangeNotification(context appengine.Context, levelId string, changedFields []string) error {
+	if len(config.ChangeNotificationQueue) == 0 {
+		return nil
+	}
+
+	task, err := newChangeNotificationTask(levelId, changedFields)
+	if err != nil {
+		return err
+	}
+
+	_, err = taskqueue.Add(context, task, config.ChangeNotificationQueue)
+	return err
+}
+
+// queueChangeNotifications queues a change notification for each of levelIds,
+// comparing the level in previous with the one in next.  A level missing from
+// next was deleted.  A transaction can add only five tasks, so writes of many
+// levels call this once they've committed, and a task that can't be added is
+// logged instead of failing a write that's already stored.
+func queueChangeNotifications(appengineContext appengine.Context, levelIds []string, previous map[string]*level.DatastoreLevel, next map[string]*level.DatastoreLevel) {
+	if len(config.ChangeNotificationQueue) == 0 {
+		return
+	}
+
+	var tasks []*taskqueue.Task
+	for _, levelId := range levelIds {
+		task, err := newChangeNotificationTask(levelId, level.ChangedFields(previous[levelId], next[levelId]))
+		if err != nil {
+			appengineContext.Errorf("Could not notify about a change to level %q: %v", levelId, err)
+			continue
+		}
+		tasks = append(tasks, task)
+	}
+
+	for start := 0; start < len(tasks); start += maxTasksPerAdd {
+		end := start + maxTasksPerAdd
+		if end > len(tasks) {
+			end = len(tasks)
+		}
+
+		_, err := taskqueue.AddMulti(appengineContext, tasks[start:end], config.ChangeNotificationQueue)
+		if err != nil {
+			appengineContext.Errorf("Could not queue %d change notifications: %v", end-start, err)
+		}
+	}
+}
+
+func newChangeNotificationTask(levelId string, changedFields []string) (*taskqueue.Task, error) {
+	payload, err := json.Marshal(&changeNotification{Key: levelId, ChangedFields: changedFields})
+	if err != nil {
+		return nil, err
+	}
+
+	return &taskqueue.Task{Method: "PULL", Payload: payload}, nil
+}
+
+// loadPreviousLevels maps each stored level among keys to the level as it's
+// stored, so that a write can report what it changed.  Nothing is loaded when
+// notifications are off.
+func loadPreviousLevels(appengineContext appengine.Context, keys []*datastore.Key) (map[string]*level.DatastoreLevel, error) {
+	result := make(map[string]*level.DatastoreLevel)
+	if len(config.ChangeNotificationQueue) == 0 || len(keys) == 0 {
+		return result, nil
+	}
+
+	dsLevels := make([]*level.DatastoreLevel, len(keys))
+	for i := range dsLevels {
+		dsLevels[i] = &level.DatastoreLevel{}
+	}
+
+	err := datastore.GetMulti(appengineContext, keys, dsLevels)
+	multiError, isMulti := err.(appengine.MultiError)
+	if err != nil && !isMulti {
+		return nil, mismatch.Ignore(appengineContext, err)
+	}
+
+	for i, key := range keys {
+		if isMulti && multiError[i] == datastore.ErrNoSuchEntity {
+			continue
+		} else if isMulti && mismatch.Ignore(appengineContext, multiError[i]) != nil {
+			return nil, multiError[i]
+		}
+
+		dsLevels[i].Migrate()
+		result[key.StringID()] = dsLevels[i]
+	}
+
+	return result, nil
+}
+
+// levelsByKey maps each level to its key.
+func levelsByKey(dsLevels []*level.DatastoreLevel) map[string]*level.DatastoreLevel {
+	result := make(map[string]*level.DatastoreLevel)
+	for _, dsLevel := range dsLevels {
+		result[dsLevel.Key] = dsLevel
+	}
+
+	return result
+}
@@ -0,0 +1,139 @@
+package levels
+
+import (
+	"encoding/json"
+	"net/http"
+	"sort"
+
+	"appengine"
+	"appengine/datastore"
+
+	"github.com/gin-gonic/gin"
+
+	"bootcamp/editorservice/apierror"
+	"bootcamp/editorservice/levels/level"
+	"bootcamp/editorservice/requestid"
+)
+
+// --- Types and constants
+
+// overridesResponse splits a level's resolved fields into the ones it sets itself
+// and the ones it inherits, each mapped to the ancestor it comes from.
+type overridesResponse struct {
+	Key       string            `json:"key"`
+	Self      []string          `json:"self"`
+	Inherited map[string]string `json:"inherited"`
+}
+
+// Where each field of GET /levels/:id/inheritance-delta comes from
+const (
+	deltaSelf      string = "self"
+	deltaInherited string = "inherited"
+	deltaUnset     string = "unset"
+)
+
+// fieldDelta is one field of a level's inheritance delta.  Value is the resolved
+// value, and Source the ancestor it's inherited from; both are left out when the
+// field is unset.
+type fieldDelta struct {
+	Status string          `json:"status"`
+	Value  json.RawMessage `json:"value,omitempty"`
+	Source string          `json:"source,omitempty"`
+}
+
+type inheritanceDeltaResponse struct {
+	Key    string                 `json:"key"`
+	Fields map[string]*fieldDelta `json:"fields"`
+}
+
+// --- Route handlers
+
+func handleOverrides(context *gin.Context) {
+	levelId := context.Param("id")
+	appengineContext := requestid.NewContext(context.Request)
+
+	chain, ok := loadChainOrRespond(context, appengineContext, levelId)
+	if !ok {
+		return
+	}
+
+	response := &overridesResponse{Key: levelId, Self: []string{}, Inherited: make(map[string]string)}
+	for name, source := range level.Provenance(chain) {
+		if source == levelId {
+			response.Self = append(response.Self, name)
+		} else {
+			response.Inherited[name] = source
+		}
+	}
+	sort.Strings(response.Self)
+
+	context.JSON(http.StatusOK, response)
+}
+
+// handleInheritanceDelta lays a level's own fields over its resolved ones, so
+// designers see at a glance what inheritance contributes.  Every field is listed
+// as self, inherited or unset.  Key and parent_key are the level's own and aren't
+// listed.
+func handleInheritanceDelta(context *gin.Context) {
+	levelId := context.Param("id")
+	appengineContext := requestid.NewContext(context.Request)
+
+	chain, ok := loadChainOrRespond(context, appengineContext, levelId)
+	if !ok {
+		return
+	}
+
+	stored := make(map[string]*level.DatastoreLevel)
+	names := []string{}
+	for _, element := range chain {
+		stored[element.Key] = element
+	}
+	for name := range level.FieldNames {
+		if name != "key" && name != "parent_key" {
+			names = append(names, name)
+		}
+	}
+	values, _ := selectFields(resolveInMemory(levelId, stored).ToJsonLevel(), names).(map[string]json.RawMessage)
+
+	provenance := level.Provenance(chain)
+	response := &inheritanceDeltaResponse{Key: levelId, Fields: make(map[string]*fieldDelta)}
+	for _, name := range names {
+		source, set := provenance[name]
+		if !set {
+			response.Fields[name] = &fieldDelta{Status: deltaUnset}
+		} else if source == levelId {
+			response.Fields[name] = &fieldDelta{Status: deltaSelf, Value: values[name]}
+		} else {
+			response.Fields[name] = &fieldDelta{Status: deltaInherited, Value: values[name], Source: source}
+		}
+	}
+
+	context.JSON(http.StatusOK, response)
+}
+
+// --- Helpers
+
+// loadChainOrRespond loads a level's raw chain for the routes that explain its
+// inheritance.  If the chain can't be loaded whole, it responds with the error
+// and returns false.
+func loadChainOrRespond(context *gin.Context, appengineContext appengine.Context, levelId string) ([]*level.DatastoreLevel, bool) {
+	chain, err := loadRawChain(appengineContext, levelId)
+	if err == datastore.ErrNoSuchEntity && len(chain) == 0 {
+		apierror.Respond(context, http.StatusNotFound, apierror.NotFound, "Level does not exist")
+		return nil, false
+	} else if err == datastore.ErrNoSuchEntity {
+		apierror.Respond(context, http.StatusNotFound, apierror.ParentNotFound, "Could not resolve the level: %+v", ErrParentNotFound)
+		return nil, false
+	} else if err == ErrParentCycle {
+		apierror.Respond(context, http.StatusConflict, apierror.CycleDetected, "Could not resolve the level: %+v", err)
+		return nil, false
+	} else if err == ErrParentChainTooDeep {
+		apierror.Respond(context, http.StatusConflict, apierror.Conflict, "Could not resolve the level: %+v", err)
+		return nil, false
+	} else if err != nil {
+		apierror.Respond(context, http.StatusInternalServerError, apierror.Internal, "Could not retrieve the level: %+v", err)
+		return nil, false
+	}
+
+	return chain, true
+}
@@ -0,0 +1,197 @@
+package levels
+
+import (
+	"errors"
+	"net/http"
+	"strconv"
+
+	"appengine/datastore"
+
+	"github.com/gin-gonic/gin"
+
+	"bootcamp/editorservice/apierror"
+	"bootcamp/editorservice/levels/level"
+	"bootcamp/editorservice/pagination"
+	"bootcamp/editorservice/requestid"
+)
+
+// --- Types and constants
+
+const (
+	defaultPageLimit int = 100
+	maxPageLimit     int = 100
+)
+
+// The sort orders a paged query accepts, mapped to datastore orders.  A leading
+// "-" sorts in descending order.
+var pageSortOrders = map[string]string{
+	"key":   "__key__",
+	"-key":  "-__key__",
+	"name":  "Name",
+	"-name": "-Name",
+}
+
+// The parameters that page tokens carry
+var pageParams = []string{"sort", "parent", "limit"}
+
+// pageResponse is a page of levels.  With ?warnings=true, Warnings lists the
+// levels on the page that couldn't be resolved.
+type pageResponse struct {
+	Levels        []*level.JsonLevel `json:"levels"`
+	Warnings      []queryWarning     `json:"warnings,omitempty"`
+	NextPageToken string             `json:"next_page_token,omitempty"`
+}
+
+// --- Route handlers
+
+// handlePagedQuery serves GET /levels with any of ?sort=, ?parent=, ?limit= or
+// ?pageToken=.  Later pages are asked for with just the token from the previous
+// page.  Parameters given alongside a token must match the ones it carries.
+func handlePagedQuery(context *gin.Context) {
+	state, err := parsePageState(context)
+	if err == pagination.ErrNoSecret {
+		apierror.Respond(context, http.StatusInternalServerError, apierror.Internal, "Could not read the page token: %+v", err)
+		return
+	} else if err != nil {
+		apierror.Respond(context, http.StatusBadRequest, apierror.InvalidRequest, "Invalid page request: %+v", err)
+		return
+	}
+
+	// Build the query
+	appengineContext := requestid.NewContext(context.Request)
+	query := datastore.NewQuery(kind).Ancestor(getLevelRootKey(appengineContext)).KeysOnly().Limit(state.Limit)
+	if len(state.Parent) > 0 {
+		query = query.Filter("Parent =", state.Parent)
+	}
+	if len(state.Sort) > 0 {
+		query = query.Order(pageSortOrders[state.Sort])
+	}
+	if len(state.Cursor) > 0 {
+		cursor, err := datastore.DecodeCursor(state.Cursor)
+		if err != nil {
+			apierror.Respond(context, http.StatusBadRequest, apierror.InvalidRequest, "Invalid page request: %+v", pagination.ErrInvalidToken)
+			return
+		}
+		query = query.Start(cursor)
+	}
+
+	// Run it, resolving each level like the query-all does
+	response := &pageResponse{Levels: []*level.JsonLevel{}}
+	iterator := query.Run(appengineContext)
+	count := 0
+	for {
+		key, err := iterator.Next(nil)
+		if err == datastore.Done {
+			break
+		} else if err != nil {
+			apierror.Respond(context, http.StatusInternalServerError, apierror.Internal, "Could not query the levels: %+v", err)
+			return
+		}
+
+		count++
+		resolvedLevel, err := getLevel(key.StringID(), appengineContext)
+		if err == nil {
+			response.Levels = append(response.Levels, (*level.DatastoreLevel)(resolvedLevel).ToJsonLevel())
+		} else if wantsWarnings(context) {
+			response.Warnings = append(response.Warnings, resolveWarning(key.StringID(), err))
+		}
+	}
+
+	// A full page may have more after it
+	if count == state.Limit {
+		cursor, err := iterator.Cursor()
+		if err != nil {
+			apierror.Respond(context, http.StatusInternalServerError, apierror.Internal, "Could not query the levels: %+v", err)
+			return
+		}
+
+		next := *state
+		next.Cursor = cursor.String()
+		response.NextPageToken, err = pagination.Encode(&next)
+		if err != nil {
+			apierror.Respond(context, http.StatusInternalServerError, apierror.Internal, "Could not make the next page token: %+v", err)
+			return
+		}
+	}
+
+	context.JSON(http.StatusOK, response)
+}
+
+// --- Helpers
+
+func isPagedQuery(context *gin.Context) bool {
+	values := context.Request.URL.Query()
+	for _, param := range append(pageParams, "pageToken") {
+		if _, ok := values[param]; ok {
+			return true
+		}
+	}
+
+	return false
+}
+
+// parsePageState works out the query to run, from the page token if there is
+// one and from the parameters otherwise.
+func parsePageState(context *gin.Context) (*pagination.State, error) {
+	values := context.Request.URL.Query()
+	requested := &pagination.State{
+		Sort:   values.Get("sort"),
+		Parent: values.Get("parent"),
+		Limit:  defaultPageLimit,
+	}
+
+	if _, ok := values["limit"]; ok {
+		limit, err := strconv.Atoi(values.Get("limit"))
+		if err != nil {
+			return nil, errors.New("limit must be a number from 1 to " + strconv.Itoa(maxPageLimit))
+		}
+		requested.Limit = limit
+	}
+
+	err := checkPageState(requested)
+	if err != nil {
+		return nil, err
+	}
+
+	token := values.Get("pageToken")
+	if len(token) == 0 {
+		return requested, nil
+	}
+
+	state, err := pagination.Decode(token)
+	if err != nil {
+		return nil, err
+	}
+	if checkPageState(state) != nil {
+		return nil, pagination.ErrInvalidToken
+	}
+
+	// Anything given alongside the token has to agree with it
+	for _, param := range pageParams {
+		if _, ok := values[param]; !ok {
+			continue
+		}
+
+		mismatch := (param == "sort" && requested.Sort != state.Sort) ||
+			(param == "parent" && requested.Parent != state.Parent) ||
+			(param == "limit" && requested.Limit != state.Limit)
+		if mismatch {
+			return nil, errors.New(param + " doesn't match the page token")
+		}
+	}
+
+	return state, nil
+}
+
+// checkPageState makes sure a page asks for a limit and sort order that paged
+// queries allow.
+func checkPageState(state *pagination.State) error {
+	if state.Limit < 1 || state.Limit > maxPageLimit {
+		return errors.New("limit must be a number from 1 to " + strconv.Itoa(maxPageLimit))
+	}
+	if _, ok := pageSortOrders[state.Sort]; !ok && len(state.Sort) > 0 {
+		return errors.New("unknown sort " + strconv.Quote(state.Sort))
+	}
+
+	return nil
+}
@@ -0,0 +1,86 @@
+package levels
+
+import (
+	"net/http"
+	"strconv"
+
+	"appengine"
+	"appengine/datastore"
+
+	"github.com/gin-gonic/gin"
+
+	"bootcamp/editorservice/apierror"
+	"bootcamp/editorservice/levels/level"
+)
+
+// --- Helpers
+
+// respondPartiallyResolved responds to GET /levels/:id?resolveDepth=N with the
+// level merged with only its N nearest ancestors, so that designers can see
+// each step of a layered inheritance.  0 is the level as it's stored, and N is
+// clamped to maxParentDepth.  These responses aren't cached, and ancestors past
+// the Nth aren't loaded, so they don't need to exist.
+func respondPartiallyResolved(context *gin.Context, appengineContext appengine.Context, levelId string, fields []string) {
+	depth, err := strconv.Atoi(context.Query("resolveDepth"))
+	if err != nil || depth < 0 {
+		apierror.Respond(context, http.StatusBadRequest, apierror.InvalidRequest, "resolveDepth must be a number of ancestors, at least 0")
+		return
+	}
+	if depth > maxParentDepth {
+		depth = maxParentDepth
+	}
+
+	chain, err := loadPartialChain(appengineContext, levelId, depth)
+	if err == datastore.ErrNoSuchEntity {
+		apierror.Respond(context, http.StatusNotFound, apierror.NotFound, "Level does not exist")
+		return
+	} else if err == ErrParentNotFound {
+		apierror.Respond(context, http.StatusNotFound, apierror.ParentNotFound, "Could not resolve the level: %+v", err)
+		return
+	} else if err == ErrParentCycle {
+		apierror.Respond(context, http.StatusConflict, apierror.CycleDetected, "Could not resolve the level: %+v", err)
+		return
+	} else if err != nil {
+		apierror.Respond(context, http.StatusInternalServerError, apierror.Internal, "Could not retrieve the level: %+v", err)
+		return
+	}
+
+	// Merge from the top of the chain down
+	result := chain[len(chain)-1]
+	for i := len(chain) - 2; i >= 0; i-- {
+		child := *chain[i]
+		child.MergeParentProperties(result)
+		result = &child
+	}
+
+	context.JSON(http.StatusOK, selectFields(result.ToJsonLevel(), fields))
+}
+
+// loadPartialChain is loadRawChain stopped after the level's depth nearest
+// ancestors.  A missing ancestor within them is ErrParentNotFound.
+func loadPartialChain(appengineContext appengine.Context, levelId string, depth int) ([]*level.DatastoreLevel, error) {
+	var chain []*level.DatastoreLevel
+	visited := make(map[string]bool)
+	currentId := levelId
+	for len(chain) <= depth {
+		if visited[currentId] {
+			return nil, ErrParentCycle
+		}
+		visited[currentId] = true
+
+		current, err := getRawLevel(appengineContext, currentId)
+		if err == datastore.ErrNoSuchEntity && len(chain) > 0 {
+			return nil, ErrParentNotFound
+		} else if err != nil {
+			return nil, err
+		}
+
+		chain = append(chain, current)
+		if !current.HasParent || len(current.Parent) == 0 {
+			break
+		}
+		currentId = current.Parent
+	}
+
+	return chain, nil
+}
@@ -0,0 +1,434 @@
+package levels
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"mime"
+	"net/http"
+	"reflect"
+	"strings"
+
+	"appengine"
+	"appengine/datastore"
+
+	"github.com/gin-gonic/gin"
+
+	"bootcamp/editorservice/apierror"
+	"bootcamp/editorservice/etag"
+	"bootcamp/editorservice/flags"
+	"bootcamp/editorservice/levels/level"
+	"bootcamp/editorservice/requestid"
+)
+
+// --- Types and constants
+
+const jsonPatchContentType string = "application/json-patch+json"
+
+// mergePatchContentType marks a body that's a partial level, whose fields
+// replace the stored ones.  Plain application/json bodies are taken the same way.
+const mergePatchContentType string = "application/merge-patch+json"
+
+// patchOperation is one operation of an RFC 6902 JSON Patch.  Paths name either a
+// top-level field ("/rows") or an entry of the spawn map ("/spawn_frequency/grunt_fire").
+type patchOperation struct {
+	Op    string          `json:"op"`
+	Path  string          `json:"path"`
+	Value json.RawMessage `json:"value"`
+}
+
+var (
+	ErrPatchTestFailed    = errors.New("levels: a patch test operation failed")
+	ErrPatchTargetMissing = errors.New("levels: a patch operation targets a field that isn't set")
+)
+
+// errInvalidPatch wraps problems with the patch document itself, as opposed to
+// problems applying it to this particular level.
+type errInvalidPatch struct {
+	message string
+}
+
+func (err *errInvalidPatch) Error() string {
+	return "levels: invalid patch: " + err.message
+}
+
+const spawnFrequencyField string = "spawn_frequency"
+
+// patchableFields holds the JSON names of the level fields a patch may touch.
+// The key comes from the URL and can't be patched.
+var patchableFields = jsonFieldNames(reflect.TypeOf(level.JsonLevel{}), "key")
+
+// --- Route handlers
+
+// handlePatch updates the stored (unresolved) level, so that inherited values
+// aren't copied into it.  The body is either a JSON Patch, or a partial level
+// whose fields replace the stored ones and leave the rest alone.  The response is
+// the resolved level and its ETag, or with Prefer: return=minimal, just the ETag
+// and a 204.
+func handlePatch(context *gin.Context) {
+	var patch func(stored *level.DatastoreLevel) (*level.JsonLevel, error)
+	contentType, _, _ := mime.ParseMediaType(context.Request.Header.Get("Content-Type"))
+	switch contentType {
+	case jsonPatchContentType:
+		var operations []patchOperation
+		err := json.NewDecoder(context.Request.Body).Decode(&operations)
+		if err != nil {
+			apierror.Respond(context, http.StatusBadRequest, apierror.InvalidRequest, "Failed to unmarshal the JSON: %+v", err)
+			return
+		}
+		patch = func(stored *level.DatastoreLevel) (*level.JsonLevel, error) {
+			return applyPatch(stored, operations)
+		}
+	case mergePatchContentType, "application/json":
+		removed, err := nullMembers(context)
+		if err != nil {
+			apierror.Respond(context, http.StatusBadRequest, apierror.InvalidRequest, "Failed to read the body: %+v", err)
+			return
+		}
+
+		var fields level.JsonLevel
+		err = bindLevel(context, &fields)
+		if err != nil {
+			apierror.Respond(context, http.StatusBadRequest, apierror.InvalidRequest, "Failed to unmarshal the JSON: %+v", err)
+			return
+		}
+		if fields.Key != nil && *fields.Key != context.Param("id") {
+			apierror.Respond(context, http.StatusBadRequest, apierror.InvalidRequest, "The level key comes from the URL and can't be changed")
+			return
+		}
+		patch = func(stored *level.DatastoreLevel) (*level.JsonLevel, error) {
+			return mergeFields(stored, &fields, removed), nil
+		}
+	default:
+		apierror.Respond(context, http.StatusUnsupportedMediaType, apierror.UnsupportedMediaType, "PATCH requires Content-Type: %s or %s", jsonPatchContentType, mergePatchContentType)
+		return
+	}
+
+	levelId := context.Param("id")
+	appengineContext := requestid.NewContext(context.Request)
+	if lock := lockedByOther(appengineContext, levelId); lock != nil {
+		respondLocked(context, lock)
+		return
+	}
+
+	// The territories are in another entity group, so the ones that would lock
+	// the level's size are looked up before the transaction
+	var territories []string
+	var err error
+	if flags.LockReferencedDimensions.Enabled {
+		territories, err = referencingTerritories(appengineContext, levelId)
+		if err != nil {
+			apierror.Respond(context, http.StatusInternalServerError, apierror.Internal, "Could not check the territories that list the level: %+v", err)
+			return
+		}
+	}
+
+	var warnings []queryWarning
+	err = datastore.RunInTransaction(appengineContext, func(transactionContext appengine.Context) error {
+		stored, err := getRawLevel(transactionContext, levelId)
+		if err != nil {
+			return err
+		}
+
+		patched, err := patch(stored)
+		if err != nil {
+			return err
+		}
+
+		err = patched.Validate()
+		if err != nil {
+			return &errInvalidPatch{message: err.Error()}
+		}
+
+		dsLevel := patched.ToDatastoreLevel()
+		if dsLevel.Parent != stored.Parent {
+			err = checkCanonicalIds(dsLevel.Parent)
+			if err != nil {
+				return &errInvalidPatch{message: err.Error()}
+			}
+		}
+
+		err = validateResolved(transactionContext, dsLevel)
+		if err != nil {
+			return &errInvalidPatch{message: err.Error()}
+		}
+
+		if len(territories) > 0 && dimensionsChanged(stored, dsLevel) {
+			return ErrDimensionsLocked
+		}
+
+		warnings, err = checkParentReference(transactionContext, dsLevel, nil)
+		if err != nil {
+			return err
+		}
+		if len(warnings) > 0 && parentsRequired() {
+			return ErrParentNotFound
+		}
+		markEdited(transactionContext, dsLevel)
+
+		_, err = datastore.Put(transactionContext, makeDatastoreKey(transactionContext, levelId), dsLevel)
+		if err != nil {
+			return err
+		}
+
+		err = recordChanges(transactionContext, []string{levelId}, nil)
+		if err != nil {
+			return err
+		}
+
+		return queueChangeNotification(transactionContext, levelId, level.ChangedFields(stored, dsLevel))
+	}, nil)
+	if err == datastore.ErrNoSuchEntity {
+		apierror.Respond(context, http.StatusNotFound, apierror.NotFound, "Level does not exist")
+		return
+	} else if err == ErrParentNotFound {
+		apierror.Respond(context, http.StatusBadRequest, apierror.ParentNotFound, "%s", warnings[0].Message)
+		return
+	} else if err == ErrDimensionsLocked {
+		respondDimensionsLocked(context, territories)
+		return
+	} else if _, invalid := err.(*errInvalidPatch); invalid {
+		apierror.Respond(context, http.StatusBadRequest, apierror.ValidationFailed, "Could not patch the level: %+v", err)
+		return
+	} else if err == ErrPatchTestFailed || err == ErrPatchTargetMissing {
+		apierror.Respond(context, http.StatusConflict, apierror.Conflict, "Could not patch the level: %+v", err)
+		return
+	} else if err != nil {
+		apierror.Respond(context, http.StatusInternalServerError, apierror.Internal, "Failed to patch the level: %+v", err)
+		return
+	}
+
+	// Invalidate everything
+	invalidateLevelCaches(appengineContext, levelId)
+	invalidateChildLevelCaches(appengineContext, levelId)
+	invalidateQueryCaches(appengineContext)
+	prewarmCaches(appengineContext, levelId)
+	queueRecomputeDescendants(appengineContext, levelId)
+
+	// Respond with the level as it now resolves.  The stored level stands in if
+	// it can't be resolved (e.g. its parent is missing).
+	var result *level.JsonLevel
+	resolvedLevel, err := getLevel(levelId, appengineContext)
+	if err == nil {
+		result = (*level.DatastoreLevel)(resolvedLevel).ToJsonLevel()
+	} else if stored, err := getRawLevel(appengineContext, levelId); err == nil {
+		result = stored.ToJsonLevel()
+	}
+
+	context.Header("ETag", etag.Of(result))
+	if preferredReturn(context) == "minimal" {
+		context.Header("Preference-Applied", "return=minimal")
+		context.Status(http.StatusNoContent)
+		return
+	}
+
+	if len(warnings) > 0 {
+		context.JSON(http.StatusOK, &levelWithWarnings{JsonLevel: result, Warnings: warnings})
+		return
+	}
+
+	context.JSON(http.StatusOK, result)
+}
+
+// --- Helpers
+
+// preferredReturn reads the return preference from a Prefer header (RFC 7240),
+// which is "minimal", "representation", or empty if none was given.
+func preferredReturn(context *gin.Context) string {
+	for _, preference := range strings.Split(context.Request.Header.Get("Prefer"), ",") {
+		preference = strings.TrimSpace(preference)
+		if strings.HasPrefix(preference, "return=") {
+			return strings.TrimPrefix(preference, "return=")
+		}
+	}
+
+	return ""
+}
+
+// mergeFields overlays the fields set in the partial level onto the stored one,
+// then unsets the removed ones, which the body had as null (RFC 7396).  Maps and
+// lists are replaced whole, so a spawn_frequency in the body is the level's
+// entire spawn map afterwards.
+func mergeFields(dsLevel *level.DatastoreLevel, fields *level.JsonLevel, removed []string) *level.JsonLevel {
+	result := dsLevel.ToJsonLevel()
+	target := reflect.ValueOf(result).Elem()
+	source := reflect.ValueOf(fields).Elem()
+	for i := 0; i < source.NumField(); i++ {
+		if !source.Field(i).IsNil() {
+			target.Field(i).Set(source.Field(i))
+		}
+	}
+
+	unset := make(map[string]bool)
+	for _, name := range removed {
+		unset[name] = true
+	}
+	for i := 0; i < target.NumField(); i++ {
+		name := strings.Split(target.Type().Field(i).Tag.Get("json"), ",")[0]
+		if unset[name] {
+			target.Field(i).Set(reflect.Zero(target.Field(i).Type()))
+		}
+	}
+
+	result.Key = new(string)
+	*result.Key = dsLevel.Key
+	return result
+}
+
+// nullMembers lists the members of a merge patch body that are null, and puts
+// the body back to be bound.  A body that isn't a JSON object has none, and is
+// left for bindLevel to refuse.
+func nullMembers(context *gin.Context) ([]string, error) {
+	body, err := ioutil.ReadAll(context.Request.Body)
+	if err != nil {
+		return nil, err
+	}
+	context.Request.Body = ioutil.NopCloser(bytes.NewReader(body))
+
+	var members map[string]json.RawMessage
+	if json.Unmarshal(body, &members) != nil {
+		return nil, nil
+	}
+
+	var result []string
+	for name, value := range members {
+		if string(bytes.TrimSpace(value)) == "null" {
+			result = append(result, name)
+		}
+	}
+
+	return result, nil
+}
+
+// applyPatch runs the operations in order against the JSON form of the level.
+func applyPatch(dsLevel *level.DatastoreLevel, operations []patchOperation) (*level.JsonLevel, error) {
+	encoded, err := json.Marshal(dsLevel.ToJsonLevel())
+	if err != nil {
+		return nil, err
+	}
+
+	var document map[string]interface{}
+	err = json.Unmarshal(encoded, &document)
+	if err != nil {
+		return nil, err
+	}
+
+	for _, operation := range operations {
+		err = applyPatchOperation(document, &operation)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	encoded, err = json.Marshal(document)
+	if err != nil {
+		return nil, err
+	}
+
+	result := &level.JsonLevel{}
+	err = json.Unmarshal(encoded, result)
+	if err != nil {
+		return nil, &errInvalidPatch{message: err.Error()}
+	}
+
+	result.Key = new(string)
+	*result.Key = dsLevel.Key
+	return result, nil
+}
+
+func applyPatchOperation(document map[string]interface{}, operation *patchOperation) error {
+	// Find the object holding the target and the target's name within it
+	container, name, err := resolvePatchPath(document, operation.Path, operation.Op == "add")
+	if err != nil {
+		return err
+	}
+
+	var value interface{}
+	if operation.Op != "remove" {
+		if len(operation.Value) == 0 {
+			return &errInvalidPatch{message: fmt.Sprintf("%s on %s needs a value", operation.Op, operation.Path)}
+		}
+
+		err = json.Unmarshal(operation.Value, &value)
+		if err != nil {
+			return &errInvalidPatch{message: err.Error()}
+		}
+	}
+
+	current, exists := container[name]
+	switch operation.Op {
+	case "add":
+		container[name] = value
+	case "replace":
+		if !exists {
+			return ErrPatchTargetMissing
+		}
+		container[name] = value
+	case "remove":
+		if !exists {
+			return ErrPatchTargetMissing
+		}
+		delete(container, name)
+	case "test":
+		if !exists || !reflect.DeepEqual(current, value) {
+			return ErrPatchTestFailed
+		}
+	default:
+		return &errInvalidPatch{message: fmt.Sprintf("unsupported op %q", operation.Op)}
+	}
+
+	return nil
+}
+
+// resolvePatchPath splits a JSON pointer into the object it points into and the
+// member name.  With create, a missing spawn map is added so entries can be added to it.
+func resolvePatchPath(document map[string]interface{}, path string, create bool) (map[string]interface{}, string, error) {
+	if !strings.HasPrefix(path, "/") {
+		return nil, "", &errInvalidPatch{message: fmt.Sprintf("bad path %q", path)}
+	}
+
+	tokens := strings.Split(path[1:], "/")
+	for i := range tokens {
+		tokens[i] = strings.Replace(strings.Replace(tokens[i], "~1", "/", -1), "~0", "~", -1)
+	}
+
+	if !patchableFields[tokens[0]] {
+		return nil, "", &errInvalidPatch{message: fmt.Sprintf("%q is not a patchable field", tokens[0])}
+	}
+	if len(tokens) == 1 {
+		return document, tokens[0], nil
+	}
+	if len(tokens) > 2 || tokens[0] != spawnFrequencyField {
+		return nil, "", &errInvalidPatch{message: fmt.Sprintf("bad path %q", path)}
+	}
+
+	spawnFrequency, ok := document[spawnFrequencyField].(map[string]interface{})
+	if !ok {
+		if !create {
+			return nil, "", ErrPatchTargetMissing
+		}
+		spawnFrequency = make(map[string]interface{})
+		document[spawnFrequencyField] = spawnFrequency
+	}
+
+	return spawnFrequency, tokens[1], nil
+}
+
+// jsonFieldNames collects the JSON names of a struct's fields, less any excluded ones.
+func jsonFieldNames(structType reflect.Type, excluded ...string) map[string]bool {
+	result := make(map[string]bool)
+	for i := 0; i < structType.NumField(); i++ {
+		name := strings.Split(structType.Field(i).Tag.Get("json"), ",")[0]
+		if len(name) > 0 && name != "-" {
+			result[name] = true
+		}
+	}
+
+	for _, name := range excluded {
+		delete(result, name)
+	}
+
+	return result
+}
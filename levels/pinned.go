@@ -0,0 +1,48 @@
+package levels
+
+import (
+	"net/http"
+
+	"github.com/gin-gonic/gin"
+
+	"bootcamp/editorservice/cache"
+	"bootcamp/editorservice/config"
+	"bootcamp/editorservice/levels/level"
+	"bootcamp/editorservice/requestid"
+)
+
+// --- Types and constants
+
+// warmPinnedResponse lists the pinned levels that were cached, and the ones that
+// couldn't be resolved.
+type warmPinnedResponse struct {
+	Warmed []string       `json:"warmed"`
+	Failed []queryWarning `json:"failed"`
+}
+
+// --- Route handlers
+
+// handleWarmPinned reloads the levels in config.PinnedLevels into the level and
+// response caches.  Cached levels never expire, so it's memcache evicting them
+// that this undoes; cron calls it every few minutes (see cron.yaml).
+func handleWarmPinned(context *gin.Context) {
+	appengineContext := requestid.NewContext(context.Request)
+	response := &warmPinnedResponse{Warmed: []string{}, Failed: []queryWarning{}}
+	for _, levelId := range config.PinnedLevels {
+		// Fresh from the datastore, which recaches its ancestors too
+		resolvedLevel, err := getFreshLevel(levelId, appengineContext)
+		if err != nil {
+			response.Failed = append(response.Failed, queryWarning{Key: levelId, Code: errorCode(err), Message: err.Error()})
+			continue
+		}
+
+		cache.CacheResource(appengineContext, &cache.ResponseEntry{
+			Path:     buildResourcePath(levelId),
+			Code:     http.StatusOK,
+			Response: (*level.DatastoreLevel)(resolvedLevel).ToJsonLevel(),
+		})
+		response.Warmed = append(response.Warmed, levelId)
+	}
+
+	context.JSON(http.StatusOK, response)
+}
@@ -0,0 +1,72 @@
+package levels
+
+import (
+	"net/http"
+
+	"github.com/gin-gonic/gin"
+
+	"bootcamp/editorservice/apierror"
+	"bootcamp/editorservice/levels/level"
+	"bootcamp/editorservice/requestid"
+)
+
+// --- Types and constants
+
+// deletePreview shows what every level below a level would look like once it's
+// deleted.  Children are listed nearest first.
+type deletePreview struct {
+	Key      string               `json:"key"`
+	Children []deletePreviewChild `json:"children"`
+}
+
+// deletePreviewChild is a descendant resolved without the deleted level, along
+// with the fields it would lose compared with how it resolves today.  Error is
+// the code reading it would fail with once the level is gone.
+type deletePreviewChild struct {
+	Key        string           `json:"key"`
+	LostFields []string         `json:"lost_fields"`
+	Level      *level.JsonLevel `json:"level"`
+	Error      apierror.Code    `json:"error"`
+}
+
+// --- Route handlers
+
+// handleDeletePreview resolves each descendant of a level twice in memory, once
+// as things stand and once with the level gone.  Without it, a child's chain
+// stops at its missing parent and the level shown is what the rest of the chain
+// gives it.  A real read refuses to do that: after the delete every descendant
+// is a 404 PARENT_NOT_FOUND, which is reported alongside.
+func handleDeletePreview(context *gin.Context) {
+	levelId := context.Param("id")
+	appengineContext := requestid.NewContext(context.Request)
+
+	before, err := loadStoredLevels(appengineContext)
+	if err != nil {
+		apierror.Respond(context, http.StatusInternalServerError, apierror.Internal, "Could not load the levels: %+v", err)
+		return
+	}
+	if _, ok := before[levelId]; !ok {
+		apierror.Respond(context, http.StatusNotFound, apierror.NotFound, "Level does not exist")
+		return
+	}
+
+	after := make(map[string]*level.DatastoreLevel)
+	for storedId, stored := range before {
+		if storedId != levelId {
+			after[storedId] = stored
+		}
+	}
+
+	response := &deletePreview{Key: levelId, Children: []deletePreviewChild{}}
+	for _, childId := range descendantIds(levelId, before) {
+		resolved := resolveInMemory(childId, after)
+		response.Children = append(response.Children, deletePreviewChild{
+			Key:        childId,
+			LostFields: level.UnsetFields(resolveInMemory(childId, before), resolved),
+			Level:      resolved.ToJsonLevel(),
+			Error:      apierror.ParentNotFound,
+		})
+	}
+
+	context.JSON(http.StatusOK, response)
+}
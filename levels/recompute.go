@@ -0,0 +1,135 @@
+package levels
+
+import (
+	"net/http"
+	"net/url"
+
+	"appengine"
+	"appengine/taskqueue"
+
+	"github.com/gin-gonic/gin"
+
+	"bootcamp/editorservice/apierror"
+	"bootcamp/editorservice/cache"
+	"bootcamp/editorservice/flags"
+	"bootcamp/editorservice/levels/level"
+	"bootcamp/editorservice/requestid"
+)
+
+// --- Types and constants
+
+const recomputeDescendantsPath string = "/admin/levels/recompute-descendants"
+
+// recomputeResponse lists the descendants that were cached, and the ones that
+// couldn't be resolved.
+type recomputeResponse struct {
+	Recomputed []string       `json:"recomputed"`
+	Failed     []queryWarning `json:"failed"`
+}
+
+// --- Route handlers
+
+// handleRecomputeDescendants resolves every level below the levels given as key
+// form values and caches it, nearest first, so that the first read of each after
+// its ancestor changed is a hit.  The tree is walked down from the given levels
+// with a query per level, and each descendant is recomputed once even when it's
+// below several of them.  Writes queue one task for every level they wrote under
+// the recompute_descendants flag, and administrators can call it themselves.
+func handleRecomputeDescendants(context *gin.Context) {
+	err := context.Request.ParseForm()
+	if err != nil {
+		apierror.Respond(context, http.StatusBadRequest, apierror.InvalidRequest, "Could not parse the form: %+v", err)
+		return
+	}
+
+	levelIds := uniqueIds(context.Request.Form["key"])
+	if len(levelIds) == 0 {
+		apierror.Respond(context, http.StatusBadRequest, apierror.InvalidRequest, "Name the levels whose descendants to recompute with ?key=")
+		return
+	}
+
+	// Walk down from every written level at once.  A written level that's below
+	// another one is recomputed too, but its own descendants are only walked once.
+	appengineContext := requestid.NewContext(context.Request)
+	response := &recomputeResponse{Recomputed: []string{}, Failed: []queryWarning{}}
+	walked := make(map[string]bool)
+	for _, levelId := range levelIds {
+		walked[levelId] = true
+	}
+	recomputed := make(map[string]bool)
+	pending := levelIds
+	for len(pending) > 0 {
+		children, err := childIds(appengineContext, pending[0])
+		if err != nil {
+			apierror.Respond(context, http.StatusInternalServerError, apierror.Internal, "Could not load the levels below %s: %+v", pending[0], err)
+			return
+		}
+		pending = pending[1:]
+
+		for _, childId := range children {
+			if recomputed[childId] {
+				continue
+			}
+			recomputed[childId] = true
+			recomputeLevel(appengineContext, childId, response)
+
+			if !walked[childId] {
+				walked[childId] = true
+				pending = append(pending, childId)
+			}
+		}
+	}
+
+	context.JSON(http.StatusOK, response)
+}
+
+// --- Helpers
+
+// recomputeLevel resolves one level into its response cache entry, and notes in
+// the response whether it could.
+func recomputeLevel(appengineContext appengine.Context, levelId string, response *recomputeResponse) {
+	// Fill through a lease, so a write that lands in the meantime wins
+	responseEntry := &cache.ResponseEntry{Path: buildResourcePath(levelId)}
+	lease := cache.TakeLease(appengineContext, responseEntry)
+
+	resolvedLevel, err := getLevel(levelId, appengineContext)
+	if err != nil {
+		response.Failed = append(response.Failed, queryWarning{Key: levelId, Code: errorCode(err), Message: err.Error()})
+		return
+	}
+
+	responseEntry.Code = http.StatusOK
+	responseEntry.Response = (*level.DatastoreLevel)(resolvedLevel).ToJsonLevel()
+	cache.CacheResourceWithLease(appengineContext, lease, responseEntry)
+	response.Recomputed = append(response.Recomputed, levelId)
+}
+
+// uniqueIds drops the repeats from levelIds, keeping the first of each.
+func uniqueIds(levelIds []string) []string {
+	seen := make(map[string]bool)
+	var result []string
+	for _, levelId := range levelIds {
+		if len(levelId) == 0 || seen[levelId] {
+			continue
+		}
+		seen[levelId] = true
+		result = append(result, levelId)
+	}
+	return result
+}
+
+// queueRecomputeDescendants queues one handleRecomputeDescendants task for the
+// levels a write just made, if the recompute_descendants flag is on.  It's called
+// after the invalidations.  Failing to queue it only costs the descendants a
+// cache miss.
+func queueRecomputeDescendants(appengineContext appengine.Context, levelIds ...string) {
+	if !flags.RecomputeDescendants.Enabled || len(levelIds) == 0 {
+		return
+	}
+
+	task := taskqueue.NewPOSTTask(recomputeDescendantsPath, url.Values{"key": levelIds})
+	_, err := taskqueue.Add(appengineContext, task, "")
+	if err != nil {
+		appengineContext.Warningf("Could not queue recomputing the levels below %v: %v", levelIds, err)
+	}
+}
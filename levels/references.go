@@ -0,0 +1,90 @@
+package levels
+
+import (
+	"fmt"
+
+	"appengine"
+	"appengine/datastore"
+
+	"bootcamp/editorservice/apierror"
+	"bootcamp/editorservice/config"
+	"bootcamp/editorservice/flags"
+	"bootcamp/editorservice/levels/level"
+	"bootcamp/editorservice/mismatch"
+)
+
+// --- Types and constants
+
+// referenceWarnings is the body of a write that went through despite references
+// that don't exist.
+type referenceWarnings struct {
+	Warnings []queryWarning `json:"warnings"`
+}
+
+// levelWithWarnings is a level response with the same warnings added alongside
+// its fields.
+type levelWithWarnings struct {
+	*level.JsonLevel
+	Warnings []queryWarning `json:"warnings,omitempty"`
+}
+
+// --- Helpers
+
+// parentsRequired reports whether a write naming a missing parent is refused,
+// either for config.StrictReferences or the require_parent flag.
+func parentsRequired() bool {
+	return config.StrictReferences || flags.RequireParent.Enabled
+}
+
+// checkParentReference warns about dsLevel's parent if it isn't stored.  Parents
+// in pending are about to be written alongside it, so they count as stored.
+func checkParentReference(appengineContext appengine.Context, dsLevel *level.DatastoreLevel, pending map[string]bool) ([]queryWarning, error) {
+	if !dsLevel.HasParent || len(dsLevel.Parent) == 0 || pending[dsLevel.Parent] {
+		return nil, nil
+	}
+
+	_, err := getRawLevel(appengineContext, dsLevel.Parent)
+	if err == datastore.ErrNoSuchEntity {
+		return []queryWarning{{
+			Key:     dsLevel.Key,
+			Code:    apierror.ParentNotFound,
+			Message: fmt.Sprintf("The parent %q does not exist", dsLevel.Parent),
+		}}, nil
+	}
+
+	return nil, err
+}
+
+// MissingLevels lists the given level ids that aren't stored, in order.  The
+// territories resource calls this to check the levels a territory lists.
+func MissingLevels(appengineContext appengine.Context, levelIds []string) ([]string, error) {
+	if len(levelIds) == 0 {
+		return nil, nil
+	}
+
+	keys := make([]*datastore.Key, len(levelIds))
+	for i, levelId := range levelIds {
+		keys[i] = makeDatastoreKey(appengineContext, levelId)
+	}
+
+	dsLevels := make([]level.DatastoreLevel, len(keys))
+	err := datastore.GetMulti(appengineContext, keys, dsLevels)
+	multiError, isMulti := err.(appengine.MultiError)
+	if err != nil && !isMulti {
+		return nil, mismatch.Ignore(appengineContext, err)
+	}
+
+	var result []string
+	for i, levelId := range levelIds {
+		if !isMulti || multiError[i] == nil {
+			continue
+		}
+		if multiError[i] == datastore.ErrNoSuchEntity {
+			result = append(result, levelId)
+		} else if mismatch.Ignore(appengineContext, multiError[i]) != nil {
+			return nil, multiError[i]
+		}
+	}
+
+	return result, nil
+}
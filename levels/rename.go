@@ -0,0 +1,100 @@
+package levels
+
+import (
+	"net/http"
+	"sort"
+
+	"appengine"
+	"appengine/datastore"
+
+	"github.com/gin-gonic/gin"
+
+	"bootcamp/editorservice/apierror"
+	"bootcamp/editorservice/ids"
+	"bootcamp/editorservice/requestid"
+)
+
+// --- Types and constants
+
+// renameImpact lists what refers to a level by its key, and so would have to be
+// rewritten if it were renamed.  Children are the levels whose parent it is, and
+// Territories the ones listing it.  TargetFree says whether the new key could be
+// used, and Reason why not when it can't.
+type renameImpact struct {
+	Key         string   `json:"key"`
+	To          string   `json:"to"`
+	TargetFree  bool     `json:"target_free"`
+	Reason      string   `json:"reason,omitempty"`
+	Children    []string `json:"children"`
+	Territories []string `json:"territories"`
+}
+
+// --- Route handlers
+
+// handleRenameImpact serves GET /levels/:id/rename-impact?to=, so editors can
+// preview a rename before making it.  Nothing is changed.
+func handleRenameImpact(context *gin.Context) {
+	newId := context.Query("to")
+	if len(newId) == 0 {
+		apierror.Respond(context, http.StatusBadRequest, apierror.InvalidRequest, "The new key must be given with ?to=")
+		return
+	}
+
+	levelId := context.Param("id")
+	appengineContext := requestid.NewContext(context.Request)
+	_, err := getRawLevel(appengineContext, levelId)
+	if err == datastore.ErrNoSuchEntity {
+		apierror.Respond(context, http.StatusNotFound, apierror.NotFound, "Level does not exist")
+		return
+	} else if err != nil {
+		apierror.Respond(context, http.StatusInternalServerError, apierror.Internal, "Could not retrieve the level: %+v", err)
+		return
+	}
+
+	response := &renameImpact{Key: levelId, To: newId}
+	response.Children, err = childIds(appengineContext, levelId)
+	if err != nil {
+		apierror.Respond(context, http.StatusInternalServerError, apierror.Internal, "Could not find the level's children: %+v", err)
+		return
+	}
+	response.Territories, err = referencingTerritories(appengineContext, levelId)
+	if err != nil {
+		apierror.Respond(context, http.StatusInternalServerError, apierror.Internal, "Could not find the territories that list the level: %+v", err)
+		return
+	}
+
+	// Then whether the new key can be taken
+	if newId == levelId {
+		response.Reason = "The new key is the level's own"
+	} else if isReservedId(newId) {
+		response.Reason = "The new key is reserved"
+	} else if err := ids.Check(newId); err != nil {
+		response.Reason = err.Error()
+	} else {
+		_, err = getRawLevel(appengineContext, newId)
+		if err == nil {
+			response.Reason = "A level with the new key already exists"
+		} else if err != datastore.ErrNoSuchEntity {
+			apierror.Respond(context, http.StatusInternalServerError, apierror.Internal, "Could not check the new key: %+v", err)
+			return
+		}
+	}
+	response.TargetFree = len(response.Reason) == 0
+
+	context.JSON(http.StatusOK, response)
+}
+
+// --- Helpers
+
+// childIds lists the keys of the levels whose parent is levelId, sorted.
+func childIds(appengineContext appengine.Context, levelId string) ([]string, error) {
+	query := datastore.NewQuery(kind).Ancestor(getLevelRootKey(appengineContext)).Filter("Parent =", levelId).KeysOnly()
+	keys, err := query.GetAll(appengineContext, nil)
+	if err != nil {
+		return nil, err
+	}
+
+	result := keyIds(keys)
+	sort.Strings(result)
+	return result, nil
+}
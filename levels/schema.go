@@ -0,0 +1,134 @@
+package levels
+
+import (
+	"fmt"
+	"net/http"
+	"net/url"
+
+	"appengine"
+	"appengine/datastore"
+	"appengine/taskqueue"
+
+	"github.com/gin-gonic/gin"
+
+	"bootcamp/editorservice/apierror"
+	"bootcamp/editorservice/config"
+	"bootcamp/editorservice/ids"
+	"bootcamp/editorservice/levels/level"
+	"bootcamp/editorservice/mismatch"
+	"bootcamp/editorservice/requestid"
+)
+
+// --- Types and constants
+
+const migrateLevelsPath string = "/admin/levels/migrate"
+
+// maxMigrationTaskIdLength is the longest level id that fits in a migration
+// task's name, which may be at most 500 characters.  Longer ids go unnamed.
+const maxMigrationTaskIdLength int = 450
+
+type schemaVersionResponse struct {
+	SchemaVersion int64 `json:"schema_version"`
+	MigrateOnRead bool  `json:"migrate_on_read"`
+}
+
+// --- Route handlers
+
+// handleSchemaVersion reports the schema version levels are written with, and
+// whether older levels are upgraded in the datastore when they're read.
+func handleSchemaVersion(context *gin.Context) {
+	context.JSON(http.StatusOK, &schemaVersionResponse{
+		SchemaVersion: level.CurrentSchemaVersion,
+		MigrateOnRead: config.MigrateOnRead,
+	})
+}
+
+// handleMigrateLevels writes the levels named with ?key= back in the current
+// schema version, in one transaction that also records them for delta syncs.
+// Reads queue it for the older levels they come across, rather than writing on
+// the read path; levels that are already current are left alone.
+func handleMigrateLevels(context *gin.Context) {
+	levelIds := context.Request.URL.Query()["key"]
+	if len(levelIds) == 0 {
+		apierror.Respond(context, http.StatusBadRequest, apierror.InvalidRequest, "Name the levels to migrate with ?key=")
+		return
+	}
+	if !checkBatchSize(context, len(levelIds)) {
+		return
+	}
+
+	appengineContext := requestid.NewContext(context.Request)
+	migrated := 0
+	err := datastore.RunInTransaction(appengineContext, func(transactionContext appengine.Context) error {
+		migrated = 0
+
+		keys := make([]*datastore.Key, len(levelIds))
+		stored := make([]*level.DatastoreLevel, len(levelIds))
+		for i, levelId := range levelIds {
+			keys[i] = makeDatastoreKey(transactionContext, levelId)
+			stored[i] = &level.DatastoreLevel{}
+		}
+		err := datastore.GetMulti(transactionContext, keys, stored)
+		multiError, isMulti := err.(appengine.MultiError)
+		if err != nil && !isMulti {
+			return mismatch.Ignore(transactionContext, err)
+		}
+
+		var staleKeys []*datastore.Key
+		var staleLevels []*level.DatastoreLevel
+		for i := range keys {
+			if isMulti && multiError[i] == datastore.ErrNoSuchEntity {
+				continue
+			} else if isMulti && mismatch.Ignore(transactionContext, multiError[i]) != nil {
+				return multiError[i]
+			}
+			if stored[i].Migrate() {
+				staleKeys = append(staleKeys, keys[i])
+				staleLevels = append(staleLevels, stored[i])
+			}
+		}
+		if len(staleKeys) == 0 {
+			return nil
+		}
+
+		_, err = datastore.PutMulti(transactionContext, staleKeys, staleLevels)
+		if err != nil {
+			return err
+		}
+
+		migrated = len(staleKeys)
+		return recordChanges(transactionContext, keyIds(staleKeys), nil)
+	}, nil)
+	if err != nil {
+		apierror.Respond(context, http.StatusInternalServerError, apierror.Internal, "Could not migrate the levels: %+v", err)
+		return
+	}
+
+	// Derived index fields may have changed, which filtered queries depend on
+	if migrated > 0 {
+		invalidateQueryCaches(appengineContext)
+	}
+	context.JSON(http.StatusOK, &reindexResponse{Scanned: len(levelIds), Updated: migrated})
+}
+
+// --- Helpers
+
+// queueMigration queues handleMigrateLevels for a level that was read under an
+// older schema version, if config.MigrateOnRead is set.  The reader already has
+// the upgraded level, so failing to queue it is only logged, and the next read
+// tries again.  The task is named after the level and the version, so reads
+// that come across the same level before it's migrated don't queue it again.
+func queueMigration(appengineContext appengine.Context, levelId string) {
+	if !config.MigrateOnRead {
+		return
+	}
+
+	task := &taskqueue.Task{Path: migrateLevelsPath + "?key=" + url.QueryEscape(levelId), Method: "POST"}
+	if ids.CheckCanonical(levelId) == nil && len(levelId) <= maxMigrationTaskIdLength {
+		task.Name = fmt.Sprintf("migrate-v%d-%s", level.CurrentSchemaVersion, levelId)
+	}
+	_, err := taskqueue.Add(appengineContext, task, "")
+	if err != nil && err != taskqueue.ErrTaskAlreadyAdded {
+		appengineContext.Warningf("Could not queue migrating level %s to schema version %d: %v", levelId, level.CurrentSchemaVersion, err)
+	}
+}
@@ -0,0 +1,63 @@
+package levels
+
+import (
+	"net/http"
+
+	"appengine/datastore"
+
+	"github.com/gin-gonic/gin"
+
+	"bootcamp/editorservice/apierror"
+	"bootcamp/editorservice/etag"
+	"bootcamp/editorservice/levels/level"
+	"bootcamp/editorservice/requestid"
+)
+
+// --- Types and constants
+
+// spawnsResponse is the part of a resolved level the game's spawn system reads.
+// Fields that no level in the chain sets are left out, as in the full level.
+type spawnsResponse struct {
+	Key                 *string             `json:"key"`
+	SpawnFrequency      *map[string]float32 `json:"spawn_frequency,omitempty"`
+	SpawnsPerSecond     *float32            `json:"spawns_per_second,omitempty"`
+	MaxActiveUnits      *int32              `json:"max_active_units,omitempty"`
+	UnitDelayMultiplier *float32            `json:"unit_delay_multiplier,omitempty"`
+}
+
+// --- Route handlers
+
+// handleSpawns returns just the resolved spawn settings of a level.  It's built
+// from the level cache, so it stays as fresh as GET /levels/:id.
+func handleSpawns(context *gin.Context) {
+	levelId := context.Param("id")
+	appengineContext := requestid.NewContext(context.Request)
+
+	resolvedLevel, err := getLevel(levelId, appengineContext)
+	if err == datastore.ErrNoSuchEntity {
+		apierror.Respond(context, http.StatusNotFound, apierror.NotFound, "Level does not exist")
+		return
+	} else if err == ErrParentNotFound {
+		apierror.Respond(context, http.StatusNotFound, apierror.ParentNotFound, "Could not resolve the level: %+v", err)
+		return
+	} else if err == ErrParentCycle {
+		apierror.Respond(context, http.StatusConflict, apierror.CycleDetected, "Could not resolve the level: %+v", err)
+		return
+	} else if err != nil {
+		apierror.Respond(context, http.StatusInternalServerError, apierror.Internal, "Could not retrieve the level: %+v", err)
+		return
+	}
+
+	resolved := (*level.DatastoreLevel)(resolvedLevel).ToJsonLevel()
+	response := &spawnsResponse{
+		Key:                 resolved.Key,
+		SpawnFrequency:      resolved.SpawnFrequency,
+		SpawnsPerSecond:     resolved.SpawnsPerSecond,
+		MaxActiveUnits:      resolved.MaxActiveUnits,
+		UnitDelayMultiplier: resolved.UnitDelayMultiplier,
+	}
+	if etag.NotModified(context, etag.Of(response)) {
+		return
+	}
+	context.JSON(http.StatusOK, response)
+}
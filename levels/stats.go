@@ -0,0 +1,134 @@
+package levels
+
+import (
+	"net/http"
+	"sort"
+
+	"github.com/gin-gonic/gin"
+
+	"bootcamp/editorservice/apierror"
+	"bootcamp/editorservice/cache"
+	"bootcamp/editorservice/levels/level"
+	"bootcamp/editorservice/requestid"
+)
+
+// --- Types and constants
+
+const queryStatsKey string = "query:stats@levels"
+
+// statsResponse summarizes the resolved levels.  Levels that can't be resolved
+// are left out.  Each aggregate only looks at the levels that have the field,
+// and is zero when none do.
+type statsResponse struct {
+	Count             int            `json:"count"`
+	AverageDuration   float64        `json:"average_duration"`
+	Rows              statsRange     `json:"rows"`
+	Columns           statsRange     `json:"columns"`
+	DistinctUnitTypes int            `json:"distinct_unit_types"`
+	CountByTag        map[string]int `json:"count_by_tag"`
+}
+
+type statsRange struct {
+	Min int32 `json:"min"`
+	Max int32 `json:"max"`
+}
+
+// --- Route handlers
+
+func handleStats(context *gin.Context) {
+	appengineContext := requestid.NewContext(context.Request)
+
+	// Check response cache
+	responseEntry := &cache.ResponseEntry{Path: queryStatsKey}
+	err := cache.GetCachedResource(appengineContext, responseEntry)
+	if err == nil {
+		context.JSON(responseEntry.Code, responseEntry.Response)
+		return
+	}
+
+	// Load every stored level in one go, and resolve them in memory
+	stored, err := loadStoredLevels(appengineContext)
+	if err != nil {
+		apierror.Respond(context, http.StatusInternalServerError, apierror.Internal, "Could not load the levels: %+v", err)
+		return
+	}
+
+	levelIds := make([]string, 0, len(stored))
+	for levelId := range stored {
+		levelIds = append(levelIds, levelId)
+	}
+	sort.Strings(levelIds)
+
+	var resolved []*level.DatastoreLevel
+	for _, levelId := range levelIds {
+		if _, err := chainInMemory(levelId, stored); err == nil {
+			resolved = append(resolved, resolveInMemory(levelId, stored))
+		}
+	}
+
+	// Cache and return the result
+	cacheEntry := &cache.ResponseEntry{
+		Path:     queryStatsKey,
+		Code:     http.StatusOK,
+		Response: computeStats(resolved),
+	}
+	cache.CacheResource(appengineContext, cacheEntry)
+	context.JSON(cacheEntry.Code, cacheEntry.Response)
+}
+
+// --- Helpers
+
+func computeStats(resolved []*level.DatastoreLevel) *statsResponse {
+	result := &statsResponse{Count: len(resolved), CountByTag: make(map[string]int)}
+
+	var totalDuration float64
+	durations := 0
+	hasRows, hasColumns := false, false
+	unitTypes := make(map[string]bool)
+	for _, dsLevel := range resolved {
+		if dsLevel.HasDuration {
+			totalDuration += float64(dsLevel.Duration)
+			durations++
+		}
+		if dsLevel.HasRows {
+			result.Rows = widenRange(result.Rows, dsLevel.Rows, !hasRows)
+			hasRows = true
+		}
+		if dsLevel.HasColumns {
+			result.Columns = widenRange(result.Columns, dsLevel.Columns, !hasColumns)
+			hasColumns = true
+		}
+		if dsLevel.HasSpawnFrequency {
+			for _, element := range dsLevel.SpawnFrequency {
+				unitTypes[element.UnitType] = true
+			}
+		}
+		if dsLevel.HasTags {
+			counted := make(map[string]bool)
+			for _, tag := range dsLevel.Tags {
+				if !counted[tag] {
+					counted[tag] = true
+					result.CountByTag[tag]++
+				}
+			}
+		}
+	}
+
+	if durations > 0 {
+		result.AverageDuration = totalDuration / float64(durations)
+	}
+	result.DistinctUnitTypes = len(unitTypes)
+	return result
+}
+
+// widenRange extends a range to take in value.  first starts a new range.
+func widenRange(current statsRange, value int32, first bool) statsRange {
+	if first || value < current.Min {
+		current.Min = value
+	}
+	if first || value > current.Max {
+		current.Max = value
+	}
+
+	return current
+}
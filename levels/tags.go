@@ -0,0 +1,248 @@
+package levels
+
+import (
+	"errors"
+	"net/http"
+
+	"appengine"
+	"appengine/datastore"
+
+	"github.com/gin-gonic/gin"
+
+	"bootcamp/editorservice/apierror"
+	"bootcamp/editorservice/levels/level"
+	"bootcamp/editorservice/mismatch"
+	"bootcamp/editorservice/requestid"
+)
+
+// --- Types and constants
+
+// How GET /levels?tag= combines several tags, selected with ?tagMode=
+const (
+	tagModeAll string = "all"
+	tagModeAny string = "any"
+)
+
+var errTaggedLevelsMissing = errors.New("levels: some of the levels to tag do not exist")
+
+// tagsRequest is the body of POST /levels/tags.  Tags in both lists end up
+// added, since removals are applied first.
+type tagsRequest struct {
+	Keys       []string `json:"keys"`
+	AddTags    []string `json:"addTags"`
+	RemoveTags []string `json:"removeTags"`
+}
+
+type taggedLevel struct {
+	Key  string   `json:"key"`
+	Tags []string `json:"tags"`
+}
+
+type tagsResponse struct {
+	Levels []taggedLevel `json:"levels"`
+}
+
+// --- Route handlers
+
+// handleTagQuery returns the levels carrying the given tags, all of them by
+// default or any of them with ?tagMode=any.
+//
+// Equality filters on a list property each match any element, and several of
+// them AND together, so "all" runs as one datastore query.  That needs the
+// composite (ancestor, Tags) index in index.yaml.  The datastore has no OR, so
+// "any" loads the levels and matches them here instead.
+func handleTagQuery(context *gin.Context) {
+	tags := context.Request.URL.Query()["tag"]
+	mode := context.DefaultQuery("tagMode", tagModeAll)
+	if mode != tagModeAll && mode != tagModeAny {
+		apierror.Respond(context, http.StatusBadRequest, apierror.InvalidRequest, "Unknown tagMode %q", mode)
+		return
+	}
+
+	appengineContext := requestid.NewContext(context.Request)
+	var keys []*datastore.Key
+	var err error
+	if mode == tagModeAll {
+		keys, err = queryAllTags(appengineContext, tags)
+	} else {
+		keys, err = queryAnyTag(appengineContext, tags)
+	}
+	if err != nil {
+		apierror.Respond(context, http.StatusInternalServerError, apierror.Internal, "Could not query the levels: %+v", err)
+		return
+	}
+
+	// Resolve each match like the query-all does
+	levels, warnings := resolveLevels(appengineContext, keys)
+	context.JSON(http.StatusOK, queryBody(context, levels, warnings))
+}
+
+// handleTags adds and removes tags across many levels in one transaction, so
+// either every level is retagged or none are.  Each level keeps its tags in
+// order, without duplicates, with new ones after the ones it had.
+func handleTags(context *gin.Context) {
+	var request tagsRequest
+	err := context.BindJSON(&request)
+	if err != nil {
+		apierror.Respond(context, http.StatusBadRequest, apierror.InvalidRequest, "Failed to unmarshal the JSON: %+v", err)
+		return
+	}
+	if !checkBatchSize(context, len(request.Keys)) {
+		return
+	}
+	for _, tag := range append(append([]string{}, request.AddTags...), request.RemoveTags...) {
+		if len(tag) == 0 {
+			apierror.Respond(context, http.StatusBadRequest, apierror.ValidationFailed, "Tags must not be empty")
+			return
+		}
+	}
+
+	err = checkCanonicalIds(request.Keys...)
+	if err != nil {
+		apierror.Respond(context, http.StatusBadRequest, apierror.InvalidRequest, "Invalid keys: %+v", err)
+		return
+	}
+
+	appengineContext := requestid.NewContext(context.Request)
+	for _, levelId := range request.Keys {
+		if lock := lockedByOther(appengineContext, levelId); lock != nil {
+			respondLocked(context, lock)
+			return
+		}
+	}
+
+	keys := make([]*datastore.Key, len(request.Keys))
+	for i, levelId := range request.Keys {
+		keys[i] = makeDatastoreKey(appengineContext, levelId)
+	}
+
+	var missing []string
+	var previous map[string]*level.DatastoreLevel
+	var dsLevels []*level.DatastoreLevel
+	response := &tagsResponse{Levels: make([]taggedLevel, len(keys))}
+	err = datastore.RunInTransaction(appengineContext, func(transactionContext appengine.Context) error {
+		previous = make(map[string]*level.DatastoreLevel)
+		dsLevels = make([]*level.DatastoreLevel, len(keys))
+		for i := range dsLevels {
+			dsLevels[i] = &level.DatastoreLevel{}
+		}
+
+		err := datastore.GetMulti(transactionContext, keys, dsLevels)
+		if multiError, ok := err.(appengine.MultiError); ok {
+			missing = nil
+			for i, keyErr := range multiError {
+				if keyErr == datastore.ErrNoSuchEntity {
+					missing = append(missing, request.Keys[i])
+				} else if mismatch.Ignore(transactionContext, keyErr) != nil {
+					return keyErr
+				}
+			}
+			if len(missing) > 0 {
+				return errTaggedLevelsMissing
+			}
+		} else if err != nil {
+			return err
+		}
+
+		for i, dsLevel := range dsLevels {
+			dsLevel.Migrate()
+			stored := *dsLevel
+			previous[request.Keys[i]] = &stored
+			dsLevel.Tags = retag(dsLevel.Tags, request.AddTags, request.RemoveTags)
+			dsLevel.HasTags = dsLevel.HasTags || len(dsLevel.Tags) > 0
+			markEdited(transactionContext, dsLevel)
+			response.Levels[i] = taggedLevel{Key: request.Keys[i], Tags: append([]string{}, dsLevel.Tags...)}
+		}
+
+		_, err = datastore.PutMulti(transactionContext, keys, dsLevels)
+		if err != nil {
+			return err
+		}
+
+		return recordChanges(transactionContext, keyIds(keys), nil)
+	}, nil)
+	if err == errTaggedLevelsMissing {
+		apierror.Respond(context, http.StatusNotFound, apierror.NotFound, "These levels do not exist: %v", missing)
+		return
+	} else if err == datastore.ErrConcurrentTransaction {
+		apierror.Respond(context, http.StatusConflict, apierror.Conflict, "The levels were changed by another request at the same time.  Try again.")
+		return
+	} else if err != nil {
+		apierror.Respond(context, http.StatusInternalServerError, apierror.Internal, "Failed to retag the levels: %+v", err)
+		return
+	}
+
+	queueChangeNotifications(appengineContext, request.Keys, previous, levelsByKey(dsLevels))
+
+	// Tags aren't inherited, so only the levels themselves go stale
+	for _, levelId := range request.Keys {
+		invalidateLevelCaches(appengineContext, levelId)
+	}
+	invalidateQueryCaches(appengineContext)
+
+	context.JSON(http.StatusOK, response)
+}
+
+// --- Helpers
+
+func queryAllTags(appengineContext appengine.Context, tags []string) ([]*datastore.Key, error) {
+	query := datastore.NewQuery(kind).Ancestor(getLevelRootKey(appengineContext)).KeysOnly()
+	for _, tag := range tags {
+		query = query.Filter("Tags =", tag)
+	}
+
+	return query.GetAll(appengineContext, nil)
+}
+
+func queryAnyTag(appengineContext appengine.Context, tags []string) ([]*datastore.Key, error) {
+	var dsLevels []level.DatastoreLevel
+	query := datastore.NewQuery(kind).Ancestor(getLevelRootKey(appengineContext))
+	keys, err := query.GetAll(appengineContext, &dsLevels)
+	err = mismatch.Ignore(appengineContext, err)
+	if err != nil {
+		return nil, err
+	}
+
+	wanted := make(map[string]bool)
+	for _, tag := range tags {
+		wanted[tag] = true
+	}
+
+	var result []*datastore.Key
+	for i := range dsLevels {
+		for _, tag := range dsLevels[i].Tags {
+			if wanted[tag] {
+				result = append(result, keys[i])
+				break
+			}
+		}
+	}
+
+	return result, nil
+}
+
+// retag removes the tags in remove from tags, then appends the ones in add it
+// doesn't have yet.  Duplicates already in tags are dropped too.
+func retag(tags []string, add []string, remove []string) []string {
+	removed := make(map[string]bool)
+	for _, tag := range remove {
+		removed[tag] = true
+	}
+
+	result := []string{}
+	seen := make(map[string]bool)
+	for _, tag := range tags {
+		if !removed[tag] && !seen[tag] {
+			seen[tag] = true
+			result = append(result, tag)
+		}
+	}
+	for _, tag := range add {
+		if !seen[tag] {
+			seen[tag] = true
+			result = append(result, tag)
+		}
+	}
+
+	return result
+}
@@ -0,0 +1,178 @@
+package levels
+
+import (
+	"net/http"
+	"time"
+
+	"appengine"
+	"appengine/datastore"
+
+	"github.com/gin-gonic/gin"
+
+	"bootcamp/editorservice/apierror"
+	"bootcamp/editorservice/config"
+	"bootcamp/editorservice/requestid"
+)
+
+// --- Types and constants
+
+const tombstoneKind string = "LevelTombstone"
+
+// pruneBatchSize is how many tombstones are dropped in each transaction.
+const pruneBatchSize = 200
+
+// levelTombstone marks a deleted level for delta syncs, keyed by the level's id.
+// Writing the level again removes it.
+type levelTombstone struct {
+	Version   int64
+	DeletedAt time.Time
+}
+
+// deletedLevel stands in for a deleted level in GET /levels?includeDeleted=true.
+// Version is the collection version that deleted it.
+type deletedLevel struct {
+	Key       string    `json:"key"`
+	Deleted   bool      `json:"deleted"`
+	DeletedAt time.Time `json:"deleted_at"`
+	Version   int64     `json:"-"`
+}
+
+type pruneResponse struct {
+	Pruned int `json:"pruned"`
+}
+
+// --- Route handlers
+
+// handlePruneTombstones drops the tombstones older than the retention window,
+// and remembers the newest version dropped so that deltas from before it are
+// refused rather than silently missing deletes.  They're dropped a chunk at a
+// time, each in its own transaction along with the version it raises.
+func handlePruneTombstones(context *gin.Context) {
+	cutoff := time.Now().AddDate(0, 0, -config.TombstoneRetentionDays)
+	appengineContext := requestid.NewContext(context.Request)
+
+	pruned := 0
+	var cursor *datastore.Cursor
+	for {
+		query := datastore.NewQuery(tombstoneKind).Ancestor(getLevelRootKey(appengineContext)).
+			Filter("DeletedAt <", cutoff).KeysOnly().Limit(pruneBatchSize)
+		if cursor != nil {
+			query = query.Start(*cursor)
+		}
+
+		var keys []*datastore.Key
+		iterator := query.Run(appengineContext)
+		for {
+			key, err := iterator.Next(nil)
+			if err == datastore.Done {
+				break
+			} else if err != nil {
+				apierror.Respond(context, http.StatusInternalServerError, apierror.Internal, "Failed to prune the tombstones after pruning %d: %+v", pruned, err)
+				return
+			}
+			keys = append(keys, key)
+		}
+		if len(keys) == 0 {
+			break
+		}
+
+		count, err := pruneTombstones(appengineContext, keys, cutoff)
+		if err != nil {
+			apierror.Respond(context, http.StatusInternalServerError, apierror.Internal, "Failed to prune the tombstones after pruning %d: %+v", pruned, err)
+			return
+		}
+		pruned += count
+
+		// A short chunk is the last one
+		if len(keys) < pruneBatchSize {
+			break
+		}
+
+		next, err := iterator.Cursor()
+		if err != nil {
+			apierror.Respond(context, http.StatusInternalServerError, apierror.Internal, "Failed to prune the tombstones after pruning %d: %+v", pruned, err)
+			return
+		}
+		cursor = &next
+	}
+
+	context.JSON(http.StatusOK, &pruneResponse{Pruned: pruned})
+}
+
+// --- Helpers
+
+// pruneTombstones deletes the tombstones under keys in one transaction, and
+// raises the collection's pruned version to the newest of them.  They're read
+// again first, since a level deleted again since the query has a fresh
+// tombstone that has to stay.
+func pruneTombstones(appengineContext appengine.Context, keys []*datastore.Key, cutoff time.Time) (int, error) {
+	pruned := 0
+	err := datastore.RunInTransaction(appengineContext, func(transactionContext appengine.Context) error {
+		pruned = 0
+
+		tombstones := make([]levelTombstone, len(keys))
+		err := datastore.GetMulti(transactionContext, keys, tombstones)
+		multiError, isMulti := err.(appengine.MultiError)
+		if err != nil && !isMulti {
+			return err
+		}
+
+		version, err := getCollectionVersion(transactionContext)
+		if err != nil {
+			return err
+		}
+
+		var expiredKeys []*datastore.Key
+		for i := range keys {
+			if isMulti && multiError[i] == datastore.ErrNoSuchEntity {
+				continue
+			} else if isMulti && multiError[i] != nil {
+				return multiError[i]
+			}
+			if !tombstones[i].DeletedAt.Before(cutoff) {
+				continue
+			}
+
+			expiredKeys = append(expiredKeys, keys[i])
+			if tombstones[i].Version > version.PrunedVersion {
+				version.PrunedVersion = tombstones[i].Version
+			}
+		}
+		if len(expiredKeys) == 0 {
+			return nil
+		}
+
+		err = datastore.DeleteMulti(transactionContext, expiredKeys)
+		if err != nil {
+			return err
+		}
+
+		_, err = datastore.Put(transactionContext, makeCollectionVersionKey(transactionContext), version)
+		pruned = len(expiredKeys)
+		return err
+	}, nil)
+
+	return pruned, err
+}
+
+func makeTombstoneKey(context appengine.Context, levelId string) *datastore.Key {
+	return datastore.NewKey(context, tombstoneKind, levelId, 0, getLevelRootKey(context))
+}
+
+// deletedLevels lists a marker for each tombstone that hasn't been pruned, in key
+// order.
+func deletedLevels(appengineContext appengine.Context) ([]*deletedLevel, error) {
+	var tombstones []levelTombstone
+	query := datastore.NewQuery(tombstoneKind).Ancestor(getLevelRootKey(appengineContext))
+	keys, err := query.GetAll(appengineContext, &tombstones)
+	if err != nil {
+		return nil, err
+	}
+
+	result := make([]*deletedLevel, len(keys))
+	for i, key := range keys {
+		result[i] = &deletedLevel{Key: key.StringID(), Deleted: true, DeletedAt: tombstones[i].DeletedAt, Version: tombstones[i].Version}
+	}
+
+	return result, nil
+}
@@ -0,0 +1,203 @@
+package levels
+
+import (
+	"net/http"
+	"sort"
+
+	"appengine/datastore"
+
+	"github.com/gin-gonic/gin"
+
+	"bootcamp/editorservice/apierror"
+	"bootcamp/editorservice/cache"
+	"bootcamp/editorservice/config"
+	"bootcamp/editorservice/levels/level"
+	"bootcamp/editorservice/mismatch"
+	"bootcamp/editorservice/requestid"
+)
+
+// --- Types and constants
+
+const queryTreeKey string = "query:tree@levels"
+
+// The config.TreeOrder that sorts siblings by key alone.  Anything else sorts by
+// name first.
+const treeOrderKey string = "key"
+
+// treeNode is a stored (unresolved) level along with the levels that name it as their parent.
+type treeNode struct {
+	*level.JsonLevel
+	Children []*treeNode `json:"children"`
+}
+
+type treeResponse struct {
+	Roots []*treeNode `json:"roots"`
+
+	// Each cycle lists the keys of the levels that make it up.  Levels in a cycle
+	// (and any levels below them) can't be reached from a root, so they don't
+	// appear in Roots.
+	Cycles [][]string `json:"cycles"`
+}
+
+// --- Route handlers
+
+func handleTree(context *gin.Context) {
+	appengineContext := requestid.NewContext(context.Request)
+
+	// Check response cache
+	responseEntry := &cache.ResponseEntry{Path: queryTreeKey}
+	err := cache.GetCachedResource(appengineContext, responseEntry)
+	if err == nil {
+		context.JSON(responseEntry.Code, responseEntry.Response)
+		return
+	}
+
+	// Load every stored level in one go
+	var dsLevels []level.DatastoreLevel
+	query := datastore.NewQuery(kind).Ancestor(getLevelRootKey(appengineContext))
+	_, err = query.GetAll(appengineContext, &dsLevels)
+	err = mismatch.Ignore(appengineContext, err)
+	if err != nil {
+		apierror.Respond(context, http.StatusInternalServerError, apierror.Internal, "Could not load the levels: %+v", err)
+		return
+	}
+
+	tree, err := buildTree(dsLevels)
+	if err == ErrParentChainTooDeep {
+		apierror.Respond(context, http.StatusConflict, apierror.Conflict, "Could not build the tree: %+v", err)
+		return
+	} else if err != nil {
+		apierror.Respond(context, http.StatusInternalServerError, apierror.Internal, "Could not build the tree: %+v", err)
+		return
+	}
+
+	// Cache and return the result
+	cacheEntry := &cache.ResponseEntry{
+		Path:     queryTreeKey,
+		Code:     http.StatusOK,
+		Response: tree,
+	}
+	cache.CacheResource(appengineContext, cacheEntry)
+	context.JSON(cacheEntry.Code, cacheEntry.Response)
+}
+
+// --- Helpers
+
+// buildTree arranges the levels by their parent keys.  Levels without a parent,
+// or whose parent doesn't exist, become roots.  Siblings (and the roots) come in
+// config.TreeOrder, so the tree is the same from one request to the next.  A
+// level with more than maxParentDepth ancestors is ErrParentChainTooDeep.
+func buildTree(dsLevels []level.DatastoreLevel) (*treeResponse, error) {
+	nodes := make(map[string]*treeNode)
+	parents := make(map[string]string)
+	stored := make(map[string]*level.DatastoreLevel)
+	for i := range dsLevels {
+		dsLevel := &dsLevels[i]
+		nodes[dsLevel.Key] = &treeNode{JsonLevel: dsLevel.ToJsonLevel(), Children: []*treeNode{}}
+		stored[dsLevel.Key] = dsLevel
+		if dsLevel.HasParent && len(dsLevel.Parent) > 0 {
+			parents[dsLevel.Key] = dsLevel.Parent
+		}
+	}
+
+	// Ordering the keys up front orders every list of siblings built from them
+	var keys []string
+	sortNames := make(map[string]string)
+	for key := range nodes {
+		keys = append(keys, key)
+		if config.TreeOrder != treeOrderKey {
+			sortNames[key] = resolveInMemory(key, stored).Name
+		}
+	}
+	sort.Sort(&treeOrder{keys: keys, names: sortNames})
+
+	// Link children to parents and collect the roots
+	result := &treeResponse{Roots: []*treeNode{}, Cycles: [][]string{}}
+	for _, key := range keys {
+		parentKey, hasParent := parents[key]
+		parentNode, parentExists := nodes[parentKey]
+		if hasParent && parentExists {
+			parentNode.Children = append(parentNode.Children, nodes[key])
+		} else {
+			result.Roots = append(result.Roots, nodes[key])
+		}
+	}
+
+	// Anything that can't be reached from a root is in, or hangs off of, a cycle
+	reached, err := markReached(result.Roots)
+	if err != nil {
+		return nil, err
+	}
+
+	scanned := make(map[string]bool)
+	for _, key := range keys {
+		if reached[key] || scanned[key] {
+			continue
+		}
+
+		// Walk up the parents until we come back around
+		var path []string
+		positions := make(map[string]int)
+		for current := key; !reached[current] && !scanned[current]; current = parents[current] {
+			if position, seen := positions[current]; seen {
+				result.Cycles = append(result.Cycles, path[position:])
+				break
+			}
+			positions[current] = len(path)
+			path = append(path, current)
+		}
+
+		for _, element := range path {
+			scanned[element] = true
+		}
+	}
+
+	return result, nil
+}
+
+// markReached collects the keys of the nodes and everything below them.  It
+// keeps its own stack rather than recursing, so that it's bounded by
+// maxParentDepth instead of by the goroutine's stack.
+func markReached(roots []*treeNode) (map[string]bool, error) {
+	type pendingNode struct {
+		node  *treeNode
+		depth int
+	}
+
+	reached := make(map[string]bool)
+	var pending []pendingNode
+	for _, root := range roots {
+		pending = append(pending, pendingNode{node: root})
+	}
+	for len(pending) > 0 {
+		current := pending[len(pending)-1]
+		pending = pending[:len(pending)-1]
+		if current.depth > maxParentDepth {
+			return nil, ErrParentChainTooDeep
+		}
+
+		reached[*current.node.Key] = true
+		for _, child := range current.node.Children {
+			pending = append(pending, pendingNode{node: child, depth: current.depth + 1})
+		}
+	}
+
+	return reached, nil
+}
+
+// treeOrder sorts keys by their names, then by the keys themselves.  With no
+// names, that's by key alone.
+type treeOrder struct {
+	keys  []string
+	names map[string]string
+}
+
+func (order *treeOrder) Len() int      { return len(order.keys) }
+func (order *treeOrder) Swap(i, j int) { order.keys[i], order.keys[j] = order.keys[j], order.keys[i] }
+func (order *treeOrder) Less(i, j int) bool {
+	nameI, nameJ := order.names[order.keys[i]], order.names[order.keys[j]]
+	if nameI != nameJ {
+		return nameI < nameJ
+	}
+	return order.keys[i] < order.keys[j]
+}
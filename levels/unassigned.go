@@ -0,0 +1,96 @@
+package levels
+
+import (
+	"net/http"
+
+	"appengine"
+	"appengine/datastore"
+
+	"github.com/gin-gonic/gin"
+
+	"bootcamp/editorservice/apierror"
+	"bootcamp/editorservice/cache"
+	"bootcamp/editorservice/mismatch"
+	"bootcamp/editorservice/requestid"
+	"bootcamp/editorservice/territories/territory"
+)
+
+// --- Types and constants
+
+const queryUnassignedKey string = "query:unassigned@levels"
+const queryUnassignedWarningsKey string = "query:unassigned-warnings@levels"
+
+// --- Route handlers
+
+// handleUnassignedQuery returns the levels that no territory lists in its Levels.
+func handleUnassignedQuery(context *gin.Context) {
+	appengineContext := requestid.NewContext(context.Request)
+	cacheKey := queryUnassignedKey
+	if wantsWarnings(context) {
+		cacheKey = queryUnassignedWarningsKey
+	}
+
+	// Check response cache
+	responseEntry := &cache.ResponseEntry{Path: cacheKey}
+	err := cache.GetCachedResource(appengineContext, responseEntry)
+	if err == nil {
+		context.JSON(responseEntry.Code, responseEntry.Response)
+		return
+	}
+
+	// Collect every level id that a territory refers to
+	var territories []territory.Territory
+	query := datastore.NewQuery(territory.Kind).Ancestor(territory.RootKey(appengineContext))
+	_, err = query.GetAll(appengineContext, &territories)
+	err = mismatch.Ignore(appengineContext, err)
+	if err != nil {
+		apierror.Respond(context, http.StatusInternalServerError, apierror.Internal, "Could not load the territories: %+v", err)
+		return
+	}
+
+	assigned := make(map[string]bool)
+	for _, element := range territories {
+		if element.Levels != nil {
+			for _, levelId := range *element.Levels {
+				assigned[levelId] = true
+			}
+		}
+	}
+
+	// Query to get every level key
+	query = datastore.NewQuery(kind).Ancestor(getLevelRootKey(appengineContext)).KeysOnly()
+	keys, err := query.GetAll(appengineContext, nil)
+	if err != nil {
+		apierror.Respond(context, http.StatusInternalServerError, apierror.Internal, "Could not load the levels: %+v", err)
+		return
+	}
+
+	// Resolve the ones that aren't assigned
+	var unassigned []*datastore.Key
+	for _, element := range keys {
+		if !assigned[element.StringID()] {
+			unassigned = append(unassigned, element)
+		}
+	}
+	levels, warnings := resolveLevels(appengineContext, unassigned)
+
+	// Cache and return the result
+	cacheEntry := &cache.ResponseEntry{
+		Path:     cacheKey,
+		Code:     http.StatusOK,
+		Response: queryBody(context, levels, warnings),
+	}
+	cache.CacheResource(appengineContext, cacheEntry)
+	context.JSON(cacheEntry.Code, cacheEntry.Response)
+}
+
+// --- Helpers
+
+// InvalidateTerritoryCaches drops the cached level responses that depend on
+// territory data.  The territories resource calls this whenever a territory changes.
+func InvalidateTerritoryCaches(context appengine.Context) {
+	unassignedEntry := &cache.ResponseEntry{Path: queryUnassignedKey}
+	cache.InvalidateCacheEntry(context, unassignedEntry)
+	unassignedWarningsEntry := &cache.ResponseEntry{Path: queryUnassignedWarningsKey}
+	cache.InvalidateCacheEntry(context, unassignedWarningsEntry)
+}
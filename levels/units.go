@@ -0,0 +1,64 @@
+package levels
+
+import (
+	"net/http"
+	"sort"
+
+	"github.com/gin-gonic/gin"
+
+	"bootcamp/editorservice/apierror"
+	"bootcamp/editorservice/levels/level"
+	"bootcamp/editorservice/requestid"
+)
+
+// --- Route handlers
+
+// handleUnitQuery returns the levels whose resolved spawn frequencies include the
+// unit type named with ?usesUnit=, in key order, so a retired unit type can be
+// cleaned out before it's purged.
+//
+// Unit types are map keys, which the datastore can't filter on, so every level
+// is loaded in one query and resolved here.  A level whose parent chain is
+// broken still counts for whatever part of it could be loaded.
+func handleUnitQuery(context *gin.Context) {
+	unitType := context.Query("usesUnit")
+	if len(unitType) == 0 {
+		apierror.Respond(context, http.StatusBadRequest, apierror.InvalidRequest, "usesUnit must name a unit type")
+		return
+	}
+
+	appengineContext := requestid.NewContext(context.Request)
+	stored, err := loadStoredLevels(appengineContext)
+	if err != nil {
+		apierror.Respond(context, http.StatusInternalServerError, apierror.Internal, "Could not load the levels: %+v", err)
+		return
+	}
+
+	var levelIds []string
+	for levelId := range stored {
+		levelIds = append(levelIds, levelId)
+	}
+	sort.Strings(levelIds)
+
+	response := []*level.JsonLevel{}
+	for _, levelId := range levelIds {
+		resolved := resolveInMemory(levelId, stored)
+		if usesUnit(resolved, unitType) {
+			response = append(response, resolved.ToJsonLevel())
+		}
+	}
+
+	context.JSON(http.StatusOK, response)
+}
+
+// --- Helpers
+
+func usesUnit(dsLevel *level.DatastoreLevel, unitType string) bool {
+	for _, element := range dsLevel.SpawnFrequency {
+		if element.UnitType == unitType {
+			return true
+		}
+	}
+
+	return false
+}
@@ -0,0 +1,167 @@
+package levels
+
+import (
+	"encoding/json"
+	"net/http"
+	"reflect"
+
+	"appengine/datastore"
+
+	"github.com/gin-gonic/gin"
+
+	"bootcamp/editorservice/apierror"
+	"bootcamp/editorservice/cache"
+	"bootcamp/editorservice/levels/level"
+	"bootcamp/editorservice/requestid"
+)
+
+// --- Types and constants
+
+// cacheMismatch is a cached level that doesn't match what the datastore resolves
+// to.  Cache is either "level" or "response".  Fresh is nil if the level can no
+// longer be resolved.
+type cacheMismatch struct {
+	Key    string           `json:"key"`
+	Cache  string           `json:"cache"`
+	Cached interface{}      `json:"cached"`
+	Fresh  *level.JsonLevel `json:"fresh"`
+}
+
+type verifyResponse struct {
+	Checked    int             `json:"checked"`
+	Mismatches []cacheMismatch `json:"mismatches"`
+}
+
+// purgeResponse lists the cache keys that were dropped, out of those checked.
+type purgeResponse struct {
+	Checked int      `json:"checked"`
+	Purged  int      `json:"purged"`
+	Keys    []string `json:"keys"`
+}
+
+// --- Route handlers
+
+// handleVerifyCache compares each level's cache entries against a fresh
+// resolution from the datastore and reports the ones that differ.  Nothing is
+// written, so stale entries stay put for investigation.
+func handleVerifyCache(context *gin.Context) {
+	appengineContext := requestid.NewContext(context.Request)
+
+	query := datastore.NewQuery(kind).Ancestor(getLevelRootKey(appengineContext)).KeysOnly()
+	keys, err := query.GetAll(appengineContext, nil)
+	if err != nil {
+		apierror.Respond(context, http.StatusInternalServerError, apierror.Internal, "Could not query the levels: %+v", err)
+		return
+	}
+
+	response := &verifyResponse{Mismatches: []cacheMismatch{}}
+	for _, key := range keys {
+		levelId := key.StringID()
+		response.Checked++
+
+		var fresh *level.JsonLevel
+		resolved, err := resolveUncached(appengineContext, levelId)
+		if err == nil {
+			fresh = resolved.ToJsonLevel()
+		}
+
+		// Level cache
+		levelEntry := &levelCacheEntry{Key: levelId}
+		if cache.GetCachedResource(appengineContext, levelEntry) == nil {
+			cached := (*level.DatastoreLevel)(levelEntry).ToJsonLevel()
+			if !sameJson(cached, fresh) {
+				response.Mismatches = append(response.Mismatches, cacheMismatch{Key: levelId, Cache: "level", Cached: cached, Fresh: fresh})
+			}
+		}
+
+		// Response cache, where a cached 404 also counts as a mismatch
+		responseEntry := &cache.ResponseEntry{Path: buildResourcePath(levelId)}
+		if cache.GetCachedResource(appengineContext, responseEntry) == nil {
+			if responseEntry.Code != http.StatusOK || !sameJson(responseEntry.Response, fresh) {
+				response.Mismatches = append(response.Mismatches, cacheMismatch{Key: levelId, Cache: "response", Cached: responseEntry.Response, Fresh: fresh})
+			}
+		}
+	}
+
+	context.JSON(http.StatusOK, response)
+}
+
+// handlePurgeOrphanedCache drops the cache entries left behind by deleted
+// levels, which nothing reads or invalidates again until a level with the same
+// key is written: the level, its response, and its descendant counts as of the
+// delete.  The collection-wide query responses are dropped too, in case one was
+// cached with a deleted level in it.  Memcache can't list its keys, so the
+// deleted levels come from their tombstones; ones deleted before the tombstones
+// were pruned, and counts cached at older versions, are left for memcache to
+// evict.  Leases are left alone, since the reads that took them are still under
+// way.
+func handlePurgeOrphanedCache(context *gin.Context) {
+	appengineContext := requestid.NewContext(context.Request)
+
+	deleted, err := deletedLevels(appengineContext)
+	if err != nil {
+		apierror.Respond(context, http.StatusInternalServerError, apierror.Internal, "Could not query the deleted levels: %+v", err)
+		return
+	}
+
+	cacheKeys := queryCacheKeys()
+	for _, element := range deleted {
+		cacheKeys = append(cacheKeys, orphanedCacheKeys(element)...)
+	}
+
+	response := &purgeResponse{Keys: []string{}}
+	for _, cacheKey := range cacheKeys {
+		response.Checked++
+		_, leased, err := cache.Inspect(appengineContext, cacheKey)
+		if err != nil || leased {
+			continue
+		}
+
+		err = cache.InvalidateCacheEntryByKey(appengineContext, cacheKey)
+		if err != nil {
+			apierror.Respond(context, http.StatusInternalServerError, apierror.Internal, "Could not purge %s: %+v", cacheKey, err)
+			return
+		}
+		response.Purged++
+		response.Keys = append(response.Keys, cacheKey)
+	}
+
+	context.JSON(http.StatusOK, response)
+}
+
+// --- Helpers
+
+// orphanedCacheKeys lists the cache keys a deleted level can leave behind.  Its
+// descendant counts are cached under the collection version they were read at,
+// and only the latest one they could have been, just before the delete, is
+// listed.
+func orphanedCacheKeys(element *deletedLevel) []string {
+	result := []string{
+		(&levelCacheEntry{Key: element.Key}).GetCacheKey(),
+		(&cache.ResponseEntry{Path: buildResourcePath(element.Key)}).GetCacheKey(),
+	}
+	for _, recursive := range []bool{false, true} {
+		result = append(result, (&cache.ResponseEntry{Path: descendantCountPath(element.Key, recursive, element.Version-1)}).GetCacheKey())
+	}
+
+	return result
+}
+
+// sameJson compares two values by their JSON forms, so a struct matches the map
+// it was decoded into.
+func sameJson(a interface{}, b interface{}) bool {
+	decodedA, errA := normalizeJson(a)
+	decodedB, errB := normalizeJson(b)
+	return errA == nil && errB == nil && reflect.DeepEqual(decodedA, decodedB)
+}
+
+func normalizeJson(value interface{}) (interface{}, error) {
+	encoded, err := json.Marshal(value)
+	if err != nil {
+		return nil, err
+	}
+
+	var result interface{}
+	err = json.Unmarshal(encoded, &result)
+	return result, err
+}
@@ -0,0 +1,81 @@
+package levels
+
+import (
+	"net/http"
+	"net/url"
+
+	"appengine"
+	"appengine/taskqueue"
+
+	"github.com/gin-gonic/gin"
+
+	"bootcamp/editorservice/apierror"
+	"bootcamp/editorservice/cache"
+	"bootcamp/editorservice/flags"
+	"bootcamp/editorservice/requestid"
+)
+
+// --- Types and constants
+
+const warmLevelPath string = "/admin/levels/warm"
+
+// unresolvedHeader marks a response that's the level as stored, without what it
+// inherits from its parents.
+const unresolvedHeader string = "X-Level-Unresolved"
+
+// --- Route handlers
+
+// handleWarmLevel resolves ?key= and fills the level and response caches for it,
+// for the task respondBeforeWarming queues.
+func handleWarmLevel(context *gin.Context) {
+	levelId := context.Query("key")
+	if len(levelId) == 0 {
+		apierror.Respond(context, http.StatusBadRequest, apierror.InvalidRequest, "Name the level to warm with ?key=")
+		return
+	}
+
+	prewarmCaches(requestid.NewContext(context.Request), levelId)
+	context.JSON(http.StatusOK, nil)
+}
+
+// --- Helpers
+
+// respondBeforeWarming answers a read that missed the response cache with the
+// level as it's stored, under the warm_on_miss flag, and leaves resolving and
+// caching it to a task.  That's only exact for a root level, so a level with a
+// parent is only answered this way when the client passed ?allowUnresolved=true,
+// and the response says so in unresolvedHeader.  It returns false, having
+// responded with nothing, when the read should be handled as usual: the flag is
+// off, the level cache has the level, or the level can't be loaded.
+func respondBeforeWarming(context *gin.Context, appengineContext appengine.Context, levelId string, fields []string) bool {
+	if !flags.WarmOnMiss.Enabled {
+		return false
+	}
+
+	// A level cache hit resolves cheaply anyway
+	if cache.GetCachedResource(appengineContext, &levelCacheEntry{Key: levelId}) == nil {
+		return false
+	}
+
+	stored, err := getRawLevel(appengineContext, levelId)
+	if err != nil {
+		return false
+	}
+	hasParent := stored.HasParent && len(stored.Parent) > 0
+	if hasParent && context.Query("allowUnresolved") != "true" {
+		return false
+	}
+
+	task := &taskqueue.Task{Path: warmLevelPath + "?key=" + url.QueryEscape(levelId), Method: "POST"}
+	_, err = taskqueue.Add(appengineContext, task, "")
+	if err != nil {
+		appengineContext.Warningf("Could not queue warming %s, so resolving it now: %v", levelId, err)
+		return false
+	}
+
+	if hasParent {
+		context.Header(unresolvedHeader, "true")
+	}
+	context.JSON(http.StatusOK, selectFields(stored.ToJsonLevel(), fields))
+	return true
+}
@@ -0,0 +1,20 @@
+// Package mismatch lets entities written under an older schema load under the
+// current one, for every resource.
+package mismatch
+
+import (
+	"appengine"
+	"appengine/datastore"
+)
+
+// Ignore treats datastore.ErrFieldMismatch as a warning.  It's returned when a
+// stored entity has properties the struct doesn't know about (e.g. written under
+// an older schema), but the fields we do know about are still loaded.
+func Ignore(context appengine.Context, err error) error {
+	if mismatch, ok := err.(*datastore.ErrFieldMismatch); ok {
+		context.Warningf("Ignoring a datastore field mismatch: %v", mismatch)
+		return nil
+	}
+
+	return err
+}
@@ -0,0 +1,115 @@
+// Package requestid tags each request with a correlation id, so that a client
+// can trace a request through the logs.
+//
+// The id comes from the request's X-Request-ID header, or is generated if it
+// doesn't have a usable one.  It's echoed back in the response header, and every
+// log line written through a context from NewContext is prefixed with it.
+package requestid
+
+import (
+	"crypto/rand"
+	"encoding/hex"
+	"net/http"
+
+	"appengine"
+
+	"github.com/gin-gonic/gin"
+)
+
+// --- Types and constants
+
+const Header string = "X-Request-ID"
+
+// maxLength bounds a client-supplied id.  Longer ones are replaced.
+const maxLength int = 128
+
+// --- Middleware
+
+// Middleware settles the request's id before anything else handles it.  The id
+// is written back into the request header, so everything after this sees the
+// same one.
+func Middleware() gin.HandlerFunc {
+	return func(c *gin.Context) {
+		id := c.Request.Header.Get(Header)
+		if !isUsable(id) {
+			id = generate()
+		}
+
+		c.Request.Header.Set(Header, id)
+		c.Header(Header, id)
+		c.Next()
+	}
+}
+
+// --- Contexts
+
+// NewContext is appengine.NewContext, with the request's id in front of every
+// log line.  Use it instead of appengine.NewContext in handlers.
+func NewContext(request *http.Request) appengine.Context {
+	context := appengine.NewContext(request)
+	id := request.Header.Get(Header)
+	if len(id) == 0 {
+		return context
+	}
+
+	return &loggingContext{Context: context, id: id}
+}
+
+// loggingContext prefixes log lines with the request id.  Everything else goes
+// straight to the wrapped context.
+type loggingContext struct {
+	appengine.Context
+	id string
+}
+
+func (c *loggingContext) Debugf(format string, args ...interface{}) {
+	c.Context.Debugf("[%s] "+format, c.prefixed(args)...)
+}
+
+func (c *loggingContext) Infof(format string, args ...interface{}) {
+	c.Context.Infof("[%s] "+format, c.prefixed(args)...)
+}
+
+func (c *loggingContext) Warningf(format string, args ...interface{}) {
+	c.Context.Warningf("[%s] "+format, c.prefixed(args)...)
+}
+
+func (c *loggingContext) Errorf(format string, args ...interface{}) {
+	c.Context.Errorf("[%s] "+format, c.prefixed(args)...)
+}
+
+func (c *loggingContext) Criticalf(format string, args ...interface{}) {
+	c.Context.Criticalf("[%s] "+format, c.prefixed(args)...)
+}
+
+// --- Helpers
+
+// prefixed puts the id in front of the log arguments.  It's passed as an
+// argument rather than spliced into the format so that a % in it can't garble
+// the line.
+func (c *loggingContext) prefixed(args []interface{}) []interface{} {
+	return append([]interface{}{c.id}, args...)
+}
+
+// isUsable accepts ids of letters, digits, '-', '_' and '.', up to maxLength.
+func isUsable(id string) bool {
+	if len(id) == 0 || len(id) > maxLength {
+		return false
+	}
+
+	for _, r := range id {
+		isAlphanumeric := (r >= 'a' && r <= 'z') || (r >= 'A' && r <= 'Z') || (r >= '0' && r <= '9')
+		if !isAlphanumeric && r != '-' && r != '_' && r != '.' {
+			return false
+		}
+	}
+
+	return true
+}
+
+// generate makes a random 128-bit id.
+func generate() string {
+	id := make([]byte, 16)
+	rand.Read(id)
+	return hex.EncodeToString(id)
+}
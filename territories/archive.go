@@ -0,0 +1,32 @@
+package territories
+
+import (
+	"appengine"
+
+	"github.com/gin-gonic/gin"
+
+	"bootcamp/editorservice/territories/territory"
+)
+
+// --- Route handlers
+
+// handleArchive hides a territory from the territory list without deleting it.
+// It can still be read by id, and is listed with ?archived=true.
+func handleArchive(context *gin.Context) {
+	setArchived(context, true)
+}
+
+// handleRestore brings an archived territory back into the territory list.
+func handleRestore(context *gin.Context) {
+	setArchived(context, false)
+}
+
+// --- Helpers
+
+// setArchived takes no body, so the change is never rejected for its version.
+func setArchived(context *gin.Context, archived bool) {
+	updateStored(context, nil, nil, func(transactionContext appengine.Context, stored *territory.Territory) error {
+		stored.Archived = &archived
+		return nil
+	})
+}
@@ -0,0 +1,118 @@
+package territories
+
+import (
+	"net/http"
+
+	"appengine"
+	"appengine/datastore"
+
+	"github.com/gin-gonic/gin"
+
+	"bootcamp/editorservice/apierror"
+	"bootcamp/editorservice/config"
+	"bootcamp/editorservice/flags"
+	"bootcamp/editorservice/ids"
+	"bootcamp/editorservice/mismatch"
+	"bootcamp/editorservice/requestid"
+	"bootcamp/editorservice/territories/territory"
+)
+
+// --- Types and constants
+
+type batchIdsRequest struct {
+	Ids []string `json:"ids"`
+}
+
+// batchItemResult reports the outcome for one item of a batch, using the status
+// code the item would have gotten as a single request.
+type batchItemResult struct {
+	Key    string `json:"key"`
+	Status int    `json:"status"`
+	Error  string `json:"error,omitempty"`
+}
+
+type batchGetResponse struct {
+	Results     []batchItemResult      `json:"results"`
+	Territories []*territory.Territory `json:"territories"`
+	Missing     []string               `json:"missing"`
+}
+
+// --- Route handlers
+
+func handleBatchGet(context *gin.Context) {
+	var request batchIdsRequest
+	err := context.BindJSON(&request)
+	if err != nil {
+		apierror.Respond(context, http.StatusBadRequest, apierror.InvalidRequest, "Failed to unmarshal the JSON: %+v", err)
+		return
+	}
+	if len(request.Ids) > config.MaxBatchItems {
+		apierror.Respond(context, http.StatusBadRequest, apierror.InvalidRequest, "A batch may have at most %d items, but this one has %d.  Split it into smaller batches.", config.MaxBatchItems, len(request.Ids))
+		return
+	}
+
+	// Load them all in one go
+	appengineContext := requestid.NewContext(context.Request)
+	keys := make([]*datastore.Key, len(request.Ids))
+	territories := make([]*territory.Territory, len(request.Ids))
+	for i, territoryId := range request.Ids {
+		keys[i] = makeDatastoreKey(appengineContext, territoryId)
+		territories[i] = &territory.Territory{}
+	}
+
+	err = datastore.GetMulti(appengineContext, keys, territories)
+	multiError, isMultiError := err.(appengine.MultiError)
+	if err != nil && !isMultiError {
+		apierror.Respond(context, http.StatusInternalServerError, apierror.Internal, "Could not retrieve the territories: %+v", err)
+		return
+	}
+
+	response := &batchGetResponse{
+		Results:     make([]batchItemResult, len(request.Ids)),
+		Territories: []*territory.Territory{},
+		Missing:     []string{},
+	}
+	for i, territoryId := range request.Ids {
+		response.Results[i].Key = territoryId
+
+		// With normalize_ids, a variant of an id doesn't name the territory
+		if flags.NormalizeIds.Enabled {
+			if err := ids.CheckCanonical(territoryId); err != nil {
+				response.Results[i].Status = http.StatusBadRequest
+				response.Results[i].Error = err.Error()
+				continue
+			}
+		}
+
+		var itemErr error
+		if isMultiError {
+			itemErr = mismatch.Ignore(appengineContext, multiError[i])
+		}
+
+		if itemErr == datastore.ErrNoSuchEntity {
+			response.Results[i].Status = http.StatusNotFound
+			response.Results[i].Error = "Territory does not exist"
+			response.Missing = append(response.Missing, territoryId)
+		} else if itemErr != nil {
+			response.Results[i].Status = http.StatusInternalServerError
+			response.Results[i].Error = itemErr.Error()
+		} else {
+			response.Results[i].Status = http.StatusOK
+			response.Territories = append(response.Territories, territories[i])
+		}
+	}
+
+	context.JSON(batchStatus(response.Results), response)
+}
+
+// --- Helpers
+
+func batchStatus(results []batchItemResult) int {
+	for _, result := range results {
+		if result.Status >= http.StatusMultipleChoices {
+			return http.StatusMultiStatus
+		}
+	}
+
+	return http.StatusOK
+}
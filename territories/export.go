@@ -0,0 +1,72 @@
+package territories
+
+import (
+	"net/http"
+
+	"appengine/datastore"
+
+	"github.com/gin-gonic/gin"
+
+	"bootcamp/editorservice/apierror"
+	"bootcamp/editorservice/levels"
+	"bootcamp/editorservice/levels/level"
+	"bootcamp/editorservice/requestid"
+	"bootcamp/editorservice/territories/territory"
+)
+
+// --- Types and constants
+
+// territoryBundle is one territory with every level it needs, in the form
+// /territories/import takes.  Levels are as stored, with their ancestors ahead of
+// them, and Missing lists the levels or ancestors that couldn't be included.
+// Versions maps each level to the collection version that last wrote it, so an
+// import with ?skipOlder=true can tell which stored levels changed since.
+type territoryBundle struct {
+	Territories []*territory.Territory `json:"territories"`
+	Levels      []*level.JsonLevel     `json:"levels"`
+	Missing     []string               `json:"missing"`
+	Versions    map[string]int64       `json:"versions,omitempty"`
+}
+
+// --- Route handlers
+
+// handleExport serves GET /territories/:id/export.
+func handleExport(context *gin.Context) {
+	territoryId := context.Param("id")
+	appengineContext := requestid.NewContext(context.Request)
+	stored, err := getStoredTerritory(appengineContext, territoryId)
+	if err == datastore.ErrNoSuchEntity {
+		apierror.Respond(context, http.StatusNotFound, apierror.NotFound, "Territory does not exist")
+		return
+	} else if err != nil {
+		apierror.Respond(context, http.StatusInternalServerError, apierror.Internal, "Could not retrieve the territory: %+v", err)
+		return
+	}
+
+	var levelIds []string
+	if stored.Levels != nil {
+		levelIds = *stored.Levels
+	}
+	bundledLevels, missing, err := levels.LevelsWithAncestors(appengineContext, levelIds)
+	if err != nil {
+		apierror.Respond(context, http.StatusInternalServerError, apierror.Internal, "Could not load the territory's levels: %+v", err)
+		return
+	}
+
+	bundledIds := make([]string, len(bundledLevels))
+	for i, jsonLevel := range bundledLevels {
+		bundledIds[i] = *jsonLevel.Key
+	}
+	versions, err := levels.ChangeVersions(appengineContext, bundledIds)
+	if err != nil {
+		apierror.Respond(context, http.StatusInternalServerError, apierror.Internal, "Could not load the levels' versions: %+v", err)
+		return
+	}
+
+	context.JSON(http.StatusOK, &territoryBundle{
+		Territories: []*territory.Territory{stored},
+		Levels:      bundledLevels,
+		Missing:     missing,
+		Versions:    versions,
+	})
+}
@@ -0,0 +1,228 @@
+package territories
+
+import (
+	"net/http"
+
+	"appengine/datastore"
+
+	"github.com/gin-gonic/gin"
+
+	"bootcamp/editorservice/apierror"
+	"bootcamp/editorservice/ids"
+	"bootcamp/editorservice/levels"
+	"bootcamp/editorservice/levels/level"
+	"bootcamp/editorservice/requestid"
+)
+
+// --- Types and constants
+
+// How an import treats levels and territories that are already stored, selected
+// with ?conflict=.  fail refuses the whole import, skip keeps the stored ones
+// and writes the rest, and overwrite replaces them.
+const (
+	conflictFail      string = "fail"
+	conflictSkip      string = "skip"
+	conflictOverwrite string = "overwrite"
+)
+
+// importKeys lists levels and territories by key.
+type importKeys struct {
+	Levels      []string `json:"levels"`
+	Territories []string `json:"territories"`
+}
+
+type importResult struct {
+	Written importKeys `json:"written"`
+	Skipped importKeys `json:"skipped"`
+}
+
+// importRefused is the body of a 400 for a bundle that isn't consistent.
+type importRefused struct {
+	apierror.Response
+	Problems []levels.ImportProblem `json:"problems"`
+}
+
+// importConflict is the body of a 409 for a bundle with keys that are already
+// stored, when the conflict mode is fail.
+type importConflict struct {
+	apierror.Response
+	Existing importKeys `json:"existing"`
+}
+
+// --- Route handlers
+
+// handleImport serves POST /territories/import, which takes a bundle like the
+// one /territories/:id/export writes and stores its levels and its territory.
+// The bundle is checked first, and nothing is written if it doesn't hold
+// together.  The levels are written in one transaction and the territory after
+// them, so a territory that fails to write leaves its levels in place.
+//
+// With ?conflict=overwrite&skipOlder=true, stored entities written since the
+// bundle was exported are kept and reported as skipped, so an old bundle can't
+// roll back newer edits.  Levels are compared by the versions in the bundle and
+// the territory by its own version.
+func handleImport(context *gin.Context) {
+	conflict := context.DefaultQuery("conflict", conflictFail)
+	if conflict != conflictFail && conflict != conflictSkip && conflict != conflictOverwrite {
+		apierror.Respond(context, http.StatusBadRequest, apierror.InvalidRequest, "Unknown conflict mode %q", conflict)
+		return
+	}
+	skipOlder := context.Query("skipOlder") == "true"
+	if skipOlder && conflict != conflictOverwrite {
+		apierror.Respond(context, http.StatusBadRequest, apierror.InvalidRequest, "?skipOlder=true only applies with ?conflict=%s", conflictOverwrite)
+		return
+	}
+
+	var bundle territoryBundle
+	err := context.BindJSON(&bundle)
+	if err != nil {
+		apierror.Respond(context, http.StatusBadRequest, apierror.InvalidRequest, "Failed to unmarshal the JSON: %+v", err)
+		return
+	}
+	if len(bundle.Territories) != 1 || bundle.Territories[0] == nil {
+		apierror.Respond(context, http.StatusBadRequest, apierror.InvalidRequest, "The bundle must have exactly one territory, but this one has %d", len(bundle.Territories))
+		return
+	}
+	element := bundle.Territories[0]
+	if element.Id != nil && isReservedId(*element.Id) {
+		apierror.Respond(context, http.StatusBadRequest, apierror.InvalidRequest, "The territory id %q is reserved", *element.Id)
+		return
+	}
+	if err := checkLevelCount(nil, element); err != nil {
+		apierror.Respond(context, http.StatusBadRequest, apierror.ValidationFailed, "Could not import the territory: %+v", err)
+		return
+	}
+
+	// Check the bundle holds together
+	appengineContext := requestid.NewContext(context.Request)
+	problems, err := levels.ValidateImport(appengineContext, bundle.Levels, bundle.Territories)
+	if err != nil {
+		apierror.Respond(context, http.StatusInternalServerError, apierror.Internal, "Could not check the bundle: %+v", err)
+		return
+	}
+	if len(problems) > 0 {
+		context.JSON(http.StatusBadRequest, &importRefused{
+			Response: *apierror.New(apierror.ValidationFailed, "The bundle has %d problems", len(problems)),
+			Problems: problems,
+		})
+		return
+	}
+
+	// Find what's already stored
+	levelIds := make([]string, len(bundle.Levels))
+	for i, jsonLevel := range bundle.Levels {
+		levelIds[i] = *jsonLevel.Key
+	}
+	missing, err := levels.MissingLevels(appengineContext, levelIds)
+	if err != nil {
+		apierror.Respond(context, http.StatusInternalServerError, apierror.Internal, "Could not check which levels exist: %+v", err)
+		return
+	}
+	isNew := make(map[string]bool)
+	for _, levelId := range missing {
+		isNew[levelId] = true
+	}
+
+	existing := importKeys{Levels: []string{}, Territories: []string{}}
+	for _, levelId := range levelIds {
+		if !isNew[levelId] {
+			existing.Levels = append(existing.Levels, levelId)
+		}
+	}
+	storedTerritory, err := getStoredTerritory(appengineContext, *element.Id)
+	if err == nil {
+		existing.Territories = append(existing.Territories, *element.Id)
+	} else if err != datastore.ErrNoSuchEntity {
+		apierror.Respond(context, http.StatusInternalServerError, apierror.Internal, "Could not retrieve the territory: %+v", err)
+		return
+	}
+
+	// Settle the collisions
+	hasCollisions := len(existing.Levels) > 0 || len(existing.Territories) > 0
+	if conflict == conflictFail && hasCollisions {
+		context.JSON(http.StatusConflict, &importConflict{
+			Response: *apierror.New(apierror.Conflict, "Some of the bundle is already stored.  Import it with ?conflict=skip or ?conflict=overwrite."),
+			Existing: existing,
+		})
+		return
+	}
+
+	result := &importResult{
+		Written: importKeys{Levels: []string{}, Territories: []string{}},
+		Skipped: importKeys{Levels: []string{}, Territories: []string{}},
+	}
+	var storedVersions map[string]int64
+	if skipOlder {
+		storedVersions, err = levels.ChangeVersions(appengineContext, existing.Levels)
+		if err != nil {
+			apierror.Respond(context, http.StatusInternalServerError, apierror.Internal, "Could not load the levels' versions: %+v", err)
+			return
+		}
+	}
+
+	var written []*level.JsonLevel
+	for _, jsonLevel := range bundle.Levels {
+		levelId := *jsonLevel.Key
+		stale := skipOlder && olderThanStored(bundle.Versions, storedVersions, levelId)
+		if (conflict == conflictSkip || stale) && !isNew[levelId] {
+			result.Skipped.Levels = append(result.Skipped.Levels, levelId)
+			continue
+		}
+		written = append(written, jsonLevel)
+		result.Written.Levels = append(result.Written.Levels, levelId)
+	}
+
+	// Write the levels, then the territory
+	problems, err = levels.ImportLevels(appengineContext, written)
+	if err != nil {
+		apierror.Respond(context, http.StatusInternalServerError, apierror.Internal, "Failed to store the levels: %+v", err)
+		return
+	}
+	if len(problems) > 0 {
+		context.JSON(http.StatusBadRequest, &importRefused{
+			Response: *apierror.New(apierror.ValidationFailed, "The bundle has %d problems", len(problems)),
+			Problems: problems,
+		})
+		return
+	}
+
+	if len(existing.Territories) > 0 && (conflict == conflictSkip || skipOlder && element.OlderThan(storedTerritory)) {
+		result.Skipped.Territories = append(result.Skipped.Territories, *element.Id)
+		context.JSON(http.StatusOK, result)
+		return
+	}
+
+	err = putTerritory(appengineContext, element)
+	if _, isCycle := err.(*requirementCycleError); isCycle {
+		apierror.Respond(context, http.StatusConflict, apierror.CycleDetected, "Could not store the territory: %+v", err)
+		return
+	} else if err == datastore.ErrConcurrentTransaction {
+		apierror.Respond(context, http.StatusConflict, apierror.Conflict, "The territory was changed by another request at the same time.  Try again.")
+		return
+	} else if ids.IsKeyError(err) {
+		apierror.Respond(context, http.StatusBadRequest, apierror.InvalidRequest, "Invalid territory id: %+v", err)
+		return
+	} else if err != nil {
+		apierror.Respond(context, http.StatusInternalServerError, apierror.Internal, "Failed to store the territory: %+v", err)
+		return
+	}
+	result.Written.Territories = append(result.Written.Territories, *element.Id)
+
+	// Invalidate everything, then fill in the territory itself for the next read
+	invalidateResponseCache(appengineContext, *element.Id)
+	invalidateQueryCaches(appengineContext)
+	prewarmResponseCache(appengineContext, *element.Id)
+
+	context.JSON(http.StatusOK, result)
+}
+
+// --- Helpers
+
+// olderThanStored reports whether a bundle's copy of a stored level predates the
+// stored level's last write.  A level the bundle has no version for counts as
+// older, so that a bundle exported before versions were included can't roll
+// anything back.
+func olderThanStored(bundleVersions map[string]int64, storedVersions map[string]int64, levelId string) bool {
+	bundleVersion, ok := bundleVersions[levelId]
+	return !ok || bundleVersion < storedVersions[levelId]
+}
@@ -0,0 +1,230 @@
+package territories
+
+import (
+	"fmt"
+	"net/http"
+
+	"appengine"
+	"appengine/datastore"
+
+	"github.com/gin-gonic/gin"
+
+	"bootcamp/editorservice/apierror"
+	"bootcamp/editorservice/config"
+	"bootcamp/editorservice/flags"
+	"bootcamp/editorservice/ids"
+	"bootcamp/editorservice/levels"
+	"bootcamp/editorservice/requestid"
+	"bootcamp/editorservice/territories/territory"
+)
+
+// --- Types and constants
+
+// levelsRequest is the body of the routes that change a territory's levels.
+// Version is optional; when it's given, the change is rejected with a 409 if the
+// territory has been written since the client read that version.
+type levelsRequest struct {
+	Levels  []string `json:"levels"`
+	Version *int64   `json:"version,omitempty"`
+}
+
+// referenceWarning is a level a written territory lists that doesn't exist, or
+// whose id can't be a level id at all.
+type referenceWarning struct {
+	Key     string        `json:"key"`
+	Code    apierror.Code `json:"code"`
+	Message string        `json:"message"`
+}
+
+// referenceWarnings is the body of a write that went through despite listing
+// levels that don't exist.
+type referenceWarnings struct {
+	Warnings []referenceWarning `json:"warnings"`
+}
+
+// malformedLevelIds is the body of a 400 for a write listing ids that can't be
+// level ids.
+type malformedLevelIds struct {
+	apierror.Response
+	Invalid []referenceWarning `json:"invalid"`
+}
+
+// tooManyLevelsError refuses a write that would leave a territory listing more
+// than config.MaxTerritoryLevels distinct levels.
+type tooManyLevelsError struct {
+	Count int
+}
+
+func (err *tooManyLevelsError) Error() string {
+	return fmt.Sprintf("territories: the territory would list %d levels, but at most %d are allowed", err.Count, config.MaxTerritoryLevels)
+}
+
+// territoryWithWarnings is a territory response with the same warnings added
+// alongside its fields.
+type territoryWithWarnings struct {
+	*territory.Territory
+	Warnings []referenceWarning `json:"warnings,omitempty"`
+}
+
+// --- Route handlers
+
+// handleAddLevels adds levels to the end of a territory's list, skipping any
+// that are already there.
+func handleAddLevels(context *gin.Context) {
+	updateLevels(context, true, func(stored *territory.Territory, levels []string) error {
+		stored.AddLevels(levels)
+		return nil
+	})
+}
+
+// handleRemoveLevels drops levels from a territory's list.
+func handleRemoveLevels(context *gin.Context) {
+	updateLevels(context, false, func(stored *territory.Territory, levels []string) error {
+		stored.RemoveLevels(levels)
+		return nil
+	})
+}
+
+// handleReorderLevels puts a territory's levels in a new order.  The request
+// must list exactly the levels the territory has.
+func handleReorderLevels(context *gin.Context) {
+	updateLevels(context, false, func(stored *territory.Territory, levels []string) error {
+		return stored.ReorderLevels(levels)
+	})
+}
+
+// handleCopyLevels replaces a territory's levels with another territory's, or
+// with ?levelsMode=append adds them to the end like PATCH does.  Both are read
+// in the same transaction, so the copy is of one consistent source.
+func handleCopyLevels(context *gin.Context) {
+	levelsMode := context.DefaultQuery("levelsMode", levelsModeReplace)
+	if levelsMode != levelsModeReplace && levelsMode != levelsModeAppend {
+		apierror.Respond(context, http.StatusBadRequest, apierror.InvalidRequest, "Unknown levelsMode %q", levelsMode)
+		return
+	}
+
+	sourceId := context.Param("sourceId")
+	updateStored(context, nil, nil, func(transactionContext appengine.Context, stored *territory.Territory) error {
+		source, err := getStoredTerritory(transactionContext, sourceId)
+		if err == datastore.ErrNoSuchEntity {
+			return errSourceMissing
+		} else if err != nil {
+			return err
+		}
+
+		levels := []string{}
+		if source.Levels != nil {
+			levels = append(levels, *source.Levels...)
+		}
+		if levelsMode == levelsModeAppend {
+			stored.AddLevels(levels)
+		} else {
+			stored.Levels = &levels
+		}
+		return nil
+	})
+}
+
+// --- Helpers
+
+// updateLevels applies change to the territory's levels with updateStored.
+// Routes that add levels have them checked with checkLevelReferences first.
+func updateLevels(context *gin.Context, addsLevels bool, change func(stored *territory.Territory, levels []string) error) {
+	var request levelsRequest
+	err := context.BindJSON(&request)
+	if err != nil {
+		apierror.Respond(context, http.StatusBadRequest, apierror.InvalidRequest, "Failed to unmarshal the JSON: %+v", err)
+		return
+	}
+
+	var warnings []referenceWarning
+	if addsLevels {
+		var ok bool
+		warnings, ok = checkLevelReferences(context, request.Levels)
+		if !ok {
+			return
+		}
+	}
+
+	updateStored(context, request.Version, warnings, func(transactionContext appengine.Context, stored *territory.Territory) error {
+		return change(stored, request.Levels)
+	})
+}
+
+// checkLevelReferences warns about each of levelIds that isn't stored.  With
+// config.StrictReferences they're refused instead, and it responds with a 400
+// and returns false.  It also returns false after responding to an error, or
+// to ids that checkLevelIds refuses.
+func checkLevelReferences(context *gin.Context, levelIds []string) ([]referenceWarning, bool) {
+	if !checkLevelIds(context, levelIds) {
+		return nil, false
+	}
+
+	appengineContext := requestid.NewContext(context.Request)
+	missing, err := levels.MissingLevels(appengineContext, levelIds)
+	if err != nil {
+		apierror.Respond(context, http.StatusInternalServerError, apierror.Internal, "Could not check the levels: %+v", err)
+		return nil, false
+	}
+	if len(missing) == 0 {
+		return nil, true
+	}
+	if config.StrictReferences {
+		apierror.Respond(context, http.StatusBadRequest, apierror.NotFound, "These levels do not exist: %v", missing)
+		return nil, false
+	}
+
+	var warnings []referenceWarning
+	for _, levelId := range missing {
+		warnings = append(warnings, referenceWarning{
+			Key:     levelId,
+			Code:    apierror.NotFound,
+			Message: fmt.Sprintf("The level %q does not exist", levelId),
+		})
+	}
+
+	return warnings, true
+}
+
+// checkLevelCount returns a *tooManyLevelsError if next, the territory as it's
+// about to be stored, lists more distinct levels than config.MaxTerritoryLevels.
+// Territories stored over the cap before it was lowered may keep their levels or
+// lose some, but not gain any, so previous is the stored territory or nil.
+func checkLevelCount(previous *territory.Territory, next *territory.Territory) error {
+	count := next.LevelCount()
+	if config.MaxTerritoryLevels <= 0 || count <= config.MaxTerritoryLevels {
+		return nil
+	}
+	if previous != nil && count <= previous.LevelCount() {
+		return nil
+	}
+
+	return &tooManyLevelsError{Count: count}
+}
+
+// checkLevelIds refuses levelIds that can't be level ids, whether or not such a
+// level could exist, so typos like an empty entry are caught on write.  With
+// normalize_ids, ids that aren't canonical are refused too.  It responds with a
+// 400 listing them and returns false if there are any.
+func checkLevelIds(context *gin.Context, levelIds []string) bool {
+	check := ids.Check
+	if flags.NormalizeIds.Enabled {
+		check = ids.CheckCanonical
+	}
+
+	var invalid []referenceWarning
+	for _, levelId := range levelIds {
+		if err := check(levelId); err != nil {
+			invalid = append(invalid, referenceWarning{Key: levelId, Code: apierror.InvalidRequest, Message: err.Error()})
+		}
+	}
+	if len(invalid) == 0 {
+		return true
+	}
+
+	context.JSON(http.StatusBadRequest, &malformedLevelIds{
+		Response: *apierror.New(apierror.InvalidRequest, "The territory lists %d malformed level ids", len(invalid)),
+		Invalid:  invalid,
+	})
+	return false
+}
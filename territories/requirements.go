@@ -0,0 +1,57 @@
+package territories
+
+import (
+	"strings"
+
+	"appengine"
+	"appengine/datastore"
+
+	"bootcamp/editorservice/mismatch"
+	"bootcamp/editorservice/territories/territory"
+)
+
+// --- Types and constants
+
+// requirementCycleError reports unlock requirements that lead from a territory
+// back to itself.
+type requirementCycleError struct {
+	Cycle []string
+}
+
+func (err *requirementCycleError) Error() string {
+	return "territories: the unlock requirements form a cycle: " + strings.Join(err.Cycle, " -> ")
+}
+
+// --- Helpers
+
+// checkRequirementCycle makes sure that storing t wouldn't let its unlock
+// requirements lead back to it.  Call it in the same transaction as the write.
+func checkRequirementCycle(context appengine.Context, t *territory.Territory) error {
+	if t.RequiresTerritories == nil || len(*t.RequiresTerritories) == 0 {
+		return nil
+	}
+
+	// Gather everyone's requirements, with t's as they're about to be stored
+	var stored []*territory.Territory
+	query := datastore.NewQuery(kind).Ancestor(getTerritoryRootKey(context))
+	_, err := query.GetAll(context, &stored)
+	err = mismatch.Ignore(context, err)
+	if err != nil {
+		return err
+	}
+
+	requires := make(map[string][]string)
+	for _, element := range stored {
+		if element.Id != nil && element.RequiresTerritories != nil {
+			requires[*element.Id] = *element.RequiresTerritories
+		}
+	}
+	requires[*t.Id] = *t.RequiresTerritories
+
+	cycle := territory.FindRequirementCycle(*t.Id, requires)
+	if cycle != nil {
+		return &requirementCycleError{Cycle: cycle}
+	}
+
+	return nil
+}
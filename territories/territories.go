@@ -2,7 +2,7 @@
 package territories
 
 import (
-	"encoding/json"
+	"errors"
 	"net/http"
 
 	"appengine"
@@ -10,84 +10,110 @@ import (
 
 	"github.com/gin-gonic/gin"
 
+	"bootcamp/editorservice/apierror"
 	"bootcamp/editorservice/cache"
+	"bootcamp/editorservice/deleted"
+	"bootcamp/editorservice/etag"
+	"bootcamp/editorservice/flags"
+	"bootcamp/editorservice/ids"
+	"bootcamp/editorservice/levels"
+	"bootcamp/editorservice/mismatch"
+	"bootcamp/editorservice/requestid"
 	"bootcamp/editorservice/territories/territory"
 )
 
 // --- Types and constants
 
-const kind string = "Territory"
+const kind string = territory.Kind
 const queryAllKey string = "query:all@territories"
+const queryArchivedKey string = "query:archived@territories"
 
-// All territories share a single entity root.  This isn't really important.
-const territoryRootKeyName string = "TerritoryRoot"
+// queryLimit is how many territories the territory list holds.
+const queryLimit int = 100
 
-var territoryRootKey *datastore.Key
-
-// -- Response cache
+var (
+	errCacheSkipped    = errors.New("territories: the cache was skipped")
+	errVersionConflict = errors.New("territories: the territory was changed since that version")
+	errSourceMissing   = errors.New("territories: the source territory does not exist")
+)
 
-type responseCacheEntry struct {
-	Path     string
-	Code     int
-	Response interface{}
-}
+// How PATCH treats the levels list, selected with ?levelsMode=
+const (
+	levelsModeReplace string = "replace"
+	levelsModeAppend  string = "append"
+)
 
-func (entry *responseCacheEntry) GetCacheKey() string {
-	return "response:" + entry.Path
-}
+// --- Route handlers
 
-func (entry *responseCacheEntry) MarshalBinary() ([]byte, error) {
-	return json.Marshal(entry)
-}
+// Collection-wide routes share the /territories/:id pattern with single
+// territories, so their names can't be used as territory ids.
+var collectionPostRoutes map[string]gin.HandlerFunc
 
-func (entry *responseCacheEntry) UnmarshalBinary(data []byte) error {
-	return json.Unmarshal(data, entry)
+func init() {
+	collectionPostRoutes = map[string]gin.HandlerFunc{
+		"batch-get": handleBatchGet,
+		"import":    handleImport,
+		"validate":  handleValidateBody,
+	}
 }
 
-// --- Route handlers
-
 // Init sets up routes for this resource
 func Init(router *gin.Engine) {
 	router.GET("/territories/:id", handleGet)
 	router.POST("/territories/:id", handlePost)
 	router.PUT("/territories/:id", handlePut)
+	router.PATCH("/territories/:id", handlePatch)
 	router.DELETE("/territories/:id", handleDelete)
+	router.POST("/territories/:id/levels/add", handleAddLevels)
+	router.POST("/territories/:id/levels/remove", handleRemoveLevels)
+	router.POST("/territories/:id/levels/reorder", handleReorderLevels)
+	router.POST("/territories/:id/copy-levels-from/:sourceId", handleCopyLevels)
+	router.GET("/territories/:id/export", handleExport)
+	router.POST("/territories/:id/archive", handleArchive)
+	router.POST("/territories/:id/restore", handleRestore)
+	router.POST("/territories/:id/validate", handleValidate)
 	router.GET("/territories", handleQuery)
 }
 
 func handleGet(context *gin.Context) {
 	path := context.Request.URL.Path
 	territoryId := context.Param("id")
-	appengineContext := appengine.NewContext(context.Request)
+	appengineContext := requestid.NewContext(context.Request)
 	result := &territory.Territory{}
 
-	// Check response cache
-	cachedResponse := &responseCacheEntry{Path: path}
-	err := cache.GetCachedResource(appengineContext, cachedResponse)
+	// Check response cache.  Cache-Control: no-cache skips it, but still refreshes it.
+	cachedResponse := &cache.ResponseEntry{Path: path}
+	err := errCacheSkipped
+	if !cache.WantsFreshData(context.Request) {
+		err = cache.GetCachedResource(appengineContext, cachedResponse)
+	}
 	if err == nil {
 		context.JSON(cachedResponse.Code, cachedResponse.Response)
 		return
 	} else /*err != nil*/ {
 		// Check datastore
 		err = datastore.Get(appengineContext, makeDatastoreKey(appengineContext, territoryId), result)
+		err = mismatch.Ignore(appengineContext, err)
 		if err == datastore.ErrNoSuchEntity {
-			cacheEntry := responseCacheEntry{
+			cacheEntry := cache.ResponseEntry{
 				Path:     path,
 				Code:     http.StatusNotFound,
-				Response: "Territory does not exist",
+				Response: apierror.New(apierror.NotFound, "Territory does not exist"),
+			}
+			if cachesMisses(context) {
+				cache.CacheResource(appengineContext, &cacheEntry)
 			}
-			cache.CacheResource(appengineContext, &cacheEntry)
-			context.String(cacheEntry.Code, cacheEntry.Response.(string))
+			context.JSON(cacheEntry.Code, cacheEntry.Response)
 			return
 		} else if err != nil {
-			context.String(http.StatusInternalServerError, "Could not retrieve the territory: %+v\n", err)
+			apierror.Respond(context, http.StatusInternalServerError, apierror.Internal, "Could not retrieve the territory: %+v", err)
 			return
 		}
 	}
 
 	// If we got this far, then we found the territory
 	// Cache and return the result
-	cacheEntry := &responseCacheEntry{
+	cacheEntry := &cache.ResponseEntry{
 		Path:     path,
 		Code:     http.StatusOK,
 		Response: result,
@@ -98,30 +124,72 @@ func handleGet(context *gin.Context) {
 }
 
 func handlePost(context *gin.Context) {
+	if handler, ok := collectionPostRoutes[context.Param("id")]; ok && context.Request.Method == "POST" {
+		handler(context)
+		return
+	}
+
 	var territory territory.Territory
 
 	// Unmarshal
 	err := context.BindJSON(&territory)
 	if err != nil {
-		context.String(http.StatusBadRequest, "Failed to unmarshal the JSON: %+v\n", err)
+		apierror.Respond(context, http.StatusBadRequest, apierror.InvalidRequest, "Failed to unmarshal the JSON: %+v", err)
 		return
 	}
 
 	// The territory id must come from the URL path
 	territory.Id = new(string)
 	*territory.Id = context.Param("id")
-
-	// Write to datastore
-	appengineContext := appengine.NewContext(context.Request)
-	_, err = datastore.Put(appengineContext, makeDatastoreKey(appengineContext, *territory.Id), &territory)
+	if isReservedId(*territory.Id) {
+		apierror.Respond(context, http.StatusBadRequest, apierror.InvalidRequest, "The territory id %q is reserved", *territory.Id)
+		return
+	}
+	err = ids.Check(*territory.Id)
 	if err != nil {
-		context.String(http.StatusInternalServerError, "Failed to store the territory: %+v", err)
+		apierror.Respond(context, http.StatusBadRequest, apierror.InvalidRequest, "Invalid territory id: %+v", err)
 		return
 	}
 
-	// Invalidate everything
+	// Check the levels it lists exist
+	var warnings []referenceWarning
+	if territory.Levels != nil {
+		var ok bool
+		warnings, ok = checkLevelReferences(context, *territory.Levels)
+		if !ok {
+			return
+		}
+	}
+
+	// Write to datastore, making sure the unlock requirements don't lead back around
+	appengineContext := requestid.NewContext(context.Request)
+	err = putTerritory(appengineContext, &territory)
+	if _, isCycle := err.(*requirementCycleError); isCycle {
+		apierror.Respond(context, http.StatusConflict, apierror.CycleDetected, "Could not store the territory: %+v", err)
+		return
+	} else if _, tooMany := err.(*tooManyLevelsError); tooMany {
+		apierror.Respond(context, http.StatusBadRequest, apierror.ValidationFailed, "Could not store the territory: %+v", err)
+		return
+	} else if err == datastore.ErrConcurrentTransaction {
+		apierror.Respond(context, http.StatusConflict, apierror.Conflict, "The territory was changed by another request at the same time.  Try again.")
+		return
+	} else if ids.IsKeyError(err) {
+		apierror.Respond(context, http.StatusBadRequest, apierror.InvalidRequest, "Invalid territory id: %+v", err)
+		return
+	} else if err != nil {
+		apierror.Respond(context, http.StatusInternalServerError, apierror.Internal, "Failed to store the territory: %+v", err)
+		return
+	}
+
+	// Invalidate everything, then fill in the territory itself for the next read
 	invalidateResponseCache(appengineContext, *territory.Id)
 	invalidateQueryCaches(appengineContext)
+	prewarmResponseCache(appengineContext, *territory.Id)
+
+	if len(warnings) > 0 {
+		context.JSON(http.StatusOK, &referenceWarnings{Warnings: warnings})
+		return
+	}
 
 	context.JSON(http.StatusOK, nil)
 }
@@ -130,14 +198,116 @@ func handlePut(context *gin.Context) {
 	handlePost(context)
 }
 
+func handlePatch(context *gin.Context) {
+	levelsMode := context.DefaultQuery("levelsMode", levelsModeReplace)
+	if levelsMode != levelsModeReplace && levelsMode != levelsModeAppend {
+		apierror.Respond(context, http.StatusBadRequest, apierror.InvalidRequest, "Unknown levelsMode %q", levelsMode)
+		return
+	}
+
+	// Unmarshal
+	var patch territory.Territory
+	err := context.BindJSON(&patch)
+	if err != nil {
+		apierror.Respond(context, http.StatusBadRequest, apierror.InvalidRequest, "Failed to unmarshal the JSON: %+v", err)
+		return
+	}
+
+	// Check the levels it lists exist
+	var warnings []referenceWarning
+	if patch.Levels != nil {
+		var ok bool
+		warnings, ok = checkLevelReferences(context, *patch.Levels)
+		if !ok {
+			return
+		}
+	}
+
+	// Apply the patch to the stored territory.  This happens in a transaction so that
+	// concurrent appends to the levels list can't overwrite each other, and a patch
+	// that gives a version is rejected if the territory has moved past it.
+	territoryId := context.Param("id")
+	appengineContext := requestid.NewContext(context.Request)
+	key := makeDatastoreKey(appengineContext, territoryId)
+	err = datastore.RunInTransaction(appengineContext, func(transactionContext appengine.Context) error {
+		stored, err := getStoredTerritory(transactionContext, territoryId)
+		if err != nil {
+			return err
+		}
+		if !stored.VersionMatches(patch.Version) {
+			return errVersionConflict
+		}
+
+		previous := *stored
+		stored.Patch(&patch, levelsMode == levelsModeAppend)
+		stored.NextVersion(stored)
+		stored.Id = &territoryId
+		err = checkLevelCount(&previous, stored)
+		if err != nil {
+			return err
+		}
+		err = checkRequirementCycle(transactionContext, stored)
+		if err != nil {
+			return err
+		}
+
+		_, err = datastore.Put(transactionContext, key, stored)
+		return err
+	}, nil)
+	if err == datastore.ErrNoSuchEntity {
+		apierror.Respond(context, http.StatusNotFound, apierror.NotFound, "Territory does not exist")
+		return
+	} else if _, isCycle := err.(*requirementCycleError); isCycle {
+		apierror.Respond(context, http.StatusConflict, apierror.CycleDetected, "Could not update the territory: %+v", err)
+		return
+	} else if _, tooMany := err.(*tooManyLevelsError); tooMany {
+		apierror.Respond(context, http.StatusBadRequest, apierror.ValidationFailed, "Could not update the territory: %+v", err)
+		return
+	} else if err == errVersionConflict || err == datastore.ErrConcurrentTransaction {
+		apierror.Respond(context, http.StatusConflict, apierror.Conflict, "Could not update the territory: %+v", err)
+		return
+	} else if err != nil {
+		apierror.Respond(context, http.StatusInternalServerError, apierror.Internal, "Failed to update the territory: %+v", err)
+		return
+	}
+
+	// Invalidate everything, then fill in the territory itself for the next read
+	invalidateResponseCache(appengineContext, territoryId)
+	invalidateQueryCaches(appengineContext)
+	prewarmResponseCache(appengineContext, territoryId)
+
+	if len(warnings) > 0 {
+		context.JSON(http.StatusOK, &referenceWarnings{Warnings: warnings})
+		return
+	}
+
+	context.JSON(http.StatusOK, nil)
+}
+
 func handleDelete(context *gin.Context) {
 	territoryId := context.Param("id")
-	appengineContext := appengine.NewContext(context.Request)
+	appengineContext := requestid.NewContext(context.Request)
+
+	// Delete from datastore.  With strict_delete, a territory that doesn't exist
+	// is a 404.
+	var err error
+	if flags.StrictDelete.Enabled {
+		err = datastore.RunInTransaction(appengineContext, func(transactionContext appengine.Context) error {
+			_, err := getStoredTerritory(transactionContext, territoryId)
+			if err != nil {
+				return err
+			}
 
-	// Delete from datastore
-	err := datastore.Delete(appengineContext, makeDatastoreKey(appengineContext, territoryId))
-	if err != nil {
-		context.String(http.StatusInternalServerError, "Failed to delete the territory: %+v", err)
+			return datastore.Delete(transactionContext, makeDatastoreKey(transactionContext, territoryId))
+		}, nil)
+	} else {
+		err = datastore.Delete(appengineContext, makeDatastoreKey(appengineContext, territoryId))
+	}
+	if err == datastore.ErrNoSuchEntity {
+		apierror.Respond(context, http.StatusNotFound, apierror.NotFound, "Territory does not exist")
+		return
+	} else if err != nil {
+		apierror.Respond(context, http.StatusInternalServerError, apierror.Internal, "Failed to delete the territory: %+v", err)
 		return
 	}
 
@@ -145,32 +315,85 @@ func handleDelete(context *gin.Context) {
 	invalidateResponseCache(appengineContext, territoryId)
 	invalidateQueryCaches(appengineContext)
 
-	context.JSON(http.StatusOK, nil)
+	deleted.Respond(context)
 }
 
+// handleQuery lists the territories that aren't archived, or with ?archived=true
+// the ones that are.
 func handleQuery(context *gin.Context) {
-	appengineContext := appengine.NewContext(context.Request)
+	appengineContext := requestid.NewContext(context.Request)
+	archived := context.Query("archived") == "true"
+	cacheKey := queryAllKey
+	if archived {
+		cacheKey = queryArchivedKey
+	}
 
 	// Check response cache
-	responseEntry := &responseCacheEntry{Path: queryAllKey}
+	responseEntry := &cache.ResponseEntry{Path: cacheKey}
 	err := cache.GetCachedResource(appengineContext, responseEntry)
 	if err == nil {
+		if etag.NotModified(context, responseEntry.ETag) {
+			return
+		}
 		context.JSON(responseEntry.Code, responseEntry.Response)
 		return
 	}
 
-	// Query to get all the territories
+	// Query to get the first queryLimit territories.  Older territories don't
+	// have the archived property at all, so they're sorted out here rather than
+	// by a filter, a page at a time until there are enough.
 	var response []*territory.Territory
-	query := datastore.NewQuery(kind).Ancestor(getTerritoryRootKey(appengineContext)).Limit(100)
-	_, err = query.GetAll(appengineContext, &response)
+	var cursor *datastore.Cursor
+	for len(response) < queryLimit {
+		query := datastore.NewQuery(kind).Ancestor(getTerritoryRootKey(appengineContext)).Limit(queryLimit)
+		if cursor != nil {
+			query = query.Start(*cursor)
+		}
+
+		iterator := query.Run(appengineContext)
+		count := 0
+		for len(response) < queryLimit {
+			element := &territory.Territory{}
+			_, err = iterator.Next(element)
+			if err == datastore.Done {
+				break
+			}
+			err = mismatch.Ignore(appengineContext, err)
+			if err != nil {
+				apierror.Respond(context, http.StatusInternalServerError, apierror.Internal, "Could not query the territories: %+v", err)
+				return
+			}
+
+			count++
+			if element.IsArchived() == archived {
+				response = append(response, element)
+			}
+		}
+
+		// A short page is the last one
+		if count < queryLimit || len(response) == queryLimit {
+			break
+		}
+
+		next, err := iterator.Cursor()
+		if err != nil {
+			apierror.Respond(context, http.StatusInternalServerError, apierror.Internal, "Could not query the territories: %+v", err)
+			return
+		}
+		cursor = &next
+	}
 
 	// Cache and return the result
-	cacheEntry := &responseCacheEntry{
-		Path:     queryAllKey,
+	cacheEntry := &cache.ResponseEntry{
+		Path:     cacheKey,
 		Code:     http.StatusOK,
 		Response: response,
+		ETag:     etag.Of(response),
 	}
 	cache.CacheResource(appengineContext, cacheEntry)
+	if etag.NotModified(context, cacheEntry.ETag) {
+		return
+	}
 	context.JSON(cacheEntry.Code, cacheEntry.Response)
 }
 
@@ -180,24 +403,182 @@ func buildResourcePath(territoryId string) string {
 	return "/territories/" + territoryId
 }
 
+// cachesMisses reports whether a 404 may be cached for the request, which
+// ?cacheMiss=false turns off.
+func cachesMisses(context *gin.Context) bool {
+	return context.Query("cacheMiss") != "false"
+}
+
+func isReservedId(territoryId string) bool {
+	_, isPostRoute := collectionPostRoutes[territoryId]
+	return isPostRoute
+}
+
+// updateStored applies change to the stored territory as a read-modify-write in
+// a transaction, so that concurrent changes either serialize or fail with a 409
+// instead of overwriting each other.  A non-nil expected version must match the
+// stored one.  The updated territory is returned so that clients have its new
+// version, along with any warnings.
+func updateStored(context *gin.Context, expected *int64, warnings []referenceWarning, change func(transactionContext appengine.Context, stored *territory.Territory) error) {
+	territoryId := context.Param("id")
+	appengineContext := requestid.NewContext(context.Request)
+	var result *territory.Territory
+	err := datastore.RunInTransaction(appengineContext, func(transactionContext appengine.Context) error {
+		stored, err := getStoredTerritory(transactionContext, territoryId)
+		if err != nil {
+			return err
+		}
+		if !stored.VersionMatches(expected) {
+			return errVersionConflict
+		}
+
+		previous := *stored
+		err = change(transactionContext, stored)
+		if err != nil {
+			return err
+		}
+		err = checkLevelCount(&previous, stored)
+		if err != nil {
+			return err
+		}
+		stored.NextVersion(stored)
+
+		_, err = datastore.Put(transactionContext, makeDatastoreKey(transactionContext, territoryId), stored)
+		result = stored
+		return err
+	}, nil)
+	if err == datastore.ErrNoSuchEntity {
+		apierror.Respond(context, http.StatusNotFound, apierror.NotFound, "Territory does not exist")
+		return
+	} else if err == errSourceMissing {
+		apierror.Respond(context, http.StatusNotFound, apierror.NotFound, "Could not update the territory: %+v", err)
+		return
+	} else if _, tooMany := err.(*tooManyLevelsError); tooMany {
+		apierror.Respond(context, http.StatusBadRequest, apierror.ValidationFailed, "Could not update the territory: %+v", err)
+		return
+	} else if err == errVersionConflict || err == territory.ErrLevelsChanged || err == datastore.ErrConcurrentTransaction {
+		apierror.Respond(context, http.StatusConflict, apierror.Conflict, "Could not update the territory: %+v", err)
+		return
+	} else if err != nil {
+		apierror.Respond(context, http.StatusInternalServerError, apierror.Internal, "Failed to update the territory: %+v", err)
+		return
+	}
+
+	// Invalidate everything, then fill in the territory itself for the next read
+	invalidateResponseCache(appengineContext, territoryId)
+	invalidateQueryCaches(appengineContext)
+	prewarmResponseCache(appengineContext, territoryId)
+
+	if len(warnings) > 0 {
+		context.JSON(http.StatusOK, &territoryWithWarnings{Territory: result, Warnings: warnings})
+		return
+	}
+
+	context.JSON(http.StatusOK, result)
+}
+
+// putTerritory writes a whole territory in a transaction, after checking it
+// doesn't list too many levels and its unlock requirements don't lead back
+// around to it.  Its version follows on from the stored one, and whether it's
+// archived is kept as it was.
+func putTerritory(appengineContext appengine.Context, element *territory.Territory) error {
+	return datastore.RunInTransaction(appengineContext, func(transactionContext appengine.Context) error {
+		err := checkRequirementCycle(transactionContext, element)
+		if err != nil {
+			return err
+		}
+
+		previous, err := getStoredTerritory(transactionContext, *element.Id)
+		if err == datastore.ErrNoSuchEntity {
+			previous = nil
+		} else if err != nil {
+			return err
+		}
+		err = checkLevelCount(previous, element)
+		if err != nil {
+			return err
+		}
+		element.NextVersion(previous)
+
+		// A whole write doesn't change whether it's archived
+		element.Archived = nil
+		if previous != nil {
+			element.Archived = previous.Archived
+		}
+
+		_, err = datastore.Put(transactionContext, makeDatastoreKey(transactionContext, *element.Id), element)
+		return err
+	}, nil)
+}
+
+// getStoredTerritory loads a territory straight from the datastore.
+func getStoredTerritory(context appengine.Context, territoryId string) (*territory.Territory, error) {
+	result := &territory.Territory{}
+	err := datastore.Get(context, makeDatastoreKey(context, territoryId), result)
+	err = mismatch.Ignore(context, err)
+	if err != nil {
+		return nil, err
+	}
+
+	return result, nil
+}
+
 func invalidateResponseCache(context appengine.Context, territoryId string) {
-	responseEntry := &responseCacheEntry{Path: buildResourcePath(territoryId)}
+	responseEntry := &cache.ResponseEntry{Path: buildResourcePath(territoryId)}
 	cache.InvalidateCacheEntry(context, responseEntry)
 }
 
+// prewarmResponseCache caches the response for a territory that was just
+// written.  It fills through a lease, so a write that lands in the meantime wins.
+func prewarmResponseCache(context appengine.Context, territoryId string) {
+	responseEntry := &cache.ResponseEntry{Path: buildResourcePath(territoryId)}
+	lease := cache.TakeLease(context, responseEntry)
+
+	result := &territory.Territory{}
+	err := datastore.Get(context, makeDatastoreKey(context, territoryId), result)
+	err = mismatch.Ignore(context, err)
+	if err != nil {
+		return
+	}
+
+	responseEntry.Code = http.StatusOK
+	responseEntry.Response = result
+	cache.CacheResourceWithLease(context, lease, responseEntry)
+}
+
 func invalidateQueryCaches(context appengine.Context) {
 	// Query-all cache
-	queryAllEntry := &responseCacheEntry{Path: queryAllKey}
+	queryAllEntry := &cache.ResponseEntry{Path: queryAllKey}
 	cache.InvalidateCacheEntry(context, queryAllEntry)
+	queryArchivedEntry := &cache.ResponseEntry{Path: queryArchivedKey}
+	cache.InvalidateCacheEntry(context, queryArchivedEntry)
+
+	// Level queries that look at territory assignments
+	levels.InvalidateTerritoryCaches(context)
 }
 
-func getTerritoryRootKey(context appengine.Context) *datastore.Key {
-	if territoryRootKey != nil {
-		return territoryRootKey
+// InvalidateAllCaches drops every cached territory response, and the territory
+// queries.  Lifting cache maintenance calls it, since anything cached before the
+// migration may be stale.
+func InvalidateAllCaches(context appengine.Context) error {
+	keys, err := datastore.NewQuery(kind).Ancestor(getTerritoryRootKey(context)).KeysOnly().GetAll(context, nil)
+	if err != nil {
+		return err
 	}
 
-	territoryRootKey = datastore.NewKey(context, kind, territoryRootKeyName, 0, nil)
-	return territoryRootKey
+	cacheKeys := []string{
+		(&cache.ResponseEntry{Path: queryAllKey}).GetCacheKey(),
+		(&cache.ResponseEntry{Path: queryArchivedKey}).GetCacheKey(),
+	}
+	for _, key := range keys {
+		cacheKeys = append(cacheKeys, (&cache.ResponseEntry{Path: buildResourcePath(key.StringID())}).GetCacheKey())
+	}
+
+	return cache.InvalidateCacheKeys(context, cacheKeys)
+}
+
+func getTerritoryRootKey(context appengine.Context) *datastore.Key {
+	return territory.RootKey(context)
 }
 
 func makeDatastoreKey(context appengine.Context, key string) *datastore.Key {
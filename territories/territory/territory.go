@@ -1,19 +1,280 @@
 package territory
 
-import "appengine/datastore"
+import (
+	"encoding/json"
+	"errors"
+	"sort"
+
+	"appengine"
+	"appengine/datastore"
+)
+
+// --- Types and constants
+
+// Kind is the datastore kind for territories.
+const Kind string = "Territory"
+
+// All territories share a single entity root.  This isn't really important.
+const rootKeyName string = "TerritoryRoot"
+
+var rootKey *datastore.Key
+
+var ErrLevelsChanged = errors.New("territory: the levels don't match the territory's current levels")
 
 // --- Type definition
 
+// Territory keeps every field as a pointer that's nil when it's unset, like
+// levels do, so that false or 0 can be told apart from a field that was left
+// out.  PATCH relies on it to change only what it's sent.  The datastore form
+// keeps a Has* flag beside each field for the same reason, and new fields should
+// follow suit.
 type Territory struct {
 	Id       *string   `json:"id,omitempty"`
 	Sequence *int32    `json:"sequence,omitempty"`
 	Name     *string   `json:"name,omitempty"`
 	Levels   *[]string `json:"levels"`
+
+	// The world the territory belongs to, and the territories that must be
+	// completed before it unlocks.
+	World               *string   `json:"world,omitempty"`
+	RequiresTerritories *[]string `json:"requires_territories,omitempty"`
+
+	// Archived territories are kept, but left out of the territory list.  The
+	// archive and restore routes change it, and so does a PATCH that sets it; a PUT
+	// keeps it as it was.  It's nil on territories that were never archived.
+	Archived *bool `json:"archived,omitempty"`
+
+	// Version counts the writes to the territory.  Clients send back the version
+	// they read to have a write rejected if someone else got there first.
+	Version *int64 `json:"version,omitempty"`
 }
 
 // --- JSON
 // Nothing to do.  The struct attributes handle it all.
 
+// --- Patching
+
+// Patch copies over the fields that are set on patch.  With appendLevels, the
+// patch's levels are added to the end of the current list (skipping any that are
+// already there) instead of replacing it.
+func (t *Territory) Patch(patch *Territory, appendLevels bool) {
+	if patch.Sequence != nil {
+		t.Sequence = patch.Sequence
+	}
+	if patch.Name != nil {
+		t.Name = patch.Name
+	}
+	if patch.World != nil {
+		t.World = patch.World
+	}
+	if patch.RequiresTerritories != nil {
+		t.RequiresTerritories = patch.RequiresTerritories
+	}
+	if patch.Archived != nil {
+		t.Archived = patch.Archived
+	}
+	if patch.Levels != nil {
+		if appendLevels && t.Levels != nil {
+			levels := appendUnique(*t.Levels, *patch.Levels)
+			t.Levels = &levels
+		} else {
+			t.Levels = patch.Levels
+		}
+	}
+}
+
+// VersionMatches reports whether expected is the territory's current version.  A
+// nil expected version matches anything, for clients that don't check.
+func (t *Territory) VersionMatches(expected *int64) bool {
+	if expected == nil {
+		return true
+	}
+
+	return versionOf(t) == *expected
+}
+
+// OlderThan reports whether t has a lower version than other, as when t was
+// exported before other was last written.  A missing version counts as 0.
+func (t *Territory) OlderThan(other *Territory) bool {
+	return versionOf(t) < versionOf(other)
+}
+
+// NextVersion sets the territory's version to follow previous's, which is nil
+// for a territory that didn't exist.
+func (t *Territory) NextVersion(previous *Territory) {
+	version := int64(1)
+	if previous != nil && previous.Version != nil {
+		version = *previous.Version + 1
+	}
+	t.Version = &version
+}
+
+// versionOf is a territory's version, which is 0 before it has one.
+func versionOf(t *Territory) int64 {
+	if t.Version == nil {
+		return 0
+	}
+
+	return *t.Version
+}
+
+// IsArchived reports whether the territory has been archived.
+func (t *Territory) IsArchived() bool {
+	return t.Archived != nil && *t.Archived
+}
+
+// --- Levels
+
+// AddLevels adds levels to the end of the list, skipping any that are already there.
+func (t *Territory) AddLevels(additions []string) {
+	levels := []string{}
+	if t.Levels != nil {
+		levels = *t.Levels
+	}
+	levels = appendUnique(levels, additions)
+	t.Levels = &levels
+}
+
+// LevelCount is how many distinct levels the list holds.
+func (t *Territory) LevelCount() int {
+	if t.Levels == nil {
+		return 0
+	}
+
+	return len(appendUnique(nil, *t.Levels))
+}
+
+// RemoveLevels drops levels from the list.  Ones that aren't there are ignored.
+func (t *Territory) RemoveLevels(removals []string) {
+	if t.Levels == nil {
+		return
+	}
+
+	removed := make(map[string]bool)
+	for _, levelId := range removals {
+		removed[levelId] = true
+	}
+
+	levels := []string{}
+	for _, levelId := range *t.Levels {
+		if !removed[levelId] {
+			levels = append(levels, levelId)
+		}
+	}
+	t.Levels = &levels
+}
+
+// ReorderLevels replaces the list with order, which must hold exactly the levels
+// already there.  Anything else means the list changed since the client read it.
+func (t *Territory) ReorderLevels(order []string) error {
+	current := []string{}
+	if t.Levels != nil {
+		current = *t.Levels
+	}
+
+	counts := make(map[string]int)
+	for _, levelId := range current {
+		counts[levelId]++
+	}
+	for _, levelId := range order {
+		counts[levelId]--
+	}
+	for _, count := range counts {
+		if count != 0 {
+			return ErrLevelsChanged
+		}
+	}
+
+	levels := append([]string{}, order...)
+	t.Levels = &levels
+	return nil
+}
+
+func appendUnique(levels []string, additions []string) []string {
+	seen := make(map[string]bool)
+	result := []string{}
+	for _, levelId := range append(append([]string{}, levels...), additions...) {
+		if !seen[levelId] {
+			seen[levelId] = true
+			result = append(result, levelId)
+		}
+	}
+
+	return result
+}
+
+// --- Changes
+
+// ChangedFields lists the JSON names of the fields that differ between two
+// territories, in sorted order.  The id and version say which territory and write
+// it is rather than what's in it, so they're left out.
+func ChangedFields(previous *Territory, next *Territory) []string {
+	before := previous.fieldValues()
+	after := next.fieldValues()
+	result := []string{}
+	for name, value := range after {
+		if before[name] != value {
+			result = append(result, name)
+		}
+	}
+	for name := range before {
+		if _, ok := after[name]; !ok {
+			result = append(result, name)
+		}
+	}
+
+	sort.Strings(result)
+	return result
+}
+
+// fieldValues maps the JSON name of each set field to its encoded value.
+func (t *Territory) fieldValues() map[string]string {
+	encoded, _ := json.Marshal(t)
+	var fields map[string]json.RawMessage
+	json.Unmarshal(encoded, &fields)
+
+	result := make(map[string]string)
+	for name, value := range fields {
+		if name != "id" && name != "version" && string(value) != "null" {
+			result[name] = string(value)
+		}
+	}
+
+	return result
+}
+
+// --- Unlock requirements
+
+// FindRequirementCycle looks for a chain of unlock requirements that leads from
+// the territory back to itself.  requires maps each territory id to the ids it
+// requires.  The cycle is returned as the ids along it, starting and ending with
+// territoryId, or nil if there isn't one.
+func FindRequirementCycle(territoryId string, requires map[string][]string) []string {
+	visited := make(map[string]bool)
+
+	var search func(current string, path []string) []string
+	search = func(current string, path []string) []string {
+		for _, required := range requires[current] {
+			if required == territoryId {
+				return append(path, required)
+			}
+			if visited[required] {
+				continue
+			}
+
+			visited[required] = true
+			cycle := search(required, append(path, required))
+			if cycle != nil {
+				return cycle
+			}
+		}
+
+		return nil
+	}
+
+	return search(territoryId, []string{territoryId})
+}
+
 // --- Datastore
 // Implements PropertyLoadSaver.
 
@@ -29,12 +290,27 @@ type dsTerritory struct {
 
 	Levels    []string
 	HasLevels bool
+
+	World    string
+	HasWorld bool
+
+	RequiresTerritories    []string
+	HasRequiresTerritories bool
+
+	Archived    bool
+	HasArchived bool
+
+	Version    int64
+	HasVersion bool
 }
 
 func (t *Territory) Load(c <-chan datastore.Property) error {
 	dst := &dsTerritory{}
+
+	// A field mismatch still loads every field it can, so pass it along to the
+	// caller after copying the fields over.
 	err := datastore.LoadStruct(dst, c)
-	if err != nil {
+	if _, mismatch := err.(*datastore.ErrFieldMismatch); err != nil && !mismatch {
 		return err
 	}
 
@@ -53,8 +329,23 @@ func (t *Territory) Load(c <-chan datastore.Property) error {
 	if dst.HasLevels {
 		t.Levels = &dst.Levels
 	}
+	if dst.HasWorld {
+		t.World = new(string)
+		*t.World = dst.World
+	}
+	if dst.HasRequiresTerritories {
+		t.RequiresTerritories = &dst.RequiresTerritories
+	}
+	if dst.HasArchived {
+		t.Archived = new(bool)
+		*t.Archived = dst.Archived
+	}
+	if dst.HasVersion {
+		t.Version = new(int64)
+		*t.Version = dst.Version
+	}
 
-	return nil
+	return err
 }
 
 func (t *Territory) Save(c chan<- datastore.Property) error {
@@ -76,6 +367,34 @@ func (t *Territory) Save(c chan<- datastore.Property) error {
 		dst.HasLevels = true
 		dst.Levels = *t.Levels
 	}
+	if t.World != nil {
+		dst.HasWorld = true
+		dst.World = *t.World
+	}
+	if t.RequiresTerritories != nil {
+		dst.HasRequiresTerritories = true
+		dst.RequiresTerritories = *t.RequiresTerritories
+	}
+	if t.Archived != nil {
+		dst.HasArchived = true
+		dst.Archived = *t.Archived
+	}
+	if t.Version != nil {
+		dst.HasVersion = true
+		dst.Version = *t.Version
+	}
 
 	return datastore.SaveStruct(dst, c)
 }
+
+// --- Keys
+
+// RootKey returns the entity root shared by all territories.
+func RootKey(context appengine.Context) *datastore.Key {
+	if rootKey != nil {
+		return rootKey
+	}
+
+	rootKey = datastore.NewKey(context, Kind, rootKeyName, 0, nil)
+	return rootKey
+}
@@ -0,0 +1,202 @@
+package territories
+
+import (
+	"fmt"
+	"net/http"
+	"sort"
+	"strings"
+
+	"appengine"
+	"appengine/datastore"
+
+	"github.com/gin-gonic/gin"
+
+	"bootcamp/editorservice/apierror"
+	"bootcamp/editorservice/config"
+	"bootcamp/editorservice/ids"
+	"bootcamp/editorservice/levels"
+	"bootcamp/editorservice/mismatch"
+	"bootcamp/editorservice/requestid"
+	"bootcamp/editorservice/territories/territory"
+)
+
+// --- Types and constants
+
+// validationProblem is one thing wrong with a territory.  Field is the JSON
+// name of the field it's about, and Key the level or territory it names, if any.
+type validationProblem struct {
+	Field   string        `json:"field"`
+	Key     string        `json:"key,omitempty"`
+	Code    apierror.Code `json:"code"`
+	Message string        `json:"message"`
+}
+
+type territoryValidation struct {
+	Valid    bool                `json:"valid"`
+	Problems []validationProblem `json:"problems"`
+}
+
+// --- Route handlers
+
+// handleValidate checks a stored territory, like handleValidateBody does a
+// territory that hasn't been written.
+func handleValidate(context *gin.Context) {
+	territoryId := context.Param("id")
+	appengineContext := requestid.NewContext(context.Request)
+	stored, err := getStoredTerritory(appengineContext, territoryId)
+	if err == datastore.ErrNoSuchEntity {
+		apierror.Respond(context, http.StatusNotFound, apierror.NotFound, "Territory does not exist")
+		return
+	} else if err != nil {
+		apierror.Respond(context, http.StatusInternalServerError, apierror.Internal, "Could not retrieve the territory: %+v", err)
+		return
+	}
+	stored.Id = &territoryId
+
+	respondWithProblems(context, appengineContext, stored)
+}
+
+// handleValidateBody checks the territory in the body the way
+// POST /territories/:id/validate checks a stored one, without writing anything.
+// Its id is optional; when it's given, the stored territory with that id is left
+// out of the comparisons, since the body would replace it.
+func handleValidateBody(context *gin.Context) {
+	var body territory.Territory
+	err := context.BindJSON(&body)
+	if err != nil {
+		apierror.Respond(context, http.StatusBadRequest, apierror.InvalidRequest, "Failed to unmarshal the JSON: %+v", err)
+		return
+	}
+	if body.Id != nil {
+		if isReservedId(*body.Id) {
+			apierror.Respond(context, http.StatusBadRequest, apierror.InvalidRequest, "The territory id %q is reserved", *body.Id)
+			return
+		}
+		if err := ids.Check(*body.Id); err != nil {
+			apierror.Respond(context, http.StatusBadRequest, apierror.InvalidRequest, "Invalid territory id: %+v", err)
+			return
+		}
+	}
+
+	respondWithProblems(context, requestid.NewContext(context.Request), &body)
+}
+
+// --- Helpers
+
+func respondWithProblems(context *gin.Context, appengineContext appengine.Context, t *territory.Territory) {
+	problems, err := validateTerritory(appengineContext, t)
+	if err != nil {
+		apierror.Respond(context, http.StatusInternalServerError, apierror.Internal, "Could not validate the territory: %+v", err)
+		return
+	}
+
+	context.JSON(http.StatusOK, &territoryValidation{Valid: len(problems) == 0, Problems: problems})
+}
+
+// validateTerritory lists everything wrong with t: levels that are malformed,
+// listed twice, don't exist or are too many, a sequence that's missing,
+// negative or taken by another territory in the same world, and unlock
+// requirements on territories that don't exist or that lead back around to t.
+// Archived territories don't hold on to their sequence.
+func validateTerritory(appengineContext appengine.Context, t *territory.Territory) ([]validationProblem, error) {
+	problems := []validationProblem{}
+	problem := func(field string, key string, code apierror.Code, format string, values ...interface{}) {
+		problems = append(problems, validationProblem{Field: field, Key: key, Code: code, Message: fmt.Sprintf(format, values...)})
+	}
+
+	var territoryId string
+	if t.Id != nil {
+		territoryId = *t.Id
+	}
+
+	// The levels
+	if t.Levels != nil {
+		var wellFormed []string
+		seen := make(map[string]bool)
+		for _, levelId := range *t.Levels {
+			if err := ids.Check(levelId); err != nil {
+				problem("levels", levelId, apierror.InvalidRequest, "Invalid level id: %v", err)
+			} else if seen[levelId] {
+				problem("levels", levelId, apierror.InvalidRequest, "The level %q is listed more than once", levelId)
+			} else {
+				wellFormed = append(wellFormed, levelId)
+			}
+			seen[levelId] = true
+		}
+
+		if err, tooMany := checkLevelCount(nil, t).(*tooManyLevelsError); tooMany {
+			problem("levels", "", apierror.ValidationFailed, "The territory lists %d levels, but at most %d are allowed", err.Count, config.MaxTerritoryLevels)
+		}
+
+		missing, err := levels.MissingLevels(appengineContext, wellFormed)
+		if err != nil {
+			return nil, err
+		}
+		for _, levelId := range missing {
+			problem("levels", levelId, apierror.NotFound, "The level %q does not exist", levelId)
+		}
+	}
+
+	// Everything else is checked against the other territories
+	var stored []*territory.Territory
+	query := datastore.NewQuery(kind).Ancestor(getTerritoryRootKey(appengineContext))
+	_, err := query.GetAll(appengineContext, &stored)
+	err = mismatch.Ignore(appengineContext, err)
+	if err != nil {
+		return nil, err
+	}
+
+	others := make(map[string]*territory.Territory)
+	var otherIds []string
+	for _, element := range stored {
+		if element.Id != nil && *element.Id != territoryId {
+			others[*element.Id] = element
+			otherIds = append(otherIds, *element.Id)
+		}
+	}
+	sort.Strings(otherIds)
+
+	// The sequence
+	if t.Sequence == nil {
+		problem("sequence", "", apierror.ValidationFailed, "The territory has no sequence")
+	} else if *t.Sequence < 0 {
+		problem("sequence", "", apierror.ValidationFailed, "The sequence is %d but must be at least 0", *t.Sequence)
+	} else if !t.IsArchived() {
+		for _, otherId := range otherIds {
+			other := others[otherId]
+			if !other.IsArchived() && other.Sequence != nil && *other.Sequence == *t.Sequence && worldOf(other) == worldOf(t) {
+				problem("sequence", otherId, apierror.Conflict, "The territory %q in the same world has the sequence %d too", otherId, *t.Sequence)
+			}
+		}
+	}
+
+	// The unlock requirements
+	if t.RequiresTerritories != nil {
+		requires := make(map[string][]string)
+		for otherId, other := range others {
+			if other.RequiresTerritories != nil {
+				requires[otherId] = *other.RequiresTerritories
+			}
+		}
+		requires[territoryId] = *t.RequiresTerritories
+
+		for _, requiredId := range *t.RequiresTerritories {
+			if _, ok := others[requiredId]; !ok && requiredId != territoryId {
+				problem("requires_territories", requiredId, apierror.NotFound, "The territory %q does not exist", requiredId)
+			}
+		}
+		if cycle := territory.FindRequirementCycle(territoryId, requires); cycle != nil {
+			problem("requires_territories", "", apierror.CycleDetected, "The unlock requirements form a cycle: %s", strings.Join(cycle, " -> "))
+		}
+	}
+
+	return problems, nil
+}
+
+func worldOf(t *territory.Territory) string {
+	if t.World == nil {
+		return ""
+	}
+
+	return *t.World
+}
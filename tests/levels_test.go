@@ -4,18 +4,33 @@ package tests
 
 import (
 	"bytes"
+	"compress/gzip"
+	"encoding/base64"
 	"encoding/json"
 	"fmt"
 	"io/ioutil"
 	"net/http"
 	"net/http/httptest"
+	"sort"
+	"strings"
 	"testing"
+	"time"
 
 	"github.com/stretchr/testify/assert"
 
+	"appengine"
 	"appengine/aetest"
+	"appengine/datastore"
+	"appengine/memcache"
+	"appengine/taskqueue"
+	"appengine/user"
 
 	main "bootcamp/editorservice/appengine"
+	"bootcamp/editorservice/cache"
+	"bootcamp/editorservice/config"
+	"bootcamp/editorservice/flags"
+	"bootcamp/editorservice/levels/level"
+	"bootcamp/editorservice/pagination"
 )
 
 // The test package must reference the main package.
@@ -25,7 +40,7 @@ var _ = main.Import
 // --- Types and constants
 
 type TestContext struct {
-	t  *testing.T
+	t  testing.TB
 	ae aetest.Instance
 }
 
@@ -41,10 +56,242 @@ type Level struct {
 	MaxActiveUnits      int32              `json:"max_active_units,omitempty"`
 	SpawnsPerSecond     float32            `json:"spawns_per_second,omitempty"`
 	SpawnFrequency      map[string]float32 `json:"spawn_frequency,omitempty"`
+	Tags                []string           `json:"tags,omitempty"`
+}
+
+type LevelTreeNode struct {
+	Key      string          `json:"key"`
+	Parent   string          `json:"parent_key"`
+	Children []LevelTreeNode `json:"children"`
+}
+
+type ReparentCheck struct {
+	Valid  bool   `json:"valid"`
+	Code   string `json:"code"`
+	Reason string `json:"reason"`
+}
+
+type RenameImpact struct {
+	TargetFree  bool     `json:"target_free"`
+	Reason      string   `json:"reason"`
+	Children    []string `json:"children"`
+	Territories []string `json:"territories"`
+}
+
+type LevelTree struct {
+	Roots  []LevelTreeNode `json:"roots"`
+	Cycles [][]string      `json:"cycles"`
+}
+
+type BatchItemResult struct {
+	Key      string        `json:"key"`
+	Status   int           `json:"status"`
+	Error    string        `json:"error"`
+	Warnings []interface{} `json:"warnings"`
+}
+
+type SubResponse struct {
+	Status int             `json:"status"`
+	Body   json.RawMessage `json:"body"`
+}
+
+type LevelLock struct {
+	Key       string    `json:"key"`
+	Editor    string    `json:"editor"`
+	ExpiresAt time.Time `json:"expires_at"`
+}
+
+type BatchSummary struct {
+	Created int `json:"created"`
+	Updated int `json:"updated"`
+	Failed  int `json:"failed"`
+}
+
+type BatchWriteResponse struct {
+	Results []BatchItemResult `json:"results"`
+	Summary *BatchSummary     `json:"summary"`
+}
+
+type ReindexResponse struct {
+	Scanned int `json:"scanned"`
+	Updated int `json:"updated"`
+}
+
+type SchemaVersion struct {
+	SchemaVersion int64 `json:"schema_version"`
+	MigrateOnRead bool  `json:"migrate_on_read"`
+}
+
+// testLevelCacheEntry writes straight to the level cache
+type testLevelCacheEntry level.DatastoreLevel
+
+func (entry *testLevelCacheEntry) GetCacheKey() string {
+	return "level:" + entry.Key
+}
+
+func (entry *testLevelCacheEntry) MarshalBinary() ([]byte, error) {
+	return (*level.DatastoreLevel)(entry).MarshalCompact(), nil
+}
+
+func (entry *testLevelCacheEntry) UnmarshalBinary(data []byte) error {
+	return (*level.DatastoreLevel)(entry).UnmarshalCompact(data)
+}
+
+type LevelPage struct {
+	Levels        []Level `json:"levels"`
+	NextPageToken string  `json:"next_page_token"`
+}
+
+type DuplicatesResponse struct {
+	Groups [][]string `json:"groups"`
+}
+
+type PurgeResponse struct {
+	Checked int      `json:"checked"`
+	Purged  int      `json:"purged"`
+	Keys    []string `json:"keys"`
+}
+
+type VerifyResponse struct {
+	Checked    int `json:"checked"`
+	Mismatches []struct {
+		Key   string `json:"key"`
+		Cache string `json:"cache"`
+		Fresh Level  `json:"fresh"`
+	} `json:"mismatches"`
+}
+
+type DependentsReport struct {
+	AffectedChildren []struct {
+		Key    string   `json:"key"`
+		Fields []string `json:"fields"`
+	} `json:"affected_children"`
+}
+
+type LevelDelta struct {
+	Version int64    `json:"version"`
+	Levels  []Level  `json:"levels"`
+	Deleted []string `json:"deleted"`
+}
+
+type CacheStats struct {
+	Hits   int64 `json:"hits"`
+	Misses int64 `json:"misses"`
+}
+
+type DeletePreview struct {
+	Key      string `json:"key"`
+	Children []struct {
+		Key        string   `json:"key"`
+		LostFields []string `json:"lost_fields"`
+		Level      Level    `json:"level"`
+		Error      string   `json:"error"`
+	} `json:"children"`
+}
+
+type ReferenceWarnings struct {
+	Warnings []struct {
+		Key  string `json:"key"`
+		Code string `json:"code"`
+	} `json:"warnings"`
+}
+
+type ResolvedField struct {
+	Value     interface{} `json:"value"`
+	Source    string      `json:"source"`
+	Inherited bool        `json:"inherited"`
+}
+
+type FeatureFlag struct {
+	Name    string `json:"name"`
+	Enabled bool   `json:"enabled"`
+}
+
+type Overrides struct {
+	Key       string            `json:"key"`
+	Self      []string          `json:"self"`
+	Inherited map[string]string `json:"inherited"`
+}
+
+type FieldDelta struct {
+	Status string          `json:"status"`
+	Value  json.RawMessage `json:"value"`
+	Source string          `json:"source"`
+}
+
+type InheritanceDelta struct {
+	Key    string                `json:"key"`
+	Fields map[string]FieldDelta `json:"fields"`
+}
+
+type QueryResponse struct {
+	Levels   []Level `json:"levels"`
+	Warnings []struct {
+		Key  string `json:"key"`
+		Code string `json:"code"`
+	} `json:"warnings"`
+}
+
+type LevelStats struct {
+	Count           int     `json:"count"`
+	AverageDuration float64 `json:"average_duration"`
+	Rows            struct {
+		Min int32 `json:"min"`
+		Max int32 `json:"max"`
+	} `json:"rows"`
+	Columns struct {
+		Min int32 `json:"min"`
+		Max int32 `json:"max"`
+	} `json:"columns"`
+	DistinctUnitTypes int            `json:"distinct_unit_types"`
+	CountByTag        map[string]int `json:"count_by_tag"`
+}
+
+type EntityDiff struct {
+	Added    []string `json:"added"`
+	Removed  []string `json:"removed"`
+	Modified []struct {
+		Key    string   `json:"key"`
+		Fields []string `json:"fields"`
+	} `json:"modified"`
+}
+
+type BundleDiff struct {
+	Levels      EntityDiff `json:"levels"`
+	Territories EntityDiff `json:"territories"`
+}
+
+type ImportValidation struct {
+	Valid    bool `json:"valid"`
+	Problems []struct {
+		Kind string `json:"kind"`
+		Key  string `json:"key"`
+		Code string `json:"code"`
+	} `json:"problems"`
+}
+
+type ErrorResponse struct {
+	Code    string `json:"code"`
+	Message string `json:"message"`
+}
+
+type ChangeNotification struct {
+	Key           string   `json:"key"`
+	ChangedFields []string `json:"changed_fields"`
 }
 
 const baseRoute = "/levels"
 
+// changeNotificationQueue is the pull queue declared in appengine/queue.yaml.
+const changeNotificationQueue = "level-changes"
+
+var adminUser = &user.User{Email: "admin@example.com", Admin: true}
+
+func init() {
+	// Deployments set their own; paged queries need one to hand out tokens
+	config.PageTokenSecret = "test-page-token-secret"
+}
+
 // Some test levels with all properties set
 var testLevel1 = Level{
 	Name:                "test level",
@@ -85,9 +332,14 @@ const testKey2 = "test_key_2"
 
 func setup(t *testing.T) *TestContext {
 	t.Parallel()
+	return setupSerial(t)
+}
 
+// setupSerial is for tests that change package-level settings.  They run
+// before any of the parallel tests start, so they must restore what they change.
+func setupSerial(t *testing.T) *TestContext {
 	var options = aetest.Options{
-		AppID: "testapp",
+		AppID:                       "testapp",
 		StronglyConsistentDatastore: true,
 	}
 	ae, _ := aetest.NewInstance(&options)
@@ -100,12 +352,47 @@ func setup(t *testing.T) *TestContext {
 	return &context
 }
 
+func setupBenchmark(b *testing.B) *TestContext {
+	var options = aetest.Options{
+		AppID:                       "testapp",
+		StronglyConsistentDatastore: true,
+	}
+	ae, _ := aetest.NewInstance(&options)
+
+	context := TestContext{
+		t:  b,
+		ae: ae,
+	}
+
+	return &context
+}
+
 func teardown(c *TestContext) {
 	c.ae.Close()
 }
 
 // --- Tests
 
+func TestPutWithInvalidIdFails(t *testing.T) {
+	c := setup(t)
+	defer teardown(c)
+
+	// Ids the datastore won't take as key names are refused up front
+	for _, id := range []string{"__reserved__", strings.Repeat("x", 501)} {
+		code, response := invoke(c, "PUT", buildEntityRoute(id), testLevel1)
+		assert.EqualValues(t, http.StatusBadRequest, code)
+		assert.Equal(t, "INVALID_REQUEST", decodeError(response).Code)
+	}
+
+	// And so are batch items with them
+	valid := Level{Key: testKey1, Name: "valid"}
+	invalid := Level{Key: "__reserved__", Name: "invalid"}
+	code, response := invokeBatch(c, "batch-put", "best-effort", []Level{valid, invalid})
+	assert.EqualValues(t, http.StatusMultiStatus, code)
+	assert.EqualValues(t, http.StatusOK, response.Results[0].Status)
+	assert.EqualValues(t, http.StatusBadRequest, response.Results[1].Status)
+}
+
 func TestGetWithMissingObjectFails(t *testing.T) {
 	c := setup(t)
 	defer teardown(c)
@@ -346,6 +633,38 @@ func TestQueryWithValidParentInheritsProperties(t *testing.T) {
 	assert.Equal(t, parentLevel, level)
 }
 
+func TestGetWithFieldsReturnsOnlyThoseFields(t *testing.T) {
+	c := setup(t)
+	defer teardown(c)
+
+	storeLevel(c, testKey1, testLevel1)
+	childLevel := Level{Parent: testKey1, Name: "child"}
+	storeLevel(c, testKey2, childLevel)
+
+	// The first read resolves the level and the second comes from the response cache,
+	// and inherited fields can be picked like any other
+	for i := 0; i < 2; i++ {
+		code, response := loadLevelRaw(c, testKey2+"?fields=name,%20duration")
+		assert.EqualValues(t, http.StatusOK, code)
+
+		var fields map[string]interface{}
+		json.Unmarshal([]byte(response), &fields)
+		assert.Equal(t, map[string]interface{}{
+			"key":      testKey2,
+			"name":     "child",
+			"duration": float64(testLevel1.Duration),
+		}, fields)
+	}
+
+	// The full level is still served without them
+	assert.Equal(t, testLevel1.Rows, loadLevel(c, testKey2).Rows)
+
+	// Unknown fields are rejected
+	code, response := loadLevelRaw(c, testKey2+"?fields=name,durration")
+	assert.EqualValues(t, http.StatusBadRequest, code)
+	assert.Equal(t, "INVALID_REQUEST", decodeError(response).Code)
+}
+
 func TestGetWithMissingParentFails(t *testing.T) {
 	c := setup(t)
 	defer teardown(c)
@@ -357,9 +676,15 @@ func TestGetWithMissingParentFails(t *testing.T) {
 	childLevel.Parent = parentKey
 	storeLevel(c, childKey, childLevel)
 
-	// Retrieve the child level. It should error.
-	code, _ := loadLevelRaw(c, childKey)
+	// Retrieve the child level. It should error, naming the parent as the problem.
+	code, response := loadLevelRaw(c, childKey)
+	assert.EqualValues(t, http.StatusNotFound, code)
+	assert.Equal(t, "PARENT_NOT_FOUND", decodeError(response).Code)
+
+	// The same goes for the cached response
+	code, response = loadLevelRaw(c, childKey)
 	assert.EqualValues(t, http.StatusNotFound, code)
+	assert.Equal(t, "PARENT_NOT_FOUND", decodeError(response).Code)
 }
 
 func TestUpdateParentAlsoUpdatesChildren(t *testing.T) {
@@ -393,64 +718,3593 @@ func TestUpdateParentAlsoUpdatesChildren(t *testing.T) {
 	assert.Equal(t, parentLevel, level)
 }
 
-// --- Helpers
+func TestPutWithSpawnFrequencyAtLimitSucceeds(t *testing.T) {
+	c := setup(t)
+	defer teardown(c)
 
-func buildQueryRoute() string {
-	return baseRoute
+	// Store a level with exactly the maximum number of unit types
+	testLevel := testLevel1
+	testLevel.SpawnFrequency = buildSpawnFrequency(config.MaxSpawnFrequencyEntries)
+	storeLevel(c, testKey1, testLevel)
+
+	// All of the entries should come back
+	level := loadLevel(c, testKey1)
+	assert.EqualValues(t, config.MaxSpawnFrequencyEntries, len(level.SpawnFrequency))
 }
 
-func buildEntityRoute(id string) string {
-	return baseRoute + "/" + id
+func TestPutWithSpawnFrequencyOverLimitFails(t *testing.T) {
+	c := setup(t)
+	defer teardown(c)
+
+	// Store a level with one more unit type than allowed
+	testLevel := testLevel1
+	testLevel.SpawnFrequency = buildSpawnFrequency(config.MaxSpawnFrequencyEntries + 1)
+	code, response := invoke(c, "PUT", buildEntityRoute(testKey1), testLevel)
+	assert.EqualValues(t, http.StatusBadRequest, code)
+	assert.Equal(t, "VALIDATION_FAILED", decodeError(response).Code)
+
+	// Nothing should have been stored
+	code, _ = loadLevelRaw(c, testKey1)
+	assert.EqualValues(t, http.StatusNotFound, code)
 }
 
-func invoke(c *TestContext, verb string, path string, obj interface{}) (code int, response string) {
-	marshalledObj, _ := json.Marshal(obj)
-	request, _ := c.ae.NewRequest(verb, path, bytes.NewBuffer(marshalledObj))
-	w := httptest.NewRecorder()
-	http.DefaultServeMux.ServeHTTP(w, request)
-	body, _ := ioutil.ReadAll(w.Body)
+func TestTreeNestsChildrenAndReportsCycles(t *testing.T) {
+	c := setup(t)
+	defer teardown(c)
 
-	code = w.Code
-	response = string(body)
+	// A small hierarchy: root -> (left -> leaf, right)
+	storeLevel(c, "root", Level{Name: "root"})
+	storeLevel(c, "left", Level{Parent: "root"})
+	storeLevel(c, "right", Level{Parent: "root"})
+	storeLevel(c, "leaf", Level{Parent: "left"})
 
-	c.t.Logf("%s %s\ncode: %+v\nresponse: %+v\n", verb, path, code, response)
-	return
+	// And two levels that are each other's parent, put straight into the
+	// datastore so that nothing resolves them before the tree is built
+	appengineContext := newAppengineContext(c)
+	rootKey := datastore.NewKey(appengineContext, "Level", "LevelRoot", 0, nil)
+	for id, parent := range map[string]string{"cycle_a": "cycle_b", "cycle_b": "cycle_a"} {
+		_, err := datastore.Put(appengineContext, datastore.NewKey(appengineContext, "Level", id, 0, rootKey), &datastore.PropertyList{
+			{Name: "Key", Value: id},
+			{Name: "HasKey", Value: true},
+			{Name: "Parent", Value: parent},
+			{Name: "HasParent", Value: true},
+		})
+		assert.Nil(t, err)
+	}
+
+	tree := loadTree(c)
+
+	// The only root is the top of the hierarchy
+	assert.EqualValues(t, 1, len(tree.Roots))
+	root := tree.Roots[0]
+	assert.Equal(t, "root", root.Key)
+
+	// Its children come back nested
+	assert.EqualValues(t, 2, len(root.Children))
+	assert.Equal(t, "left", root.Children[0].Key)
+	assert.Equal(t, "right", root.Children[1].Key)
+	assert.EqualValues(t, 1, len(root.Children[0].Children))
+	assert.Equal(t, "leaf", root.Children[0].Children[0].Key)
+	assert.EqualValues(t, 0, len(root.Children[1].Children))
+
+	// The cycle is reported rather than followed
+	assert.EqualValues(t, 1, len(tree.Cycles))
+	cycle := tree.Cycles[0]
+	sort.Strings(cycle)
+	assert.Equal(t, []string{"cycle_a", "cycle_b"}, cycle)
 }
 
-func storeLevel(c *TestContext, id string, level Level) (int, string) {
-	code, response := invoke(c, "PUT", buildEntityRoute(id), level)
-	assert.EqualValues(c.t, http.StatusOK, code)
+func TestTreeOrdersSiblingsByNameThenKey(t *testing.T) {
+	c := setup(t)
+	defer teardown(c)
 
-	// Populate the caches (help catch cache invalidation errors)
-	loadLevelRaw(c, id)
-	queryAll(c)
+	// Ties on name fall back to the key, and "c" sorts by the name it inherits
+	storeLevel(c, "root", Level{Name: "root"})
+	storeLevel(c, "a", Level{Parent: "root", Name: "zebra"})
+	storeLevel(c, "b", Level{Parent: "root", Name: "apple"})
+	storeLevel(c, "c", Level{Parent: "root"})
+	storeLevel(c, "d", Level{Parent: "root", Name: "apple"})
+	storeLevel(c, "other_root", Level{Name: "another root"})
 
-	return code, response
+	for i := 0; i < 2; i++ {
+		tree := loadTree(c)
+		assert.Equal(t, []string{"other_root", "root"}, treeKeys(tree.Roots))
+		assert.Equal(t, []string{"b", "d", "c", "a"}, treeKeys(tree.Roots[1].Children))
+	}
 }
 
-func loadLevel(c *TestContext, id string) (level Level) {
-	code, resp := invoke(c, "GET", buildEntityRoute(id), nil)
-	assert.EqualValues(c.t, http.StatusOK, code)
+func TestTreeOrdersSiblingsByKey(t *testing.T) {
+	c := setupSerial(t)
+	defer teardown(c)
 
-	json.Unmarshal([]byte(resp), &level)
-	return
+	config.TreeOrder = "key"
+	defer func(order string) { config.TreeOrder = order }(config.TreeOrder)
+
+	storeLevel(c, "root", Level{Name: "root"})
+	storeLevel(c, "a", Level{Parent: "root", Name: "zebra"})
+	storeLevel(c, "b", Level{Parent: "root", Name: "apple"})
+	storeLevel(c, "c", Level{Parent: "root"})
+
+	tree := loadTree(c)
+	assert.Equal(t, []string{"a", "b", "c"}, treeKeys(tree.Roots[0].Children))
 }
 
-func loadLevelRaw(c *TestContext, id string) (int, string) {
-	code, response := invoke(c, "GET", buildEntityRoute(id), nil)
-	return code, response
+func TestTreeReflectsLevelWrites(t *testing.T) {
+	c := setup(t)
+	defer teardown(c)
+
+	// Populate the tree cache
+	storeLevel(c, "root", Level{Name: "root"})
+	tree := loadTree(c)
+	assert.EqualValues(t, 0, len(tree.Roots[0].Children))
+
+	// Adding a child should invalidate it
+	storeLevel(c, "child", Level{Parent: "root"})
+	tree = loadTree(c)
+	assert.EqualValues(t, 1, len(tree.Roots[0].Children))
 }
 
-func deleteLevel(c *TestContext, id string) (int, string) {
-	code, response := invoke(c, "DELETE", buildEntityRoute(id), nil)
-	assert.EqualValues(c.t, http.StatusOK, code)
-	return code, response
+func TestDeepChainsFailWithoutCrashing(t *testing.T) {
+	c := setup(t)
+	defer teardown(c)
+
+	// Stored straight into the datastore, so that nothing is cached and every
+	// read walks the whole chain
+	chainKeys := storeRawChain(c, maxParentDepth+2)
+	deepest := chainKeys[len(chainKeys)-1]
+
+	code, response := loadLevelRaw(c, deepest)
+	assert.EqualValues(t, http.StatusConflict, code)
+	assert.Equal(t, "CONFLICT", decodeError(response).Code)
+
+	code, _, _ = invokeWithHeaders(c, "GET", buildEntityRoute(deepest), nil, map[string]string{"Cache-Control": "no-cache"})
+	assert.EqualValues(t, http.StatusConflict, code)
+
+	code, _ = invoke(c, "GET", buildEntityRoute("tree"), nil)
+	assert.EqualValues(t, http.StatusConflict, code)
+
+	// A batch get reports the same status for the item
+	code, response = invoke(c, "POST", baseRoute+"/batch-get", map[string]interface{}{"ids": []string{deepest}})
+	assert.EqualValues(t, http.StatusMultiStatus, code)
+	var batch struct {
+		Results []BatchItemResult `json:"results"`
+	}
+	json.Unmarshal([]byte(response), &batch)
+	if assert.Len(t, batch.Results, 1) {
+		assert.EqualValues(t, http.StatusConflict, batch.Results[0].Status)
+	}
+
+	// Levels with at most maxParentDepth ancestors still resolve
+	code, _ = loadLevelRaw(c, chainKeys[maxParentDepth])
+	assert.EqualValues(t, http.StatusOK, code)
 }
 
-func queryAll(c *TestContext) (levels []Level) {
-	code, resp := invoke(c, "GET", buildQueryRoute(), nil)
-	assert.EqualValues(c.t, http.StatusOK, code)
+func TestBestEffortBatchPutReportsEachItem(t *testing.T) {
+	c := setup(t)
+	defer teardown(c)
 
-	json.Unmarshal([]byte(resp), &levels)
+	// The middle item is invalid
+	valid1 := testLevel1
+	valid1.Key = testKey1
+	invalid := testLevel1
+	invalid.Key = "invalid_key"
+	invalid.SpawnFrequency = buildSpawnFrequency(config.MaxSpawnFrequencyEntries + 1)
+	valid2 := testLevel2
+	valid2.Key = testKey2
+
+	code, response := invokeBatch(c, "batch-put", "best-effort", []Level{valid1, invalid, valid2})
+	assert.EqualValues(t, http.StatusMultiStatus, code)
+
+	// Each item reports its own outcome, in order
+	assert.EqualValues(t, 3, len(response.Results))
+	assert.Equal(t, testKey1, response.Results[0].Key)
+	assert.EqualValues(t, http.StatusOK, response.Results[0].Status)
+	assert.Equal(t, "invalid_key", response.Results[1].Key)
+	assert.EqualValues(t, http.StatusBadRequest, response.Results[1].Status)
+	assert.NotEmpty(t, response.Results[1].Error)
+	assert.Equal(t, testKey2, response.Results[2].Key)
+	assert.EqualValues(t, http.StatusOK, response.Results[2].Status)
+
+	// The valid items were stored and the invalid one wasn't
+	_ = loadLevel(c, testKey1)
+	_ = loadLevel(c, testKey2)
+	code, _ = loadLevelRaw(c, "invalid_key")
+	assert.EqualValues(t, http.StatusNotFound, code)
+}
+
+func TestBatchPutSummarizesOutcomes(t *testing.T) {
+	c := setup(t)
+	defer teardown(c)
+
+	storeLevel(c, testKey1, testLevel1)
+
+	existing := testLevel2
+	existing.Key = testKey1
+	new1 := testLevel1
+	new1.Key = testKey2
+	new2 := testLevel2
+	new2.Key = "new_level"
+	invalid := testLevel1
+	invalid.Key = "invalid_key"
+	invalid.SpawnFrequency = buildSpawnFrequency(config.MaxSpawnFrequencyEntries + 1)
+
+	_, response := invokeBatch(c, "batch-put", "best-effort", []Level{existing, new1, invalid, new2})
+	assert.Equal(t, &BatchSummary{Created: 2, Updated: 1, Failed: 1}, response.Summary)
+
+	// A transactional batch that isn't applied counts every item as failed
+	_, response = invokeBatch(c, "batch-put", "transactional", []Level{existing, invalid})
+	assert.Equal(t, &BatchSummary{Failed: 2}, response.Summary)
+
+	// And one that is counts the levels it has just written as updates
+	_, response = invokeBatch(c, "batch-put", "transactional", []Level{existing, new2})
+	assert.Equal(t, &BatchSummary{Updated: 2}, response.Summary)
+}
+
+func TestTransactionalBatchPutAppliesNothingOnFailure(t *testing.T) {
+	c := setup(t)
+	defer teardown(c)
+
+	valid := testLevel1
+	valid.Key = testKey1
+	invalid := testLevel1
+
+	// The second item has no key
+	code, response := invokeBatch(c, "batch-put", "transactional", []Level{valid, invalid})
+	assert.EqualValues(t, http.StatusMultiStatus, code)
+	assert.EqualValues(t, http.StatusFailedDependency, response.Results[0].Status)
+	assert.EqualValues(t, http.StatusBadRequest, response.Results[1].Status)
+
+	// So the valid item wasn't stored either
+	code, _ = loadLevelRaw(c, testKey1)
+	assert.EqualValues(t, http.StatusNotFound, code)
+}
+
+func TestBatchDeleteReportsEachItem(t *testing.T) {
+	c := setup(t)
+	defer teardown(c)
+
+	storeLevel(c, testKey1, testLevel1)
+	storeLevel(c, testKey2, testLevel2)
+
+	code, response := invokeBatch(c, "batch-delete", "best-effort", map[string][]string{
+		"ids": []string{testKey1, ""},
+	})
+	assert.EqualValues(t, http.StatusMultiStatus, code)
+	assert.EqualValues(t, http.StatusOK, response.Results[0].Status)
+	assert.EqualValues(t, http.StatusBadRequest, response.Results[1].Status)
+
+	// Only the named level was deleted
+	code, _ = loadLevelRaw(c, testKey1)
+	assert.EqualValues(t, http.StatusNotFound, code)
+	_ = loadLevel(c, testKey2)
+}
+
+func TestQueryUnassignedReturnsLevelsWithoutTerritory(t *testing.T) {
+	c := setup(t)
+	defer teardown(c)
+
+	// Two levels, only one of which is in a territory
+	storeLevel(c, testKey1, testLevel1)
+	storeLevel(c, testKey2, testLevel2)
+	storeTerritory(c, "territory_1", []string{testKey1})
+
+	levels := queryUnassigned(c)
+	assert.EqualValues(t, 1, len(levels))
+	assert.Equal(t, testKey2, levels[0].Key)
+
+	// Assigning the other level should empty the list
+	storeTerritory(c, "territory_2", []string{testKey2, "not_a_level"})
+	levels = queryUnassigned(c)
+	assert.EqualValues(t, 0, len(levels))
+
+	// And a new level should show up
+	storeLevel(c, "new_level", testLevel1)
+	levels = queryUnassigned(c)
+	assert.EqualValues(t, 1, len(levels))
+	assert.Equal(t, "new_level", levels[0].Key)
+}
+
+func TestCacheMissFalseDoesNotCacheNotFound(t *testing.T) {
+	c := setup(t)
+	defer teardown(c)
+
+	// Levels written straight to the datastore (not through the API) don't
+	// invalidate anything, so a cached 404 would hide them
+	putDirectly := func(id string) {
+		appengineContext := newAppengineContext(c)
+		rootKey := datastore.NewKey(appengineContext, "Level", "LevelRoot", 0, nil)
+		key := datastore.NewKey(appengineContext, "Level", id, 0, rootKey)
+		_, err := datastore.Put(appengineContext, key, &datastore.PropertyList{
+			{Name: "Key", Value: id},
+			{Name: "HasKey", Value: true},
+			{Name: "Name", Value: id},
+			{Name: "HasName", Value: true},
+		})
+		assert.Nil(t, err)
+	}
+
+	// By default the miss is cached
+	code, _ := invoke(c, "GET", buildEntityRoute(testKey1), nil)
+	assert.EqualValues(t, http.StatusNotFound, code)
+	putDirectly(testKey1)
+	code, _ = invoke(c, "GET", buildEntityRoute(testKey1), nil)
+	assert.EqualValues(t, http.StatusNotFound, code)
+
+	// With cacheMiss=false it isn't, so the level shows up right away
+	code, _ = invoke(c, "GET", buildEntityRoute(testKey2)+"?cacheMiss=false", nil)
+	assert.EqualValues(t, http.StatusNotFound, code)
+	putDirectly(testKey2)
+	code, response := invoke(c, "GET", buildEntityRoute(testKey2), nil)
+	assert.EqualValues(t, http.StatusOK, code)
+	assert.Contains(t, response, testKey2)
+}
+
+func TestGetWithLegacyPropertySucceeds(t *testing.T) {
+	c := setup(t)
+	defer teardown(c)
+
+	// Store a level directly, with a property the service doesn't know about
+	appengineContext := newAppengineContext(c)
+	rootKey := datastore.NewKey(appengineContext, "Level", "LevelRoot", 0, nil)
+	key := datastore.NewKey(appengineContext, "Level", testKey1, 0, rootKey)
+	legacyLevel := &datastore.PropertyList{
+		{Name: "Key", Value: testKey1},
+		{Name: "HasKey", Value: true},
+		{Name: "Name", Value: "legacy level"},
+		{Name: "HasName", Value: true},
+		{Name: "RetiredField", Value: int64(42)},
+	}
+	_, err := datastore.Put(appengineContext, key, legacyLevel)
+	assert.Nil(t, err)
+
+	// It should still load, with the known fields populated
+	level := loadLevel(c, testKey1)
+	assert.Equal(t, testKey1, level.Key)
+	assert.Equal(t, "legacy level", level.Name)
+
+	// And show up in queries
+	levels := queryAll(c)
+	assert.EqualValues(t, 1, len(levels))
+}
+
+func TestNumbersKeepTheirFormWhenCached(t *testing.T) {
+	c := setup(t)
+	defer teardown(c)
+
+	stored := testLevel1
+	stored.ComboTimer = 0.1
+	storeLevel(c, testKey1, stored)
+	invalidateCachedLevel(newAppengineContext(c), testKey1)
+
+	// Uncached, then cached, the response is exactly the same
+	_, uncached := loadLevelRaw(c, testKey1)
+	_, cached := loadLevelRaw(c, testKey1)
+	assert.Equal(t, uncached, cached)
+	for _, response := range []string{uncached, cached} {
+		assert.Contains(t, response, `"rows":1,`)
+		assert.Contains(t, response, `"combo_timer":0.1,`)
+	}
+
+	// And the same goes for queries
+	_, uncached = invoke(c, "GET", buildQueryRoute(), nil)
+	_, cached = invoke(c, "GET", buildQueryRoute(), nil)
+	assert.Equal(t, uncached, cached)
+	assert.Contains(t, cached, `"combo_timer":0.1,`)
+}
+
+func TestQueryHonorsIfNoneMatch(t *testing.T) {
+	c := setup(t)
+	defer teardown(c)
+
+	storeLevel(c, testKey1, testLevel1)
+
+	// The first query hands out an ETag
+	code, _, headers := invokeWithHeaders(c, "GET", buildQueryRoute(), nil, nil)
+	assert.EqualValues(t, http.StatusOK, code)
+	tag := headers.Get("ETag")
+	assert.NotEmpty(t, tag)
+
+	// Asking again with that ETag gets a 304
+	code, body, _ := invokeWithHeaders(c, "GET", buildQueryRoute(), nil, map[string]string{"If-None-Match": tag})
+	assert.EqualValues(t, http.StatusNotModified, code)
+	assert.Empty(t, body)
+
+	// Changing the collection changes the ETag
+	storeLevel(c, testKey2, testLevel2)
+	code, _, headers = invokeWithHeaders(c, "GET", buildQueryRoute(), nil, map[string]string{"If-None-Match": tag})
+	assert.EqualValues(t, http.StatusOK, code)
+	assert.NotEqual(t, tag, headers.Get("ETag"))
+}
+
+func TestEveryWriteAdvancesTheCollectionVersion(t *testing.T) {
+	c := setup(t)
+	defer teardown(c)
+
+	// An empty collection starts at zero
+	version := loadCollectionVersion(c)
+	assert.EqualValues(t, 0, version)
+
+	writes := []func(){
+		func() { storeLevel(c, testKey1, testLevel1) },
+		func() { storeLevel(c, testKey2, testLevel2) },
+		func() {
+			patchLevel(c, testKey1, []map[string]interface{}{{"op": "replace", "path": "/name", "value": "renamed"}})
+		},
+		func() { reparentLevel(c, testKey2, testKey1) },
+		func() { invoke(c, "DELETE", buildEntityRoute(testKey2), nil) },
+	}
+	for i, write := range writes {
+		write()
+		next := loadCollectionVersion(c)
+		assert.True(t, next > version, "write %d didn't advance the version", i)
+		version = next
+	}
+
+	// Reads leave it alone, and it's the version deltas are taken from
+	queryAll(c)
+	loadLevel(c, testKey1)
+	assert.EqualValues(t, version, loadCollectionVersion(c))
+	assert.EqualValues(t, version, loadDelta(c, "").Version)
+}
+
+func TestCollectionETagFollowsTheVersion(t *testing.T) {
+	c := setup(t)
+	defer teardown(c)
+
+	storeLevel(c, testKey1, testLevel1)
+
+	// The query and the version route both tag their responses with the version
+	_, _, headers := invokeWithHeaders(c, "GET", buildQueryRoute(), nil, nil)
+	tag := headers.Get("ETag")
+	assert.Contains(t, tag, fmt.Sprintf("-%d-", loadCollectionVersion(c)))
+
+	code, _, headers := invokeWithHeaders(c, "GET", baseRoute+"/version", nil, nil)
+	assert.EqualValues(t, http.StatusOK, code)
+	code, _, _ = invokeWithHeaders(c, "GET", baseRoute+"/version", nil, map[string]string{"If-None-Match": headers.Get("ETag")})
+	assert.EqualValues(t, http.StatusNotModified, code)
+
+	// The form with warnings is a different response, so it gets a different tag
+	_, _, headers = invokeWithHeaders(c, "GET", buildQueryRoute()+"?warnings=true", nil, nil)
+	assert.NotEqual(t, tag, headers.Get("ETag"))
+
+	// And "version" can't be used as a level id
+	code, _ = invoke(c, "POST", buildEntityRoute("version"), testLevel2)
+	assert.EqualValues(t, http.StatusBadRequest, code)
+}
+
+func TestApplyDefaultsFillsOnlyUnsetFields(t *testing.T) {
+	c := setup(t)
+	defer teardown(c)
+
+	var defaults Level
+	json.Unmarshal([]byte(config.LevelDefaults), &defaults)
+	assert.NotEqual(t, float32(0), defaults.ComboTimer)
+
+	// A level without a combo timer, one with its own, and one that inherits it
+	storeLevel(c, "unset", Level{Name: "unset"})
+	storeLevel(c, "set", Level{Name: "set", ComboTimer: 42.0})
+	storeLevel(c, "inherited", Level{Parent: "set"})
+
+	// Without the flag, nothing is filled in
+	level := loadLevel(c, "unset")
+	assert.Equal(t, float32(0), level.ComboTimer)
+
+	// With the flag, the unset field gets the default
+	level = loadLevelWithDefaults(c, "unset")
+	assert.Equal(t, defaults.ComboTimer, level.ComboTimer)
+
+	// But it never overrides a set or inherited value
+	level = loadLevelWithDefaults(c, "set")
+	assert.Equal(t, float32(42.0), level.ComboTimer)
+	level = loadLevelWithDefaults(c, "inherited")
+	assert.Equal(t, float32(42.0), level.ComboTimer)
+
+	// And the plain response is unaffected afterwards
+	level = loadLevel(c, "unset")
+	assert.Equal(t, float32(0), level.ComboTimer)
+}
+
+func TestReparentMovesLevelToNewParent(t *testing.T) {
+	c := setup(t)
+	defer teardown(c)
+
+	// A child of the first parent
+	storeLevel(c, "parent_1", testLevel1)
+	storeLevel(c, "parent_2", testLevel2)
+	storeLevel(c, "child", Level{Parent: "parent_1"})
+	storeLevel(c, "grandchild", Level{Parent: "child"})
+
+	// Move it under the second parent
+	code, _ := reparentLevel(c, "child", "parent_2")
+	assert.EqualValues(t, http.StatusOK, code)
+
+	// It and its own children now inherit from the second parent
+	level := loadLevel(c, "child")
+	assert.Equal(t, "parent_2", level.Parent)
+	assert.Equal(t, testLevel2.Rows, level.Rows)
+	level = loadLevel(c, "grandchild")
+	assert.Equal(t, testLevel2.Rows, level.Rows)
+}
+
+func TestGrandparentChangesReachGrandchildren(t *testing.T) {
+	c := setup(t)
+	defer teardown(c)
+
+	storeLevel(c, "a", Level{Name: "a", Rows: 1})
+	storeLevel(c, "b", Level{Parent: "a"})
+	storeLevel(c, "c", Level{Parent: "b"})
+
+	// Cache all three generations resolved
+	assert.EqualValues(t, 1, loadLevel(c, "c").Rows)
+
+	// Changing the grandparent drops the grandchild's cached copy too
+	storeLevel(c, "a", Level{Name: "a", Rows: 7})
+	appengineContext := newAppengineContext(c)
+	_, err := memcache.Get(appengineContext, "response:"+buildEntityRoute("c"))
+	assert.Equal(t, memcache.ErrCacheMiss, err)
+
+	assert.EqualValues(t, 7, loadLevel(c, "c").Rows)
+	code, response, _ := invokeWithHeaders(c, "GET", buildEntityRoute("c"), nil, map[string]string{"Cache-Control": "no-cache"})
+	assert.EqualValues(t, http.StatusOK, code)
+	var fresh Level
+	json.Unmarshal([]byte(response), &fresh)
+	assert.EqualValues(t, 7, fresh.Rows)
+}
+
+func TestGetWithChainListsAncestryRootLast(t *testing.T) {
+	c := setup(t)
+	defer teardown(c)
+
+	storeLevel(c, "root", testLevel1)
+	storeLevel(c, "child", Level{Parent: "root", Name: "child"})
+	storeLevel(c, "grandchild", Level{Parent: "child"})
+
+	// The chain follows the stored parent pointers, alongside the resolved level
+	level, chain := loadLevelWithChain(c, "grandchild", "")
+	assert.Equal(t, []string{"child", "root"}, chain)
+	assert.Equal(t, "child", level.Name)
+	assert.Equal(t, testLevel1.Rows, level.Rows)
+
+	// A root has an empty chain
+	_, chain = loadLevelWithChain(c, "root", "")
+	assert.Equal(t, []string{}, chain)
+
+	// It survives a sparse fieldset, and follows a reparent
+	reparentLevel(c, "grandchild", "root")
+	level, chain = loadLevelWithChain(c, "grandchild", "&fields=rows")
+	assert.Equal(t, []string{"root"}, chain)
+	assert.Empty(t, level.Name)
+
+	// And the plain response stays as it was
+	code, response := loadLevelRaw(c, "grandchild")
+	assert.EqualValues(t, http.StatusOK, code)
+	assert.NotContains(t, response, "ancestry_keys")
+}
+
+func TestResolveDepthMergesOnlyTheNearestAncestors(t *testing.T) {
+	c := setup(t)
+	defer teardown(c)
+
+	storeLevel(c, "root", testLevel1)
+	storeLevel(c, "child", Level{Parent: "root", Name: "child", Columns: 9})
+	storeLevel(c, "grandchild", Level{Parent: "child", Duration: 8})
+
+	// One ancestor adds the child's fields and nothing from the root
+	level := loadLevelAtDepth(c, "grandchild", "1")
+	assert.Equal(t, "child", level.Name)
+	assert.EqualValues(t, 9, level.Columns)
+	assert.EqualValues(t, 8, level.Duration)
+	assert.EqualValues(t, 0, level.Rows)
+	assert.Empty(t, level.SpawnFrequency)
+
+	// 0 is the stored level, and past the root is the same as full resolution
+	level = loadLevelAtDepth(c, "grandchild", "0")
+	assert.Equal(t, Level{Key: "grandchild", Parent: "child", Duration: 8}, level)
+	assert.Equal(t, loadLevel(c, "grandchild"), loadLevelAtDepth(c, "grandchild", "2"))
+	assert.Equal(t, loadLevel(c, "grandchild"), loadLevelAtDepth(c, "grandchild", "1000"))
+
+	// Ancestors past the depth aren't needed
+	deleteLevel(c, "root")
+	level = loadLevelAtDepth(c, "grandchild", "1")
+	assert.EqualValues(t, 9, level.Columns)
+
+	code, _ := invoke(c, "GET", buildEntityRoute("grandchild")+"?resolveDepth=2", nil)
+	assert.EqualValues(t, http.StatusNotFound, code)
+	code, _ = invoke(c, "GET", buildEntityRoute("grandchild")+"?resolveDepth=-1", nil)
+	assert.EqualValues(t, http.StatusBadRequest, code)
+	code, _ = invoke(c, "GET", buildEntityRoute("missing")+"?resolveDepth=1", nil)
+	assert.EqualValues(t, http.StatusNotFound, code)
+}
+
+func TestGetRejectsParentCycles(t *testing.T) {
+	c := setup(t)
+	defer teardown(c)
+
+	// Two levels that are each other's parent
+	storeLevel(c, "cycle_a", Level{Parent: "cycle_b"})
+	storeLevel(c, "cycle_b", Level{Parent: "cycle_a"})
+
+	code, response := loadLevelRaw(c, "cycle_a")
+	assert.EqualValues(t, http.StatusConflict, code)
+	assert.Equal(t, "CYCLE_DETECTED", decodeError(response).Code)
+	assert.Contains(t, decodeError(response).Message, "cycle_a -> cycle_b -> cycle_a")
+
+	// Three, with a level hanging off of them that isn't in the cycle itself
+	storeLevel(c, "cycle_x", Level{Parent: "cycle_z"})
+	storeLevel(c, "cycle_y", Level{Parent: "cycle_x"})
+	storeLevel(c, "cycle_z", Level{Parent: "cycle_y"})
+	storeLevel(c, "tail", Level{Parent: "cycle_x"})
+
+	code, response = loadLevelRaw(c, "tail")
+	assert.EqualValues(t, http.StatusConflict, code)
+	assert.Equal(t, "CYCLE_DETECTED", decodeError(response).Code)
+	assert.Contains(t, decodeError(response).Message, "cycle_x -> cycle_z -> cycle_y -> cycle_x")
+
+	code, response, _ = invokeWithHeaders(c, "GET", buildEntityRoute("cycle_y"), nil, map[string]string{"Cache-Control": "no-cache"})
+	assert.EqualValues(t, http.StatusConflict, code)
+	assert.Contains(t, decodeError(response).Message, "cycle_y -> cycle_x -> cycle_z -> cycle_y")
+
+	// Breaking the cycle lets them resolve again
+	reparentLevel(c, "cycle_x", "")
+	code, _ = loadLevelRaw(c, "tail")
+	assert.EqualValues(t, http.StatusOK, code)
+}
+
+func TestSpawnsResolvesInheritedSpawnSettings(t *testing.T) {
+	c := setup(t)
+	defer teardown(c)
+
+	storeLevel(c, "parent", testLevel1)
+	storeLevel(c, "child", Level{Parent: "parent", Name: "child", SpawnsPerSecond: 9.0})
+
+	// The child's own setting wins, and the rest come from the parent
+	code, response := invoke(c, "GET", buildEntityRoute("child")+"/spawns", nil)
+	assert.EqualValues(t, http.StatusOK, code)
+
+	var spawns Level
+	json.Unmarshal([]byte(response), &spawns)
+	assert.Equal(t, Level{
+		Key:                 "child",
+		SpawnsPerSecond:     9.0,
+		MaxActiveUnits:      testLevel1.MaxActiveUnits,
+		UnitDelayMultiplier: testLevel1.UnitDelayMultiplier,
+		SpawnFrequency:      testLevel1.SpawnFrequency,
+	}, spawns)
+
+	// A change to the parent shows up in the child's view
+	changed := testLevel1
+	changed.SpawnFrequency = map[string]float32{"grunt_fire": 3.0}
+	storeLevel(c, "parent", changed)
+	code, response = invoke(c, "GET", buildEntityRoute("child")+"/spawns", nil)
+	assert.EqualValues(t, http.StatusOK, code)
+	var changedSpawns Level
+	json.Unmarshal([]byte(response), &changedSpawns)
+	assert.Equal(t, changed.SpawnFrequency, changedSpawns.SpawnFrequency)
+
+	code, _ = invoke(c, "GET", buildEntityRoute("missing")+"/spawns", nil)
+	assert.EqualValues(t, http.StatusNotFound, code)
+}
+
+func TestUsesUnitQueryFindsResolvedReferences(t *testing.T) {
+	c := setup(t)
+	defer teardown(c)
+
+	// testLevel1 spawns grunt_ice itself, and its child only inherits it
+	storeLevel(c, "parent", testLevel1)
+	storeLevel(c, "child", Level{Parent: "parent", Name: "child"})
+	storeLevel(c, "overridden", Level{Parent: "parent", SpawnFrequency: map[string]float32{"grunt_other": 1.0}})
+	storeLevel(c, "unrelated", testLevel2)
+	storeLevel(c, "no_spawns", Level{Name: "no spawns"})
+
+	code, response := invoke(c, "GET", buildQueryRoute()+"?usesUnit=grunt_ice", nil)
+	assert.EqualValues(t, http.StatusOK, code)
+
+	var levels []Level
+	json.Unmarshal([]byte(response), &levels)
+	keys := []string{}
+	for _, element := range levels {
+		keys = append(keys, element.Key)
+	}
+	assert.Equal(t, []string{"child", "parent"}, keys)
+
+	// A unit nothing uses matches nothing, and the unit type is required
+	code, response = invoke(c, "GET", buildQueryRoute()+"?usesUnit=retired", nil)
+	assert.EqualValues(t, http.StatusOK, code)
+	assert.Equal(t, "[]", response)
+	code, _ = invoke(c, "GET", buildQueryRoute()+"?usesUnit=", nil)
+	assert.EqualValues(t, http.StatusBadRequest, code)
+}
+
+func TestReparentWithEmptyTargetDetaches(t *testing.T) {
+	c := setup(t)
+	defer teardown(c)
+
+	storeLevel(c, testKey1, testLevel1)
+	storeLevel(c, testKey2, Level{Parent: testKey1, Name: "child"})
+
+	code, _ := reparentLevel(c, testKey2, "")
+	assert.EqualValues(t, http.StatusOK, code)
+
+	// The level is a root now, and only has its own fields
+	level := loadLevel(c, testKey2)
+	assert.Equal(t, Level{Key: testKey2, Name: "child"}, level)
+}
+
+func TestReparentRejectsCycle(t *testing.T) {
+	c := setup(t)
+	defer teardown(c)
+
+	// grandparent <- parent <- child
+	storeLevel(c, "grandparent", testLevel1)
+	storeLevel(c, "parent", Level{Parent: "grandparent"})
+	storeLevel(c, "child", Level{Parent: "parent"})
+
+	// Making the grandparent a child of its own descendant would form a cycle
+	code, response := reparentLevel(c, "grandparent", "child")
+	assert.EqualValues(t, http.StatusConflict, code)
+	assert.Equal(t, "CYCLE_DETECTED", decodeError(response).Code)
+
+	// Nothing changed
+	level := loadLevel(c, "grandparent")
+	assert.Equal(t, "", level.Parent)
+	level = loadLevel(c, "child")
+	assert.Equal(t, testLevel1.Rows, level.Rows)
+}
+
+func TestReparentRejectsMissingParent(t *testing.T) {
+	c := setup(t)
+	defer teardown(c)
+
+	storeLevel(c, testKey1, testLevel1)
+
+	code, response := reparentLevel(c, testKey1, "nonExistingKey")
+	assert.EqualValues(t, http.StatusBadRequest, code)
+	assert.Equal(t, "PARENT_NOT_FOUND", decodeError(response).Code)
+
+	code, response = reparentLevel(c, "nonExistingKey", testKey1)
+	assert.EqualValues(t, http.StatusNotFound, code)
+	assert.Equal(t, "NOT_FOUND", decodeError(response).Code)
+}
+
+func TestCanReparentChecksWithoutChanging(t *testing.T) {
+	c := setup(t)
+	defer teardown(c)
+
+	// grandparent <- parent <- child, and other on its own
+	storeLevel(c, "grandparent", testLevel1)
+	storeLevel(c, "parent", Level{Parent: "grandparent"})
+	storeLevel(c, "child", Level{Parent: "parent"})
+	storeLevel(c, "other", testLevel2)
+
+	check := canReparent(c, "child", "other")
+	assert.True(t, check.Valid)
+	assert.Equal(t, "parent", loadLevel(c, "child").Parent)
+
+	check = canReparent(c, "grandparent", "child")
+	assert.False(t, check.Valid)
+	assert.Equal(t, "CYCLE_DETECTED", check.Code)
+	assert.NotEmpty(t, check.Reason)
+
+	check = canReparent(c, "child", "nonExistingKey")
+	assert.False(t, check.Valid)
+	assert.Equal(t, "PARENT_NOT_FOUND", check.Code)
+
+	code, _ := invoke(c, "GET", buildEntityRoute("nonExistingKey")+"/can-reparent?to=other", nil)
+	assert.EqualValues(t, http.StatusNotFound, code)
+	code, _ = invoke(c, "GET", buildEntityRoute("child")+"/can-reparent", nil)
+	assert.EqualValues(t, http.StatusBadRequest, code)
+}
+
+func TestDescendantCountIsDirectOrRecursive(t *testing.T) {
+	c := setup(t)
+	defer teardown(c)
+
+	storeLevel(c, "root", Level{Name: "root"})
+	storeLevel(c, "a", Level{Parent: "root"})
+	storeLevel(c, "b", Level{Parent: "root"})
+	storeLevel(c, "a1", Level{Parent: "a"})
+	storeLevel(c, "a2", Level{Parent: "a"})
+	storeLevel(c, "a1x", Level{Parent: "a1"})
+
+	assert.Equal(t, 2, countDescendants(c, "root", false))
+	assert.Equal(t, 5, countDescendants(c, "root", true))
+	assert.Equal(t, 3, countDescendants(c, "a", true))
+	assert.Equal(t, 0, countDescendants(c, "b", true))
+
+	// The cached counts follow changes to the tree
+	storeLevel(c, "b1", Level{Parent: "b"})
+	assert.Equal(t, 6, countDescendants(c, "root", true))
+	deleteLevel(c, "a1x")
+	assert.Equal(t, 5, countDescendants(c, "root", true))
+	assert.Equal(t, 0, countDescendants(c, "a1", false))
+
+	// A cycle is only walked once
+	appengineContext := newAppengineContext(c)
+	rootKey := datastore.NewKey(appengineContext, "Level", "LevelRoot", 0, nil)
+	for id, parent := range map[string]string{"loop_a": "loop_b", "loop_b": "loop_a"} {
+		_, err := datastore.Put(appengineContext, datastore.NewKey(appengineContext, "Level", id, 0, rootKey), &datastore.PropertyList{
+			{Name: "Key", Value: id},
+			{Name: "HasKey", Value: true},
+			{Name: "Parent", Value: parent},
+			{Name: "HasParent", Value: true},
+		})
+		assert.Nil(t, err)
+	}
+	assert.Equal(t, 1, countDescendants(c, "loop_a", true))
+
+	code, _ := invoke(c, "GET", buildEntityRoute("missing")+"/descendant-count", nil)
+	assert.EqualValues(t, http.StatusNotFound, code)
+}
+
+func TestRenameImpactListsReferences(t *testing.T) {
+	c := setup(t)
+	defer teardown(c)
+
+	storeLevel(c, testKey1, testLevel1)
+	storeLevel(c, "child", Level{Parent: testKey1})
+	storeLevel(c, "grandchild", Level{Parent: "child"})
+	storeLevel(c, testKey2, testLevel2)
+	storeTerritory(c, "territory", []string{testKey2, testKey1})
+	storeTerritory(c, "unrelated", []string{testKey2})
+
+	impact := loadRenameImpact(c, testKey1, "renamed")
+	assert.Equal(t, []string{"child"}, impact.Children)
+	assert.Equal(t, []string{"territory"}, impact.Territories)
+	assert.True(t, impact.TargetFree)
+
+	// A key that's taken isn't free
+	impact = loadRenameImpact(c, testKey1, testKey2)
+	assert.False(t, impact.TargetFree)
+	assert.NotEmpty(t, impact.Reason)
+
+	code, _ := invoke(c, "GET", buildEntityRoute("nonExistingKey")+"/rename-impact?to=renamed", nil)
+	assert.EqualValues(t, http.StatusNotFound, code)
+}
+
+func TestBulkTagsAddAndRemoveAcrossLevels(t *testing.T) {
+	c := setup(t)
+	defer teardown(c)
+
+	storeLevel(c, testKey1, Level{Name: "one", Tags: []string{"boss", "ice"}})
+	storeLevel(c, testKey2, Level{Name: "two"})
+	storeLevel(c, "child", Level{Parent: testKey1, Tags: []string{"ice", "ice"}})
+
+	code, response := invoke(c, "POST", buildQueryRoute()+"/tags", map[string]interface{}{
+		"keys":       []string{testKey1, testKey2, "child"},
+		"addTags":    []string{"desert", "boss", "desert"},
+		"removeTags": []string{"ice"},
+	})
+	assert.EqualValues(t, http.StatusOK, code)
+	assert.Contains(t, response, `"levels"`)
+
+	assert.Equal(t, []string{"boss", "desert"}, loadLevel(c, testKey1).Tags)
+	assert.Equal(t, []string{"desert", "boss"}, loadLevel(c, testKey2).Tags)
+	assert.Equal(t, []string{"desert", "boss"}, loadLevel(c, "child").Tags)
+
+	// A missing level leaves every level as it was
+	code, _ = invoke(c, "POST", buildQueryRoute()+"/tags", map[string]interface{}{
+		"keys":    []string{testKey1, "nonExistingKey"},
+		"addTags": []string{"new"},
+	})
+	assert.EqualValues(t, http.StatusNotFound, code)
+	assert.Equal(t, []string{"boss", "desert"}, loadLevel(c, testKey1).Tags)
+}
+
+// --- Benchmarks
+
+// maxParentDepth mirrors the number of ancestors a level may have.
+const maxParentDepth = 32
+
+const benchmarkChainDepth = 10
+const benchmarkChildCount = 10
+
+// Resolves children of a deep chain with none of the ancestors cached, so every
+// child walks the whole chain.  This is the cost without the resolved-chain cache.
+func TestJsonPatchReplacesScalarField(t *testing.T) {
+	c := setup(t)
+	defer teardown(c)
+
+	storeLevel(c, testKey1, testLevel1)
+
+	code, _ := patchLevel(c, testKey1, []map[string]interface{}{
+		{"op": "test", "path": "/rows", "value": testLevel1.Rows},
+		{"op": "replace", "path": "/rows", "value": 42},
+	})
+	assert.EqualValues(t, http.StatusOK, code)
+
+	// Only the patched field changes
+	expected := testLevel1
+	expected.Key = testKey1
+	expected.Rows = 42
+	assert.Equal(t, expected, loadLevel(c, testKey1))
+}
+
+func TestJsonPatchRemovesSpawnEntry(t *testing.T) {
+	c := setup(t)
+	defer teardown(c)
+
+	storeLevel(c, testKey1, testLevel1)
+
+	code, _ := patchLevel(c, testKey1, []map[string]interface{}{
+		{"op": "remove", "path": "/spawn_frequency/grunt_ice"},
+		{"op": "add", "path": "/spawn_frequency/grunt_new", "value": 3.0},
+	})
+	assert.EqualValues(t, http.StatusOK, code)
+
+	level := loadLevel(c, testKey1)
+	assert.Equal(t, map[string]float32{"grunt_fire": 1.0, "grunt_new": 3.0}, level.SpawnFrequency)
+}
+
+func TestMergePatchUpdatesOnlyGivenFields(t *testing.T) {
+	c := setup(t)
+	defer teardown(c)
+
+	storeLevel(c, testKey1, testLevel1)
+	storeLevel(c, testKey2, Level{Parent: testKey1, Name: "child"})
+	loadLevel(c, testKey2)
+
+	code, _ := mergePatchLevel(c, testKey1, map[string]interface{}{"combo_timer": 9.5})
+	assert.EqualValues(t, http.StatusOK, code)
+
+	expected := testLevel1
+	expected.Key = testKey1
+	expected.ComboTimer = 9.5
+	assert.Equal(t, expected, loadLevel(c, testKey1))
+
+	// The child was cached with the old value, and inherits the new one
+	assert.EqualValues(t, 9.5, loadLevel(c, testKey2).ComboTimer)
+
+	// A spawn map replaces the stored one whole
+	code, _ = mergePatchLevel(c, testKey1, map[string]interface{}{"spawn_frequency": map[string]float32{"grunt_new": 3.0}})
+	assert.EqualValues(t, http.StatusOK, code)
+	assert.Equal(t, map[string]float32{"grunt_new": 3.0}, loadLevel(c, testKey1).SpawnFrequency)
+	assert.Equal(t, "test level", loadLevel(c, testKey1).Name)
+
+	// Plain JSON bodies merge too
+	code, _, _ = invokeWithHeaders(c, "PATCH", buildEntityRoute(testKey1), map[string]interface{}{"rows": 5}, map[string]string{"Content-Type": "application/json"})
+	assert.EqualValues(t, http.StatusOK, code)
+	assert.EqualValues(t, 5, loadLevel(c, testKey1).Rows)
+
+	// The key can't change, the result must be valid, and the level must exist
+	code, _ = mergePatchLevel(c, testKey1, map[string]interface{}{"key": "other"})
+	assert.EqualValues(t, http.StatusBadRequest, code)
+	code, _ = mergePatchLevel(c, testKey1, map[string]interface{}{"tags": []string{""}})
+	assert.EqualValues(t, http.StatusBadRequest, code)
+	code, _ = mergePatchLevel(c, "missing", map[string]interface{}{"rows": 1})
+	assert.EqualValues(t, http.StatusNotFound, code)
+}
+
+func TestMergePatchNullRemovesFields(t *testing.T) {
+	c := setup(t)
+	defer teardown(c)
+
+	storeLevel(c, testKey1, testLevel1)
+	storeLevel(c, testKey2, Level{Parent: testKey1, Name: "child", Rows: 7})
+
+	// The child's own rows go, so it inherits its parent's again
+	code, _ := mergePatchLevel(c, testKey2, map[string]interface{}{"rows": nil, "name": "renamed"})
+	assert.EqualValues(t, http.StatusOK, code)
+	child := loadLevel(c, testKey2)
+	assert.Equal(t, "renamed", child.Name)
+	assert.Equal(t, testLevel1.Rows, child.Rows)
+
+	code, response := invoke(c, "GET", buildEntityRoute(testKey2)+"?resolveDepth=0", nil)
+	assert.EqualValues(t, http.StatusOK, code)
+	var stored map[string]interface{}
+	json.Unmarshal([]byte(response), &stored)
+	_, hasRows := stored["rows"]
+	assert.False(t, hasRows)
+
+	// Removing a field that isn't set changes nothing
+	code, _ = mergePatchLevel(c, testKey2, map[string]interface{}{"duration": nil})
+	assert.EqualValues(t, http.StatusOK, code)
+	assert.Equal(t, child, loadLevel(c, testKey2))
+}
+
+func TestJsonPatchFailsAsAWhole(t *testing.T) {
+	c := setup(t)
+	defer teardown(c)
+
+	storeLevel(c, testKey1, testLevel1)
+
+	// A failed test stops the patch before anything is written
+	code, _ := patchLevel(c, testKey1, []map[string]interface{}{
+		{"op": "replace", "path": "/name", "value": "patched"},
+		{"op": "test", "path": "/rows", "value": 999},
+	})
+	assert.EqualValues(t, http.StatusConflict, code)
+	assert.Equal(t, testLevel1.Name, loadLevel(c, testKey1).Name)
+
+	// Unknown fields and the key can't be patched
+	code, _ = patchLevel(c, testKey1, []map[string]interface{}{{"op": "add", "path": "/unknown", "value": 1}})
+	assert.EqualValues(t, http.StatusBadRequest, code)
+	code, _ = patchLevel(c, testKey1, []map[string]interface{}{{"op": "replace", "path": "/key", "value": "other"}})
+	assert.EqualValues(t, http.StatusBadRequest, code)
+
+	// Missing levels and other content types are rejected
+	code, _ = patchLevel(c, testKey2, []map[string]interface{}{{"op": "replace", "path": "/rows", "value": 1}})
+	assert.EqualValues(t, http.StatusNotFound, code)
+	code, _ = invoke(c, "PATCH", buildEntityRoute(testKey1), map[string]interface{}{"rows": 1})
+	assert.EqualValues(t, http.StatusUnsupportedMediaType, code)
+}
+
+func TestPutWithCompressedBodySucceeds(t *testing.T) {
+	c := setup(t)
+	defer teardown(c)
+
+	marshalledLevel, _ := json.Marshal(testLevel1)
+	var compressed bytes.Buffer
+	writer := gzip.NewWriter(&compressed)
+	writer.Write(marshalledLevel)
+	writer.Close()
+
+	code, _, _ := invokeRaw(c, "PUT", buildEntityRoute(testKey1), compressed.Bytes(), map[string]string{"Content-Encoding": "gzip"})
+	assert.EqualValues(t, http.StatusOK, code)
+
+	expected := testLevel1
+	expected.Key = testKey1
+	assert.Equal(t, expected, loadLevel(c, testKey1))
+
+	// Unknown encodings are refused
+	code, _, _ = invokeRaw(c, "PUT", buildEntityRoute(testKey2), marshalledLevel, map[string]string{"Content-Encoding": "br"})
+	assert.EqualValues(t, http.StatusUnsupportedMediaType, code)
+	code, _ = loadLevelRaw(c, testKey2)
+	assert.EqualValues(t, http.StatusNotFound, code)
+}
+
+func TestCompressedBodiesAreCappedOnceDecompressed(t *testing.T) {
+	c := setupSerial(t)
+	defer teardown(c)
+
+	defer func(limit int) { config.MaxCacheItemBytes = limit }(config.MaxCacheItemBytes)
+	config.MaxCacheItemBytes = 1024
+
+	// A name of zeroes compresses to almost nothing
+	bomb := testLevel1
+	bomb.Name = strings.Repeat("0", 4096)
+	marshalledLevel, _ := json.Marshal(bomb)
+	var compressed bytes.Buffer
+	writer := gzip.NewWriter(&compressed)
+	writer.Write(marshalledLevel)
+	writer.Close()
+	assert.True(t, compressed.Len() < 1024)
+
+	code, _, _ := invokeRaw(c, "PUT", buildEntityRoute(testKey1), compressed.Bytes(), map[string]string{"Content-Encoding": "gzip"})
+	assert.EqualValues(t, http.StatusBadRequest, code)
+	code, _ = loadLevelRaw(c, testKey1)
+	assert.EqualValues(t, http.StatusNotFound, code)
+}
+
+func TestOnlyLargeResponsesAreCompressed(t *testing.T) {
+	c := setup(t)
+	defer teardown(c)
+
+	acceptGzip := map[string]string{"Accept-Encoding": "gzip, deflate"}
+	storeLevel(c, testKey1, testLevel1)
+
+	// A single level is under the threshold, so it's sent as it is
+	code, response, headers := invokeRaw(c, "GET", buildEntityRoute(testKey1), nil, acceptGzip)
+	assert.EqualValues(t, http.StatusOK, code)
+	assert.Empty(t, headers.Get("Content-Encoding"))
+	var single Level
+	json.Unmarshal([]byte(response), &single)
+	assert.Equal(t, testLevel1.Name, single.Name)
+
+	// The whole collection isn't
+	for i := 0; i < 10; i++ {
+		storeLevel(c, fmt.Sprintf("level_%d", i), testLevel2)
+	}
+	_, uncompressed := invoke(c, "GET", buildQueryRoute(), nil)
+	assert.True(t, len(uncompressed) >= config.MinGzipBytes)
+
+	code, response, headers = invokeRaw(c, "GET", buildQueryRoute(), nil, acceptGzip)
+	assert.EqualValues(t, http.StatusOK, code)
+	assert.Equal(t, "gzip", headers.Get("Content-Encoding"))
+	reader, err := gzip.NewReader(strings.NewReader(response))
+	if assert.NoError(t, err) {
+		decompressed, _ := ioutil.ReadAll(reader)
+		assert.Equal(t, uncompressed, string(decompressed))
+	}
+
+	// Clients that don't accept gzip get it uncompressed
+	_, _, headers = invokeRaw(c, "GET", buildQueryRoute(), nil, map[string]string{"Accept-Encoding": "gzip;q=0"})
+	assert.Empty(t, headers.Get("Content-Encoding"))
+}
+
+func TestNoCacheHeaderBypassesStaleCache(t *testing.T) {
+	c := setup(t)
+	defer teardown(c)
+
+	storeLevel(c, testKey1, Level{Name: "cached"})
+
+	// Change the stored level behind the caches' back
+	appengineContext := newAppengineContext(c)
+	rootKey := datastore.NewKey(appengineContext, "Level", "LevelRoot", 0, nil)
+	key := datastore.NewKey(appengineContext, "Level", testKey1, 0, rootKey)
+	_, err := datastore.Put(appengineContext, key, &datastore.PropertyList{
+		{Name: "Key", Value: testKey1},
+		{Name: "HasKey", Value: true},
+		{Name: "Name", Value: "fresh"},
+		{Name: "HasName", Value: true},
+	})
+	assert.Nil(t, err)
+	assert.Equal(t, "cached", loadLevel(c, testKey1).Name)
+
+	// Asking for fresh data goes to the datastore
+	code, response, _ := invokeWithHeaders(c, "GET", buildEntityRoute(testKey1), nil, map[string]string{"Cache-Control": "no-cache"})
+	assert.EqualValues(t, http.StatusOK, code)
+	var level Level
+	json.Unmarshal([]byte(response), &level)
+	assert.Equal(t, "fresh", level.Name)
+
+	// And refreshes the caches for everyone else
+	assert.Equal(t, "fresh", loadLevel(c, testKey1).Name)
+}
+
+func TestPagedQueryCarriesSortInToken(t *testing.T) {
+	c := setup(t)
+	defer teardown(c)
+
+	// Key order and name order differ
+	storeLevel(c, "level_1", Level{Name: "c"})
+	storeLevel(c, "level_2", Level{Name: "a"})
+	storeLevel(c, "level_3", Level{Name: "b"})
+
+	code, page := queryPage(c, "?sort=name&limit=2")
+	assert.EqualValues(t, http.StatusOK, code)
+	assert.Equal(t, []string{"a", "b"}, levelNames(page.Levels))
+	assert.NotEmpty(t, page.NextPageToken)
+
+	// The next page keeps the sort and limit without being told again
+	code, next := queryPage(c, "?pageToken="+page.NextPageToken)
+	assert.EqualValues(t, http.StatusOK, code)
+	assert.Equal(t, []string{"c"}, levelNames(next.Levels))
+	assert.Empty(t, next.NextPageToken)
+
+	// Repeating a parameter is fine, but changing one isn't
+	code, _ = queryPage(c, "?sort=name&pageToken="+page.NextPageToken)
+	assert.EqualValues(t, http.StatusOK, code)
+	code, _ = queryPage(c, "?sort=-name&pageToken="+page.NextPageToken)
+	assert.EqualValues(t, http.StatusBadRequest, code)
+}
+
+func TestPagedQueryRejectsTamperedToken(t *testing.T) {
+	c := setup(t)
+	defer teardown(c)
+
+	storeLevel(c, "level_1", Level{Name: "a"})
+	storeLevel(c, "level_2", Level{Name: "b"})
+
+	_, page := queryPage(c, "?sort=name&limit=1")
+	assert.NotEmpty(t, page.NextPageToken)
+
+	// Swap in a payload asking for a bigger page, keeping the old signature
+	parts := strings.Split(page.NextPageToken, ".")
+	payload, _ := base64.RawURLEncoding.DecodeString(parts[0])
+	payload = bytes.Replace(payload, []byte(`"limit":1`), []byte(`"limit":50`), 1)
+	tampered := base64.RawURLEncoding.EncodeToString(payload) + "." + parts[1]
+
+	code, _ := queryPage(c, "?pageToken="+tampered)
+	assert.EqualValues(t, http.StatusBadRequest, code)
+	code, _ = queryPage(c, "?pageToken=garbage")
+	assert.EqualValues(t, http.StatusBadRequest, code)
+
+	// Even a properly signed token can't ask for more than a page may hold
+	oversized, err := pagination.Encode(&pagination.State{Limit: 1000})
+	assert.Nil(t, err)
+	code, _ = queryPage(c, "?pageToken="+oversized)
+	assert.EqualValues(t, http.StatusBadRequest, code)
+	unsorted, err := pagination.Encode(&pagination.State{Sort: "Name", Limit: 1})
+	assert.Nil(t, err)
+	code, _ = queryPage(c, "?pageToken="+unsorted)
+	assert.EqualValues(t, http.StatusBadRequest, code)
+}
+
+func TestPagedQueryNeedsATokenSecret(t *testing.T) {
+	c := setupSerial(t)
+	defer teardown(c)
+
+	storeLevel(c, "level_1", Level{Name: "a"})
+	storeLevel(c, "level_2", Level{Name: "b"})
+	_, page := queryPage(c, "?sort=name&limit=1")
+	assert.NotEmpty(t, page.NextPageToken)
+
+	defer func(secret string) { config.PageTokenSecret = secret }(config.PageTokenSecret)
+	config.PageTokenSecret = ""
+
+	// Nothing is signed or accepted without one
+	code, _ := queryPage(c, "?sort=name&limit=1")
+	assert.EqualValues(t, http.StatusInternalServerError, code)
+	code, _ = queryPage(c, "?pageToken="+page.NextPageToken)
+	assert.EqualValues(t, http.StatusInternalServerError, code)
+
+	// A page with nothing after it needs no token
+	code, _ = queryPage(c, "?sort=name")
+	assert.EqualValues(t, http.StatusOK, code)
+}
+
+func TestExportStreamsEveryLevel(t *testing.T) {
+	c := setup(t)
+	defer teardown(c)
+
+	// More than one page worth
+	var batch []Level
+	for i := 0; i < 150; i++ {
+		batch = append(batch, Level{Key: fmt.Sprintf("level_%03d", i), Name: "exported"})
+	}
+	code, _ := invokeBatch(c, "batch-put", "best-effort", batch[:75])
+	assert.EqualValues(t, http.StatusOK, code)
+	code, _ = invokeBatch(c, "batch-put", "best-effort", batch[75:])
+	assert.EqualValues(t, http.StatusOK, code)
+
+	code, response := invoke(c, "GET", "/export", nil)
+	assert.EqualValues(t, http.StatusOK, code)
+
+	var exported []Level
+	err := json.Unmarshal([]byte(response), &exported)
+	assert.Nil(t, err)
+	assert.EqualValues(t, 150, len(exported))
+
+	keys := make(map[string]bool)
+	for _, element := range exported {
+		keys[element.Key] = true
+	}
+	for _, element := range batch {
+		assert.True(t, keys[element.Key], element.Key)
+	}
+}
+
+func TestCompressedExportStillStreams(t *testing.T) {
+	c := setup(t)
+	defer teardown(c)
+
+	// Three pages worth, each well over the gzip threshold
+	var batch []Level
+	for i := 0; i < 250; i++ {
+		batch = append(batch, Level{Key: fmt.Sprintf("level_%03d", i), Name: "exported"})
+	}
+	for start := 0; start < len(batch); start += 50 {
+		code, _ := invokeBatch(c, "batch-put", "best-effort", batch[start:start+50])
+		assert.EqualValues(t, http.StatusOK, code)
+	}
+
+	request, _ := c.ae.NewRequest("GET", "/export", nil)
+	request.Header.Set("Accept-Encoding", "gzip")
+	recorder := &flushRecorder{ResponseRecorder: httptest.NewRecorder()}
+	http.DefaultServeMux.ServeHTTP(recorder, request)
+	assert.EqualValues(t, http.StatusOK, recorder.Code)
+	assert.Equal(t, "gzip", recorder.HeaderMap.Get("Content-Encoding"))
+
+	// Each page reached the client before the whole body was written
+	if assert.True(t, len(recorder.flushed) >= 2) {
+		assert.True(t, recorder.flushed[0] > 0)
+		assert.True(t, recorder.flushed[0] < recorder.flushed[1])
+		assert.True(t, recorder.flushed[1] < recorder.Body.Len())
+	}
+
+	reader, err := gzip.NewReader(recorder.Body)
+	if assert.NoError(t, err) {
+		var exported []Level
+		assert.Nil(t, json.NewDecoder(reader).Decode(&exported))
+		assert.EqualValues(t, 250, len(exported))
+	}
+}
+
+func TestJsonPatchHonorsPreferReturn(t *testing.T) {
+	c := setup(t)
+	defer teardown(c)
+
+	storeLevel(c, testKey1, testLevel1)
+	storeLevel(c, testKey2, Level{Parent: testKey1})
+	operations := []map[string]interface{}{{"op": "add", "path": "/name", "value": "patched"}}
+
+	// The full resolved level comes back for return=representation
+	headers := map[string]string{"Content-Type": "application/json-patch+json", "Prefer": "return=representation"}
+	code, response, responseHeaders := invokeWithHeaders(c, "PATCH", buildEntityRoute(testKey2), operations, headers)
+	assert.EqualValues(t, http.StatusOK, code)
+	assert.NotEmpty(t, responseHeaders.Get("ETag"))
+
+	var level Level
+	json.Unmarshal([]byte(response), &level)
+	assert.Equal(t, "patched", level.Name)
+	assert.Equal(t, testLevel1.Rows, level.Rows)
+
+	// But only the ETag for return=minimal
+	headers["Prefer"] = "return=minimal"
+	operations[0]["value"] = "patched again"
+	code, response, responseHeaders = invokeWithHeaders(c, "PATCH", buildEntityRoute(testKey2), operations, headers)
+	assert.EqualValues(t, http.StatusNoContent, code)
+	assert.Empty(t, response)
+	assert.NotEmpty(t, responseHeaders.Get("ETag"))
+	assert.Equal(t, "patched again", loadLevel(c, testKey2).Name)
+}
+
+func TestReindexBackfillsHasParent(t *testing.T) {
+	c := setup(t)
+	defer teardown(c)
+
+	storeLevel(c, testKey1, testLevel1)
+
+	// Store a level directly, as older versions did without the HasParent field
+	appengineContext := newAppengineContext(c)
+	rootKey := datastore.NewKey(appengineContext, "Level", "LevelRoot", 0, nil)
+	key := datastore.NewKey(appengineContext, "Level", testKey2, 0, rootKey)
+	legacyLevel := &datastore.PropertyList{
+		{Name: "Key", Value: testKey2},
+		{Name: "HasKey", Value: true},
+		{Name: "Parent", Value: testKey1},
+		{Name: "Name", Value: "legacy child"},
+		{Name: "HasName", Value: true},
+	}
+	_, err := datastore.Put(appengineContext, key, legacyLevel)
+	assert.Nil(t, err)
+
+	// Reindexing fills it in, without waiting for the level to be read, and
+	// reports the rewrite to delta syncs
+	version := loadCollectionVersion(c)
+	code, response := invokeAsUser(c, "POST", "/admin/levels/reindex", nil, adminUser)
+	assert.EqualValues(t, http.StatusOK, code)
+	var result ReindexResponse
+	json.Unmarshal([]byte(response), &result)
+	assert.EqualValues(t, 2, result.Scanned)
+	assert.EqualValues(t, 1, result.Updated)
+	assert.True(t, loadCollectionVersion(c) > version)
+	delta := loadDelta(c, fmt.Sprintf("?since=%d", version))
+	if assert.Len(t, delta.Levels, 1) {
+		assert.Equal(t, testKey2, delta.Levels[0].Key)
+	}
+
+	var stored datastore.PropertyList
+	datastore.Get(appengineContext, key, &stored)
+	assert.Contains(t, stored, datastore.Property{Name: "HasParent", Value: true})
+
+	// So the level now inherits from its parent
+	level := loadLevel(c, testKey2)
+	assert.Equal(t, testKey1, level.Parent)
+	assert.Equal(t, testLevel1.Rows, level.Rows)
+
+	// And a second run has nothing left to do
+	code, response = invokeAsUser(c, "POST", "/admin/levels/reindex", nil, adminUser)
+	assert.EqualValues(t, http.StatusOK, code)
+	json.Unmarshal([]byte(response), &result)
+	assert.EqualValues(t, 0, result.Updated)
+}
+
+func TestReindexRequiresAdmin(t *testing.T) {
+	c := setup(t)
+	defer teardown(c)
+
+	code, _ := invokeAsUser(c, "POST", "/admin/levels/reindex", nil, nil)
+	assert.EqualValues(t, http.StatusUnauthorized, code)
+
+	code, _ = invokeAsUser(c, "POST", "/admin/levels/reindex", nil, &user.User{Email: "editor@example.com"})
+	assert.EqualValues(t, http.StatusForbidden, code)
+}
+
+func TestReadMigratesOlderLevels(t *testing.T) {
+	c := setup(t)
+	defer teardown(c)
+
+	code, response := invoke(c, "GET", "/schema/version", nil)
+	assert.EqualValues(t, http.StatusOK, code)
+	var schema SchemaVersion
+	json.Unmarshal([]byte(response), &schema)
+	assert.True(t, schema.SchemaVersion > 0)
+	assert.True(t, schema.MigrateOnRead)
+
+	// Levels written now carry the current version
+	storeLevel(c, testKey1, testLevel1)
+	appengineContext := newAppengineContext(c)
+	rootKey := datastore.NewKey(appengineContext, "Level", "LevelRoot", 0, nil)
+	var stored datastore.PropertyList
+	datastore.Get(appengineContext, datastore.NewKey(appengineContext, "Level", testKey1, 0, rootKey), &stored)
+	assert.Contains(t, stored, datastore.Property{Name: "SchemaVersion", Value: schema.SchemaVersion})
+
+	// Store a level directly, as older versions did without a schema version or
+	// the HasParent field
+	key := datastore.NewKey(appengineContext, "Level", testKey2, 0, rootKey)
+	legacyLevel := &datastore.PropertyList{
+		{Name: "Key", Value: testKey2},
+		{Name: "HasKey", Value: true},
+		{Name: "Parent", Value: testKey1},
+		{Name: "Name", Value: "legacy child"},
+		{Name: "HasName", Value: true},
+	}
+	_, err := datastore.Put(appengineContext, key, legacyLevel)
+	assert.Nil(t, err)
+
+	// The first read upgrades it, so it inherits from its parent straight away
+	version := loadCollectionVersion(c)
+	level := loadLevel(c, testKey2)
+	assert.Equal(t, testKey1, level.Parent)
+	assert.Equal(t, testLevel1.Rows, level.Rows)
+
+	// But leaves writing it back to a task
+	stored = nil
+	datastore.Get(appengineContext, key, &stored)
+	assert.NotContains(t, stored, datastore.Property{Name: "HasParent", Value: true})
+	assert.Equal(t, version, loadCollectionVersion(c))
+
+	code, response = invokeAsUser(c, "POST", "/admin/levels/migrate?key="+testKey1+"&key="+testKey2, nil, adminUser)
+	assert.EqualValues(t, http.StatusOK, code)
+	var migrated ReindexResponse
+	json.Unmarshal([]byte(response), &migrated)
+	assert.EqualValues(t, 1, migrated.Updated)
+
+	// Which writes the upgrade back, where delta syncs see it
+	stored = nil
+	datastore.Get(appengineContext, key, &stored)
+	assert.Contains(t, stored, datastore.Property{Name: "HasParent", Value: true})
+	assert.Contains(t, stored, datastore.Property{Name: "SchemaVersion", Value: schema.SchemaVersion})
+	assert.True(t, loadCollectionVersion(c) > version)
+
+	// So there's nothing left for a reindex to do
+	code, response = invokeAsUser(c, "POST", "/admin/levels/reindex", nil, adminUser)
+	assert.EqualValues(t, http.StatusOK, code)
+	var result ReindexResponse
+	json.Unmarshal([]byte(response), &result)
+	assert.EqualValues(t, 0, result.Updated)
+}
+
+func TestDuplicatesGroupsIdenticalLevels(t *testing.T) {
+	c := setup(t)
+	defer teardown(c)
+
+	storeLevel(c, "copy_b", testLevel1)
+	storeLevel(c, "copy_a", testLevel1)
+	storeLevel(c, "distinct", testLevel2)
+
+	code, response := invokeAsUser(c, "GET", "/admin/levels/duplicates", nil, adminUser)
+	assert.EqualValues(t, http.StatusOK, code)
+
+	var result DuplicatesResponse
+	json.Unmarshal([]byte(response), &result)
+	assert.Equal(t, [][]string{{"copy_a", "copy_b"}}, result.Groups)
+
+	// A child that only differs through its parent is the same once resolved
+	storeLevel(c, "inherits", Level{Parent: "copy_a"})
+	storeLevel(c, "copy_c", Level{Parent: "copy_a", Name: testLevel1.Name})
+	code, response = invokeAsUser(c, "GET", "/admin/levels/duplicates?resolved=true", nil, adminUser)
+	assert.EqualValues(t, http.StatusOK, code)
+	json.Unmarshal([]byte(response), &result)
+	assert.Equal(t, [][]string{{"copy_a", "copy_b"}, {"copy_c", "inherits"}}, result.Groups)
+}
+
+func TestVerifyCacheFlagsStaleEntries(t *testing.T) {
+	c := setup(t)
+	defer teardown(c)
+
+	storeLevel(c, testKey1, Level{Name: "cached"})
+	storeLevel(c, testKey2, Level{Name: "consistent"})
+
+	// Change one level behind the caches' back
+	appengineContext := newAppengineContext(c)
+	rootKey := datastore.NewKey(appengineContext, "Level", "LevelRoot", 0, nil)
+	key := datastore.NewKey(appengineContext, "Level", testKey1, 0, rootKey)
+	_, err := datastore.Put(appengineContext, key, &datastore.PropertyList{
+		{Name: "Key", Value: testKey1},
+		{Name: "HasKey", Value: true},
+		{Name: "Name", Value: "fresh"},
+		{Name: "HasName", Value: true},
+	})
+	assert.Nil(t, err)
+
+	code, response := invokeAsUser(c, "POST", "/admin/cache/verify", nil, adminUser)
+	assert.EqualValues(t, http.StatusOK, code)
+
+	var result VerifyResponse
+	json.Unmarshal([]byte(response), &result)
+	assert.EqualValues(t, 2, result.Checked)
+	assert.EqualValues(t, 2, len(result.Mismatches))
+	for _, mismatch := range result.Mismatches {
+		assert.Equal(t, testKey1, mismatch.Key)
+		assert.Equal(t, "fresh", mismatch.Fresh.Name)
+	}
+
+	// The stale entries are left alone
+	assert.Equal(t, "cached", loadLevel(c, testKey1).Name)
+}
+
+func TestPurgeOrphanedCacheDropsDeletedLevels(t *testing.T) {
+	c := setup(t)
+	defer teardown(c)
+
+	storeLevel(c, testKey1, testLevel1)
+	storeLevel(c, testKey2, testLevel2)
+	loadLevel(c, testKey2)
+	deleteLevel(c, testKey1)
+
+	// Seed entries the delete's invalidation missed, including a query-all
+	// that still lists the level and its count from just before the delete
+	appengineContext := newAppengineContext(c)
+	countKey := fmt.Sprintf("response:descendant-count:%s:false@%d", testKey1, loadCollectionVersion(c)-1)
+	stale := []string{"response:query:all@levels", "level:" + testKey1, "response:" + buildEntityRoute(testKey1), countKey}
+	for _, key := range stale {
+		memcache.Set(appengineContext, &memcache.Item{Key: key, Value: []byte("stale")})
+	}
+
+	// Only admins may purge
+	code, _ := invoke(c, "POST", "/admin/cache/purge-orphans", nil)
+	assert.EqualValues(t, http.StatusUnauthorized, code)
+
+	code, response := invokeAsUser(c, "POST", "/admin/cache/purge-orphans", nil, adminUser)
+	assert.EqualValues(t, http.StatusOK, code)
+
+	var result PurgeResponse
+	json.Unmarshal([]byte(response), &result)
+	assert.EqualValues(t, 10, result.Checked)
+	assert.EqualValues(t, 4, result.Purged)
+	assert.Equal(t, stale, result.Keys)
+	for _, key := range stale {
+		_, err := memcache.Get(appengineContext, key)
+		assert.Equal(t, memcache.ErrCacheMiss, err, key)
+	}
+
+	// Live levels keep their entries, and there's nothing left to purge
+	_, err := memcache.Get(appengineContext, "level:"+testKey2)
+	assert.Nil(t, err)
+	code, response = invokeAsUser(c, "POST", "/admin/cache/purge-orphans", nil, adminUser)
+	assert.EqualValues(t, http.StatusOK, code)
+	json.Unmarshal([]byte(response), &result)
+	assert.EqualValues(t, 0, result.Purged)
+}
+
+func TestCheckDependentsWarnsAboutLostFields(t *testing.T) {
+	c := setup(t)
+	defer teardown(c)
+
+	storeLevel(c, "parent", Level{Name: "parent", Rows: 3, Columns: 4})
+	storeLevel(c, "child", Level{Parent: "parent", Name: "child"})
+
+	// Dropping columns from the parent leaves the child without any
+	code, response := invoke(c, "PUT", baseRoute+"/parent?checkDependents=true", Level{Name: "parent", Rows: 3})
+	assert.EqualValues(t, http.StatusOK, code)
+
+	var report DependentsReport
+	json.Unmarshal([]byte(response), &report)
+	assert.Equal(t, 1, len(report.AffectedChildren))
+	assert.Equal(t, "child", report.AffectedChildren[0].Key)
+	assert.Equal(t, []string{"columns"}, report.AffectedChildren[0].Fields)
+
+	// The write still went through
+	assert.Equal(t, Level{Key: "child", Parent: "parent", Name: "child", Rows: 3}, loadLevel(c, "child"))
+}
+
+func TestCheckDependentsEnforceBlocksWrite(t *testing.T) {
+	c := setup(t)
+	defer teardown(c)
+
+	storeLevel(c, "parent", Level{Name: "parent", Rows: 3, Columns: 4})
+	storeLevel(c, "child", Level{Parent: "parent", Name: "child"})
+
+	code, response := invoke(c, "PUT", baseRoute+"/parent?checkDependents=true&enforce=true", Level{Name: "parent", Rows: 3})
+	assert.EqualValues(t, http.StatusConflict, code)
+
+	var report DependentsReport
+	json.Unmarshal([]byte(response), &report)
+	assert.Equal(t, 1, len(report.AffectedChildren))
+	assert.Equal(t, "child", report.AffectedChildren[0].Key)
+
+	// Nothing changed
+	assert.Equal(t, Level{Key: "child", Parent: "parent", Name: "child", Rows: 3, Columns: 4}, loadLevel(c, "child"))
+
+	// A write the child doesn't depend on goes through
+	code, _ = invoke(c, "PUT", baseRoute+"/parent?checkDependents=true&enforce=true", Level{Name: "renamed", Rows: 5, Columns: 4})
+	assert.EqualValues(t, http.StatusOK, code)
+	assert.Equal(t, Level{Key: "child", Parent: "parent", Name: "child", Rows: 5, Columns: 4}, loadLevel(c, "child"))
+}
+
+func TestFieldReportsValueAndSource(t *testing.T) {
+	c := setup(t)
+	defer teardown(c)
+
+	storeLevel(c, "root", Level{Name: "root", Duration: 60})
+	storeLevel(c, "parent", Level{Parent: "root", Name: "parent", Rows: 3})
+	storeLevel(c, "child", Level{Parent: "parent", Name: "child"})
+
+	// Set on the level itself
+	code, field := loadField(c, "child", "name")
+	assert.EqualValues(t, http.StatusOK, code)
+	assert.Equal(t, ResolvedField{Value: "child", Source: "self"}, field)
+
+	// Inherited from the parent, and from further up
+	code, field = loadField(c, "child", "rows")
+	assert.EqualValues(t, http.StatusOK, code)
+	assert.Equal(t, ResolvedField{Value: 3.0, Source: "parent", Inherited: true}, field)
+
+	code, field = loadField(c, "child", "duration")
+	assert.EqualValues(t, http.StatusOK, code)
+	assert.Equal(t, ResolvedField{Value: 60.0, Source: "root", Inherited: true}, field)
+
+	// Set nowhere in the chain
+	code, _ = loadField(c, "child", "columns")
+	assert.EqualValues(t, http.StatusNotFound, code)
+
+	// Not a level field at all
+	code, _ = loadField(c, "child", "colums")
+	assert.EqualValues(t, http.StatusBadRequest, code)
+}
+
+func TestDeletePreviewShowsWhatChildrenLose(t *testing.T) {
+	c := setup(t)
+	defer teardown(c)
+
+	storeLevel(c, "root", Level{Name: "root", Duration: 60})
+	storeLevel(c, "parent", Level{Parent: "root", Name: "parent", Rows: 3, Columns: 4, ComboTimer: 1.5})
+	storeLevel(c, "child", Level{Parent: "parent", Name: "child", Columns: 5})
+	storeLevel(c, "grandchild", Level{Parent: "child", Name: "grandchild"})
+
+	code, response := invoke(c, "GET", buildEntityRoute("parent")+"/delete-preview", nil)
+	assert.EqualValues(t, http.StatusOK, code)
+
+	var preview DeletePreview
+	json.Unmarshal([]byte(response), &preview)
+	assert.Equal(t, "parent", preview.Key)
+	assert.Equal(t, 2, len(preview.Children))
+
+	// The child keeps what it sets itself, and stops inheriting from above
+	assert.Equal(t, "child", preview.Children[0].Key)
+	assert.Equal(t, []string{"combo_timer", "duration", "rows"}, preview.Children[0].LostFields)
+	assert.Equal(t, Level{Key: "child", Parent: "parent", Name: "child", Columns: 5}, preview.Children[0].Level)
+	assert.Equal(t, "PARENT_NOT_FOUND", preview.Children[0].Error)
+
+	// And so does everything below it
+	assert.Equal(t, "grandchild", preview.Children[1].Key)
+	assert.Equal(t, []string{"combo_timer", "duration", "rows"}, preview.Children[1].LostFields)
+	assert.Equal(t, Level{Key: "grandchild", Parent: "child", Name: "grandchild", Columns: 5}, preview.Children[1].Level)
+	assert.Equal(t, "PARENT_NOT_FOUND", preview.Children[1].Error)
+
+	// Nothing was deleted
+	assert.Equal(t, Level{Key: "child", Parent: "parent", Name: "child", Rows: 3, Columns: 5, Duration: 60, ComboTimer: 1.5}, loadLevel(c, "child"))
+}
+
+func TestDeletePreviewWithMissingLevelFails(t *testing.T) {
+	c := setup(t)
+	defer teardown(c)
+
+	code, response := invoke(c, "GET", buildEntityRoute(testKey1)+"/delete-preview", nil)
+	assert.EqualValues(t, http.StatusNotFound, code)
+	assert.Equal(t, "NOT_FOUND", decodeError(response).Code)
+}
+
+func TestQueryByEditor(t *testing.T) {
+	c := setup(t)
+	defer teardown(c)
+
+	alice := &user.User{Email: "alice@example.com"}
+	bob := &user.User{Email: "bob@example.com"}
+	invokeAsUser(c, "PUT", buildEntityRoute("first"), Level{Name: "first"}, alice)
+	invokeAsUser(c, "PUT", buildEntityRoute("second"), Level{Name: "second"}, bob)
+	invokeAsUser(c, "PUT", buildEntityRoute("third"), Level{Name: "third"}, alice)
+	storeLevel(c, "anonymous", Level{Name: "anonymous"})
+
+	assert.Equal(t, []string{"first", "third"}, queryTags(c, "editedBy=alice@example.com"))
+	assert.Equal(t, []string{"second"}, queryTags(c, "editedBy=bob@example.com"))
+	assert.Equal(t, []string{"anonymous"}, queryTags(c, "editedBy="))
+
+	// The last write counts, including a reparent
+	code, _ := invokeAsUser(c, "POST", buildEntityRoute("first")+"/reparent?to=second", nil, bob)
+	assert.EqualValues(t, http.StatusOK, code)
+	assert.Equal(t, []string{"third"}, queryTags(c, "editedBy=alice@example.com"))
+	assert.Equal(t, []string{"first", "second"}, queryTags(c, "editedBy=bob@example.com"))
+}
+
+func TestQueryByEditorChangedSince(t *testing.T) {
+	c := setup(t)
+	defer teardown(c)
+
+	alice := &user.User{Email: "alice@example.com"}
+	invokeAsUser(c, "PUT", buildEntityRoute("earlier"), Level{Name: "earlier"}, alice)
+	time.Sleep(10 * time.Millisecond)
+	since := time.Now().UTC().Format(time.RFC3339Nano)
+	time.Sleep(10 * time.Millisecond)
+	invokeAsUser(c, "PUT", buildEntityRoute("later"), Level{Name: "later"}, alice)
+
+	assert.Equal(t, []string{"later"}, queryTags(c, "editedBy=alice@example.com&changedSince="+since))
+
+	code, response := invoke(c, "GET", baseRoute+"?editedBy=alice@example.com&changedSince=today", nil)
+	assert.EqualValues(t, http.StatusBadRequest, code)
+	assert.Equal(t, "INVALID_REQUEST", decodeError(response).Code)
+}
+
+func TestDeltaReturnsChangesSinceVersion(t *testing.T) {
+	c := setup(t)
+	defer teardown(c)
+
+	storeLevel(c, "kept", Level{Name: "kept"})
+	storeLevel(c, "updated", Level{Name: "updated"})
+	storeLevel(c, "deleted", Level{Name: "deleted"})
+
+	first := loadDelta(c, "")
+	assert.Equal(t, []string{"kept", "updated", "deleted"}, levelNames(first.Levels))
+	assert.Equal(t, []string{}, first.Deleted)
+
+	storeLevel(c, "updated", Level{Name: "updated again"})
+	deleteLevel(c, "deleted")
+	storeLevel(c, "created", Level{Name: "created"})
+
+	second := loadDelta(c, fmt.Sprintf("?since=%d", first.Version))
+	assert.True(t, second.Version > first.Version)
+	assert.Equal(t, []string{"updated again", "created"}, levelNames(second.Levels))
+	assert.Equal(t, []string{"deleted"}, second.Deleted)
+
+	// Nothing has changed since then
+	third := loadDelta(c, fmt.Sprintf("?since=%d", second.Version))
+	assert.Equal(t, second.Version, third.Version)
+	assert.Equal(t, 0, len(third.Levels))
+	assert.Equal(t, 0, len(third.Deleted))
+
+	code, _ := invoke(c, "GET", baseRoute+"/delta?since=yesterday", nil)
+	assert.EqualValues(t, http.StatusBadRequest, code)
+}
+
+func TestDeleteLeavesTombstoneUntilRecreated(t *testing.T) {
+	c := setup(t)
+	defer teardown(c)
+
+	storeLevel(c, "phoenix", Level{Name: "phoenix"})
+	deleteLevel(c, "phoenix")
+
+	delta := loadDelta(c, "")
+	assert.Equal(t, 0, len(delta.Levels))
+	assert.Equal(t, []string{"phoenix"}, delta.Deleted)
+
+	// Writing the level again clears its tombstone
+	storeLevel(c, "phoenix", Level{Name: "reborn"})
+	delta = loadDelta(c, "")
+	assert.Equal(t, []string{"reborn"}, levelNames(delta.Levels))
+	assert.Equal(t, []string{}, delta.Deleted)
+}
+
+func TestQueryIncludesDeletedLevelsOnRequest(t *testing.T) {
+	c := setup(t)
+	defer teardown(c)
+
+	storeLevel(c, "survivor", Level{Name: "survivor"})
+	storeLevel(c, "phoenix", Level{Name: "phoenix"})
+	deleteLevel(c, "phoenix")
+
+	// By default, only the levels still there
+	assert.Equal(t, []string{"survivor"}, levelNames(queryAll(c)))
+
+	// Asked for, the deleted one follows as a marker
+	code, response := invoke(c, "GET", buildQueryRoute()+"?includeDeleted=true", nil)
+	assert.EqualValues(t, http.StatusOK, code)
+
+	var levels []map[string]interface{}
+	json.Unmarshal([]byte(response), &levels)
+	if assert.Equal(t, 2, len(levels)) {
+		assert.Equal(t, "survivor", levels[0]["name"])
+		assert.Nil(t, levels[0]["deleted"])
+		assert.Equal(t, "phoenix", levels[1]["key"])
+		assert.Equal(t, true, levels[1]["deleted"])
+		deletedAt, err := time.Parse(time.RFC3339, fmt.Sprint(levels[1]["deleted_at"]))
+		assert.Nil(t, err)
+		assert.True(t, time.Since(deletedAt) < time.Minute)
+		assert.Nil(t, levels[1]["name"])
+	}
+
+	// The plain query wasn't cached with the marker in it
+	assert.Equal(t, []string{"survivor"}, levelNames(queryAll(c)))
+}
+
+func TestPruneTombstonesRefusesOlderDeltas(t *testing.T) {
+	c := setup(t)
+	defer teardown(c)
+
+	storeLevel(c, "first", Level{Name: "first"})
+	storeLevel(c, "second", Level{Name: "second"})
+
+	// A tombstone from long ago, and a fresh one
+	appengineContext := newAppengineContext(c)
+	rootKey := datastore.NewKey(appengineContext, "Level", "LevelRoot", 0, nil)
+	key := datastore.NewKey(appengineContext, "LevelTombstone", "ancient", 0, rootKey)
+	_, err := datastore.Put(appengineContext, key, &datastore.PropertyList{
+		{Name: "Version", Value: int64(2)},
+		{Name: "DeletedAt", Value: time.Now().AddDate(-1, 0, 0)},
+	})
+	assert.Nil(t, err)
+	deleteLevel(c, "second")
+
+	code, response := invokeAsUser(c, "POST", "/admin/levels/prune-tombstones", nil, adminUser)
+	assert.EqualValues(t, http.StatusOK, code)
+	assert.Equal(t, `{"pruned":1}`, strings.TrimSpace(response))
+
+	// A mirror that may not have seen the pruned delete has to start over
+	code, _ = invoke(c, "GET", baseRoute+"/delta?since=1", nil)
+	assert.EqualValues(t, http.StatusGone, code)
+
+	assert.Equal(t, []string{"second"}, loadDelta(c, "?since=2").Deleted)
+	assert.Equal(t, []string{"second"}, loadDelta(c, "").Deleted)
+}
+
+func TestQueryByTagsMatchesAllOrAny(t *testing.T) {
+	c := setup(t)
+	defer teardown(c)
+
+	storeLevel(c, "fire_boss", Level{Name: "fire boss", Tags: []string{"boss", "fire"}})
+	storeLevel(c, "ice_boss", Level{Name: "ice boss", Tags: []string{"boss", "ice"}})
+	storeLevel(c, "fire_field", Level{Name: "fire field", Tags: []string{"fire"}})
+	storeLevel(c, "untagged", Level{Name: "untagged"})
+
+	// Tags aren't inherited
+	storeLevel(c, "fire_boss_child", Level{Parent: "fire_boss", Name: "child"})
+
+	assert.Equal(t, []string{"fire boss"}, queryTags(c, "tag=boss&tag=fire&tagMode=all"))
+	assert.Equal(t, []string{"fire boss"}, queryTags(c, "tag=boss&tag=fire"))
+	assert.Equal(t, []string{"fire boss", "fire field", "ice boss"}, queryTags(c, "tag=boss&tag=fire&tagMode=any"))
+	assert.Equal(t, []string{"fire boss", "fire field"}, queryTags(c, "tag=fire&tagMode=any"))
+	assert.Equal(t, []string{}, queryTags(c, "tag=water&tagMode=any"))
+
+	code, _ := invoke(c, "GET", baseRoute+"?tag=boss&tagMode=some", nil)
+	assert.EqualValues(t, http.StatusBadRequest, code)
+}
+
+func TestOverridesSplitsOwnAndInheritedFields(t *testing.T) {
+	c := setup(t)
+	defer teardown(c)
+
+	storeLevel(c, "grandparent", Level{Name: "grandparent", Rows: 3, Columns: 4, Tags: []string{"boss"}})
+	storeLevel(c, "parent", Level{Parent: "grandparent", Columns: 5})
+	storeLevel(c, "child", Level{Parent: "parent", Name: "child", Duration: 60})
+
+	overrides := loadOverrides(c, "child")
+	assert.Equal(t, "child", overrides.Key)
+	assert.Equal(t, []string{"duration", "name"}, overrides.Self)
+	assert.Equal(t, map[string]string{"rows": "grandparent", "columns": "parent"}, overrides.Inherited)
+
+	// A root level sets everything itself
+	overrides = loadOverrides(c, "grandparent")
+	assert.Equal(t, []string{"columns", "name", "rows", "tags"}, overrides.Self)
+	assert.Equal(t, map[string]string{}, overrides.Inherited)
+
+	code, _ := invoke(c, "GET", buildEntityRoute("missing")+"/overrides", nil)
+	assert.EqualValues(t, http.StatusNotFound, code)
+}
+
+func TestInheritanceDeltaShowsWhereEachFieldComesFrom(t *testing.T) {
+	c := setup(t)
+	defer teardown(c)
+
+	storeLevel(c, "grandparent", Level{Name: "grandparent", Rows: 3, Columns: 4, Tags: []string{"boss"}})
+	storeLevel(c, "parent", Level{Parent: "grandparent", Columns: 5})
+	storeLevel(c, "child", Level{Parent: "parent", Name: "child", Duration: 60})
+
+	code, response := invoke(c, "GET", buildEntityRoute("child")+"/inheritance-delta", nil)
+	assert.EqualValues(t, http.StatusOK, code)
+
+	var delta InheritanceDelta
+	json.Unmarshal([]byte(response), &delta)
+	assert.Equal(t, "child", delta.Key)
+
+	// Its own fields, then inherited ones with where they come from
+	assert.Equal(t, "self", delta.Fields["name"].Status)
+	assert.Equal(t, `"child"`, string(delta.Fields["name"].Value))
+	assert.Equal(t, "self", delta.Fields["duration"].Status)
+	assert.Equal(t, `60`, string(delta.Fields["duration"].Value))
+	assert.Equal(t, FieldDelta{Status: "inherited", Value: json.RawMessage(`3`), Source: "grandparent"}, delta.Fields["rows"])
+	assert.Equal(t, FieldDelta{Status: "inherited", Value: json.RawMessage(`5`), Source: "parent"}, delta.Fields["columns"])
+
+	// Tags aren't inherited, and nothing sets the combo timer
+	assert.Equal(t, FieldDelta{Status: "unset"}, delta.Fields["tags"])
+	assert.Equal(t, FieldDelta{Status: "unset"}, delta.Fields["combo_timer"])
+	_, listed := delta.Fields["key"]
+	assert.False(t, listed)
+
+	code, _ = invoke(c, "GET", buildEntityRoute("missing")+"/inheritance-delta", nil)
+	assert.EqualValues(t, http.StatusNotFound, code)
+}
+
+func TestQueryWarnsAboutUnresolvableLevels(t *testing.T) {
+	c := setup(t)
+	defer teardown(c)
+
+	storeLevel(c, "good_1", Level{Name: "good 1", Tags: []string{"boss"}})
+	storeLevel(c, "good_2", Level{Name: "good 2", Parent: "good_1", Tags: []string{"boss"}})
+	storeLevel(c, "orphan", Level{Name: "orphan", Parent: "missing", Tags: []string{"boss"}})
+
+	// By default the broken level is left out of a plain array
+	code, response := invoke(c, "GET", buildQueryRoute(), nil)
+	assert.EqualValues(t, http.StatusOK, code)
+
+	var levels []Level
+	json.Unmarshal([]byte(response), &levels)
+	assert.Equal(t, []string{"good 1", "good 2"}, levelNames(levels))
+
+	// Asked for, it's listed as a warning alongside the levels, and the same
+	// goes for the filtered and paged queries
+	for _, query := range []string{"", "&tag=boss", "&editedBy=", "&unassigned=true", "&limit=10"} {
+		code, response = invoke(c, "GET", buildQueryRoute()+"?warnings=true"+query, nil)
+		assert.EqualValues(t, http.StatusOK, code, query)
+
+		var result QueryResponse
+		json.Unmarshal([]byte(response), &result)
+		assert.Equal(t, []string{"good 1", "good 2"}, levelNames(result.Levels), query)
+		if assert.Equal(t, 1, len(result.Warnings), query) {
+			assert.Equal(t, "orphan", result.Warnings[0].Key)
+			assert.Equal(t, "PARENT_NOT_FOUND", result.Warnings[0].Code)
+		}
+	}
+}
+
+func TestDiffBundleComparesTwoBundles(t *testing.T) {
+	c := setup(t)
+	defer teardown(c)
+
+	from := map[string]interface{}{
+		"levels": []Level{
+			{Key: "same", Name: "same"},
+			{Key: "changed", Name: "before", Rows: 4},
+		},
+		"territories": []map[string]interface{}{
+			{"id": "kept", "levels": []string{"same"}, "version": 1},
+			{"id": "dropped", "levels": []string{"changed"}},
+		},
+	}
+	to := map[string]interface{}{
+		"levels": []Level{
+			{Key: "same", Name: "same"},
+			{Key: "changed", Name: "after", Rows: 4},
+			{Key: "added", Name: "added"},
+		},
+		"territories": []map[string]interface{}{
+			{"id": "kept", "levels": []string{"same"}, "version": 7},
+		},
+	}
+
+	diff := diffBundles(c, map[string]interface{}{"from": from, "to": to})
+	assert.Equal(t, []string{"added"}, diff.Levels.Added)
+	assert.Empty(t, diff.Levels.Removed)
+	assert.Equal(t, 1, len(diff.Levels.Modified))
+	assert.Equal(t, "changed", diff.Levels.Modified[0].Key)
+	assert.Equal(t, []string{"name"}, diff.Levels.Modified[0].Fields)
+
+	// Only the territory's version differs, which isn't content
+	assert.Empty(t, diff.Territories.Added)
+	assert.Equal(t, []string{"dropped"}, diff.Territories.Removed)
+	assert.Empty(t, diff.Territories.Modified)
+}
+
+func TestDiffBundleComparesWithLiveData(t *testing.T) {
+	c := setup(t)
+	defer teardown(c)
+
+	storeLevel(c, "same", Level{Name: "same"})
+	storeLevel(c, "changed", Level{Name: "live", Rows: 5})
+	storeTerritory(c, "world", []string{"same", "changed"})
+
+	from := map[string]interface{}{
+		"levels": []Level{
+			{Key: "same", Name: "same"},
+			{Key: "changed", Name: "live"},
+			{Key: "deleted", Name: "deleted"},
+		},
+		"territories": []map[string]interface{}{
+			{"id": "world", "levels": []string{"same"}},
+		},
+	}
+
+	diff := diffBundles(c, map[string]interface{}{"from": from})
+	assert.Empty(t, diff.Levels.Added)
+	assert.Equal(t, []string{"deleted"}, diff.Levels.Removed)
+	assert.Equal(t, 1, len(diff.Levels.Modified))
+	assert.Equal(t, []string{"rows"}, diff.Levels.Modified[0].Fields)
+	assert.Equal(t, 1, len(diff.Territories.Modified))
+	assert.Equal(t, "world", diff.Territories.Modified[0].Key)
+	assert.Equal(t, []string{"levels"}, diff.Territories.Modified[0].Fields)
+
+	code, _ := invoke(c, "POST", "/diff-bundle", map[string]interface{}{})
+	assert.EqualValues(t, http.StatusBadRequest, code)
+}
+
+func TestStatsSummarizeResolvedLevels(t *testing.T) {
+	c := setup(t)
+	defer teardown(c)
+
+	// Nothing stored yet
+	stats := loadStats(c)
+	assert.Equal(t, 0, stats.Count)
+	assert.EqualValues(t, 0, stats.AverageDuration)
+	assert.Equal(t, map[string]int{}, stats.CountByTag)
+
+	storeLevel(c, "base", Level{Rows: 4, Columns: 6, Duration: 60, SpawnFrequency: map[string]float32{"grunt": 1, "archer": 2}, Tags: []string{"easy"}})
+	storeLevel(c, "child", Level{Parent: "base", Rows: 8, Duration: 90, SpawnFrequency: map[string]float32{"grunt": 1, "knight": 1}, Tags: []string{"easy", "boss"}})
+	storeLevel(c, "small", Level{Rows: 2, Columns: 10})
+	storeLevel(c, "orphan", Level{Parent: "missing", Rows: 100})
+
+	// The child inherits its columns from the base, and the orphan is left out
+	stats = loadStats(c)
+	assert.Equal(t, 3, stats.Count)
+	assert.EqualValues(t, 75, stats.AverageDuration)
+	assert.EqualValues(t, 2, stats.Rows.Min)
+	assert.EqualValues(t, 8, stats.Rows.Max)
+	assert.EqualValues(t, 6, stats.Columns.Min)
+	assert.EqualValues(t, 10, stats.Columns.Max)
+	assert.Equal(t, 3, stats.DistinctUnitTypes)
+	assert.Equal(t, map[string]int{"easy": 2, "boss": 1}, stats.CountByTag)
+
+	// Writes refresh the cached stats
+	deleteLevel(c, "small")
+	stats = loadStats(c)
+	assert.Equal(t, 2, stats.Count)
+	assert.EqualValues(t, 4, stats.Rows.Min)
+}
+
+func TestImportValidateAcceptsCleanBundle(t *testing.T) {
+	c := setup(t)
+	defer teardown(c)
+
+	storeLevel(c, "stored", Level{Name: "stored", Rows: 5})
+
+	// Parents and territory references may point into the bundle or at stored levels
+	bundle := map[string]interface{}{
+		"levels": []Level{
+			{Key: "bundle_child", Parent: "bundle_parent"},
+			{Key: "bundle_parent", Parent: "stored", Name: "bundle parent"},
+		},
+		"territories": []map[string]interface{}{
+			{"id": "world", "levels": []string{"stored", "bundle_child"}},
+		},
+	}
+	result := validateImport(c, bundle)
+	assert.True(t, result.Valid)
+	assert.Empty(t, result.Problems)
+
+	// Nothing was written
+	code, _ := loadLevelRaw(c, "bundle_parent")
+	assert.EqualValues(t, http.StatusNotFound, code)
+}
+
+func TestImportValidateReportsBrokenReferences(t *testing.T) {
+	c := setup(t)
+	defer teardown(c)
+
+	storeLevel(c, "stored", Level{Name: "stored"})
+
+	bundle := map[string]interface{}{
+		"levels": []Level{
+			{Key: "fine", Parent: "stored"},
+			{Key: "dangling", Parent: "missing"},
+			{Key: "cycle_a", Parent: "cycle_b"},
+			{Key: "cycle_b", Parent: "cycle_a"},
+			{Key: "fine", Name: "duplicate"},
+		},
+		"territories": []map[string]interface{}{
+			{"id": "world", "levels": []string{"fine", "nowhere"}},
+		},
+	}
+	result := validateImport(c, bundle)
+	assert.False(t, result.Valid)
+
+	var problems []string
+	for _, problem := range result.Problems {
+		problems = append(problems, problem.Kind+" "+problem.Key+" "+problem.Code)
+	}
+	assert.Equal(t, []string{
+		"level fine INVALID_REQUEST",
+		"level dangling PARENT_NOT_FOUND",
+		"level cycle_a CYCLE_DETECTED",
+		"level cycle_b CYCLE_DETECTED",
+		"territory world NOT_FOUND",
+	}, problems)
+}
+
+func TestStaleReadCannotRepopulateCacheAfterWrite(t *testing.T) {
+	c := setup(t)
+	defer teardown(c)
+
+	storeLevel(c, testKey1, Level{Name: "before"})
+	appengineContext := newAppengineContext(c)
+	invalidateCachedLevel(appengineContext, testKey1)
+
+	// A reader misses the cache and loads the old level...
+	stale := &testLevelCacheEntry{Key: testKey1, HasKey: true, Name: "before", HasName: true}
+	lease := cache.TakeLease(appengineContext, stale)
+	assert.NotNil(t, lease)
+
+	// ...a writer updates it and invalidates the cache...
+	code, _ := invoke(c, "PUT", buildEntityRoute(testKey1), Level{Name: "after"})
+	assert.EqualValues(t, http.StatusOK, code)
+
+	// ...and then the reader tries to cache what it loaded
+	err := cache.CacheResourceWithLease(appengineContext, lease, stale)
+	assert.Equal(t, cache.ErrLeaseLost, err)
+	assert.Equal(t, "after", loadLevel(c, testKey1).Name)
+
+	// Without a write in between, the reader does fill the cache
+	invalidateCachedLevel(appengineContext, testKey1)
+	cached := &testLevelCacheEntry{Key: testKey1, HasKey: true, Name: "from cache", HasName: true}
+	lease = cache.TakeLease(appengineContext, cached)
+	err = cache.CacheResourceWithLease(appengineContext, lease, cached)
+	assert.Nil(t, err)
+	assert.Equal(t, "from cache", loadLevel(c, testKey1).Name)
+}
+
+func TestMultiBatchRunsMixedRequests(t *testing.T) {
+	c := setup(t)
+	defer teardown(c)
+
+	storeLevel(c, testKey2, testLevel2)
+	invalid := testLevel1
+	invalid.SpawnFrequency = buildSpawnFrequency(config.MaxSpawnFrequencyEntries + 1)
+	requests := []map[string]interface{}{
+		{"method": "PUT", "path": buildEntityRoute(testKey1), "body": testLevel1},
+		{"method": "PUT", "path": buildEntityRoute("invalid"), "body": invalid},
+		{"method": "PUT", "path": "/territories/territory", "body": map[string]interface{}{"levels": []string{testKey1}}},
+		{"method": "DELETE", "path": buildEntityRoute(testKey2)},
+	}
+
+	// Best effort runs everything, and reports the failure in its place
+	code, results := runMultiBatch(c, "best-effort", requests)
+	assert.EqualValues(t, http.StatusMultiStatus, code)
+	assert.Equal(t, []int{http.StatusOK, http.StatusBadRequest, http.StatusOK, http.StatusNoContent}, subStatuses(results))
+	assert.Equal(t, "VALIDATION_FAILED", decodeError(string(results[1].Body)).Code)
+	assert.Equal(t, testLevel1.Name, loadLevel(c, testKey1).Name)
+	code, _ = invoke(c, "GET", buildEntityRoute(testKey2), nil)
+	assert.EqualValues(t, http.StatusNotFound, code)
+
+	// Stop-on-error stops at the failure, and the rest aren't run
+	requests[0]["path"] = buildEntityRoute(testKey2)
+	requests[3]["path"] = buildEntityRoute(testKey1)
+	code, results = runMultiBatch(c, "stop-on-error", requests)
+	assert.EqualValues(t, http.StatusMultiStatus, code)
+	assert.Equal(t, []int{http.StatusOK, http.StatusBadRequest, http.StatusFailedDependency, http.StatusFailedDependency}, subStatuses(results))
+	assert.Equal(t, testLevel1.Name, loadLevel(c, testKey1).Name)
+
+	// But the write before the failure isn't rolled back
+	assert.Equal(t, testLevel1.Name, loadLevel(c, testKey2).Name)
+
+	// Sub-requests that all succeed get a plain 200, with each route's own body
+	code, results = runMultiBatch(c, "stop-on-error", []map[string]interface{}{
+		{"method": "GET", "path": buildEntityRoute(testKey1)},
+	})
+	assert.EqualValues(t, http.StatusOK, code)
+	var level Level
+	json.Unmarshal(results[0].Body, &level)
+	assert.Equal(t, testKey1, level.Key)
+
+	// Transactional applies nothing when a sub-request fails, or can't be part of
+	// the transaction
+	code, results = runMultiBatch(c, "transactional", requests)
+	assert.EqualValues(t, http.StatusMultiStatus, code)
+	assert.Equal(t, []int{http.StatusFailedDependency, http.StatusBadRequest, http.StatusBadRequest, http.StatusFailedDependency}, subStatuses(results))
+	code, results = runMultiBatch(c, "transactional", []map[string]interface{}{requests[0], requests[1], requests[3]})
+	assert.EqualValues(t, http.StatusMultiStatus, code)
+	assert.Equal(t, []int{http.StatusFailedDependency, http.StatusBadRequest, http.StatusFailedDependency}, subStatuses(results))
+	assert.Equal(t, "VALIDATION_FAILED", decodeError(string(results[1].Body)).Code)
+	assert.Equal(t, testLevel1.Name, loadLevel(c, testKey1).Name)
+
+	// And all of it when every one succeeds
+	renamed := testLevel1
+	renamed.Name = "renamed"
+	code, results = runMultiBatch(c, "transactional", []map[string]interface{}{
+		{"method": "PUT", "path": buildEntityRoute(testKey2), "body": renamed},
+		{"method": "DELETE", "path": buildEntityRoute(testKey1)},
+	})
+	assert.EqualValues(t, http.StatusOK, code)
+	assert.Equal(t, []int{http.StatusOK, http.StatusNoContent}, subStatuses(results))
+	assert.Equal(t, "renamed", loadLevel(c, testKey2).Name)
+	code, _ = invoke(c, "GET", buildEntityRoute(testKey1), nil)
+	assert.EqualValues(t, http.StatusNotFound, code)
+}
+
+func TestMultiBatchRefusesNestedBatches(t *testing.T) {
+	c := setup(t)
+	defer teardown(c)
+
+	for _, path := range []string{"/v1/batch", "/v1/./batch?mode=stop-on-error", "http://example.com/levels"} {
+		code, results := runMultiBatch(c, "best-effort", []map[string]interface{}{
+			{"method": "POST", "path": path, "body": []interface{}{}},
+		})
+		assert.EqualValues(t, http.StatusMultiStatus, code)
+		assert.Equal(t, []int{http.StatusBadRequest}, subStatuses(results))
+	}
+}
+
+func TestCorsExposesCustomHeaders(t *testing.T) {
+	c := setup(t)
+	defer teardown(c)
+
+	storeLevel(c, testKey1, testLevel1)
+	code, _, headers := invokeWithHeaders(c, "GET", buildEntityRoute(testKey1), nil, map[string]string{"Origin": "http://localhost"})
+	assert.EqualValues(t, http.StatusOK, code)
+
+	exposed := strings.Split(headers.Get("Access-Control-Expose-Headers"), ", ")
+	assert.Contains(t, exposed, "ETag")
+	assert.Contains(t, exposed, "Location")
+}
+
+func TestRequestIdIsEchoedOrGenerated(t *testing.T) {
+	c := setup(t)
+	defer teardown(c)
+
+	// A supplied id comes back as it is
+	code, _, headers := invokeWithHeaders(c, "GET", buildEntityRoute(testKey1), nil, map[string]string{"X-Request-ID": "editor-1234"})
+	assert.EqualValues(t, http.StatusNotFound, code)
+	assert.Equal(t, "editor-1234", headers.Get("X-Request-ID"))
+
+	// A missing one is made up, differently each time
+	_, _, first := invokeWithHeaders(c, "GET", buildEntityRoute(testKey1), nil, nil)
+	_, _, second := invokeWithHeaders(c, "GET", buildEntityRoute(testKey1), nil, nil)
+	assert.Equal(t, 32, len(first.Get("X-Request-ID")))
+	assert.NotEqual(t, first.Get("X-Request-ID"), second.Get("X-Request-ID"))
+
+	// And so is one that couldn't go safely into a log line
+	_, _, headers = invokeWithHeaders(c, "GET", buildEntityRoute(testKey1), nil, map[string]string{"X-Request-ID": "100%\nforged"})
+	assert.Equal(t, 32, len(headers.Get("X-Request-ID")))
+}
+
+func TestHeavyRoutesRefuseRequestsPastTheLimit(t *testing.T) {
+	c := setup(t)
+	defer teardown(c)
+
+	storeLevel(c, testKey1, testLevel1)
+
+	// Slots are given back, so heavy requests one after another all run
+	for i := 0; i < config.MaxHeavyRequests+1; i++ {
+		code, _ := invoke(c, "GET", baseRoute+"/stats", nil)
+		assert.EqualValues(t, http.StatusOK, code)
+	}
+
+	// With every slot taken by other requests, they get a 429
+	appengineContext := newAppengineContext(c)
+	memcache.Set(appengineContext, &memcache.Item{Key: "semaphore:heavy", Value: []byte(fmt.Sprint(config.MaxHeavyRequests))})
+	for _, path := range []string{baseRoute + "/stats", baseRoute + "/tree", "/export"} {
+		code, response, headers := invokeWithHeaders(c, "GET", path, nil, nil)
+		assert.EqualValues(t, http.StatusTooManyRequests, code)
+		assert.Equal(t, "TOO_MANY_REQUESTS", decodeError(response).Code)
+		assert.NotEmpty(t, headers.Get("Retry-After"))
+	}
+
+	// Everything else is unaffected
+	code, _ := invoke(c, "GET", buildEntityRoute(testKey1), nil)
+	assert.EqualValues(t, http.StatusOK, code)
+	code, _ = invoke(c, "GET", buildQueryRoute(), nil)
+	assert.EqualValues(t, http.StatusOK, code)
+
+	// And a slot coming free lets the next one in
+	memcache.Increment(appengineContext, "semaphore:heavy", -1, 0)
+	code, _ = invoke(c, "GET", baseRoute+"/stats", nil)
+	assert.EqualValues(t, http.StatusOK, code)
+}
+
+func TestWarmPinnedRecachesPinnedLevels(t *testing.T) {
+	c := setupSerial(t)
+	defer teardown(c)
+
+	config.PinnedLevels = []string{"child", "missing"}
+	defer func() { config.PinnedLevels = nil }()
+
+	storeLevel(c, "parent", testLevel1)
+	storeLevel(c, "child", Level{Parent: "parent", Name: "child"})
+	storeLevel(c, "unpinned", testLevel2)
+
+	// Evicted entries come back, along with the pinned level's ancestors
+	appengineContext := newAppengineContext(c)
+	evicted := []string{"level:child", "response:" + buildEntityRoute("child"), "level:parent", "level:unpinned"}
+	memcache.DeleteMulti(appengineContext, evicted)
+
+	code, response := invokeAsUser(c, "GET", "/admin/levels/warm-pinned", nil, adminUser)
+	assert.EqualValues(t, http.StatusOK, code)
+	var warmed struct {
+		Warmed []string `json:"warmed"`
+		Failed []struct {
+			Key  string `json:"key"`
+			Code string `json:"code"`
+		} `json:"failed"`
+	}
+	json.Unmarshal([]byte(response), &warmed)
+	assert.Equal(t, []string{"child"}, warmed.Warmed)
+	assert.EqualValues(t, 1, len(warmed.Failed))
+	assert.Equal(t, "NOT_FOUND", warmed.Failed[0].Code)
+
+	for _, key := range evicted[:3] {
+		_, err := memcache.Get(appengineContext, key)
+		assert.Nil(t, err, key)
+	}
+	_, err := memcache.Get(appengineContext, "level:unpinned")
+	assert.Equal(t, memcache.ErrCacheMiss, err)
+
+	// Cron may call it without signing in, but nobody else may
+	code, _, _ = invokeWithHeaders(c, "GET", "/admin/levels/warm-pinned", nil, map[string]string{"X-Appengine-Cron": "true"})
+	assert.EqualValues(t, http.StatusOK, code)
+	code, _ = invoke(c, "GET", "/admin/levels/warm-pinned", nil)
+	assert.EqualValues(t, http.StatusUnauthorized, code)
+}
+
+func TestQueryConsistencyModes(t *testing.T) {
+	// An eventually consistent datastore, so that plain queries lag behind writes
+	ae, _ := aetest.NewInstance(&aetest.Options{AppID: "testapp"})
+	c := &TestContext{t: t, ae: ae}
+	defer teardown(c)
+
+	appengineContext := newAppengineContext(c)
+	names := []string{"level 0", "level 1", "level 2", "level 3"}
+	queryNames := func() []string {
+		memcache.Delete(appengineContext, "response:query:all@levels")
+		return levelNames(queryAll(c))
+	}
+
+	// The default ancestor query sees every write straight away
+	for i, name := range names[:2] {
+		storeLevel(c, fmt.Sprintf("strong_%d", i), Level{Name: name})
+	}
+	assert.Equal(t, names[:2], queryNames())
+
+	// The eventual mode catches up in time
+	config.EventuallyConsistentQueries = true
+	defer func() { config.EventuallyConsistentQueries = false }()
+
+	for i, name := range names[2:] {
+		storeLevel(c, fmt.Sprintf("xeventual_%d", i), Level{Name: name})
+	}
+	var found []string
+	for attempt := 0; attempt < 50 && len(found) < len(names); attempt++ {
+		found = queryNames()
+	}
+	assert.Equal(t, names, found)
+}
+
+func TestStopFlushesBatchedInvalidations(t *testing.T) {
+	c := setupSerial(t)
+	defer teardown(c)
+
+	config.BatchCacheInvalidations = true
+	defer func() { config.BatchCacheInvalidations = false }()
+
+	storeLevel(c, testKey1, testLevel1)
+	appengineContext := newAppengineContext(c)
+	_, err := memcache.Get(appengineContext, "level:"+testKey1)
+	assert.Nil(t, err)
+
+	// Outside of a request, the invalidation waits in the queue
+	invalidateCachedLevel(appengineContext, testKey1)
+	_, err = memcache.Get(appengineContext, "level:"+testKey1)
+	assert.Nil(t, err)
+
+	// Until the instance is stopped
+	code, _ := invoke(c, "GET", "/_ah/stop", nil)
+	assert.EqualValues(t, http.StatusOK, code)
+	_, err = memcache.Get(appengineContext, "level:"+testKey1)
+	assert.Equal(t, memcache.ErrCacheMiss, err)
+}
+
+func TestEveryLevelWriteIsNotified(t *testing.T) {
+	c := setupSerial(t)
+	defer teardown(c)
+
+	config.ChangeNotificationQueue = changeNotificationQueue
+	defer func() { config.ChangeNotificationQueue = "" }()
+
+	storeLevel(c, testKey1, testLevel1)
+	leaseChangeNotifications(c)
+
+	// A single field update lists just that field
+	code, _ := patchLevel(c, testKey1, []map[string]interface{}{{"op": "replace", "path": "/rows", "value": 9}})
+	assert.EqualValues(t, http.StatusOK, code)
+	assert.Equal(t, []ChangeNotification{{Key: testKey1, ChangedFields: []string{"rows"}}}, leaseChangeNotifications(c))
+
+	// A write that changes nothing is still notified, with no fields
+	unchanged := testLevel1
+	unchanged.Key = testKey1
+	unchanged.Rows = 9
+	code, _ = invokeBatch(c, "batch-put", "best-effort", []Level{unchanged})
+	assert.EqualValues(t, http.StatusOK, code)
+	assert.Equal(t, []ChangeNotification{{Key: testKey1, ChangedFields: []string{}}}, leaseChangeNotifications(c))
+
+	// Retagging and deleting are writes too
+	code, _ = invoke(c, "POST", buildQueryRoute()+"/tags", map[string]interface{}{"keys": []string{testKey1}, "addTags": []string{"boss"}})
+	assert.EqualValues(t, http.StatusOK, code)
+	assert.Equal(t, []ChangeNotification{{Key: testKey1, ChangedFields: []string{"tags"}}}, leaseChangeNotifications(c))
+
+	deleteLevel(c, testKey1)
+	notifications := leaseChangeNotifications(c)
+	if assert.Len(t, notifications, 1) {
+		assert.Equal(t, testKey1, notifications[0].Key)
+		assert.Contains(t, notifications[0].ChangedFields, "rows")
+	}
+}
+
+func TestAdminCacheShowsEntries(t *testing.T) {
+	c := setup(t)
+	defer teardown(c)
+
+	storeLevel(c, testKey1, testLevel1)
+
+	// Admins only
+	code, _ := invoke(c, "GET", "/admin/cache/level:"+testKey1, nil)
+	assert.EqualValues(t, http.StatusUnauthorized, code)
+
+	// The level cache entry is decoded from its compact form
+	code, response := invokeAsUser(c, "GET", "/admin/cache/level:"+testKey1, nil, adminUser)
+	assert.EqualValues(t, http.StatusOK, code)
+	var entry struct {
+		Key     string `json:"key"`
+		Exists  bool   `json:"exists"`
+		Raw     []byte `json:"raw"`
+		Decoded Level  `json:"decoded"`
+	}
+	json.Unmarshal([]byte(response), &entry)
+	assert.Equal(t, "level:"+testKey1, entry.Key)
+	assert.True(t, entry.Exists)
+	assert.NotEmpty(t, entry.Raw)
+	assert.Equal(t, testLevel1.Name, entry.Decoded.Name)
+
+	// Response cache keys have slashes in them
+	code, response = invokeAsUser(c, "GET", "/admin/cache/response:"+buildEntityRoute(testKey1), nil, adminUser)
+	assert.EqualValues(t, http.StatusOK, code)
+	assert.Contains(t, response, testLevel1.Name)
+
+	code, response = invokeAsUser(c, "GET", "/admin/cache/level:missing", nil, adminUser)
+	assert.EqualValues(t, http.StatusNotFound, code)
+	assert.Equal(t, "NOT_FOUND", decodeError(response).Code)
+}
+
+func TestCorruptCacheEntryIsAMiss(t *testing.T) {
+	c := setup(t)
+	defer teardown(c)
+
+	storeLevel(c, testKey1, testLevel1)
+
+	// Overwrite both of the level's cache entries with junk
+	appengineContext := newAppengineContext(c)
+	for _, key := range []string{"level:" + testKey1, "response:" + buildEntityRoute(testKey1)} {
+		err := memcache.Set(appengineContext, &memcache.Item{Key: key, Value: []byte("\x00not a cache entry")})
+		assert.Nil(t, err)
+	}
+
+	// The level is still served, and the entries are refilled with good data
+	expected := testLevel1
+	expected.Key = testKey1
+	assert.Equal(t, expected, loadLevel(c, testKey1))
+	for _, key := range []string{"level:" + testKey1, "response:" + buildEntityRoute(testKey1)} {
+		item, err := memcache.Get(appengineContext, key)
+		assert.Nil(t, err)
+		if err == nil {
+			assert.NotEqual(t, []byte("\x00not a cache entry"), item.Value)
+		}
+	}
+	assert.Equal(t, expected, loadLevel(c, testKey1))
+}
+
+func TestFirstGetAfterPutIsServedFromCache(t *testing.T) {
+	c := setupSerial(t)
+	defer teardown(c)
+
+	storeLevel(c, "parent", Level{Name: "parent", Rows: 3})
+	code, _ := invoke(c, "PUT", buildEntityRoute("child"), Level{Parent: "parent", Name: "child"})
+	assert.EqualValues(t, http.StatusOK, code)
+
+	before := loadCacheStats(c)
+	level := loadLevel(c, "child")
+	after := loadCacheStats(c)
+
+	// The write cached the child with its parent merged in
+	assert.Equal(t, Level{Key: "child", Parent: "parent", Name: "child", Rows: 3}, level)
+	assert.Equal(t, before.Misses, after.Misses)
+	assert.Equal(t, before.Hits+1, after.Hits)
+}
+
+func TestStrictDeleteFlagRejectsMissingLevels(t *testing.T) {
+	c := setupSerial(t)
+	defer teardown(c)
+
+	// Deleting a level that isn't there succeeds by default
+	code, _ := invoke(c, "DELETE", buildEntityRoute(testKey1), nil)
+	assert.EqualValues(t, http.StatusNoContent, code)
+
+	flags.StrictDelete.Enabled = true
+	defer func() { flags.StrictDelete.Enabled = false }()
+
+	// With the flag it's a 404, but existing levels still delete
+	code, response := invoke(c, "DELETE", buildEntityRoute(testKey1), nil)
+	assert.EqualValues(t, http.StatusNotFound, code)
+	assert.Equal(t, "NOT_FOUND", decodeError(response).Code)
+
+	storeLevel(c, testKey1, testLevel1)
+	code, _ = invoke(c, "DELETE", buildEntityRoute(testKey1), nil)
+	assert.EqualValues(t, http.StatusNoContent, code)
+	code, _ = invoke(c, "GET", buildEntityRoute(testKey1), nil)
+	assert.EqualValues(t, http.StatusNotFound, code)
+}
+
+func TestDeleteWithBodyFlag(t *testing.T) {
+	c := setupSerial(t)
+	defer teardown(c)
+
+	// Deletes are a 204 with no body by default
+	storeLevel(c, testKey1, testLevel1)
+	code, response := invoke(c, "DELETE", buildEntityRoute(testKey1), nil)
+	assert.EqualValues(t, http.StatusNoContent, code)
+	assert.Empty(t, response)
+
+	flags.DeleteWithBody.Enabled = true
+	defer func() { flags.DeleteWithBody.Enabled = false }()
+
+	// With the flag they're the 200 and null body they used to be, locks included
+	storeLevel(c, testKey1, testLevel1)
+	code, _ = invokeAsUser(c, "POST", buildEntityRoute(testKey1)+"/lock", nil, adminUser)
+	assert.EqualValues(t, http.StatusOK, code)
+	code, response = invokeAsUser(c, "DELETE", buildEntityRoute(testKey1)+"/lock", nil, adminUser)
+	assert.EqualValues(t, http.StatusOK, code)
+	assert.Equal(t, "null", strings.TrimSpace(response))
+	code, response = invoke(c, "DELETE", buildEntityRoute(testKey1), nil)
+	assert.EqualValues(t, http.StatusOK, code)
+	assert.Equal(t, "null", strings.TrimSpace(response))
+}
+
+func TestRejectUnknownFieldsFlag(t *testing.T) {
+	c := setupSerial(t)
+	defer teardown(c)
+
+	body := []byte(`{"name": "level", "rowz": 3}`)
+
+	// Unknown fields are dropped by default
+	code, _, _ := invokeRaw(c, "PUT", buildEntityRoute(testKey1), body, nil)
+	assert.EqualValues(t, http.StatusOK, code)
+
+	flags.RejectUnknownFields.Enabled = true
+	defer func() { flags.RejectUnknownFields.Enabled = false }()
+
+	// With the flag they're refused, and known fields still go through
+	code, response, _ := invokeRaw(c, "PUT", buildEntityRoute(testKey2), body, nil)
+	assert.EqualValues(t, http.StatusBadRequest, code)
+	assert.Equal(t, "INVALID_REQUEST", decodeError(response).Code)
+	assert.Contains(t, response, "rowz")
+
+	code, _, _ = invokeRaw(c, "PUT", buildEntityRoute(testKey2), []byte(`{"name": "level", "rows": 3}`), nil)
+	assert.EqualValues(t, http.StatusOK, code)
+}
+
+func TestRequireParentFlag(t *testing.T) {
+	c := setupSerial(t)
+	defer teardown(c)
+
+	// A level may name a parent that doesn't exist yet by default
+	code, _ := invoke(c, "PUT", buildEntityRoute("child1"), Level{Parent: "parent", Name: "child1"})
+	assert.EqualValues(t, http.StatusOK, code)
+
+	flags.RequireParent.Enabled = true
+	defer func() { flags.RequireParent.Enabled = false }()
+
+	// With the flag it has to exist first
+	code, response := invoke(c, "PUT", buildEntityRoute("child2"), Level{Parent: "parent", Name: "child2"})
+	assert.EqualValues(t, http.StatusBadRequest, code)
+	assert.Equal(t, "PARENT_NOT_FOUND", decodeError(response).Code)
+
+	storeLevel(c, "parent", Level{Name: "parent"})
+	code, _ = invoke(c, "PUT", buildEntityRoute("child2"), Level{Parent: "parent", Name: "child2"})
+	assert.EqualValues(t, http.StatusOK, code)
+}
+
+func TestLockReferencedDimensionsFlag(t *testing.T) {
+	c := setupSerial(t)
+	defer teardown(c)
+
+	flags.LockReferencedDimensions.Enabled = true
+	defer func() { flags.LockReferencedDimensions.Enabled = false }()
+
+	// A level no territory lists can still be resized
+	storeLevel(c, testKey1, testLevel1)
+	resized := testLevel1
+	resized.Rows++
+	code, _ := invoke(c, "PUT", buildEntityRoute(testKey1), resized)
+	assert.EqualValues(t, http.StatusOK, code)
+
+	// Once territories list it, the size is locked and they're named
+	storeTerritory(c, "territory_b", []string{testKey1})
+	storeTerritory(c, "territory_a", []string{testKey2, testKey1})
+	resized.Rows++
+	code, response := invoke(c, "PUT", buildEntityRoute(testKey1), resized)
+	assert.EqualValues(t, http.StatusConflict, code)
+	assert.Equal(t, "CONFLICT", decodeError(response).Code)
+
+	var locked struct {
+		Territories []string `json:"territories"`
+	}
+	json.Unmarshal([]byte(response), &locked)
+	assert.Equal(t, []string{"territory_a", "territory_b"}, locked.Territories)
+
+	code, _ = patchLevel(c, testKey1, []map[string]interface{}{{"op": "replace", "path": "/columns", "value": 99}})
+	assert.EqualValues(t, http.StatusConflict, code)
+	assert.EqualValues(t, testLevel1.Rows+1, loadLevel(c, testKey1).Rows)
+
+	// Other fields can still change
+	renamed := testLevel1
+	renamed.Rows++
+	renamed.Name = "renamed"
+	code, _ = invoke(c, "PUT", buildEntityRoute(testKey1), renamed)
+	assert.EqualValues(t, http.StatusOK, code)
+}
+
+func TestLevelLocks(t *testing.T) {
+	c := setupSerial(t)
+	defer teardown(c)
+
+	alice := &user.User{Email: "alice@example.com"}
+	bob := &user.User{Email: "bob@example.com"}
+	storeLevel(c, testKey1, testLevel1)
+
+	// Bob takes the lock, and everyone can see he has it
+	code, _ := invokeAsUser(c, "POST", buildEntityRoute(testKey1)+"/lock", nil, bob)
+	assert.EqualValues(t, http.StatusOK, code)
+	code, response := invoke(c, "GET", buildEntityRoute(testKey1)+"/lock", nil)
+	assert.EqualValues(t, http.StatusOK, code)
+	assert.Equal(t, "bob@example.com", decodeLock(response).Editor)
+
+	// Alice can neither take it nor release it
+	code, response = invokeAsUser(c, "POST", buildEntityRoute(testKey1)+"/lock", nil, alice)
+	assert.EqualValues(t, http.StatusLocked, code)
+	assert.Equal(t, "LOCKED", decodeError(response).Code)
+	code, _ = invokeAsUser(c, "DELETE", buildEntityRoute(testKey1)+"/lock", nil, alice)
+	assert.EqualValues(t, http.StatusLocked, code)
+
+	// Bob can renew it and then release it
+	code, _ = invokeAsUser(c, "POST", buildEntityRoute(testKey1)+"/lock", nil, bob)
+	assert.EqualValues(t, http.StatusOK, code)
+	code, _ = invokeAsUser(c, "DELETE", buildEntityRoute(testKey1)+"/lock", nil, bob)
+	assert.EqualValues(t, http.StatusNoContent, code)
+	code, _ = invoke(c, "GET", buildEntityRoute(testKey1)+"/lock", nil)
+	assert.EqualValues(t, http.StatusNotFound, code)
+
+	// Locking takes a signed-in editor and a level that exists
+	code, _ = invoke(c, "POST", buildEntityRoute(testKey1)+"/lock", nil)
+	assert.EqualValues(t, http.StatusUnauthorized, code)
+	code, _ = invokeAsUser(c, "POST", buildEntityRoute("missing")+"/lock", nil, bob)
+	assert.EqualValues(t, http.StatusNotFound, code)
+}
+
+func TestLevelLocksExpire(t *testing.T) {
+	c := setupSerial(t)
+	defer teardown(c)
+
+	previous := config.LevelLockSeconds
+	config.LevelLockSeconds = 1
+	defer func() { config.LevelLockSeconds = previous }()
+
+	storeLevel(c, testKey1, testLevel1)
+	code, _ := invokeAsUser(c, "POST", buildEntityRoute(testKey1)+"/lock", nil, &user.User{Email: "bob@example.com"})
+	assert.EqualValues(t, http.StatusOK, code)
+
+	// Once it runs out, someone else can take it
+	time.Sleep(1100 * time.Millisecond)
+	code, _ = invoke(c, "GET", buildEntityRoute(testKey1)+"/lock", nil)
+	assert.EqualValues(t, http.StatusNotFound, code)
+	code, response := invokeAsUser(c, "POST", buildEntityRoute(testKey1)+"/lock", nil, &user.User{Email: "alice@example.com"})
+	assert.EqualValues(t, http.StatusOK, code)
+	assert.Equal(t, "alice@example.com", decodeLock(response).Editor)
+}
+
+func TestEnforceLevelLocksFlag(t *testing.T) {
+	c := setupSerial(t)
+	defer teardown(c)
+
+	alice := &user.User{Email: "alice@example.com"}
+	bob := &user.User{Email: "bob@example.com"}
+	storeLevel(c, testKey1, testLevel1)
+	invokeAsUser(c, "POST", buildEntityRoute(testKey1)+"/lock", nil, bob)
+
+	// By default a lock is only advisory
+	code, _ := invokeAsUser(c, "PUT", buildEntityRoute(testKey1), testLevel2, alice)
+	assert.EqualValues(t, http.StatusOK, code)
+
+	flags.EnforceLevelLocks.Enabled = true
+	defer func() { flags.EnforceLevelLocks.Enabled = false }()
+
+	// With the flag, only the holder may write the level
+	code, response := invokeAsUser(c, "PUT", buildEntityRoute(testKey1), testLevel1, alice)
+	assert.EqualValues(t, http.StatusLocked, code)
+	assert.Equal(t, "bob@example.com", decodeLock(response).Editor)
+	code, _ = invokeAsUser(c, "DELETE", buildEntityRoute(testKey1), nil, alice)
+	assert.EqualValues(t, http.StatusLocked, code)
+	assert.Equal(t, testLevel2.Name, loadLevel(c, testKey1).Name)
+
+	code, _ = invokeAsUser(c, "PUT", buildEntityRoute(testKey1), testLevel1, bob)
+	assert.EqualValues(t, http.StatusOK, code)
+	assert.Equal(t, testLevel1.Name, loadLevel(c, testKey1).Name)
+}
+
+func TestRecomputeDescendantsFlag(t *testing.T) {
+	c := setupSerial(t)
+	defer teardown(c)
+
+	flags.RecomputeDescendants.Enabled = true
+	defer func() { flags.RecomputeDescendants.Enabled = false }()
+
+	storeLevel(c, testKey1, testLevel1)
+	storeLevel(c, testKey2, Level{Parent: testKey1, Name: "child"})
+	storeLevel(c, "grandchild", Level{Parent: testKey2, Name: "grandchild"})
+	loadLevel(c, "grandchild")
+
+	// Editing the base queues the task that recomputes what's below it.  It's
+	// run here as the queue would run it.
+	edited := testLevel1
+	edited.Duration = 42
+	storeLevel(c, testKey1, edited)
+
+	code, response, _ := invokeWithHeaders(c, "POST", "/admin/levels/recompute-descendants?key="+testKey1, nil, map[string]string{"X-AppEngine-QueueName": "default"})
+	assert.EqualValues(t, http.StatusOK, code)
+	var recomputed struct {
+		Recomputed []string `json:"recomputed"`
+	}
+	json.Unmarshal([]byte(response), &recomputed)
+	assert.Equal(t, []string{testKey2, "grandchild"}, recomputed.Recomputed)
+
+	// So the next read is a hit, with the edit in it
+	appengineContext := newAppengineContext(c)
+	item, err := memcache.Get(appengineContext, "response:/levels/grandchild")
+	assert.NoError(t, err)
+	if item != nil {
+		assert.Contains(t, string(item.Value), `"duration":42`)
+	}
+	assert.EqualValues(t, 42, loadLevel(c, "grandchild").Duration)
+
+	// A batch queues one task for every level it wrote.  Levels below several of
+	// them are recomputed once.
+	code, response, _ = invokeWithHeaders(c, "POST", "/admin/levels/recompute-descendants?key="+testKey2+"&key="+testKey1+"&key="+testKey1, nil, map[string]string{"X-AppEngine-QueueName": "default"})
+	assert.EqualValues(t, http.StatusOK, code)
+	recomputed.Recomputed = nil
+	json.Unmarshal([]byte(response), &recomputed)
+	assert.Equal(t, []string{"grandchild", testKey2}, recomputed.Recomputed)
+
+	// Outside the task queue, only administrators may run it
+	code, _ = invoke(c, "POST", "/admin/levels/recompute-descendants?key="+testKey1, nil)
+	assert.EqualValues(t, http.StatusUnauthorized, code)
+}
+
+func TestEmptyBodyCreatesMinimalLevel(t *testing.T) {
+	c := setup(t)
+	defer teardown(c)
+
+	for _, body := range []string{"", " \n"} {
+		code, _, _ := invokeRaw(c, "PUT", buildEntityRoute(testKey1), []byte(body), nil)
+		assert.EqualValues(t, http.StatusOK, code)
+	}
+
+	stored := loadLevel(c, testKey1)
+	assert.Equal(t, Level{Key: testKey1}, stored)
+}
+
+func TestRejectEmptyBodiesFlag(t *testing.T) {
+	c := setupSerial(t)
+	defer teardown(c)
+
+	flags.RejectEmptyBodies.Enabled = true
+	defer func() { flags.RejectEmptyBodies.Enabled = false }()
+
+	code, response, _ := invokeRaw(c, "PUT", buildEntityRoute(testKey1), []byte(""), nil)
+	assert.EqualValues(t, http.StatusBadRequest, code)
+	assert.Equal(t, "INVALID_REQUEST", decodeError(response).Code)
+
+	code, _ = loadLevelRaw(c, testKey1)
+	assert.EqualValues(t, http.StatusNotFound, code)
+}
+
+func TestRawShowsTheStoredLevel(t *testing.T) {
+	c := setup(t)
+	defer teardown(c)
+
+	storeLevel(c, testKey1, testLevel1)
+	storeLevel(c, testKey2, Level{Parent: testKey1, Name: "child"})
+
+	code, _ := invoke(c, "GET", "/admin/levels/raw/"+testKey2, nil)
+	assert.EqualValues(t, http.StatusUnauthorized, code)
+
+	// The child's own fields are flagged, and the inherited ones aren't
+	var raw map[string]interface{}
+	code, response := invokeAsUser(c, "GET", "/admin/levels/raw/"+testKey2, nil, adminUser)
+	assert.EqualValues(t, http.StatusOK, code)
+	json.Unmarshal([]byte(response), &raw)
+	assert.Equal(t, testKey1, raw["Parent"])
+	assert.Equal(t, true, raw["HasParent"])
+	assert.Equal(t, true, raw["HasName"])
+	assert.Equal(t, false, raw["HasRows"])
+	assert.Equal(t, false, raw["HasSpawnFrequency"])
+
+	// And spawn frequencies are the stored slice, not a map
+	var parentRaw struct {
+		SpawnFrequency []struct {
+			UnitType       string
+			SpawnFrequency float32
+		}
+		HasSpawnFrequency bool
+	}
+	_, response = invokeAsUser(c, "GET", "/admin/levels/raw/"+testKey1, nil, adminUser)
+	json.Unmarshal([]byte(response), &parentRaw)
+	assert.True(t, parentRaw.HasSpawnFrequency)
+	spawns := make(map[string]float32)
+	for _, element := range parentRaw.SpawnFrequency {
+		spawns[element.UnitType] = element.SpawnFrequency
+	}
+	assert.Equal(t, testLevel1.SpawnFrequency, spawns)
+
+	code, _ = invokeAsUser(c, "GET", "/admin/levels/raw/nonExistingKey", nil, adminUser)
+	assert.EqualValues(t, http.StatusNotFound, code)
+}
+
+func TestCacheMaintenanceBypassesTheCache(t *testing.T) {
+	c := setupSerial(t)
+	defer teardown(c)
+
+	storeLevel(c, testKey1, Level{Name: "cached"})
+	assert.Equal(t, "cached", loadLevel(c, testKey1).Name)
+
+	code, _ := invoke(c, "POST", "/admin/cache/maintenance?enabled=true", nil)
+	assert.EqualValues(t, http.StatusUnauthorized, code)
+
+	code, response := invokeAsUser(c, "POST", "/admin/cache/maintenance?enabled=true", nil, adminUser)
+	assert.EqualValues(t, http.StatusOK, code)
+	assert.Contains(t, response, `"enabled":true`)
+	defer cache.SetMaintenance(newAppengineContext(c), false)
+
+	// A change behind the caches' back is read straight away
+	appengineContext := newAppengineContext(c)
+	rootKey := datastore.NewKey(appengineContext, "Level", "LevelRoot", 0, nil)
+	key := datastore.NewKey(appengineContext, "Level", testKey1, 0, rootKey)
+	_, err := datastore.Put(appengineContext, key, &datastore.PropertyList{
+		{Name: "Key", Value: testKey1},
+		{Name: "HasKey", Value: true},
+		{Name: "Name", Value: "migrated"},
+		{Name: "HasName", Value: true},
+	})
+	assert.Nil(t, err)
+	assert.Equal(t, "migrated", loadLevel(c, testKey1).Name)
+
+	// And nothing new is cached
+	storeLevel(c, testKey2, Level{Name: "uncached"})
+	assert.Equal(t, "uncached", loadLevel(c, testKey2).Name)
+	for _, cacheKey := range []string{"level:" + testKey2, "response:" + buildEntityRoute(testKey2)} {
+		_, err = memcache.Get(appengineContext, cacheKey)
+		assert.Equal(t, memcache.ErrCacheMiss, err, cacheKey)
+	}
+
+	// It's stored, so every instance picks it up
+	var state cache.MaintenanceState
+	err = datastore.Get(appengineContext, datastore.NewKey(appengineContext, "CacheMaintenance", "state", 0, nil), &state)
+	assert.NoError(t, err)
+	assert.True(t, state.Enabled)
+
+	// Lifting it invalidates what was cached before, but leaves locks alone
+	code, _ = invokeAsUser(c, "POST", buildEntityRoute(testKey2)+"/lock", nil, adminUser)
+	assert.EqualValues(t, http.StatusOK, code)
+	code, response = invokeAsUser(c, "POST", "/admin/cache/maintenance?enabled=false", nil, adminUser)
+	assert.EqualValues(t, http.StatusOK, code)
+	assert.Contains(t, response, `"enabled":false`)
+	_, err = memcache.Get(appengineContext, "level:"+testKey1)
+	assert.Equal(t, memcache.ErrCacheMiss, err)
+	assert.Equal(t, "migrated", loadLevel(c, testKey1).Name)
+	_, err = memcache.Get(appengineContext, "lock:level:"+testKey2)
+	assert.NoError(t, err)
+
+	code, _ = invokeAsUser(c, "POST", "/admin/cache/maintenance?enabled=maybe", nil, adminUser)
+	assert.EqualValues(t, http.StatusBadRequest, code)
+}
+
+func TestNormalizeIdsFlag(t *testing.T) {
+	c := setupSerial(t)
+	defer teardown(c)
+
+	flags.NormalizeIds.Enabled = true
+	defer func() { flags.NormalizeIds.Enabled = false }()
+
+	// Variants of an id all name the same level
+	storeLevel(c, "Test_Key_1", Level{Name: "first"})
+	assert.Equal(t, testKey1, loadLevel(c, testKey1).Key)
+	assert.Equal(t, "first", loadLevel(c, "%20TEST_KEY_1%20").Name)
+
+	// Including after a write through another variant, so the caches agree
+	storeLevel(c, "test_KEY_1", Level{Name: "second"})
+	assert.Equal(t, "second", loadLevel(c, "Test_Key_1").Name)
+	assert.Equal(t, "second", loadLevel(c, testKey1).Name)
+
+	// And the same territory
+	storeTerritory(c, "Some_Territory", []string{testKey1})
+	code, response := invoke(c, "GET", "/territories/some_territory", nil)
+	assert.EqualValues(t, http.StatusOK, code)
+	assert.Contains(t, response, testKey1)
+
+	// Ids that can't be made canonical are refused
+	for _, id := range []string{"bad!id", "%20%20", "caf%C3%A9"} {
+		code, response = invoke(c, "PUT", buildEntityRoute(id), Level{Name: "bad"})
+		assert.EqualValues(t, http.StatusBadRequest, code, id)
+		assert.Equal(t, "INVALID_REQUEST", decodeError(response).Code)
+
+		code, _ = invoke(c, "GET", "/territories/"+id, nil)
+		assert.EqualValues(t, http.StatusBadRequest, code, id)
+	}
+
+	// Ids in bodies can't be rewritten, so variants there are refused
+	code, response = invoke(c, "PUT", buildEntityRoute(testKey2), Level{Parent: "Test_Key_1"})
+	assert.EqualValues(t, http.StatusBadRequest, code)
+	assert.Equal(t, "INVALID_REQUEST", decodeError(response).Code)
+	code, _ = loadLevelRaw(c, testKey2)
+	assert.EqualValues(t, http.StatusNotFound, code)
+
+	code, batch := invokeBatch(c, "batch-put", "best-effort", []Level{{Key: "Test_Key_2", Name: "variant"}})
+	assert.EqualValues(t, http.StatusMultiStatus, code)
+	if assert.Len(t, batch.Results, 1) {
+		assert.EqualValues(t, http.StatusBadRequest, batch.Results[0].Status)
+	}
+
+	code, batch = invokeBatch(c, "batch-delete", "best-effort", map[string]interface{}{"ids": []string{"TEST_KEY_1"}})
+	assert.EqualValues(t, http.StatusMultiStatus, code)
+	if assert.Len(t, batch.Results, 1) {
+		assert.EqualValues(t, http.StatusBadRequest, batch.Results[0].Status)
+	}
+	assert.Equal(t, "second", loadLevel(c, testKey1).Name)
+
+	code, response = invoke(c, "POST", baseRoute+"/batch-get", map[string]interface{}{"ids": []string{"TEST_KEY_1"}})
+	assert.EqualValues(t, http.StatusMultiStatus, code)
+	assert.Contains(t, response, `"status":400`)
+}
+
+func TestWarmOnMissFlag(t *testing.T) {
+	c := setupSerial(t)
+	defer teardown(c)
+
+	flags.WarmOnMiss.Enabled = true
+	defer func() { flags.WarmOnMiss.Enabled = false }()
+
+	storeLevel(c, testKey1, testLevel1)
+	storeLevel(c, testKey2, Level{Parent: testKey1, Name: "child"})
+
+	appengineContext := newAppengineContext(c)
+	evict := func() {
+		memcache.DeleteMulti(appengineContext, []string{
+			"level:" + testKey1, "response:" + buildEntityRoute(testKey1),
+			"level:" + testKey2, "response:" + buildEntityRoute(testKey2),
+		})
+	}
+
+	// A root level is the same stored or resolved, so it's answered straight away
+	evict()
+	code, response, headers := invokeWithHeaders(c, "GET", buildEntityRoute(testKey1), nil, nil)
+	assert.EqualValues(t, http.StatusOK, code)
+	assert.Empty(t, headers.Get("X-Level-Unresolved"))
+	var root Level
+	json.Unmarshal([]byte(response), &root)
+	assert.Equal(t, testLevel1.Name, root.Name)
+	assert.Equal(t, testLevel1.Rows, root.Rows)
+
+	// A child is still resolved inline, unless the client can do without
+	evict()
+	assert.Equal(t, testLevel1.Rows, loadLevel(c, testKey2).Rows)
+
+	evict()
+	code, response, headers = invokeWithHeaders(c, "GET", buildEntityRoute(testKey2)+"?allowUnresolved=true", nil, nil)
+	assert.EqualValues(t, http.StatusOK, code)
+	assert.Equal(t, "true", headers.Get("X-Level-Unresolved"))
+	var child Level
+	json.Unmarshal([]byte(response), &child)
+	assert.Equal(t, "child", child.Name)
+	assert.EqualValues(t, 0, child.Rows)
+
+	// The queued task fills the caches, run here as the queue would run it
+	code, _, _ = invokeWithHeaders(c, "POST", "/admin/levels/warm?key="+testKey2, nil, map[string]string{"X-AppEngine-QueueName": "default"})
+	assert.EqualValues(t, http.StatusOK, code)
+	for _, cacheKey := range []string{"level:" + testKey2, "response:" + buildEntityRoute(testKey2)} {
+		_, err := memcache.Get(appengineContext, cacheKey)
+		assert.NoError(t, err, cacheKey)
+	}
+	assert.Equal(t, testLevel1.Rows, loadLevel(c, testKey2).Rows)
+
+	code, _ = invoke(c, "POST", "/admin/levels/warm?key="+testKey2, nil)
+	assert.EqualValues(t, http.StatusUnauthorized, code)
+}
+
+func TestAdminFlagsListsEveryFlag(t *testing.T) {
+	c := setupSerial(t)
+	defer teardown(c)
+
+	flags.RequireParent.Enabled = true
+	defer func() { flags.RequireParent.Enabled = false }()
+
+	code, _ := invoke(c, "GET", "/admin/flags", nil)
+	assert.EqualValues(t, http.StatusUnauthorized, code)
+
+	code, response := invokeAsUser(c, "GET", "/admin/flags", nil, adminUser)
+	assert.EqualValues(t, http.StatusOK, code)
+
+	var listed []FeatureFlag
+	json.Unmarshal([]byte(response), &listed)
+	assert.Equal(t, []FeatureFlag{
+		{Name: "strict_delete", Enabled: false},
+		{Name: "reject_unknown_fields", Enabled: false},
+		{Name: "require_parent", Enabled: true},
+		{Name: "lock_referenced_dimensions", Enabled: false},
+		{Name: "enforce_level_locks", Enabled: false},
+		{Name: "recompute_descendants", Enabled: false},
+		{Name: "reject_empty_bodies", Enabled: false},
+		{Name: "cache_maintenance", Enabled: false},
+		{Name: "normalize_ids", Enabled: false},
+		{Name: "warm_on_miss", Enabled: false},
+		{Name: "delete_with_body", Enabled: false},
+	}, listed)
+}
+
+func TestOversizedItemsAreNotCached(t *testing.T) {
+	c := setupSerial(t)
+	defer teardown(c)
+
+	config.MaxCacheItemBytes = 256
+	defer func(max int) { config.MaxCacheItemBytes = max }(config.MaxCacheItemBytes)
+
+	small := Level{Name: "small"}
+	large := Level{Name: strings.Repeat("large", 100)}
+	storeLevel(c, "small", small)
+	storeLevel(c, "large", large)
+	loadLevel(c, "small")
+	loadLevel(c, "large")
+
+	// The small level is cached as usual, and the large one isn't
+	appengineContext := newAppengineContext(c)
+	_, err := memcache.Get(appengineContext, "level:small")
+	assert.Nil(t, err)
+	_, err = memcache.Get(appengineContext, "response:"+buildEntityRoute("small"))
+	assert.Nil(t, err)
+	_, err = memcache.Get(appengineContext, "level:large")
+	assert.Equal(t, memcache.ErrCacheMiss, err)
+	_, err = memcache.Get(appengineContext, "response:"+buildEntityRoute("large"))
+	assert.Equal(t, memcache.ErrCacheMiss, err)
+
+	// It's still served, straight from the datastore
+	large.Key = "large"
+	assert.Equal(t, large, loadLevel(c, "large"))
+}
+
+func TestDanglingParentIsAWarningByDefault(t *testing.T) {
+	c := setup(t)
+	defer teardown(c)
+
+	code, response := invoke(c, "PUT", buildEntityRoute("child"), Level{Parent: "missing", Name: "child"})
+	assert.EqualValues(t, http.StatusOK, code)
+
+	var warnings ReferenceWarnings
+	json.Unmarshal([]byte(response), &warnings)
+	assert.Equal(t, 1, len(warnings.Warnings))
+	assert.Equal(t, "child", warnings.Warnings[0].Key)
+	assert.Equal(t, "PARENT_NOT_FOUND", warnings.Warnings[0].Code)
+
+	// Batch items get their warnings too, but not for parents in the same batch
+	var batch BatchWriteResponse
+	code, batch = invokeBatch(c, "batch-put", "best-effort", []Level{
+		{Key: "orphan", Parent: "missing", Name: "orphan"},
+		{Key: "batchParent", Name: "batchParent"},
+		{Key: "batchChild", Parent: "batchParent", Name: "batchChild"},
+	})
+	assert.EqualValues(t, http.StatusOK, code)
+	assert.Equal(t, 1, len(batch.Results[0].Warnings))
+	assert.Equal(t, 0, len(batch.Results[2].Warnings))
+
+	// A parent that exists is no warning
+	storeLevel(c, "parent", Level{Name: "parent"})
+	code, response = invoke(c, "PUT", buildEntityRoute("child"), Level{Parent: "parent", Name: "child"})
+	assert.EqualValues(t, http.StatusOK, code)
+	assert.NotContains(t, response, "warnings")
+}
+
+func TestStrictReferencesRefuseDanglingParents(t *testing.T) {
+	c := setupSerial(t)
+	defer teardown(c)
+
+	config.StrictReferences = true
+	defer func() { config.StrictReferences = false }()
+
+	code, response := invoke(c, "PUT", buildEntityRoute("child"), Level{Parent: "missing", Name: "child"})
+	assert.EqualValues(t, http.StatusBadRequest, code)
+	assert.Equal(t, "PARENT_NOT_FOUND", decodeError(response).Code)
+	code, _ = loadLevelRaw(c, "child")
+	assert.EqualValues(t, http.StatusNotFound, code)
+
+	// The batch item is refused, and a parent in the same batch is still fine
+	code, batch := invokeBatch(c, "batch-put", "best-effort", []Level{
+		{Key: "orphan", Parent: "missing", Name: "orphan"},
+		{Key: "batchParent", Name: "batchParent"},
+		{Key: "batchChild", Parent: "batchParent", Name: "batchChild"},
+	})
+	assert.EqualValues(t, http.StatusMultiStatus, code)
+	assert.EqualValues(t, http.StatusBadRequest, batch.Results[0].Status)
+	assert.EqualValues(t, http.StatusOK, batch.Results[2].Status)
+
+	// So is a PATCH that points at a missing parent
+	storeLevel(c, "child", Level{Parent: "batchParent", Name: "child"})
+	code, response = patchLevel(c, "child", []map[string]interface{}{{"op": "replace", "path": "/parent_key", "value": "missing"}})
+	assert.EqualValues(t, http.StatusBadRequest, code)
+	assert.Equal(t, "PARENT_NOT_FOUND", decodeError(response).Code)
+}
+
+func TestBatchSizeIsCapped(t *testing.T) {
+	c := setupSerial(t)
+	defer teardown(c)
+
+	config.MaxBatchItems = 3
+	defer func(max int) { config.MaxBatchItems = max }(config.MaxBatchItems)
+
+	var levels []Level
+	var ids []string
+	for i := 0; i < 4; i++ {
+		levels = append(levels, Level{Key: fmt.Sprintf("batch_%d", i), Name: "batched"})
+		ids = append(ids, fmt.Sprintf("batch_%d", i))
+	}
+
+	// One over the limit is rejected outright
+	code, _ := invokeBatch(c, "batch-put", "best-effort", levels)
+	assert.EqualValues(t, http.StatusBadRequest, code)
+	code, _ = loadLevelRaw(c, "batch_0")
+	assert.EqualValues(t, http.StatusNotFound, code)
+
+	code, _ = invoke(c, "POST", baseRoute+"/batch-get", map[string]interface{}{"ids": ids})
+	assert.EqualValues(t, http.StatusBadRequest, code)
+	code, _ = invokeBatch(c, "batch-delete", "best-effort", map[string]interface{}{"ids": ids})
+	assert.EqualValues(t, http.StatusBadRequest, code)
+
+	// At the limit is fine
+	code, _ = invokeBatch(c, "batch-put", "best-effort", levels[:3])
+	assert.EqualValues(t, http.StatusOK, code)
+	code, _ = invoke(c, "POST", baseRoute+"/batch-get", map[string]interface{}{"ids": ids[:3]})
+	assert.EqualValues(t, http.StatusOK, code)
+	code, _ = invokeBatch(c, "batch-delete", "best-effort", map[string]interface{}{"ids": ids[:3]})
+	assert.EqualValues(t, http.StatusOK, code)
+}
+
+func BenchmarkResolveSharedChainUncached(b *testing.B) {
+	benchmarkResolveSharedChain(b, true)
+}
+
+// Resolves the same children with the resolved ancestors left in the level cache.
+func BenchmarkResolveSharedChainCached(b *testing.B) {
+	benchmarkResolveSharedChain(b, false)
+}
+
+func benchmarkResolveSharedChain(b *testing.B, invalidateChain bool) {
+	c := setupBenchmark(b)
+	defer teardown(c)
+
+	// Build a deep chain and hang several children off of the bottom of it
+	chainKeys := storeChain(c, benchmarkChainDepth)
+	var childKeys []string
+	for i := 0; i < benchmarkChildCount; i++ {
+		childKey := fmt.Sprintf("child_%d", i)
+		storeLevel(c, childKey, Level{Parent: chainKeys[len(chainKeys)-1]})
+		childKeys = append(childKeys, childKey)
+	}
+
+	appengineContext := newAppengineContext(c)
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		for _, childKey := range childKeys {
+			b.StopTimer()
+			invalidateCachedLevel(appengineContext, childKey)
+			if invalidateChain {
+				for _, chainKey := range chainKeys {
+					invalidateCachedLevel(appengineContext, chainKey)
+				}
+			}
+			b.StartTimer()
+
+			loadLevel(c, childKey)
+		}
+	}
+}
+
+// --- Helpers
+
+// flushRecorder notes how much of the body had been written at each flush.
+type flushRecorder struct {
+	*httptest.ResponseRecorder
+	flushed []int
+}
+
+func (recorder *flushRecorder) Flush() {
+	recorder.flushed = append(recorder.flushed, recorder.Body.Len())
+	recorder.ResponseRecorder.Flush()
+}
+
+// leaseChangeNotifications takes every task off the change notification queue
+// and decodes them, oldest first.
+func leaseChangeNotifications(c *TestContext) []ChangeNotification {
+	appengineContext := newAppengineContext(c)
+	tasks, err := taskqueue.Lease(appengineContext, 100, changeNotificationQueue, 60)
+	assert.Nil(c.t, err)
+
+	notifications := []ChangeNotification{}
+	for _, task := range tasks {
+		var notification ChangeNotification
+		err = json.Unmarshal(task.Payload, &notification)
+		assert.Nil(c.t, err)
+		notifications = append(notifications, notification)
+	}
+	if len(tasks) > 0 {
+		err = taskqueue.DeleteMulti(appengineContext, tasks, changeNotificationQueue)
+		assert.Nil(c.t, err)
+	}
+
+	return notifications
+}
+
+func buildQueryRoute() string {
+	return baseRoute
+}
+
+func buildEntityRoute(id string) string {
+	return baseRoute + "/" + id
+}
+
+func invoke(c *TestContext, verb string, path string, obj interface{}) (code int, response string) {
+	code, response, _ = invokeWithHeaders(c, verb, path, obj, nil)
+	return
+}
+
+func invokeWithHeaders(c *TestContext, verb string, path string, obj interface{}, headers map[string]string) (code int, response string, responseHeaders http.Header) {
+	marshalledObj, _ := json.Marshal(obj)
+	return invokeRaw(c, verb, path, marshalledObj, headers)
+}
+
+func invokeRaw(c *TestContext, verb string, path string, body []byte, headers map[string]string) (code int, response string, responseHeaders http.Header) {
+	request, _ := c.ae.NewRequest(verb, path, bytes.NewBuffer(body))
+	for name, value := range headers {
+		request.Header.Set(name, value)
+	}
+	return serve(c, request)
+}
+
+func invokeAsUser(c *TestContext, verb string, path string, obj interface{}, u *user.User) (code int, response string) {
+	marshalledObj, _ := json.Marshal(obj)
+	request, _ := c.ae.NewRequest(verb, path, bytes.NewBuffer(marshalledObj))
+	if u != nil {
+		aetest.Login(u, request)
+	}
+	code, response, _ = serve(c, request)
+	return
+}
+
+func serve(c *TestContext, request *http.Request) (code int, response string, responseHeaders http.Header) {
+	verb, path := request.Method, request.URL.RequestURI()
+	w := httptest.NewRecorder()
+	http.DefaultServeMux.ServeHTTP(w, request)
+	body, _ := ioutil.ReadAll(w.Body)
+
+	code = w.Code
+	response = string(body)
+	responseHeaders = w.Header()
+
+	c.t.Logf("%s %s\ncode: %+v\nresponse: %+v\n", verb, path, code, response)
+	return
+}
+
+func storeLevel(c *TestContext, id string, level Level) (int, string) {
+	code, response := invoke(c, "PUT", buildEntityRoute(id), level)
+	assert.EqualValues(c.t, http.StatusOK, code)
+
+	// Populate the caches (help catch cache invalidation errors)
+	loadLevelRaw(c, id)
+	queryAll(c)
+
+	return code, response
+}
+
+func loadLevel(c *TestContext, id string) (level Level) {
+	code, resp := invoke(c, "GET", buildEntityRoute(id), nil)
+	assert.EqualValues(c.t, http.StatusOK, code)
+
+	json.Unmarshal([]byte(resp), &level)
+	return
+}
+
+func loadLevelAtDepth(c *TestContext, id string, depth string) (level Level) {
+	code, resp := invoke(c, "GET", buildEntityRoute(id)+"?resolveDepth="+depth, nil)
+	assert.EqualValues(c.t, http.StatusOK, code)
+
+	json.Unmarshal([]byte(resp), &level)
+	return
+}
+
+func loadLevelWithChain(c *TestContext, id string, query string) (Level, []string) {
+	code, response := invoke(c, "GET", buildEntityRoute(id)+"?withChain=true"+query, nil)
+	assert.EqualValues(c.t, http.StatusOK, code)
+
+	var result struct {
+		Level
+		AncestryKeys []string `json:"ancestry_keys"`
+	}
+	json.Unmarshal([]byte(response), &result)
+	return result.Level, result.AncestryKeys
+}
+
+func runMultiBatch(c *TestContext, mode string, requests []map[string]interface{}) (int, []SubResponse) {
+	code, response := invoke(c, "POST", "/v1/batch?mode="+mode, requests)
+
+	var batch struct {
+		Results []SubResponse `json:"results"`
+	}
+	json.Unmarshal([]byte(response), &batch)
+	return code, batch.Results
+}
+
+func subStatuses(results []SubResponse) []int {
+	statuses := []int{}
+	for _, result := range results {
+		statuses = append(statuses, result.Status)
+	}
+	return statuses
+}
+
+func loadLevelRaw(c *TestContext, id string) (int, string) {
+	code, response := invoke(c, "GET", buildEntityRoute(id), nil)
+	return code, response
+}
+
+func deleteLevel(c *TestContext, id string) (int, string) {
+	code, response := invoke(c, "DELETE", buildEntityRoute(id), nil)
+	assert.EqualValues(c.t, http.StatusNoContent, code)
+	return code, response
+}
+
+func queryAll(c *TestContext) []Level {
+	code, resp := invoke(c, "GET", buildQueryRoute(), nil)
+	assert.EqualValues(c.t, http.StatusOK, code)
+
+	var levels []Level
+	json.Unmarshal([]byte(resp), &levels)
+	return levels
+}
+
+func buildSpawnFrequency(size int) map[string]float32 {
+	spawnFrequency := make(map[string]float32)
+	for i := 0; i < size; i++ {
+		spawnFrequency[fmt.Sprintf("unit_%d", i)] = 1.0
+	}
+	return spawnFrequency
+}
+
+func treeKeys(nodes []LevelTreeNode) []string {
+	keys := []string{}
+	for _, node := range nodes {
+		keys = append(keys, node.Key)
+	}
+	return keys
+}
+
+func loadTree(c *TestContext) (tree LevelTree) {
+	code, resp := invoke(c, "GET", baseRoute+"/tree", nil)
+	assert.EqualValues(c.t, http.StatusOK, code)
+
+	json.Unmarshal([]byte(resp), &tree)
+	return
+}
+
+func invokeBatch(c *TestContext, operation string, mode string, obj interface{}) (int, BatchWriteResponse) {
+	var response BatchWriteResponse
+	code, resp := invoke(c, "POST", baseRoute+"/"+operation+"?mode="+mode, obj)
+	json.Unmarshal([]byte(resp), &response)
+	return code, response
+}
+
+func newAppengineContext(c *TestContext) appengine.Context {
+	request, _ := c.ae.NewRequest("GET", "/", nil)
+	return appengine.NewContext(request)
+}
+
+// invalidateCachedLevel drops a level from the level and response caches.
+func invalidateCachedLevel(context appengine.Context, id string) {
+	cache.InvalidateCacheEntryByKey(context, "level:"+id)
+	cache.InvalidateCacheEntryByKey(context, "response:"+buildEntityRoute(id))
+}
+
+// storeChain stores a chain of levels, each the parent of the next, and returns their keys root-first.
+func storeChain(c *TestContext, depth int) []string {
+	var keys []string
+	for i := 0; i < depth; i++ {
+		key := fmt.Sprintf("chain_%d", i)
+		chainLevel := Level{Name: key}
+		if i == 0 {
+			chainLevel = testLevel1
+		} else {
+			chainLevel.Parent = keys[i-1]
+		}
+		storeLevel(c, key, chainLevel)
+		keys = append(keys, key)
+	}
+	return keys
+}
+
+// storeRawChain puts a chain of levels straight into the datastore, without
+// going through the API or its caches, and returns their keys root-first.
+func storeRawChain(c *TestContext, depth int) []string {
+	appengineContext := newAppengineContext(c)
+	rootKey := datastore.NewKey(appengineContext, "Level", "LevelRoot", 0, nil)
+
+	var keys []string
+	for i := 0; i < depth; i++ {
+		key := fmt.Sprintf("deep_%d", i)
+		properties := datastore.PropertyList{
+			{Name: "Key", Value: key},
+			{Name: "HasKey", Value: true},
+		}
+		if i > 0 {
+			properties = append(properties,
+				datastore.Property{Name: "Parent", Value: keys[i-1]},
+				datastore.Property{Name: "HasParent", Value: true})
+		}
+		datastore.Put(appengineContext, datastore.NewKey(appengineContext, "Level", key, 0, rootKey), &properties)
+		keys = append(keys, key)
+	}
+	return keys
+}
+
+func queryUnassigned(c *TestContext) (levels []Level) {
+	code, resp := invoke(c, "GET", buildQueryRoute()+"?unassigned=true", nil)
+	assert.EqualValues(c.t, http.StatusOK, code)
+
+	json.Unmarshal([]byte(resp), &levels)
+	return
+}
+
+func diffBundles(c *TestContext, request interface{}) (diff BundleDiff) {
+	code, resp := invoke(c, "POST", "/diff-bundle", request)
+	assert.EqualValues(c.t, http.StatusOK, code)
+
+	json.Unmarshal([]byte(resp), &diff)
+	return
+}
+
+func loadStats(c *TestContext) (stats LevelStats) {
+	code, resp := invoke(c, "GET", buildEntityRoute("stats"), nil)
+	assert.EqualValues(c.t, http.StatusOK, code)
+
+	json.Unmarshal([]byte(resp), &stats)
+	return
+}
+
+func validateImport(c *TestContext, bundle interface{}) (result ImportValidation) {
+	code, resp := invoke(c, "POST", "/import/validate", bundle)
+	assert.EqualValues(c.t, http.StatusOK, code)
+
+	json.Unmarshal([]byte(resp), &result)
+	return
+}
+
+func storeTerritory(c *TestContext, id string, levels []string) {
+	territory := map[string]interface{}{"levels": levels}
+	code, _ := invoke(c, "PUT", "/territories/"+id, territory)
+	assert.EqualValues(c.t, http.StatusOK, code)
+}
+
+func loadLevelWithDefaults(c *TestContext, id string) (level Level) {
+	code, resp := invoke(c, "GET", buildEntityRoute(id)+"?applyDefaults=true", nil)
+	assert.EqualValues(c.t, http.StatusOK, code)
+
+	json.Unmarshal([]byte(resp), &level)
+	return
+}
+
+func reparentLevel(c *TestContext, id string, newParentId string) (int, string) {
+	return invoke(c, "POST", buildEntityRoute(id)+"/reparent?to="+newParentId, nil)
+}
+
+func canReparent(c *TestContext, id string, newParentId string) (check ReparentCheck) {
+	code, response := invoke(c, "GET", buildEntityRoute(id)+"/can-reparent?to="+newParentId, nil)
+	assert.EqualValues(c.t, http.StatusOK, code)
+
+	json.Unmarshal([]byte(response), &check)
+	return
+}
+
+func loadRenameImpact(c *TestContext, id string, newId string) (impact RenameImpact) {
+	code, response := invoke(c, "GET", buildEntityRoute(id)+"/rename-impact?to="+newId, nil)
+	assert.EqualValues(c.t, http.StatusOK, code)
+
+	json.Unmarshal([]byte(response), &impact)
+	return
+}
+
+func loadDelta(c *TestContext, query string) (delta LevelDelta) {
+	code, response := invoke(c, "GET", baseRoute+"/delta"+query, nil)
+	assert.EqualValues(c.t, http.StatusOK, code)
+
+	json.Unmarshal([]byte(response), &delta)
+	return
+}
+
+func loadCollectionVersion(c *TestContext) int64 {
+	code, response := invoke(c, "GET", baseRoute+"/version", nil)
+	assert.EqualValues(c.t, http.StatusOK, code)
+
+	var version struct {
+		Version int64 `json:"version"`
+	}
+	json.Unmarshal([]byte(response), &version)
+	return version.Version
+}
+
+func patchLevel(c *TestContext, id string, operations []map[string]interface{}) (int, string) {
+	code, response, _ := invokeWithHeaders(c, "PATCH", buildEntityRoute(id), operations, map[string]string{"Content-Type": "application/json-patch+json"})
+	return code, response
+}
+
+func mergePatchLevel(c *TestContext, id string, fields map[string]interface{}) (int, string) {
+	code, response, _ := invokeWithHeaders(c, "PATCH", buildEntityRoute(id), fields, map[string]string{"Content-Type": "application/merge-patch+json"})
+	return code, response
+}
+
+func queryPage(c *TestContext, query string) (int, LevelPage) {
+	code, resp := invoke(c, "GET", buildQueryRoute()+query, nil)
+
+	var page LevelPage
+	json.Unmarshal([]byte(resp), &page)
+	return code, page
+}
+
+func levelNames(levels []Level) []string {
+	names := []string{}
+	for _, level := range levels {
+		names = append(names, level.Name)
+	}
+	return names
+}
+
+func loadCacheStats(c *TestContext) (stats CacheStats) {
+	code, response := invokeAsUser(c, "GET", "/admin/cache/stats", nil, adminUser)
+	assert.EqualValues(c.t, http.StatusOK, code)
+
+	json.Unmarshal([]byte(response), &stats)
+	return
+}
+
+// queryTags returns the names of the levels matching a tag query, sorted.
+func queryTags(c *TestContext, query string) []string {
+	code, response := invoke(c, "GET", baseRoute+"?"+query, nil)
+	assert.EqualValues(c.t, http.StatusOK, code)
+
+	var levels []Level
+	json.Unmarshal([]byte(response), &levels)
+	names := levelNames(levels)
+	sort.Strings(names)
+	return names
+}
+
+func loadField(c *TestContext, id string, name string) (int, ResolvedField) {
+	code, response := invoke(c, "GET", buildEntityRoute(id)+"/field/"+name, nil)
+
+	var field ResolvedField
+	json.Unmarshal([]byte(response), &field)
+	return code, field
+}
+
+func countDescendants(c *TestContext, id string, recursive bool) int {
+	code, response := invoke(c, "GET", buildEntityRoute(id)+fmt.Sprintf("/descendant-count?recursive=%t", recursive), nil)
+	assert.EqualValues(c.t, http.StatusOK, code)
+
+	var result struct {
+		Count int `json:"count"`
+	}
+	json.Unmarshal([]byte(response), &result)
+	return result.Count
+}
+
+func loadOverrides(c *TestContext, id string) (overrides Overrides) {
+	code, response := invoke(c, "GET", buildEntityRoute(id)+"/overrides", nil)
+	assert.EqualValues(c.t, http.StatusOK, code)
+
+	json.Unmarshal([]byte(response), &overrides)
+	return
+}
+
+// decodeLock reads the lock from a lock route's response, or from a 423.
+func decodeLock(response string) (lock LevelLock) {
+	var locked struct {
+		Lock *LevelLock `json:"lock"`
+	}
+	json.Unmarshal([]byte(response), &locked)
+	if locked.Lock != nil {
+		return *locked.Lock
+	}
+
+	json.Unmarshal([]byte(response), &lock)
+	return
+}
+
+func decodeError(response string) (result ErrorResponse) {
+	json.Unmarshal([]byte(response), &result)
 	return
 }
@@ -9,13 +9,19 @@ import (
 	"io/ioutil"
 	"net/http"
 	"net/http/httptest"
+	"sync"
 	"testing"
 
 	"github.com/stretchr/testify/assert"
 
+	"appengine"
 	"appengine/aetest"
+	"appengine/datastore"
+	"appengine/memcache"
 
 	main "bootcamp/editorservice/appengine"
+	"bootcamp/editorservice/config"
+	"bootcamp/editorservice/flags"
 )
 
 // The test package must reference the main package.
@@ -34,6 +40,67 @@ type Territory struct {
 	Sequence int32    `json:"sequence,omitempty"`
 	Name     string   `json:"name,omitempty"`
 	Levels   []string `json:"levels"`
+
+	World               string   `json:"world,omitempty"`
+	RequiresTerritories []string `json:"requires_territories,omitempty"`
+
+	Archived *bool `json:"archived,omitempty"`
+}
+
+type BatchGetResponse struct {
+	Results []struct {
+		Key    string `json:"key"`
+		Status int    `json:"status"`
+	} `json:"results"`
+	Territories []Territory `json:"territories"`
+	Missing     []string    `json:"missing"`
+}
+
+// VersionedTerritory is what the levels routes return
+type VersionedTerritory struct {
+	Levels  []string `json:"levels"`
+	Version int64    `json:"version"`
+}
+
+type ReferenceWarnings struct {
+	Warnings []struct {
+		Key  string `json:"key"`
+		Code string `json:"code"`
+	} `json:"warnings"`
+}
+
+// TerritoryBundle is what the export route returns.  Levels are left as maps so
+// tests can tell which fields were stored.
+type TerritoryBundle struct {
+	Territories []Territory              `json:"territories"`
+	Levels      []map[string]interface{} `json:"levels"`
+	Missing     []string                 `json:"missing"`
+	Versions    map[string]int64         `json:"versions"`
+}
+
+type ImportResult struct {
+	Written struct {
+		Levels      []string `json:"levels"`
+		Territories []string `json:"territories"`
+	} `json:"written"`
+	Skipped struct {
+		Levels      []string `json:"levels"`
+		Territories []string `json:"territories"`
+	} `json:"skipped"`
+}
+
+type TerritoryValidation struct {
+	Valid    bool `json:"valid"`
+	Problems []struct {
+		Field string `json:"field"`
+		Key   string `json:"key"`
+		Code  string `json:"code"`
+	} `json:"problems"`
+}
+
+type ErrorResponse struct {
+	Code    string `json:"code"`
+	Message string `json:"message"`
 }
 
 const baseRoute = "/territories"
@@ -66,9 +133,14 @@ const testKey2 = "test_key_2"
 
 func setup(t *testing.T) *TestContext {
 	t.Parallel()
+	return setupSerial(t)
+}
 
+// setupSerial is for tests that change package-level settings.  They run
+// before any of the parallel tests start, so they must restore what they change.
+func setupSerial(t *testing.T) *TestContext {
 	var options = aetest.Options{
-		AppID: "testapp",
+		AppID:                       "testapp",
 		StronglyConsistentDatastore: true,
 	}
 	ae, _ := aetest.NewInstance(&options)
@@ -96,6 +168,24 @@ func TestGetWithMissingObjectFails(t *testing.T) {
 	assert.EqualValues(t, http.StatusNotFound, code)
 }
 
+func TestCacheMissFalseDoesNotCacheNotFound(t *testing.T) {
+	c := setup(t)
+	defer teardown(c)
+
+	appengineContext := newAppengineContext(c)
+	cacheKey := "response:" + buildEntityRoute(testKey1)
+
+	code, _ := invoke(c, "GET", buildEntityRoute(testKey1)+"?cacheMiss=false", nil)
+	assert.EqualValues(t, http.StatusNotFound, code)
+	_, err := memcache.Get(appengineContext, cacheKey)
+	assert.Equal(t, memcache.ErrCacheMiss, err)
+
+	code, _ = invoke(c, "GET", buildEntityRoute(testKey1), nil)
+	assert.EqualValues(t, http.StatusNotFound, code)
+	_, err = memcache.Get(appengineContext, cacheKey)
+	assert.Nil(t, err)
+}
+
 func TestPutThenGetWithSameObjectMatches(t *testing.T) {
 	c := setup(t)
 	defer teardown(c)
@@ -153,6 +243,7 @@ func TestDeleteWithMissingObjectSucceeds(t *testing.T) {
 	// It doesn't 404, and that's fine. It shouldn't matter.
 	// Datastore is returning success behind the scenes, and changing that
 	// would require doing get+delete which right now is needlessly expensive.
+	// Deployments that want the 404 can turn on the strict_delete flag.
 	deleteTerritory(c, "nonExistingKey")
 	// asserts in the helper
 }
@@ -171,6 +262,124 @@ func TestDeleteWithExistingObjectSucceeds(t *testing.T) {
 	assert.EqualValues(t, http.StatusNotFound, code)
 }
 
+func TestStrictDeleteFlagRejectsMissingTerritories(t *testing.T) {
+	c := setupSerial(t)
+	defer teardown(c)
+
+	flags.StrictDelete.Enabled = true
+	defer func() { flags.StrictDelete.Enabled = false }()
+
+	code, response := invoke(c, "DELETE", buildEntityRoute("nonExistingKey"), nil)
+	assert.EqualValues(t, http.StatusNotFound, code)
+	assert.Equal(t, "NOT_FOUND", decodeError(response).Code)
+
+	storeTerritory(c, testKey1, testTerritory1)
+	deleteTerritory(c, testKey1)
+	code, _ = loadTerritoryRaw(c, testKey1)
+	assert.EqualValues(t, http.StatusNotFound, code)
+}
+
+func TestDeleteWithBodyFlagForTerritories(t *testing.T) {
+	c := setupSerial(t)
+	defer teardown(c)
+
+	storeTerritory(c, testKey1, testTerritory1)
+	code, response := invoke(c, "DELETE", buildEntityRoute(testKey1), nil)
+	assert.EqualValues(t, http.StatusNoContent, code)
+	assert.Empty(t, response)
+
+	flags.DeleteWithBody.Enabled = true
+	defer func() { flags.DeleteWithBody.Enabled = false }()
+
+	storeTerritory(c, testKey1, testTerritory1)
+	code, response = invoke(c, "DELETE", buildEntityRoute(testKey1), nil)
+	assert.EqualValues(t, http.StatusOK, code)
+	assert.Equal(t, "null\n", response)
+}
+
+func TestMissingLevelsAreAWarningByDefault(t *testing.T) {
+	c := setup(t)
+	defer teardown(c)
+
+	// No levels are stored here, so every level the territory lists is missing
+	code, response := storeTerritory(c, testKey1, Territory{Name: "territory", Levels: []string{"a", "b"}})
+	assert.EqualValues(t, http.StatusOK, code)
+
+	var warnings ReferenceWarnings
+	json.Unmarshal([]byte(response), &warnings)
+	assert.Equal(t, []string{"a", "b"}, warningKeys(warnings))
+
+	// Adding levels warns about just the new ones
+	code, updated := updateLevels(c, testKey1, "add", map[string]interface{}{"levels": []string{"c"}})
+	assert.EqualValues(t, http.StatusOK, code)
+	assert.Equal(t, []string{"a", "b", "c"}, updated.Levels)
+
+	_, raw := invoke(c, "POST", buildEntityRoute(testKey1)+"/levels/add", map[string]interface{}{"levels": []string{"d"}})
+	json.Unmarshal([]byte(raw), &warnings)
+	assert.Equal(t, []string{"d"}, warningKeys(warnings))
+}
+
+func TestStrictReferencesRefuseMissingLevels(t *testing.T) {
+	c := setupSerial(t)
+	defer teardown(c)
+
+	config.StrictReferences = true
+	defer func() { config.StrictReferences = false }()
+
+	code, response := invoke(c, "PUT", buildEntityRoute(testKey1), Territory{Name: "territory", Levels: []string{"a"}})
+	assert.EqualValues(t, http.StatusBadRequest, code)
+	assert.Equal(t, "NOT_FOUND", decodeError(response).Code)
+	code, _ = loadTerritoryRaw(c, testKey1)
+	assert.EqualValues(t, http.StatusNotFound, code)
+
+	// Territories without levels still go through, but adding missing ones doesn't
+	storeTerritory(c, testKey1, Territory{Name: "territory", Levels: []string{}})
+	code, _ = patchTerritory(c, testKey1, "", Territory{Name: "renamed"})
+	assert.EqualValues(t, http.StatusOK, code)
+	code, response = invoke(c, "POST", buildEntityRoute(testKey1)+"/levels/add", map[string]interface{}{"levels": []string{"a"}})
+	assert.EqualValues(t, http.StatusBadRequest, code)
+	assert.Equal(t, "NOT_FOUND", decodeError(response).Code)
+}
+
+func TestTerritoryLevelsAreCapped(t *testing.T) {
+	c := setupSerial(t)
+	defer teardown(c)
+
+	limit := config.MaxTerritoryLevels
+	config.MaxTerritoryLevels = 3
+	defer func() { config.MaxTerritoryLevels = limit }()
+
+	// At the limit, counting a level listed twice once
+	storeTerritory(c, testKey1, Territory{Name: "full", Levels: []string{"a", "b", "a", "c"}})
+
+	// Over it, whether written whole, patched or added to
+	code, response := invoke(c, "PUT", buildEntityRoute(testKey2), Territory{Name: "over", Levels: []string{"a", "b", "c", "d"}})
+	assert.EqualValues(t, http.StatusBadRequest, code)
+	assert.Equal(t, "VALIDATION_FAILED", decodeError(response).Code)
+	code, _ = loadTerritoryRaw(c, testKey2)
+	assert.EqualValues(t, http.StatusNotFound, code)
+
+	code, _ = patchTerritory(c, testKey1, "append", Territory{Levels: []string{"d"}})
+	assert.EqualValues(t, http.StatusBadRequest, code)
+	code, _ = updateLevels(c, testKey1, "add", map[string]interface{}{"levels": []string{"d"}})
+	assert.EqualValues(t, http.StatusBadRequest, code)
+	assert.Equal(t, []string{"a", "b", "a", "c"}, loadTerritory(c, testKey1).Levels)
+
+	// Levels it already lists can still be added and reordered
+	code, result := updateLevels(c, testKey1, "add", map[string]interface{}{"levels": []string{"b"}})
+	assert.EqualValues(t, http.StatusOK, code)
+	assert.Equal(t, []string{"a", "b", "c"}, result.Levels)
+	code, result = updateLevels(c, testKey1, "reorder", map[string]interface{}{"levels": []string{"c", "b", "a"}, "version": result.Version})
+	assert.EqualValues(t, http.StatusOK, code)
+	assert.Equal(t, []string{"c", "b", "a"}, result.Levels)
+
+	// And a territory over a lowered cap can shed levels
+	config.MaxTerritoryLevels = 1
+	code, result = updateLevels(c, testKey1, "remove", map[string]interface{}{"levels": []string{"c"}})
+	assert.EqualValues(t, http.StatusOK, code)
+	assert.Equal(t, []string{"b", "a"}, result.Levels)
+}
+
 func TestDeleteDifferentiatesById(t *testing.T) {
 	c := setup(t)
 	defer teardown(c)
@@ -251,8 +460,718 @@ func TestQueryLimitsResults(t *testing.T) {
 	assert.EqualValues(t, 100, len(territories))
 }
 
+func TestGetWithLegacyPropertySucceeds(t *testing.T) {
+	c := setup(t)
+	defer teardown(c)
+
+	// Store a territory directly, with a property the service doesn't know about
+	appengineContext := newAppengineContext(c)
+	rootKey := datastore.NewKey(appengineContext, "Territory", "TerritoryRoot", 0, nil)
+	key := datastore.NewKey(appengineContext, "Territory", testKey1, 0, rootKey)
+	legacyTerritory := &datastore.PropertyList{
+		{Name: "Id", Value: testKey1},
+		{Name: "HasId", Value: true},
+		{Name: "Name", Value: "legacy territory"},
+		{Name: "HasName", Value: true},
+		{Name: "RetiredField", Value: int64(42)},
+	}
+	_, err := datastore.Put(appengineContext, key, legacyTerritory)
+	assert.Nil(t, err)
+
+	// It should still load, with the known fields populated
+	territory := loadTerritory(c, testKey1)
+	assert.Equal(t, testKey1, territory.Id)
+	assert.Equal(t, "legacy territory", territory.Name)
+
+	// And show up in queries
+	territories := queryAll(c)
+	assert.EqualValues(t, 1, len(territories))
+}
+
+func TestPutWithInvalidIdFails(t *testing.T) {
+	c := setup(t)
+	defer teardown(c)
+
+	code, response := invoke(c, "PUT", buildEntityRoute("__reserved__"), testTerritory1)
+	assert.EqualValues(t, http.StatusBadRequest, code)
+	assert.Equal(t, "INVALID_REQUEST", decodeError(response).Code)
+}
+
+func TestMalformedLevelIdsAreRejected(t *testing.T) {
+	c := setupSerial(t)
+	defer teardown(c)
+
+	code, response := invoke(c, "PUT", buildEntityRoute(testKey1), Territory{Levels: []string{"fine", "", "__reserved__"}})
+	assert.EqualValues(t, http.StatusBadRequest, code)
+	assert.Equal(t, "INVALID_REQUEST", decodeError(response).Code)
+
+	var malformed struct {
+		Invalid []struct {
+			Key string `json:"key"`
+		} `json:"invalid"`
+	}
+	json.Unmarshal([]byte(response), &malformed)
+	assert.EqualValues(t, 2, len(malformed.Invalid))
+	assert.Equal(t, "__reserved__", malformed.Invalid[1].Key)
+
+	code, _ = loadTerritoryRaw(c, testKey1)
+	assert.EqualValues(t, http.StatusNotFound, code)
+
+	// Adding them later is refused too
+	storeTerritory(c, testKey1, testTerritory1)
+	code, _ = invoke(c, "POST", buildEntityRoute(testKey1)+"/levels/add", map[string]interface{}{"levels": []string{""}})
+	assert.EqualValues(t, http.StatusBadRequest, code)
+	assert.Equal(t, testTerritory1.Levels, loadTerritory(c, testKey1).Levels)
+
+	// With normalize_ids, so are ids with characters a path id couldn't have
+	flags.NormalizeIds.Enabled = true
+	defer func() { flags.NormalizeIds.Enabled = false }()
+
+	code, response = invoke(c, "PUT", buildEntityRoute(testKey1), Territory{Levels: []string{"fine", "not/fine"}})
+	assert.EqualValues(t, http.StatusBadRequest, code)
+	json.Unmarshal([]byte(response), &malformed)
+	if assert.EqualValues(t, 1, len(malformed.Invalid)) {
+		assert.Equal(t, "not/fine", malformed.Invalid[0].Key)
+	}
+	assert.Equal(t, testTerritory1.Levels, loadTerritory(c, testKey1).Levels)
+}
+
+func TestPatchUpdatesOnlySuppliedFields(t *testing.T) {
+	c := setup(t)
+	defer teardown(c)
+
+	storeTerritory(c, testKey1, testTerritory1)
+
+	// Only change the name
+	patchTerritory(c, testKey1, "", map[string]interface{}{"name": "patched"})
+
+	territory := loadTerritory(c, testKey1)
+	assert.Equal(t, "patched", territory.Name)
+	assert.Equal(t, testTerritory1.Sequence, territory.Sequence)
+	assert.Equal(t, testTerritory1.Levels, territory.Levels)
+}
+
+func TestPatchWithMissingObjectFails(t *testing.T) {
+	c := setup(t)
+	defer teardown(c)
+
+	code, _ := invoke(c, "PATCH", buildEntityRoute("nonExistingKey"), map[string]interface{}{"name": "patched"})
+	assert.EqualValues(t, http.StatusNotFound, code)
+}
+
+func TestPatchAppendKeepsConcurrentAdditions(t *testing.T) {
+	c := setup(t)
+	defer teardown(c)
+
+	storeTerritory(c, testKey1, testTerritory1)
+
+	// Two editors each add a different level, both based on the same original list
+	patchTerritory(c, testKey1, "append", map[string]interface{}{"levels": []string{"test", "first_addition"}})
+	patchTerritory(c, testKey1, "append", map[string]interface{}{"levels": []string{"second_addition"}})
+
+	// Both additions survive, in order and without duplicates
+	territory := loadTerritory(c, testKey1)
+	assert.Equal(t, []string{"test", "default", "first_addition", "second_addition"}, territory.Levels)
+}
+
+func TestPatchReplaceOverwritesLevels(t *testing.T) {
+	c := setup(t)
+	defer teardown(c)
+
+	storeTerritory(c, testKey1, testTerritory1)
+	patchTerritory(c, testKey1, "", map[string]interface{}{"levels": []string{"replacement"}})
+
+	territory := loadTerritory(c, testKey1)
+	assert.Equal(t, []string{"replacement"}, territory.Levels)
+}
+
+func TestLevelsRoutesAddRemoveAndReorder(t *testing.T) {
+	c := setup(t)
+	defer teardown(c)
+
+	storeTerritory(c, testKey1, testTerritory1)
+
+	code, result := updateLevels(c, testKey1, "add", map[string]interface{}{"levels": []string{"default", "added"}})
+	assert.EqualValues(t, http.StatusOK, code)
+	assert.Equal(t, []string{"test", "default", "added"}, result.Levels)
+	assert.EqualValues(t, 2, result.Version)
+
+	code, result = updateLevels(c, testKey1, "remove", map[string]interface{}{"levels": []string{"test", "never_there"}})
+	assert.EqualValues(t, http.StatusOK, code)
+	assert.Equal(t, []string{"default", "added"}, result.Levels)
+
+	code, result = updateLevels(c, testKey1, "reorder", map[string]interface{}{"levels": []string{"added", "default"}, "version": result.Version})
+	assert.EqualValues(t, http.StatusOK, code)
+	assert.Equal(t, []string{"added", "default"}, result.Levels)
+	assert.EqualValues(t, 4, result.Version)
+
+	// Reads see the changes
+	assert.Equal(t, []string{"added", "default"}, loadTerritory(c, testKey1).Levels)
+
+	// A reorder that doesn't hold the same levels was based on an older list
+	code, _ = updateLevels(c, testKey1, "reorder", map[string]interface{}{"levels": []string{"added"}})
+	assert.EqualValues(t, http.StatusConflict, code)
+
+	code, _ = updateLevels(c, "nonExistingKey", "add", map[string]interface{}{"levels": []string{"added"}})
+	assert.EqualValues(t, http.StatusNotFound, code)
+}
+
+func TestCopyLevelsFromAnotherTerritory(t *testing.T) {
+	c := setup(t)
+	defer teardown(c)
+
+	storeTerritory(c, "source", Territory{Name: "source", Levels: []string{"b", "c"}})
+	storeTerritory(c, "target", Territory{Name: "target", Levels: []string{"a", "b"}})
+
+	// Appending skips the levels the target already has
+	code, updated := copyLevels(c, "target", "source", "?levelsMode=append")
+	assert.EqualValues(t, http.StatusOK, code)
+	assert.Equal(t, []string{"a", "b", "c"}, updated.Levels)
+
+	// Replacing takes the source's list as it is
+	storeTerritory(c, "source", Territory{Name: "source", Levels: []string{"c", "d"}})
+	code, updated = copyLevels(c, "target", "source", "")
+	assert.EqualValues(t, http.StatusOK, code)
+	assert.Equal(t, []string{"c", "d"}, updated.Levels)
+	assert.Equal(t, []string{"c", "d"}, loadTerritory(c, "target").Levels)
+	assert.Equal(t, []string{"c", "d"}, loadTerritory(c, "source").Levels)
+}
+
+func TestCopyLevelsFromMissingTerritoryFails(t *testing.T) {
+	c := setup(t)
+	defer teardown(c)
+
+	storeTerritory(c, "target", Territory{Name: "target", Levels: []string{"a"}})
+
+	code, _ := copyLevels(c, "target", "missing", "")
+	assert.EqualValues(t, http.StatusNotFound, code)
+	assert.Equal(t, []string{"a"}, loadTerritory(c, "target").Levels)
+
+	code, _ = copyLevels(c, "missing", "target", "")
+	assert.EqualValues(t, http.StatusNotFound, code)
+
+	code, _ = copyLevels(c, "target", "target", "?levelsMode=sideways")
+	assert.EqualValues(t, http.StatusBadRequest, code)
+}
+
+func TestConcurrentLevelsChangesAreNotLost(t *testing.T) {
+	c := setup(t)
+	defer teardown(c)
+
+	storeTerritory(c, testKey1, testTerritory1)
+
+	// Several editors add a level each at the same time
+	additions := []string{"first", "second", "third", "fourth"}
+	codes := make([]int, len(additions))
+	var wait sync.WaitGroup
+	for i, levelId := range additions {
+		wait.Add(1)
+		go func(i int, levelId string) {
+			defer wait.Done()
+			codes[i], _ = updateLevels(c, testKey1, "add", map[string]interface{}{"levels": []string{levelId}})
+		}(i, levelId)
+	}
+	wait.Wait()
+
+	// Every addition that was accepted made it in, and any that weren't were told so
+	levels := loadTerritory(c, testKey1).Levels
+	for i, levelId := range additions {
+		if codes[i] == http.StatusOK {
+			assert.Contains(t, levels, levelId)
+		} else {
+			assert.EqualValues(t, http.StatusConflict, codes[i])
+			assert.NotContains(t, levels, levelId)
+		}
+	}
+}
+
+func TestStaleLevelsVersionIsRejected(t *testing.T) {
+	c := setup(t)
+	defer teardown(c)
+
+	storeTerritory(c, testKey1, testTerritory1)
+
+	// Two editors read the same version and both try to change the list
+	additions := []string{"first", "second"}
+	codes := make([]int, len(additions))
+	var wait sync.WaitGroup
+	for i, levelId := range additions {
+		wait.Add(1)
+		go func(i int, levelId string) {
+			defer wait.Done()
+			codes[i], _ = updateLevels(c, testKey1, "add", map[string]interface{}{"levels": []string{levelId}, "version": 1})
+		}(i, levelId)
+	}
+	wait.Wait()
+
+	// Only one of them gets to
+	winner, loser := 0, 1
+	if codes[0] != http.StatusOK {
+		winner, loser = 1, 0
+	}
+	assert.EqualValues(t, http.StatusOK, codes[winner])
+	assert.EqualValues(t, http.StatusConflict, codes[loser])
+
+	levels := loadTerritory(c, testKey1).Levels
+	assert.Contains(t, levels, additions[winner])
+	assert.NotContains(t, levels, additions[loser])
+
+	// And the same goes for patches
+	code, response := invoke(c, "PATCH", buildEntityRoute(testKey1), map[string]interface{}{"name": "stale", "version": 1})
+	assert.EqualValues(t, http.StatusConflict, code)
+	assert.Equal(t, "CONFLICT", decodeError(response).Code)
+}
+
+func TestArchivedTerritoriesAreHiddenButRestorable(t *testing.T) {
+	c := setup(t)
+	defer teardown(c)
+
+	storeTerritory(c, testKey1, testTerritory1)
+	storeTerritory(c, testKey2, testTerritory2)
+
+	code, _ := invoke(c, "POST", buildEntityRoute(testKey1)+"/archive", nil)
+	assert.EqualValues(t, http.StatusOK, code)
+
+	// Hidden from the default list, but listed on request and still readable
+	assert.Equal(t, []string{testKey2}, territoryIds(queryAll(c)))
+	assert.Equal(t, []string{testKey1}, territoryIds(queryArchived(c)))
+	assert.Equal(t, testTerritory1.Name, loadTerritory(c, testKey1).Name)
+
+	// Replacing it doesn't bring it back by accident
+	storeTerritory(c, testKey1, testTerritory1)
+	assert.Equal(t, []string{testKey2}, territoryIds(queryAll(c)))
+
+	code, _ = invoke(c, "POST", buildEntityRoute(testKey1)+"/restore", nil)
+	assert.EqualValues(t, http.StatusOK, code)
+	assert.Equal(t, []string{testKey1, testKey2}, territoryIds(queryAll(c)))
+	assert.Empty(t, queryArchived(c))
+
+	code, _ = invoke(c, "POST", buildEntityRoute("nonExistingKey")+"/archive", nil)
+	assert.EqualValues(t, http.StatusNotFound, code)
+}
+
+func TestTerritoryListSkipsPastArchivedTerritories(t *testing.T) {
+	c := setup(t)
+	defer teardown(c)
+
+	// A whole list's worth of archived territories ahead of the live one
+	for i := 0; i < 100; i++ {
+		id := fmt.Sprintf("archived_%03d", i)
+		code, _ := invoke(c, "PUT", buildEntityRoute(id), testTerritory1)
+		assert.EqualValues(t, http.StatusOK, code)
+		code, _ = invoke(c, "POST", buildEntityRoute(id)+"/archive", nil)
+		assert.EqualValues(t, http.StatusOK, code)
+	}
+	storeTerritory(c, "zz_live", testTerritory2)
+
+	assert.Equal(t, []string{"zz_live"}, territoryIds(queryAll(c)))
+	assert.Equal(t, 100, len(queryArchived(c)))
+}
+
+func TestPatchTellsUnsetArchivedFromFalse(t *testing.T) {
+	c := setup(t)
+	defer teardown(c)
+
+	// A territory that was never archived doesn't say either way
+	storeTerritory(c, testKey1, testTerritory1)
+	assert.Nil(t, loadTerritory(c, testKey1).Archived)
+
+	code, _ := patchTerritory(c, testKey1, "", map[string]interface{}{"archived": true})
+	assert.EqualValues(t, http.StatusOK, code)
+	assert.Empty(t, queryAll(c))
+
+	// Leaving archived out of a patch keeps it archived
+	code, _ = patchTerritory(c, testKey1, "", map[string]interface{}{"name": "renamed"})
+	assert.EqualValues(t, http.StatusOK, code)
+	patched := loadTerritory(c, testKey1)
+	assert.Equal(t, "renamed", patched.Name)
+	if assert.NotNil(t, patched.Archived) {
+		assert.True(t, *patched.Archived)
+	}
+
+	// But sending false restores it, and it then says so
+	code, _ = patchTerritory(c, testKey1, "", map[string]interface{}{"archived": false})
+	assert.EqualValues(t, http.StatusOK, code)
+	restored := loadTerritory(c, testKey1)
+	if assert.NotNil(t, restored.Archived) {
+		assert.False(t, *restored.Archived)
+	}
+	assert.Equal(t, []string{testKey1}, territoryIds(queryAll(c)))
+}
+
+func TestBatchGetReturnsPresentAndMissingTerritories(t *testing.T) {
+	c := setup(t)
+	defer teardown(c)
+
+	storeTerritory(c, testKey1, testTerritory1)
+	storeTerritory(c, testKey2, testTerritory2)
+
+	code, response := batchGetTerritories(c, []string{testKey2, "missing", testKey1})
+	assert.EqualValues(t, http.StatusMultiStatus, code)
+
+	// Present territories come back in request order
+	assert.EqualValues(t, 2, len(response.Territories))
+	assert.Equal(t, testKey2, response.Territories[0].Id)
+	assert.Equal(t, testTerritory2.Levels, response.Territories[0].Levels)
+	assert.Equal(t, testKey1, response.Territories[1].Id)
+
+	// And absent ones are listed separately
+	assert.Equal(t, []string{"missing"}, response.Missing)
+	assert.EqualValues(t, http.StatusNotFound, response.Results[1].Status)
+}
+
+func TestBatchGetWithOnlyPresentTerritoriesSucceeds(t *testing.T) {
+	c := setup(t)
+	defer teardown(c)
+
+	storeTerritory(c, testKey1, testTerritory1)
+
+	code, response := batchGetTerritories(c, []string{testKey1})
+	assert.EqualValues(t, http.StatusOK, code)
+	assert.EqualValues(t, 1, len(response.Territories))
+	assert.Empty(t, response.Missing)
+}
+
+func TestValidateReportsTerritoryProblems(t *testing.T) {
+	c := setup(t)
+	defer teardown(c)
+
+	storeRawLevel(c, "test", map[string]interface{}{"name": "test"})
+	storeRawLevel(c, "default", map[string]interface{}{"name": "default"})
+	storeTerritory(c, testKey1, testTerritory1)
+
+	// A clean territory has nothing to report
+	validation := validateTerritory(c, buildEntityRoute(testKey1)+"/validate", nil)
+	assert.True(t, validation.Valid)
+	assert.Empty(t, validation.Problems)
+
+	// This one lists a level that doesn't exist, and takes the first one's sequence
+	dangling := testTerritory2
+	dangling.Sequence = testTerritory1.Sequence
+	dangling.Levels = []string{"default", "ghost"}
+	storeTerritory(c, testKey2, dangling)
+
+	validation = validateTerritory(c, buildEntityRoute(testKey2)+"/validate", nil)
+	assert.False(t, validation.Valid)
+	if assert.Equal(t, 2, len(validation.Problems)) {
+		assert.Equal(t, "levels", validation.Problems[0].Field)
+		assert.Equal(t, "ghost", validation.Problems[0].Key)
+		assert.Equal(t, "NOT_FOUND", validation.Problems[0].Code)
+		assert.Equal(t, "sequence", validation.Problems[1].Field)
+		assert.Equal(t, testKey1, validation.Problems[1].Key)
+		assert.Equal(t, "CONFLICT", validation.Problems[1].Code)
+	}
+
+	// A territory in another world may share it, but not have a negative one
+	validation = validateTerritory(c, buildEntityRoute("validate"), map[string]interface{}{
+		"sequence":             testTerritory1.Sequence,
+		"world":                "world_2",
+		"levels":               []string{"test"},
+		"requires_territories": []string{testKey1, "nowhere"},
+	})
+	assert.False(t, validation.Valid)
+	if assert.Equal(t, 1, len(validation.Problems)) {
+		assert.Equal(t, "requires_territories", validation.Problems[0].Field)
+		assert.Equal(t, "nowhere", validation.Problems[0].Key)
+	}
+
+	validation = validateTerritory(c, buildEntityRoute("validate"), map[string]interface{}{"sequence": -1, "levels": []string{}})
+	if assert.Equal(t, 1, len(validation.Problems)) {
+		assert.Equal(t, "sequence", validation.Problems[0].Field)
+		assert.Equal(t, "VALIDATION_FAILED", validation.Problems[0].Code)
+	}
+
+	// Nothing was written
+	assert.Equal(t, []string{"default", "ghost"}, loadTerritory(c, testKey2).Levels)
+	code, _ := loadTerritoryRaw(c, "validate")
+	assert.EqualValues(t, http.StatusNotFound, code)
+	code, _ = invoke(c, "POST", buildEntityRoute("missing")+"/validate", nil)
+	assert.EqualValues(t, http.StatusNotFound, code)
+}
+
+func TestRequirementOnSelfIsRejected(t *testing.T) {
+	c := setup(t)
+	defer teardown(c)
+
+	territory := testTerritory1
+	territory.RequiresTerritories = []string{testKey1}
+	code, response := invoke(c, "PUT", buildEntityRoute(testKey1), territory)
+	assert.EqualValues(t, http.StatusConflict, code)
+	assert.Equal(t, "CYCLE_DETECTED", decodeError(response).Code)
+	assert.Contains(t, decodeError(response).Message, testKey1+" -> "+testKey1)
+
+	code, _ = loadTerritoryRaw(c, testKey1)
+	assert.EqualValues(t, http.StatusNotFound, code)
+}
+
+func TestRequirementCycleIsRejected(t *testing.T) {
+	c := setup(t)
+	defer teardown(c)
+
+	// The first territory requires the second, which is fine on its own
+	first := testTerritory1
+	first.World = "world_1"
+	first.RequiresTerritories = []string{testKey2}
+	storeTerritory(c, testKey1, first)
+	storeTerritory(c, testKey2, testTerritory2)
+	assert.Equal(t, first.RequiresTerritories, loadTerritory(c, testKey1).RequiresTerritories)
+	assert.Equal(t, "world_1", loadTerritory(c, testKey1).World)
+
+	// But the second can't then require the first, whether written whole or patched
+	second := testTerritory2
+	second.RequiresTerritories = []string{testKey1}
+	code, response := invoke(c, "PUT", buildEntityRoute(testKey2), second)
+	assert.EqualValues(t, http.StatusConflict, code)
+	assert.Equal(t, "CYCLE_DETECTED", decodeError(response).Code)
+	assert.Contains(t, decodeError(response).Message, testKey2+" -> "+testKey1+" -> "+testKey2)
+
+	code, response = invoke(c, "PATCH", buildEntityRoute(testKey2), map[string]interface{}{"requires_territories": []string{testKey1}})
+	assert.EqualValues(t, http.StatusConflict, code)
+	assert.Equal(t, "CYCLE_DETECTED", decodeError(response).Code)
+	assert.Empty(t, loadTerritory(c, testKey2).RequiresTerritories)
+}
+
+func TestNoCacheHeaderBypassesStaleCache(t *testing.T) {
+	c := setup(t)
+	defer teardown(c)
+
+	storeTerritory(c, testKey1, testTerritory1)
+
+	// Change the stored territory behind the cache's back
+	appengineContext := newAppengineContext(c)
+	rootKey := datastore.NewKey(appengineContext, "Territory", "TerritoryRoot", 0, nil)
+	key := datastore.NewKey(appengineContext, "Territory", testKey1, 0, rootKey)
+	_, err := datastore.Put(appengineContext, key, &datastore.PropertyList{
+		{Name: "Id", Value: testKey1},
+		{Name: "HasId", Value: true},
+		{Name: "Name", Value: "fresh"},
+		{Name: "HasName", Value: true},
+	})
+	assert.Nil(t, err)
+	assert.Equal(t, testTerritory1.Name, loadTerritory(c, testKey1).Name)
+
+	// Asking for fresh data goes to the datastore
+	code, response, _ := invokeWithHeaders(c, "GET", buildEntityRoute(testKey1), nil, map[string]string{"Cache-Control": "no-cache"})
+	assert.EqualValues(t, http.StatusOK, code)
+	var territory Territory
+	json.Unmarshal([]byte(response), &territory)
+	assert.Equal(t, "fresh", territory.Name)
+
+	// And refreshes the cache for everyone else
+	assert.Equal(t, "fresh", loadTerritory(c, testKey1).Name)
+}
+
+func TestQueryHonorsIfNoneMatch(t *testing.T) {
+	c := setup(t)
+	defer teardown(c)
+
+	storeTerritory(c, testKey1, testTerritory1)
+
+	// The first query hands out an ETag
+	code, _, headers := invokeWithHeaders(c, "GET", buildQueryRoute(), nil, nil)
+	assert.EqualValues(t, http.StatusOK, code)
+	tag := headers.Get("ETag")
+	assert.NotEmpty(t, tag)
+
+	// Asking again with that ETag gets a 304
+	code, body, _ := invokeWithHeaders(c, "GET", buildQueryRoute(), nil, map[string]string{"If-None-Match": tag})
+	assert.EqualValues(t, http.StatusNotModified, code)
+	assert.Empty(t, body)
+
+	// Changing the collection changes the ETag
+	storeTerritory(c, testKey2, testTerritory2)
+	code, _, headers = invokeWithHeaders(c, "GET", buildQueryRoute(), nil, map[string]string{"If-None-Match": tag})
+	assert.EqualValues(t, http.StatusOK, code)
+	assert.NotEqual(t, tag, headers.Get("ETag"))
+}
+
 // --- Helpers
 
+func TestExportIncludesAncestorsOfListedLevels(t *testing.T) {
+	c := setup(t)
+	defer teardown(c)
+
+	storeThreeGenerations(c)
+	storeTerritory(c, testKey1, Territory{Levels: []string{"grandchild", "missing", "child"}})
+
+	code, response := invoke(c, "GET", buildEntityRoute(testKey1)+"/export", nil)
+	assert.EqualValues(t, http.StatusOK, code)
+
+	var bundle TerritoryBundle
+	json.Unmarshal([]byte(response), &bundle)
+	assert.EqualValues(t, 1, len(bundle.Territories))
+	assert.Equal(t, testKey1, bundle.Territories[0].Id)
+
+	// Ancestors come first, each level once, and levels stay unresolved
+	var keys []string
+	for _, level := range bundle.Levels {
+		keys = append(keys, level["key"].(string))
+	}
+	assert.Equal(t, []string{"root", "child", "grandchild"}, keys)
+	assert.Nil(t, bundle.Levels[2]["rows"])
+	assert.Equal(t, []string{"missing"}, bundle.Missing)
+
+	code, _ = invoke(c, "GET", buildEntityRoute("nonExistingKey")+"/export", nil)
+	assert.EqualValues(t, http.StatusNotFound, code)
+}
+
+func TestImportRestoresAnExportedTerritory(t *testing.T) {
+	c := setup(t)
+	defer teardown(c)
+
+	storeThreeGenerations(c)
+	storeTerritory(c, testKey1, Territory{Name: "shared world", Levels: []string{"grandchild"}})
+	code, exported := invoke(c, "GET", buildEntityRoute(testKey1)+"/export", nil)
+	assert.EqualValues(t, http.StatusOK, code)
+
+	var bundle map[string]interface{}
+	json.Unmarshal([]byte(exported), &bundle)
+
+	// Existing keys are refused by default, and skipped on request
+	code, response := invoke(c, "POST", buildEntityRoute("import"), bundle)
+	assert.EqualValues(t, http.StatusConflict, code)
+	assert.Equal(t, "CONFLICT", decodeError(response).Code)
+
+	code, response = invoke(c, "POST", buildEntityRoute("import")+"?conflict=skip", bundle)
+	assert.EqualValues(t, http.StatusOK, code)
+	var skipped ImportResult
+	json.Unmarshal([]byte(response), &skipped)
+	assert.Empty(t, skipped.Written.Levels)
+	assert.Equal(t, []string{"root", "child", "grandchild"}, skipped.Skipped.Levels)
+	assert.Equal(t, []string{testKey1}, skipped.Skipped.Territories)
+
+	// Once they're gone, the import brings back the territory and every level
+	deleteTerritory(c, testKey1)
+	for _, levelId := range []string{"grandchild", "child", "root"} {
+		code, _ = invoke(c, "DELETE", "/levels/"+levelId, nil)
+		assert.EqualValues(t, http.StatusNoContent, code)
+	}
+
+	code, response = invoke(c, "POST", buildEntityRoute("import"), bundle)
+	assert.EqualValues(t, http.StatusOK, code)
+	var imported ImportResult
+	json.Unmarshal([]byte(response), &imported)
+	assert.Equal(t, []string{"root", "child", "grandchild"}, imported.Written.Levels)
+	assert.Equal(t, []string{testKey1}, imported.Written.Territories)
+
+	restored := loadTerritory(c, testKey1)
+	assert.Equal(t, "shared world", restored.Name)
+	assert.Equal(t, []string{"grandchild"}, restored.Levels)
+
+	code, response = invoke(c, "GET", "/levels/grandchild", nil)
+	assert.EqualValues(t, http.StatusOK, code)
+	var grandchild map[string]interface{}
+	json.Unmarshal([]byte(response), &grandchild)
+	assert.Equal(t, "child", grandchild["parent_key"])
+	assert.EqualValues(t, 5, grandchild["rows"])
+	assert.Equal(t, "grandchild", grandchild["name"])
+}
+
+func TestImportRefusesInconsistentBundles(t *testing.T) {
+	c := setup(t)
+	defer teardown(c)
+
+	bundle := map[string]interface{}{
+		"territories": []interface{}{map[string]interface{}{"id": testKey1, "levels": []string{"orphan"}}},
+		"levels":      []interface{}{map[string]interface{}{"key": "orphan", "parent_key": "nowhere"}},
+	}
+	code, response := invoke(c, "POST", buildEntityRoute("import"), bundle)
+	assert.EqualValues(t, http.StatusBadRequest, code)
+	assert.Equal(t, "VALIDATION_FAILED", decodeError(response).Code)
+
+	code, _ = loadTerritoryRaw(c, testKey1)
+	assert.EqualValues(t, http.StatusNotFound, code)
+
+	bundle["territories"] = []interface{}{}
+	code, _ = invoke(c, "POST", buildEntityRoute("import"), bundle)
+	assert.EqualValues(t, http.StatusBadRequest, code)
+}
+
+func TestImportSkipsLevelsEditedSinceTheExport(t *testing.T) {
+	c := setup(t)
+	defer teardown(c)
+
+	storeRawLevel(c, "first", map[string]interface{}{"name": "first"})
+	storeRawLevel(c, "second", map[string]interface{}{"name": "second"})
+	storeTerritory(c, testKey1, Territory{Name: "shared world", Levels: []string{"first", "second"}})
+	code, exported := invoke(c, "GET", buildEntityRoute(testKey1)+"/export", nil)
+	assert.EqualValues(t, http.StatusOK, code)
+	var bundle TerritoryBundle
+	json.Unmarshal([]byte(exported), &bundle)
+	assert.Len(t, bundle.Versions, 2)
+
+	// first is edited after the export, so the bundle's copy is stale
+	storeRawLevel(c, "first", map[string]interface{}{"name": "edited"})
+	for _, level := range bundle.Levels {
+		if level["key"] == "second" {
+			level["name"] = "restored"
+		}
+	}
+
+	code, _ = invoke(c, "POST", buildEntityRoute("import")+"?skipOlder=true", bundle)
+	assert.EqualValues(t, http.StatusBadRequest, code)
+
+	code, response := invoke(c, "POST", buildEntityRoute("import")+"?conflict=overwrite&skipOlder=true", bundle)
+	assert.EqualValues(t, http.StatusOK, code)
+	var result ImportResult
+	json.Unmarshal([]byte(response), &result)
+	assert.Equal(t, []string{"first"}, result.Skipped.Levels)
+	assert.Equal(t, []string{"second"}, result.Written.Levels)
+	assert.Equal(t, []string{testKey1}, result.Written.Territories)
+
+	for levelId, name := range map[string]string{"first": "edited", "second": "restored"} {
+		code, response = invoke(c, "GET", "/levels/"+levelId, nil)
+		assert.EqualValues(t, http.StatusOK, code)
+		var stored map[string]interface{}
+		json.Unmarshal([]byte(response), &stored)
+		assert.Equal(t, name, stored["name"])
+	}
+
+	// The territory is compared by its own version
+	storeTerritory(c, testKey1, Territory{Name: "renamed", Levels: []string{"first", "second"}})
+	code, response = invoke(c, "POST", buildEntityRoute("import")+"?conflict=overwrite&skipOlder=true", bundle)
+	assert.EqualValues(t, http.StatusOK, code)
+	json.Unmarshal([]byte(response), &result)
+	assert.Equal(t, []string{testKey1}, result.Skipped.Territories)
+	assert.Equal(t, "renamed", loadTerritory(c, testKey1).Name)
+}
+
+func TestImportKeepsReferencedDimensionsLocked(t *testing.T) {
+	c := setupSerial(t)
+	defer teardown(c)
+
+	flags.LockReferencedDimensions.Enabled = true
+	defer func() { flags.LockReferencedDimensions.Enabled = false }()
+
+	storeThreeGenerations(c)
+	storeTerritory(c, testKey1, Territory{Name: "shared world", Levels: []string{"child"}})
+	code, exported := invoke(c, "GET", buildEntityRoute(testKey1)+"/export", nil)
+	assert.EqualValues(t, http.StatusOK, code)
+
+	// Overwriting the listed level with new rows is refused like a PUT would be
+	var bundle TerritoryBundle
+	json.Unmarshal([]byte(exported), &bundle)
+	for _, level := range bundle.Levels {
+		if level["key"] == "child" {
+			level["rows"] = 9
+		}
+	}
+	code, response := invoke(c, "POST", buildEntityRoute("import")+"?conflict=overwrite", bundle)
+	assert.EqualValues(t, http.StatusBadRequest, code)
+	var refused TerritoryValidation
+	json.Unmarshal([]byte(response), &refused)
+	if assert.Equal(t, 1, len(refused.Problems)) {
+		assert.Equal(t, "child", refused.Problems[0].Key)
+		assert.Equal(t, "CONFLICT", refused.Problems[0].Code)
+	}
+
+	code, response = invoke(c, "GET", "/levels/child", nil)
+	assert.EqualValues(t, http.StatusOK, code)
+	var child map[string]interface{}
+	json.Unmarshal([]byte(response), &child)
+	assert.EqualValues(t, 5, child["rows"])
+}
+
 func buildQueryRoute() string {
 	return baseRoute
 }
@@ -262,14 +1181,23 @@ func buildEntityRoute(id string) string {
 }
 
 func invoke(c *TestContext, verb string, path string, obj interface{}) (code int, response string) {
+	code, response, _ = invokeWithHeaders(c, verb, path, obj, nil)
+	return
+}
+
+func invokeWithHeaders(c *TestContext, verb string, path string, obj interface{}, headers map[string]string) (code int, response string, responseHeaders http.Header) {
 	marshalledObj, _ := json.Marshal(obj)
 	request, _ := c.ae.NewRequest(verb, path, bytes.NewBuffer(marshalledObj))
+	for name, value := range headers {
+		request.Header.Set(name, value)
+	}
 	w := httptest.NewRecorder()
 	http.DefaultServeMux.ServeHTTP(w, request)
 	body, _ := ioutil.ReadAll(w.Body)
 
 	code = w.Code
 	response = string(body)
+	responseHeaders = w.Header()
 
 	c.t.Logf("%s %s\ncode: %+v\nresponse: %+v\n", verb, path, code, response)
 	return
@@ -286,6 +1214,23 @@ func storeTerritory(c *TestContext, id string, territory Territory) (int, string
 	return code, response
 }
 
+// storeThreeGenerations stores root, child and grandchild, each the parent of
+// the next.  Only root has every field set.
+func storeThreeGenerations(c *TestContext) {
+	storeRawLevel(c, "root", map[string]interface{}{
+		"name": "root", "rows": 1, "columns": 2, "duration": 3, "combo_timer": 4,
+		"unit_delay_multiplier": 5, "max_active_units": 6, "spawns_per_second": 7,
+		"spawn_frequency": map[string]float32{"grunt_fire": 1},
+	})
+	storeRawLevel(c, "child", map[string]interface{}{"parent_key": "root", "rows": 5})
+	storeRawLevel(c, "grandchild", map[string]interface{}{"parent_key": "child", "name": "grandchild"})
+}
+
+func storeRawLevel(c *TestContext, id string, level map[string]interface{}) {
+	code, _ := invoke(c, "PUT", "/levels/"+id, level)
+	assert.EqualValues(c.t, http.StatusOK, code)
+}
+
 func loadTerritory(c *TestContext, id string) (territory Territory) {
 	code, resp := invoke(c, "GET", buildEntityRoute(id), nil)
 	assert.EqualValues(c.t, http.StatusOK, code)
@@ -301,7 +1246,7 @@ func loadTerritoryRaw(c *TestContext, id string) (int, string) {
 
 func deleteTerritory(c *TestContext, id string) (int, string) {
 	code, response := invoke(c, "DELETE", buildEntityRoute(id), nil)
-	assert.EqualValues(c.t, http.StatusOK, code)
+	assert.EqualValues(c.t, http.StatusNoContent, code)
 	return code, response
 }
 
@@ -312,3 +1257,80 @@ func queryAll(c *TestContext) (territories []Territory) {
 	json.Unmarshal([]byte(resp), &territories)
 	return
 }
+
+func newAppengineContext(c *TestContext) appengine.Context {
+	request, _ := c.ae.NewRequest("GET", "/", nil)
+	return appengine.NewContext(request)
+}
+
+func patchTerritory(c *TestContext, id string, levelsMode string, patch interface{}) (int, string) {
+	path := buildEntityRoute(id)
+	if len(levelsMode) > 0 {
+		path += "?levelsMode=" + levelsMode
+	}
+
+	code, response := invoke(c, "PATCH", path, patch)
+	assert.EqualValues(c.t, http.StatusOK, code)
+	return code, response
+}
+
+func batchGetTerritories(c *TestContext, ids []string) (int, BatchGetResponse) {
+	code, resp := invoke(c, "POST", buildEntityRoute("batch-get"), map[string]interface{}{"ids": ids})
+
+	var response BatchGetResponse
+	json.Unmarshal([]byte(resp), &response)
+	return code, response
+}
+
+func validateTerritory(c *TestContext, path string, body interface{}) (validation TerritoryValidation) {
+	code, response := invoke(c, "POST", path, body)
+	assert.EqualValues(c.t, http.StatusOK, code)
+
+	json.Unmarshal([]byte(response), &validation)
+	return
+}
+
+func decodeError(response string) (result ErrorResponse) {
+	json.Unmarshal([]byte(response), &result)
+	return
+}
+
+func updateLevels(c *TestContext, id string, operation string, request interface{}) (int, VersionedTerritory) {
+	code, resp := invoke(c, "POST", buildEntityRoute(id)+"/levels/"+operation, request)
+
+	var result VersionedTerritory
+	json.Unmarshal([]byte(resp), &result)
+	return code, result
+}
+
+func copyLevels(c *TestContext, id string, sourceId string, query string) (int, VersionedTerritory) {
+	code, resp := invoke(c, "POST", buildEntityRoute(id)+"/copy-levels-from/"+sourceId+query, nil)
+
+	var result VersionedTerritory
+	json.Unmarshal([]byte(resp), &result)
+	return code, result
+}
+
+func warningKeys(warnings ReferenceWarnings) []string {
+	keys := []string{}
+	for _, warning := range warnings.Warnings {
+		keys = append(keys, warning.Key)
+	}
+	return keys
+}
+
+func queryArchived(c *TestContext) (territories []Territory) {
+	code, resp := invoke(c, "GET", buildQueryRoute()+"?archived=true", nil)
+	assert.EqualValues(c.t, http.StatusOK, code)
+
+	json.Unmarshal([]byte(resp), &territories)
+	return
+}
+
+func territoryIds(territories []Territory) []string {
+	ids := []string{}
+	for _, territory := range territories {
+		ids = append(ids, territory.Id)
+	}
+	return ids
+}